@@ -0,0 +1,414 @@
+// Package client drives a vexShare session over its WebSocket protocol, for
+// bots, tests and the attach subcommand.
+//
+// The protocol is JSON messages of the form {"type": ..., "data": ...}. A
+// session that asks for consent first sends "consent" ({"text","hash"}),
+// answered with "consent" ({"accept"}); see Options.Consent. The server
+// then sends "role", "motd" ({"text"}) if a welcome message is set,
+// "output" (a string of terminal bytes) and notices such as "clients",
+// "controller", "notice", "idle", "deadline", "input-stalled", "paused",
+// "resync", "summary" and, with prompt detection, "prompt",
+// "command-start" and "command-end". Clients send "input" (a string),
+// "resize" ({"cols","rows"}), "keepalive", "extend", "clear", "pause",
+// "resume", "flow" ("pause" or "resume") and "kick_viewers"; only the
+// controller's input reaches the terminal unless the session shares input.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeTimeout = 10 * time.Second
+	// messageBuffer is how many non-output messages Messages holds before
+	// newer ones are dropped.
+	messageBuffer = 64
+	// waitWindow is how much unmatched output WaitFor keeps.
+	waitWindow = 1 << 20
+)
+
+// Options says how to authenticate. Set Username and Password for password
+// auth, or Token for a token share URL. The URL passed to Dial is the root
+// of the vexShare instance, including any reverse proxy base path.
+type Options struct {
+	Username string
+	Password string
+	Token    string
+	// Session names a session created through the admin API, served under
+	// the default /s/ prefix.
+	Session string
+	// Resume is the token from an earlier Role, to take back a dropped
+	// client's place within the server's reconnect grace period.
+	Resume string
+	Header http.Header
+	Dialer *websocket.Dialer
+	// HTTPClient is used for the password login.
+	HTTPClient *http.Client
+	// Consent accepts the notice of a session that asks for consent before
+	// joining. Without it such a session is declined and Dial fails.
+	Consent bool
+}
+
+// Message is one protocol message from the server.
+type Message struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Seq  uint64          `json:"seq,omitempty"`
+}
+
+// Role is the data of a "role" message.
+type Role struct {
+	Role               string   `json:"role"`
+	Access             string   `json:"access,omitempty"`
+	SharedInput        bool     `json:"sharedInput"`
+	User               string   `json:"user,omitempty"`
+	Groups             []string `json:"groups,omitempty"`
+	Resume             string   `json:"resume,omitempty"`
+	IdleTimeoutSeconds int64    `json:"idleTimeoutSeconds,omitempty"`
+	IdleExtendSeconds  int64    `json:"idleExtendSeconds,omitempty"`
+}
+
+// ShellEvent is the data of a "prompt", "command-start" or "command-end"
+// message. Source is "osc133" or "regex"; Command and ExitCode are set when
+// the shell reports them.
+type ShellEvent struct {
+	Source   string `json:"source,omitempty"`
+	Command  string `json:"command,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+}
+
+// Client is a connection to one session. Output bytes are available from
+// Output and WaitFor; every other message goes to Messages.
+type Client struct {
+	conn     *websocket.Conn
+	messages chan Message
+	done     chan struct{}
+	writeMu  sync.Mutex
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	role Role
+	err  error
+	// out holds output from offset base on. Output reads from readOff and
+	// WaitFor matches from waitOff; bytes both have passed are dropped.
+	out      []byte
+	base     int64
+	readOff  int64
+	waitOff  int64
+	reading  bool
+	gotRole  chan struct{}
+	roleOnce sync.Once
+	consent  bool
+}
+
+// Dial logs in if needed, connects, and waits for the session to assign a
+// role.
+func Dial(ctx context.Context, rawURL string, opts Options) (*Client, error) {
+	base, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("client: parse url: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("client: url scheme must be http or https, got %q", base.Scheme)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	header := http.Header{}
+	for k, v := range opts.Header {
+		header[k] = v
+	}
+	if opts.Password != "" {
+		cookies, err := login(ctx, base, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cookies {
+			header.Add("Cookie", c.String())
+		}
+	}
+
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, resp, err := dialer.DialContext(ctx, wsURL(base, opts), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("client: connect: %w (status %d)", err, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("client: connect: %w", err)
+	}
+
+	c := &Client{
+		conn:     conn,
+		messages: make(chan Message, messageBuffer),
+		done:     make(chan struct{}),
+		gotRole:  make(chan struct{}),
+		consent:  opts.Consent,
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.readLoop()
+
+	select {
+	case <-c.gotRole:
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("client: connection closed before a role was assigned: %w", c.Err())
+	case <-ctx.Done():
+		conn.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func wsURL(base *url.URL, opts Options) string {
+	u := *base
+	u.Scheme = "ws"
+	if base.Scheme == "https" {
+		u.Scheme = "wss"
+	}
+	path := base.EscapedPath()
+	switch {
+	case opts.Token != "":
+		path += "t/" + url.PathEscape(opts.Token) + "/"
+	case opts.Session != "":
+		path += "s/" + url.PathEscape(opts.Session) + "/"
+	}
+	u.RawPath = path + "ws"
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	q := url.Values{}
+	if opts.Resume != "" {
+		q.Set("resume", opts.Resume)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// login posts the credentials to the login form and returns the session
+// cookies it sets.
+func login(ctx context.Context, base *url.URL, opts Options) ([]*http.Cookie, error) {
+	hc := http.Client{}
+	if opts.HTTPClient != nil {
+		hc = *opts.HTTPClient
+	}
+	jar, _ := cookiejar.New(nil)
+	hc.Jar = jar
+	hc.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	loginURL := base.JoinPath("login")
+	form := url.Values{"username": {opts.Username}, "password": {opts.Password}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, loginURL.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("client: login: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client: login: %w", err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return nil, fmt.Errorf("client: login: %s", resp.Status)
+	}
+	return jar.Cookies(loginURL), nil
+}
+
+func (c *Client) readLoop() {
+	defer close(c.messages)
+	defer close(c.done)
+	for {
+		var msg Message
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+		switch msg.Type {
+		case "output":
+			var chunk string
+			if err := json.Unmarshal(msg.Data, &chunk); err != nil {
+				continue
+			}
+			c.mu.Lock()
+			c.out = append(c.out, chunk...)
+			c.trimLocked()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+			continue
+		case "consent":
+			_ = c.write(map[string]any{"type": "consent", "data": map[string]bool{"accept": c.consent}})
+		case "role":
+			var r Role
+			if err := json.Unmarshal(msg.Data, &r); err == nil {
+				c.mu.Lock()
+				c.role = r
+				c.mu.Unlock()
+				c.roleOnce.Do(func() { close(c.gotRole) })
+			}
+		}
+		select {
+		case c.messages <- msg:
+		default:
+		}
+	}
+}
+
+// Messages delivers every message except output. Messages that arrive
+// while the channel is full are dropped. The channel is closed when the
+// connection ends.
+func (c *Client) Messages() <-chan Message { return c.messages }
+
+// Done is closed when the connection ends.
+func (c *Client) Done() <-chan struct{} { return c.done }
+
+// Err returns why the connection ended, or nil while it is open.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Role returns the role the session last assigned.
+func (c *Client) Role() Role {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.role
+}
+
+// Send types input into the terminal.
+func (c *Client) Send(input string) error {
+	return c.write(map[string]any{"type": "input", "data": input})
+}
+
+// Resize reports the client's terminal size.
+func (c *Client) Resize(cols, rows uint16) error {
+	return c.write(map[string]any{"type": "resize", "data": map[string]uint16{"cols": cols, "rows": rows}})
+}
+
+// Keepalive holds off the session's idle timeout.
+func (c *Client) Keepalive() error {
+	return c.write(map[string]any{"type": "keepalive"})
+}
+
+func (c *Client) write(v any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+// Close closes the connection cleanly, so the server does not hold the
+// client for a reconnect.
+func (c *Client) Close() error {
+	c.writeMu.Lock()
+	_ = c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+	}
+	return c.conn.Close()
+}
+
+// Output returns a reader of the raw terminal output, starting with the
+// history the server replays on connect, or, once WaitFor has let older
+// output go, with the oldest output still kept. It returns io.EOF once the
+// connection has ended and everything has been read. Output is buffered
+// until it is read, so a caller that uses Output must keep reading it.
+func (c *Client) Output() io.Reader {
+	c.mu.Lock()
+	c.reading = true
+	c.readOff = max(c.readOff, c.base)
+	c.mu.Unlock()
+	return outputReader{c}
+}
+
+type outputReader struct{ c *Client }
+
+func (r outputReader) Read(p []byte) (int, error) {
+	c := r.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readOff = max(c.readOff, c.base)
+	for c.readOff == c.base+int64(len(c.out)) {
+		if c.err != nil {
+			return 0, io.EOF
+		}
+		c.cond.Wait()
+	}
+	n := copy(p, c.out[c.readOff-c.base:])
+	c.readOff += int64(n)
+	c.trimLocked()
+	return n, nil
+}
+
+// WaitFor waits until re matches output received since the previous match
+// and returns the matching text. It looks at no more than the last MiB.
+func (c *Client) WaitFor(ctx context.Context, re *regexp.Regexp) (string, error) {
+	stop := context.AfterFunc(ctx, func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+	defer stop()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.waitOff = max(c.waitOff, c.base)
+		pending := c.out[c.waitOff-c.base:]
+		if loc := re.FindIndex(pending); loc != nil {
+			match := string(pending[loc[0]:loc[1]])
+			c.waitOff += int64(loc[1])
+			c.trimLocked()
+			return match, nil
+		}
+		if c.err != nil {
+			return "", fmt.Errorf("client: waiting for %q: %w", re, c.err)
+		}
+		if err := ctx.Err(); err != nil {
+			return "", fmt.Errorf("client: waiting for %q in %q: %w", re, tail(pending), err)
+		}
+		c.cond.Wait()
+	}
+}
+
+func tail(b []byte) []byte {
+	const n = 200
+	if len(b) > n {
+		b = b[len(b)-n:]
+	}
+	return bytes.Clone(b)
+}
+
+// trimLocked drops output that neither Output nor WaitFor still needs. The
+// caller holds c.mu.
+func (c *Client) trimLocked() {
+	keep := max(c.waitOff, c.base+int64(len(c.out))-waitWindow)
+	if c.reading {
+		keep = min(keep, c.readOff)
+	}
+	if drop := keep - c.base; drop > 0 {
+		c.out = append(c.out[:0], c.out[drop:]...)
+		c.base = keep
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestWSURL(t *testing.T) {
+	tests := []struct {
+		base string
+		opts Options
+		want string
+	}{
+		{"http://example.com/", Options{}, "ws://example.com/ws"},
+		{"https://example.com/one/", Options{}, "wss://example.com/one/ws"},
+		{"https://example.com/", Options{Token: "a/b"}, "wss://example.com/t/a%2Fb/ws"},
+		{"http://example.com/", Options{Session: "logs"}, "ws://example.com/s/logs/ws"},
+		{"http://example.com/", Options{Resume: "r1"}, "ws://example.com/ws?resume=r1"},
+	}
+	for _, tt := range tests {
+		base, _ := url.Parse(tt.base)
+		if got := wsURL(base, tt.opts); got != tt.want {
+			t.Errorf("wsURL(%s, %+v) = %s, want %s", tt.base, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestOutputAfterWaitFor(t *testing.T) {
+	c := &Client{out: []byte("$ make\nbuilding\nok\n")}
+	c.cond = sync.NewCond(&c.mu)
+	if _, err := c.WaitFor(context.Background(), regexp.MustCompile(`building\n`)); err != nil {
+		t.Fatal(err)
+	}
+	// WaitFor has let go of what it matched past, so Output starts after it.
+	r := c.Output()
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "ok\n" {
+		t.Fatalf("Read = %q, %v, want %q", buf[:n], err, "ok\n")
+	}
+	c.mu.Lock()
+	c.err = io.ErrUnexpectedEOF
+	c.mu.Unlock()
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Errorf("Read after the end = %v, want io.EOF", err)
+	}
+}
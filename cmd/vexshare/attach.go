@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/creack/pty"
+
+	"github.com/vextm/vexshare/client"
+)
+
+// detachKey is Ctrl+], as in telnet.
+const detachKey = 0x1d
+
+func runAttach(args []string, stdin *os.File, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("attach", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	user := fs.String("user", "", "username for password auth; the password is read from VEXSHARE_PASSWORD")
+	token := fs.String("token", "", "access token for token auth")
+	name := fs.String("session", "", "named session to attach to")
+	consent := fs.Bool("consent", false, "accept the notice of a session started with --require-consent")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: vexshare attach [flags] URL")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	opts := client.Options{Username: *user, Token: *token, Session: *name, Consent: *consent}
+	if *user != "" {
+		opts.Password = os.Getenv("VEXSHARE_PASSWORD")
+		if opts.Password == "" {
+			fmt.Fprintln(stderr, "Error: --user needs the password in VEXSHARE_PASSWORD")
+			return 2
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := client.Dial(ctx, fs.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer c.Close()
+	fmt.Fprintf(stderr, "Attached as %s. Press Ctrl+] to detach.\r\n", c.Role().Role)
+
+	if restore, err := makeRaw(stdin); err == nil {
+		defer restore()
+		winch := make(chan os.Signal, 1)
+		notifyResize(winch)
+		defer signal.Stop(winch)
+		go func() {
+			for {
+				if rows, cols, err := pty.Getsize(stdin); err == nil {
+					_ = c.Resize(uint16(cols), uint16(rows))
+				}
+				select {
+				case <-winch:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() { _, _ = io.Copy(stdout, c.Output()) }()
+	detached := make(chan struct{})
+	go func() {
+		defer close(detached)
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdin.Read(buf)
+			for i := 0; i < n; i++ {
+				if buf[i] == detachKey {
+					n = i
+					err = io.EOF
+					break
+				}
+			}
+			if n > 0 && c.Send(string(buf[:n])) != nil {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-detached:
+		fmt.Fprint(stderr, "\r\nDetached.\r\n")
+	case <-c.Done():
+		fmt.Fprintf(stderr, "\r\nConnection closed: %v\r\n", c.Err())
+	}
+	return 0
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/creack/pty"
+
+	"github.com/vextm/vexshare/internal/auth"
+)
+
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+)
+
+// certExpiryWarning is how close to expiry a TLS certificate is warned
+// about.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+// runDoctor checks for the problems that keep vexShare from starting or
+// working, each on its own with a hint, and returns 1 if any check failed.
+func runDoctor(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	listen := fs.String("listen", "127.0.0.1:8080", "address the server will listen on")
+	cmd := fs.String("cmd", "bash", "command the server will run in the PTY")
+	tlsCert := fs.String("tls-cert", "", "path to the TLS certificate")
+	tlsKey := fs.String("tls-key", "", "path to the TLS private key")
+	htpasswd := fs.String("htpasswd", "", "htpasswd file to check")
+	usersFile := fs.String("users-file", "", "JSON users file to check")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: vexshare doctor [flags]")
+		fmt.Fprintln(stderr, "Pass the flags you start the server with to check them too.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	results := []checkResult{
+		checkPTY(),
+		checkShell(exec.LookPath, *cmd),
+		checkListen(*listen),
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		results = append(results, checkTLS(*tlsCert, *tlsKey, time.Now()))
+	}
+	if *htpasswd != "" {
+		results = append(results, checkAuthFile("htpasswd", *htpasswd, func(path string) error {
+			_, err := auth.LoadHtpasswd(path)
+			return err
+		}))
+	}
+	if *usersFile != "" {
+		results = append(results, checkAuthFile("users-file", *usersFile, func(path string) error {
+			_, err := auth.LoadUsersFile(path)
+			return err
+		}))
+	}
+	if r, ok := checkCgroupPids("/sys/fs/cgroup/pids.max"); ok {
+		results = append(results, r)
+	}
+	return printReport(stdout, results)
+}
+
+// printReport writes one line per check, with its hint below unless it
+// passed, and returns the exit code.
+func printReport(w io.Writer, results []checkResult) int {
+	failed, warned := 0, 0
+	for _, r := range results {
+		fmt.Fprintf(w, "%-4s  %-10s  %s\n", r.Status, r.Name, r.Detail)
+		if r.Status != checkPass && r.Hint != "" {
+			fmt.Fprintf(w, "      %-10s  hint: %s\n", "", r.Hint)
+		}
+		switch r.Status {
+		case checkFail:
+			failed++
+		case checkWarn:
+			warned++
+		}
+	}
+	fmt.Fprintf(w, "\n%d checks, %d failed, %d warnings\n", len(results), failed, warned)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// checkPTY opens a PTY and sends a line through it, as the server does for
+// every session.
+func checkPTY() checkResult {
+	r := checkResult{Name: "pty", Status: checkFail,
+		Hint: "mount devpts on /dev/pts (containers get it unless /dev is replaced), and look for SELinux or AppArmor denials in the audit log or dmesg"}
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		r.Detail = fmt.Sprintf("cannot open a PTY: %v", err)
+		return r
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+
+	const probe = "vexshare-doctor"
+	if _, err := tty.Write([]byte(probe + "\n")); err != nil {
+		r.Detail = fmt.Sprintf("cannot write to %s: %v", tty.Name(), err)
+		return r
+	}
+	got := make(chan error, 1)
+	go func() {
+		var seen []byte
+		buf := make([]byte, 256)
+		for !bytes.Contains(seen, []byte(probe)) {
+			n, err := ptmx.Read(buf)
+			if err != nil {
+				got <- err
+				return
+			}
+			seen = append(seen, buf[:n]...)
+		}
+		got <- nil
+	}()
+	select {
+	case err = <-got:
+	case <-time.After(2 * time.Second):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		r.Detail = fmt.Sprintf("nothing came back through %s: %v", tty.Name(), err)
+		return r
+	}
+	r.Status, r.Detail, r.Hint = checkPass, "opened "+tty.Name()+" and echoed through it", ""
+	return r
+}
+
+// checkShell finds the program --cmd starts.
+func checkShell(lookPath func(string) (string, error), command string) checkResult {
+	r := checkResult{Name: "command"}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		r.Status, r.Detail = checkFail, "--cmd is empty"
+		r.Hint = "set --cmd to the program to share, such as bash"
+		return r
+	}
+	path, err := lookPath(fields[0])
+	if err != nil {
+		r.Status, r.Detail = checkFail, fmt.Sprintf("%s not found: %v", fields[0], err)
+		r.Hint = "install it, or set --cmd to a program in PATH or an absolute path"
+		return r
+	}
+	r.Status, r.Detail = checkPass, fields[0]+" is "+path
+	return r
+}
+
+// checkListen binds addr and releases it at once.
+func checkListen(addr string) checkResult {
+	r := checkResult{Name: "listen"}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		r.Status, r.Detail = checkFail, err.Error()
+		r.Hint = "stop whatever holds the port or choose another with --listen; ports below 1024 need root or CAP_NET_BIND_SERVICE"
+		return r
+	}
+	ln.Close()
+	r.Status, r.Detail = checkPass, "can bind "+addr
+	return r
+}
+
+// checkTLS loads the key pair the server would and looks at the
+// certificate's validity at now.
+func checkTLS(certFile, keyFile string, now time.Time) checkResult {
+	r := checkResult{Name: "tls", Status: checkFail}
+	if certFile == "" || keyFile == "" {
+		r.Detail = "only one of --tls-cert and --tls-key is set"
+		r.Hint = "set both to serve HTTPS, or neither"
+		return r
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "both files must be PEM, and the key must be the certificate's"
+		return r
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		r.Detail = err.Error()
+		return r
+	}
+	name := leaf.Subject.CommonName
+	if len(leaf.DNSNames) > 0 {
+		name = strings.Join(leaf.DNSNames, ", ")
+	}
+	switch {
+	case now.Before(leaf.NotBefore):
+		r.Detail = fmt.Sprintf("certificate for %s is not valid until %s", name, leaf.NotBefore.Format(time.RFC3339))
+		r.Hint = "check the system clock, or wait for the certificate to become valid"
+	case !now.Before(leaf.NotAfter):
+		r.Detail = fmt.Sprintf("certificate for %s expired at %s", name, leaf.NotAfter.Format(time.RFC3339))
+		r.Hint = "renew the certificate"
+	case leaf.NotAfter.Sub(now) < certExpiryWarning:
+		r.Status = checkWarn
+		r.Detail = fmt.Sprintf("certificate for %s expires at %s", name, leaf.NotAfter.Format(time.RFC3339))
+		r.Hint = "renew the certificate soon"
+	default:
+		r.Status = checkPass
+		r.Detail = fmt.Sprintf("key matches the certificate for %s, valid until %s", name, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return r
+}
+
+// checkAuthFile parses an auth file with load and warns if anyone but its
+// owner can read it.
+func checkAuthFile(name, path string, load func(string) error) checkResult {
+	r := checkResult{Name: name, Status: checkFail}
+	fi, err := os.Stat(path)
+	if err != nil {
+		r.Detail = err.Error()
+		r.Hint = "check the path passed to --" + name
+		return r
+	}
+	if err := load(path); err != nil {
+		r.Detail = err.Error()
+		r.Hint = "fix the file; see the README for its format"
+		return r
+	}
+	if perm := fi.Mode().Perm(); perm&0o077 != 0 {
+		r.Status = checkWarn
+		r.Detail = fmt.Sprintf("%s parses, but its mode is %04o", path, perm)
+		r.Hint = "the password hashes in it can be attacked offline; chmod 600 " + path
+		return r
+	}
+	r.Status, r.Detail = checkPass, path+" parses and only its owner can read it"
+	return r
+}
+
+// checkCgroupPids warns when the cgroup allows so few processes that the
+// command and the server's threads may run out. It reports false where
+// there is no such limit file.
+func checkCgroupPids(path string) (checkResult, bool) {
+	const minPids = 64
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return checkResult{}, false
+	}
+	r := checkResult{Name: "cgroup", Status: checkPass}
+	v := strings.TrimSpace(string(data))
+	if v == "max" {
+		r.Detail = "no limit on processes"
+		return r, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		r.Status, r.Detail = checkWarn, fmt.Sprintf("cannot read %s: %q", path, v)
+		return r, true
+	}
+	r.Detail = fmt.Sprintf("up to %d processes", n)
+	if n < minPids {
+		r.Status = checkWarn
+		r.Hint = "the command, its children and the server's threads share this limit; raise it, for example with docker run --pids-limit"
+	}
+	return r, true
+}
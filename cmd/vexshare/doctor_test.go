@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckShell(t *testing.T) {
+	lookPath := func(name string) (string, error) {
+		if name == "bash" {
+			return "/usr/bin/bash", nil
+		}
+		return "", errors.New("executable file not found in $PATH")
+	}
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"bash -l", checkPass},
+		{"fish", checkFail},
+		{"  ", checkFail},
+	}
+	for _, tt := range tests {
+		if r := checkShell(lookPath, tt.cmd); r.Status != tt.want {
+			t.Errorf("checkShell(%q) = %+v, want %s", tt.cmd, r, tt.want)
+		}
+	}
+}
+
+func TestCheckListen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if r := checkListen(ln.Addr().String()); r.Status != checkFail || r.Hint == "" {
+		t.Errorf("port in use: %+v", r)
+	}
+	if r := checkListen("127.0.0.1:0"); r.Status != checkPass {
+		t.Errorf("free port: %+v", r)
+	}
+}
+
+// writeCert writes a self-signed certificate valid from notBefore to
+// notAfter and its key, and returns their paths.
+func writeCert(t *testing.T, dir string, notBefore, notAfter time.Time) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vexshare.test"},
+		DNSNames:     []string{"vexshare.test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCheckTLS(t *testing.T) {
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	cert, key := writeCert(t, t.TempDir(), now.Add(-time.Hour), now.Add(90*24*time.Hour))
+	_, otherKey := writeCert(t, t.TempDir(), now.Add(-time.Hour), now.Add(90*24*time.Hour))
+
+	tests := []struct {
+		name      string
+		cert, key string
+		now       time.Time
+		want      string
+	}{
+		{"valid", cert, key, now, checkPass},
+		{"expiring", cert, key, now.Add(80 * 24 * time.Hour), checkWarn},
+		{"expired", cert, key, now.Add(91 * 24 * time.Hour), checkFail},
+		{"not yet valid", cert, key, now.Add(-2 * time.Hour), checkFail},
+		{"mismatched key", cert, otherKey, now, checkFail},
+		{"key missing", cert, "", now, checkFail},
+	}
+	for _, tt := range tests {
+		if r := checkTLS(tt.cert, tt.key, tt.now); r.Status != tt.want {
+			t.Errorf("%s: %+v, want %s", tt.name, r, tt.want)
+		}
+	}
+}
+
+func TestCheckAuthFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(path, []byte("alice:hash\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ok := func(string) error { return nil }
+	bad := func(string) error { return errors.New("line 1: not a bcrypt hash") }
+
+	if r := checkAuthFile("htpasswd", path, ok); r.Status != checkPass {
+		t.Errorf("mode 0600: %+v", r)
+	}
+	if r := checkAuthFile("htpasswd", path, bad); r.Status != checkFail || !strings.Contains(r.Detail, "line 1") {
+		t.Errorf("parse error: %+v", r)
+	}
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if r := checkAuthFile("htpasswd", path, ok); r.Status != checkWarn || !strings.Contains(r.Hint, "chmod 600") {
+		t.Errorf("mode 0644: %+v", r)
+	}
+	if r := checkAuthFile("htpasswd", filepath.Join(dir, "missing"), ok); r.Status != checkFail {
+		t.Errorf("missing file: %+v", r)
+	}
+}
+
+func TestCheckCgroupPids(t *testing.T) {
+	dir := t.TempDir()
+	if _, ok := checkCgroupPids(filepath.Join(dir, "pids.max")); ok {
+		t.Error("reported a check without a limit file")
+	}
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"max\n", checkPass},
+		{"4096\n", checkPass},
+		{"32\n", checkWarn},
+		{"lots\n", checkWarn},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "pids.max")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if r, ok := checkCgroupPids(path); !ok || r.Status != tt.want {
+			t.Errorf("pids.max %q: %+v, want %s", tt.content, r, tt.want)
+		}
+	}
+}
+
+func TestPrintReport(t *testing.T) {
+	var out strings.Builder
+	code := printReport(&out, []checkResult{
+		{Name: "pty", Status: checkPass, Detail: "ok", Hint: "unused"},
+		{Name: "listen", Status: checkFail, Detail: "address already in use", Hint: "choose another port"},
+	})
+	if code != 1 {
+		t.Errorf("exit code %d with a failure, want 1", code)
+	}
+	if strings.Contains(out.String(), "unused") || !strings.Contains(out.String(), "hint: choose another port") {
+		t.Errorf("hints wrong:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "2 checks, 1 failed, 0 warnings") {
+		t.Errorf("summary missing:\n%s", out.String())
+	}
+	out.Reset()
+	if code := printReport(&out, []checkResult{{Name: "cgroup", Status: checkWarn}}); code != 0 {
+		t.Errorf("exit code %d with only warnings, want 0", code)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashPasswordFromPipe(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := runHashPassword([]string{"-cost", "4"}, strings.NewReader("s3cret\n"), &stdout, &stderr); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr.String())
+	}
+	hash := strings.TrimSpace(stdout.String())
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("s3cret")) != nil {
+		t.Errorf("hash %q does not match the password", hash)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("prompted when reading from a pipe: %q", stderr.String())
+	}
+}
+
+func TestHashPasswordDoesNotEcho(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("no PTY: %v", err)
+	}
+	defer ptmx.Close()
+	defer tty.Close()
+
+	prompt, stderr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prompt.Close()
+	defer stderr.Close()
+	var stdout bytes.Buffer
+	done := make(chan int, 1)
+	go func() { done <- runHashPassword([]string{"-cost", "4"}, tty, &stdout, stderr) }()
+	// The prompt comes once echo is off.
+	_ = prompt.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	if n, err := prompt.Read(buf); err != nil || !strings.Contains(string(buf[:n]), "Password: ") {
+		t.Fatalf("no prompt: %q, %v", buf[:n], err)
+	}
+	if _, err := ptmx.Write([]byte("s3cret\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-done:
+		if code != 0 {
+			t.Fatalf("exit %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hash-password did not finish")
+	}
+
+	_ = ptmx.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	echoed := make([]byte, 256)
+	n, _ := ptmx.Read(echoed)
+	if strings.Contains(string(echoed[:n]), "s3cret") {
+		t.Errorf("password echoed to the terminal: %q", echoed[:n])
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// listenAddr parses the host of a --listen address, taking localhost as
+// loopback. It fails for an empty host, which listens on every interface,
+// and for any other host name.
+func listenAddr(listen string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	if host == "localhost" {
+		return netip.IPv6Loopback(), true
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// boundListen is listen with its port replaced by the one addr is bound
+// to, so a --listen with port 0 shows the port the system picked. The host
+// is kept as given.
+func boundListen(listen string, addr net.Addr) string {
+	host, _, err := net.SplitHostPort(listen)
+	tcp, ok := addr.(*net.TCPAddr)
+	if err != nil || !ok {
+		return listen
+	}
+	return net.JoinHostPort(host, strconv.Itoa(tcp.Port))
+}
+
+// isPrivateListen reports whether a --listen address only accepts
+// connections from this machine or a private network.
+func isPrivateListen(listen string) bool {
+	addr, ok := listenAddr(listen)
+	return ok && (addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast())
+}
+
+// checkPlaintext decides whether serving plain HTTP on listen deserves a
+// warning: anything but loopback without TLS does, since keystrokes cross
+// the network in the clear. With requireTLS that is an error instead.
+func checkPlaintext(listen string, useTLS, requireTLS bool) (warn bool, err error) {
+	if useTLS {
+		return false, nil
+	}
+	if addr, ok := listenAddr(listen); ok && addr.IsLoopback() {
+		return false, nil
+	}
+	if requireTLS {
+		return true, fmt.Errorf("refusing to serve plain HTTP on %s with --require-tls; set --tls-cert and --tls-key (a self-signed certificate will do), or listen on 127.0.0.1 behind a TLS proxy or tunnel", listen)
+	}
+	return true, nil
+}
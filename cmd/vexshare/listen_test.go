@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivateListen(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"localhost:8080", true},
+		{"[::1]:8080", true},
+		{"192.168.1.10:8080", true},
+		{"10.0.0.5:8080", true},
+		{"172.16.0.1:8080", true},
+		{"[fd00::1]:8080", true},
+		{"[::ffff:192.168.1.10]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"203.0.113.5:8080", false},
+		{"172.32.0.1:8080", false},
+		{"example.com:8080", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPrivateListen(tt.listen); got != tt.want {
+			t.Errorf("isPrivateListen(%q) = %v, want %v", tt.listen, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPlaintext(t *testing.T) {
+	tests := []struct {
+		listen     string
+		tls        bool
+		requireTLS bool
+		wantWarn   bool
+		wantErr    bool
+	}{
+		{"127.0.0.1:8080", false, false, false, false},
+		{"127.0.0.1:8080", false, true, false, false},
+		{"localhost:8080", false, true, false, false},
+		{"[::1]:8080", false, true, false, false},
+		{"0.0.0.0:8080", false, false, true, false},
+		{"0.0.0.0:8080", false, true, true, true},
+		{":8080", false, false, true, false},
+		{":8080", false, true, true, true},
+		{"192.168.1.10:8080", false, false, true, false},
+		{"192.168.1.10:8080", false, true, true, true},
+		{"example.com:8080", false, false, true, false},
+		{"0.0.0.0:8080", true, false, false, false},
+		{"0.0.0.0:8080", true, true, false, false},
+		{"203.0.113.5:443", true, true, false, false},
+	}
+	for _, tt := range tests {
+		warn, err := checkPlaintext(tt.listen, tt.tls, tt.requireTLS)
+		if warn != tt.wantWarn || (err != nil) != tt.wantErr {
+			t.Errorf("checkPlaintext(%q, tls=%v, require=%v) = %v, %v; want warn=%v err=%v",
+				tt.listen, tt.tls, tt.requireTLS, warn, err, tt.wantWarn, tt.wantErr)
+		}
+	}
+}
+
+func TestBoundListen(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4zero, Port: 43127}
+	tests := []struct {
+		listen string
+		want   string
+	}{
+		{"127.0.0.1:0", "127.0.0.1:43127"},
+		{"localhost:0", "localhost:43127"},
+		{":0", ":43127"},
+		{"[::1]:0", "[::1]:43127"},
+		{"bad", "bad"},
+	}
+	for _, tt := range tests {
+		if got := boundListen(tt.listen, addr); got != tt.want {
+			t.Errorf("boundListen(%q) = %q, want %q", tt.listen, got, tt.want)
+		}
+	}
+}
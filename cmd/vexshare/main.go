@@ -2,23 +2,56 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
 	"github.com/vextm/vexshare/internal/auth"
+	"github.com/vextm/vexshare/internal/ipfilter"
+	"github.com/vextm/vexshare/internal/origin"
+	"github.com/vextm/vexshare/internal/ratelimit"
 	"github.com/vextm/vexshare/internal/server"
 	"github.com/vextm/vexshare/internal/session"
 	"github.com/vextm/vexshare/internal/tokens"
 )
 
-var Version = "dev"
+// Version, Commit and BuildTime are set with -ldflags "-X main.Version=..."
+// and reported at GET /version; --version prints Version. Without them,
+// Commit and BuildTime fall back to what go build recorded from version
+// control.
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildTime = ""
+)
+
+// defaultUI is the --ui default; building with -tags minimal_ui makes it
+// "minimal".
+var defaultUI = "full"
+
+// shutdownTimeout bounds the drain after the first SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+// defaultConsentText is the notice --require-consent shows without
+// --consent-text-file.
+const defaultConsentText = "This terminal session is recorded. By continuing, you agree that what it shows may be stored and reviewed."
 
 func main() {
 	if runtime.GOOS == "windows" {
@@ -27,19 +60,109 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == session.RLimitExecCommand {
+		os.Exit(session.RunRLimitExec(os.Args[2:], os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(runHashPassword(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "attach" {
+		os.Exit(runAttach(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	listen := flag.String("listen", "127.0.0.1:8080", "address to listen on")
 	cmd := flag.String("cmd", "bash", "command to run in PTY")
-	authMode := flag.String("auth", "password", "auth mode: password, token, password+token")
+	authMode := flag.String("auth", "password", "auth mode: password, basic, token, apikey (X-API-Key header), password+token, none (read-only, loopback or private addresses only)")
+	insecure := flag.Bool("i-know-this-is-insecure", false, "allow --auth none on an address that is not loopback or private")
 	user := flag.String("user", "vex", "username for password auth")
 	password := flag.String("password", "", "password (auto-generated if empty)")
+	passwordHash := flag.String("password-hash", "", "bcrypt hash of the password (see: vexshare hash-password)")
 	token := flag.String("token", "", "access token (auto-generated if empty)")
+	viewToken := flag.String("view-token", "", "read-only access token, accepted in the token URL path or as ?vt= (token auth modes)")
+	tokenFormat := flag.String("token-format", "base64", "format of generated tokens: base64 (vsx_ prefixed), hex")
+	htpasswd := flag.String("htpasswd", "", "htpasswd file with bcrypt entries for password auth (replaces --user/--password)")
+	usersFile := flag.String("users-file", "", "JSON users file with bcrypt hashes and roles (reloaded on SIGHUP)")
+	totp := flag.Bool("totp", false, "also ask --users-file logins for an authenticator app code, enrolling users without one at their first login")
+	loginUserLimit := flag.Int("login-user-limit", 5, "failed login attempts allowed per username within --login-user-window")
+	loginUserWindow := flag.Duration("login-user-window", 5*time.Minute, "window for --login-user-limit")
+	maxPendingLogins := flag.Int("max-pending-logins", 32, "login requests handled at once, 503 beyond it (0 = unlimited)")
+	cookieName := flag.String("cookie-name", auth.DefaultCookieName, "name of the login session cookie (suffixed with a hash of --base-path when one is set)")
+	cookieTTL := flag.Duration("cookie-ttl", auth.DefaultCookieTTL, "how long a login lasts, for both the cookie and the server-side session")
+	sessionMaxAge := flag.Int("session-max-age", -1, "session cookie Max-Age in seconds; 0 makes it last until the browser closes (-1 = --cookie-ttl)")
+	basePath := flag.String("base-path", "", "URL path a reverse proxy serves this instance under; scopes the session cookie to it")
+	maxSessions := flag.Int("max-sessions", 10000, "max login sessions held in memory, oldest evicted (0 = unlimited)")
+	maxSessionsPerUser := flag.Int("max-sessions-per-user", 0, "max concurrent login sessions per username, oldest evicted (0 = unlimited)")
 	sharedInput := flag.Bool("shared-input", false, "allow all clients to write input")
+	resizeMode := flag.String("resize-mode", "min", "how the PTY size is chosen: min (smallest client), controller")
+	onExit := flag.String("on-exit", "close", "when the command exits: close (stop the server), prompt (ask the controller to restart or quit), restart")
+	startupRetries := flag.Int("startup-retries", 0, "if the command cannot be started, try again this many times")
+	startupRetryDelay := flag.Duration("startup-retry-delay", time.Second, "pause between attempts to start the command")
+	lazyStart := flag.Bool("lazy-start", false, "start the PTY when the first client connects and keep serving after it exits")
+	scrollback := flag.Int("scrollback-bytes", session.DefaultScrollbackBytes, "size of the in-memory output history served by /api/history")
+	historySpool := flag.String("history-spool", "", "directory to spool the full output history to instead of keeping it in memory")
+	historySpoolMaxMB := flag.Int("history-spool-max-mb", 256, "size cap of the history spool in MiB, oldest output dropped first (0 = unlimited)")
+	flushBytes := flag.Int("output-flush-bytes", session.DefaultOutputFlushBytes, "send buffered terminal output once it reaches this many bytes")
+	flushDelay := flag.Duration("output-flush-delay", session.DefaultOutputFlushDelay, "send buffered terminal output this long after it started (negative = send every read at once)")
+	reconnectGrace := flag.Duration("reconnect-grace", 0, "hold a dropped client this long so a reconnect keeps its role (0 = disabled)")
+	closeGrace := flag.Duration("close-grace", 0, "when the session ends, wait this long for clients to close their connections before dropping them")
+	latencyStats := flag.Bool("latency-stats", false, "time output from the PTY to each client and report percentiles in /api/status")
+	promptRegex := flag.String("prompt-regex", "", "send a prompt event when the line the cursor is on matches this regular expression")
+	shellIntegration := flag.Bool("shell-integration", false, "send prompt, command-start and command-end events from the shell's OSC 133 marks")
+	broadcastWorkers := flag.Int("broadcast-workers", 0, "fan terminal output out to large audiences across this many goroutines (0 = serial)")
+	maxMessageBytes := flag.Int64("max-message-bytes", session.DefaultMaxMessageBytes, "largest WebSocket message accepted from a client; bigger ones close the connection")
+	notifySecurity := flag.Bool("notify-security-events", false, "show failed login attempts to connected terminal clients")
+	console := flag.Bool("console", false, "read operator commands from stdin (!note, >input); needs a terminal")
+	killGroup := flag.Bool("kill-process-group", session.DefaultKillProcessGroup, "when the session ends, also kill processes the command started in the background")
+	var rlimits rlimitFlag
+	flag.Var(&rlimits, "rlimit", "resource limit for the command as NAME:SOFT:HARD, e.g. RLIMIT_NOFILE:1024:1024 (repeatable, Linux only)")
+	persistent := flag.Bool("persistent", false, "run --cmd inside a tmux (or screen) session named vexshare that survives restarts, attaching to it if it exists")
+	runAs := flag.String("run-as", "", "run the command as USER[:GROUP] instead of the server's user (needs root)")
+	clearEnv := flag.Bool("clear-env", false, "start the command with only TERM set instead of the server's environment")
 	idleTimeout := flag.Duration("idle-timeout", 30*time.Minute, "idle timeout before session shutdown")
+	idleExtendStep := flag.Duration("idle-extend-step", 15*time.Minute, "how much the controller's Extend button adds to the idle timeout (0 = no button)")
+	idleExtendMax := flag.Duration("idle-extend-max", 2*time.Hour, "most the idle timeout can be extended in total (0 = no limit)")
+	maxConns := flag.Int("max-connections", 0, "max open TCP connections, refused beyond it (0 = unlimited)")
+	maxConnsPerIP := flag.Int("max-connections-per-ip", 0, "max open TCP connections from one peer address, not counting --trusted-proxy peers (0 = unlimited)")
+	slowClientLimit := flag.Int("slow-client-limit", 0, "ban a peer whose connections time out before sending a request more than this many times in 10 minutes (0 = never)")
+	slowClientBan := flag.Duration("slow-client-ban", 10*time.Minute, "how long --slow-client-limit bans a peer")
+	maxPerIP := flag.Int("max-sessions-per-ip", 0, "max concurrent WebSocket connections per IP (0 = unlimited)")
+	tokenMaxConns := flag.Int("token-max-connections", 0, "max concurrent WebSocket connections per share token, control and view counted separately (0 = unlimited)")
+	wsLimitAuthOnly := flag.Bool("ws-rate-limit-authenticated-only", false, "count only authenticated WebSocket upgrades against the per-IP limit")
+	rateLimitStore := flag.String("rate-limit-store", "memory", "where rate limit counts are kept: memory, redis (shared across instances)")
+	redisURL := flag.String("redis-url", "", "Redis URL for --rate-limit-store redis, e.g. redis://:password@host:6379/0")
+	adminToken := flag.String("admin-token", "", "bearer token enabling the /admin API (disabled if empty)")
+	shortURLBase := flag.String("short-url-base", "", "URL that short links for token URLs start with, e.g. https://vshr.example.com (enables GET /admin/shorten)")
+	readHeaderTimeout := flag.Duration("read-header-timeout", 15*time.Second, "time allowed to read request headers")
+	readTimeout := flag.Duration("read-timeout", 0, "time allowed to read a whole request (0 = no limit beyond per-handler caps)")
+	writeTimeout := flag.Duration("write-timeout", 15*time.Second, "time allowed to write a response (WebSockets are exempt)")
+	httpIdleTimeout := flag.Duration("http-idle-timeout", 60*time.Second, "how long idle keep-alive connections are kept open")
 	tlsCert := flag.String("tls-cert", "", "path to TLS certificate (enables HTTPS)")
 	tlsKey := flag.String("tls-key", "", "path to TLS private key (enables HTTPS)")
+	h2c := flag.Bool("h2c", false, "also serve HTTP/2 without TLS (prior knowledge), for proxies that prefer it; WebSockets still use HTTP/1.1")
+	requireTLS := flag.Bool("require-tls", os.Getenv("VEXSHARE_REQUIRE_TLS") == "1", "refuse to serve plain HTTP on a non-loopback address (default from VEXSHARE_REQUIRE_TLS=1)")
 	logLevel := flag.String("log-level", "info", "log level: debug, info, warn, error")
-	allowOrigin := flag.String("allow-origin", "", "allowed origins for WebSocket (comma-separated)")
+	allowIP := flag.String("allow-ip", "", "only accept clients from these IPs or CIDR ranges (comma-separated, empty = all)")
+	denyIP := flag.String("deny-ip", "", "refuse clients from these IPs or CIDR ranges, even if --allow-ip covers them (comma-separated)")
+	trustForwardedProto := flag.Bool("trust-forwarded-proto", false, "mark login cookies Secure when a --trusted-proxy sends X-Forwarded-Proto: https")
+	trustedProxy := flag.String("trusted-proxy", "", "IPs or CIDR ranges of the reverse proxies whose X-Forwarded-For and X-Forwarded-Proto are believed and whose connections skip the per-IP connection limits (comma-separated)")
+	sessionPrefix := flag.String("session-path-prefix", "/s/", "URL prefix under which named sessions are served")
+	forbiddenPage := flag.String("forbidden-page", "", "file served with the 403 at / in token mode (HTML if it ends in .html)")
+	forbiddenMessage := flag.String("forbidden-message", "", "plain-text message for the 403 at / in token mode")
+	var allowOrigins originFlag
+	flag.Var(&allowOrigins, "allow-origin", "allowed origins for WebSocket, such as https://app.example.com, *.preview.example.com or null (comma-separated, repeatable)")
+	title := flag.String("title", server.DefaultTitle, "name shown in the login and terminal pages' tab title and header")
+	logoURL := flag.String("logo-url", "", "logo shown on the login page and in the terminal toolbar (http, https or a /path)")
+	motd := flag.String("motd", "", "welcome message shown to each client when it connects, such as the session's rules (@path reads it from a file)")
+	requireConsent := flag.Bool("require-consent", false, "make each client accept a notice that the session is recorded before it joins")
+	consentTextFile := flag.String("consent-text-file", "", "file with the notice --require-consent shows instead of the default")
+	uiName := flag.String("ui", defaultUI, "web UI: full, minimal (terminal only, with no status or history API)")
+	banner := flag.String("banner", "on", "startup banner: on, off (off prints a JSON listening event to stdout instead)")
+	outputFormat := flag.String("output-format", "text", "startup banner format: text (to stderr), json (one object with the URLs and credentials to stdout)")
 	version := flag.Bool("version", false, "print version and exit")
+	versionAuth := flag.Bool("version-auth", false, "require the same auth as /api/status for GET /version")
 
 	flag.Parse()
 
@@ -49,9 +172,51 @@ func main() {
 	}
 
 	switch *authMode {
-	case "password", "token", "password+token":
+	case "password", "basic", "token", "apikey", "password+token":
+	case "none":
+		if !*insecure && !isPrivateListen(*listen) {
+			fmt.Fprintf(os.Stderr, "Error: --auth none serves the terminal to anyone who can reach %s; listen on a loopback or private address, or add --i-know-this-is-insecure\n", *listen)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid auth mode %q. Use: password, basic, token, apikey, password+token, none\n", *authMode)
+		os.Exit(1)
+	}
+
+	switch *onExit {
+	case session.OnExitClose, session.OnExitPrompt, session.OnExitRestart:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid --on-exit %q. Use: close, prompt, restart\n", *onExit)
+		os.Exit(1)
+	}
+
+	features, err := server.ParseUI(*uiName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --ui: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch *banner {
+	case "on", "off":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid --banner %q. Use: on, off\n", *banner)
+		os.Exit(1)
+	}
+	switch *outputFormat {
+	case "text", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid --output-format %q. Use: text, json\n", *outputFormat)
+		os.Exit(1)
+	}
+	if *outputFormat == "json" && *banner == "off" {
+		fmt.Fprintln(os.Stderr, "Error: --output-format json is a format for the banner, which --banner off turns off")
+		os.Exit(1)
+	}
+
+	switch *resizeMode {
+	case "min", "controller":
 	default:
-		fmt.Fprintf(os.Stderr, "Error: invalid auth mode %q. Use: password, token, password+token\n", *authMode)
+		fmt.Fprintf(os.Stderr, "Error: invalid resize mode %q. Use: min, controller\n", *resizeMode)
 		os.Exit(1)
 	}
 
@@ -70,9 +235,121 @@ func main() {
 		os.Exit(1)
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	if *authMode == "none" {
+		logger.Warn("authentication is disabled: anyone who can reach the server can watch the terminal", "listen", *listen)
+	}
+
+	allowIPs, err := ipfilter.Parse(*allowIP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --allow-ip: %v\n", err)
+		os.Exit(1)
+	}
+	denyIPs, err := ipfilter.Parse(*denyIP)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --deny-ip: %v\n", err)
+		os.Exit(1)
+	}
+	trustedProxies, err := ipfilter.Parse(*trustedProxy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: --trusted-proxy: %v\n", err)
+		os.Exit(1)
+	}
+
+	var rlStore ratelimit.Store
+	switch *rateLimitStore {
+	case "memory":
+		if *redisURL != "" {
+			fmt.Fprintln(os.Stderr, "Error: --redis-url requires --rate-limit-store redis")
+			os.Exit(1)
+		}
+	case "redis":
+		if *redisURL == "" {
+			fmt.Fprintln(os.Stderr, "Error: --rate-limit-store redis requires --redis-url")
+			os.Exit(1)
+		}
+		redisStore, err := ratelimit.NewRedisStore(*redisURL, logger)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --redis-url: %v\n", err)
+			os.Exit(1)
+		}
+		rlStore = redisStore
+	default:
+		fmt.Fprintf(os.Stderr, "Error: invalid --rate-limit-store %q. Use: memory, redis\n", *rateLimitStore)
+		os.Exit(1)
+	}
 
-	if *authMode == "password" || *authMode == "password+token" {
+	if *htpasswd != "" && *usersFile != "" {
+		fmt.Fprintln(os.Stderr, "Error: --htpasswd and --users-file are mutually exclusive")
+		os.Exit(1)
+	}
+
+	var authenticator auth.Authenticator
+	var users *auth.UsersFile
+	if *usersFile != "" {
+		if *authMode == "token" || *authMode == "apikey" || *authMode == "basic" {
+			fmt.Fprintln(os.Stderr, "Error: --users-file requires a password auth mode")
+			os.Exit(1)
+		}
+		var err error
+		users, err = auth.LoadUsersFile(*usersFile)
+		if err != nil {
+			logger.Error("failed to load users file", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("loaded users file", "path", *usersFile, "users", users.Len())
+		authenticator = users
+	}
+	if *totp && *usersFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: --totp requires --users-file, where enrolled secrets are saved")
+		os.Exit(1)
+	}
+	if *htpasswd != "" {
+		if *authMode == "token" || *authMode == "apikey" || *authMode == "basic" {
+			fmt.Fprintln(os.Stderr, "Error: --htpasswd requires a password auth mode")
+			os.Exit(1)
+		}
+		h, err := auth.LoadHtpasswd(*htpasswd)
+		if err != nil {
+			logger.Error("failed to load htpasswd file", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("loaded htpasswd file", "path", *htpasswd, "users", h.Len())
+		authenticator = h
+	}
+
+	// After a handoff, keep the credentials of the process this one
+	// replaced, which it may have generated.
+	handoff, err := server.InheritedHandoff()
+	if err != nil {
+		logger.Error("failed to take over from the previous process", "error", err)
+		os.Exit(1)
+	}
+	if handoff != nil {
+		if *password == "" && *passwordHash == "" {
+			*password = handoff.Password
+		}
+		if *token == "" {
+			*token = handoff.Token
+		}
+	}
+
+	if *passwordHash != "" {
+		if *password != "" {
+			fmt.Fprintln(os.Stderr, "Error: --password and --password-hash are mutually exclusive")
+			os.Exit(1)
+		}
+		if _, err := bcrypt.Cost([]byte(*passwordHash)); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --password-hash: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if (*authMode == "password" || *authMode == "basic" || *authMode == "password+token") && authenticator == nil && *passwordHash == "" {
 		if *password == "" {
+			if *banner == "off" {
+				fmt.Fprintln(os.Stderr, "Error: --banner off needs --password or --password-hash; a generated password is only shown in the banner")
+				os.Exit(1)
+			}
 			generated, err := tokens.GeneratePassword(18)
 			if err != nil {
 				logger.Error("failed to generate password", "error", err)
@@ -82,9 +359,27 @@ func main() {
 		}
 	}
 
-	if *authMode == "token" || *authMode == "password+token" {
+	if *authMode == "token" || *authMode == "apikey" || *authMode == "password+token" {
+		if *token != "" && len(*token) < tokens.MinTokenLength {
+			fmt.Fprintf(os.Stderr, "Error: --token must be at least %d characters\n", tokens.MinTokenLength)
+			os.Exit(1)
+		}
 		if *token == "" {
-			generated, err := tokens.Generate()
+			if *banner == "off" {
+				fmt.Fprintln(os.Stderr, "Error: --banner off needs --token; a generated token is only shown in the banner")
+				os.Exit(1)
+			}
+			var generated string
+			var err error
+			switch *tokenFormat {
+			case "base64":
+				generated, err = tokens.GeneratePrefixed(tokens.DefaultPrefix)
+			case "hex":
+				generated, err = tokens.GenerateHex(32)
+			default:
+				fmt.Fprintf(os.Stderr, "Error: invalid token format %q. Use: base64, hex\n", *tokenFormat)
+				os.Exit(1)
+			}
 			if err != nil {
 				logger.Error("failed to generate token", "error", err)
 				os.Exit(1)
@@ -93,49 +388,329 @@ func main() {
 		}
 	}
 
+	if *viewToken != "" {
+		if *authMode == "password" || *authMode == "basic" {
+			fmt.Fprintln(os.Stderr, "Error: --view-token requires a token auth mode")
+			os.Exit(1)
+		}
+		if len(*viewToken) < tokens.MinTokenLength {
+			fmt.Fprintf(os.Stderr, "Error: --view-token must be at least %d characters\n", tokens.MinTokenLength)
+			os.Exit(1)
+		}
+		if *viewToken == *token {
+			fmt.Fprintln(os.Stderr, "Error: --view-token must differ from --token")
+			os.Exit(1)
+		}
+	}
+
+	if *adminToken != "" && len(*adminToken) < tokens.MinTokenLength {
+		fmt.Fprintf(os.Stderr, "Error: --admin-token must be at least %d characters\n", tokens.MinTokenLength)
+		os.Exit(1)
+	}
+	if *shortURLBase != "" {
+		if *adminToken == "" {
+			fmt.Fprintln(os.Stderr, "Error: --short-url-base needs --admin-token; short links are created through the admin API")
+			os.Exit(1)
+		}
+		if *authMode != "token" && *authMode != "password+token" {
+			fmt.Fprintln(os.Stderr, "Error: --short-url-base is for token URLs; use --auth token or password+token")
+			os.Exit(1)
+		}
+	}
+
+	motdText := *motd
+	if path, ok := strings.CutPrefix(motdText, "@"); ok {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --motd: %v\n", err)
+			os.Exit(1)
+		}
+		motdText = string(body)
+	}
+
+	var consentText string
+	if *requireConsent {
+		consentText = defaultConsentText
+		if *consentTextFile != "" {
+			body, err := os.ReadFile(*consentTextFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: --consent-text-file: %v\n", err)
+				os.Exit(1)
+			}
+			consentText = strings.TrimSpace(string(body))
+			if consentText == "" {
+				fmt.Fprintln(os.Stderr, "Error: --consent-text-file is empty")
+				os.Exit(1)
+			}
+		}
+	} else if *consentTextFile != "" {
+		fmt.Fprintln(os.Stderr, "Error: --consent-text-file requires --require-consent")
+		os.Exit(1)
+	}
+
+	var forbiddenBody []byte
+	var forbiddenType string
+	switch {
+	case *forbiddenPage != "" && *forbiddenMessage != "":
+		fmt.Fprintln(os.Stderr, "Error: --forbidden-page and --forbidden-message are mutually exclusive")
+		os.Exit(1)
+	case *forbiddenPage != "":
+		body, err := os.ReadFile(*forbiddenPage)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --forbidden-page: %v\n", err)
+			os.Exit(1)
+		}
+		forbiddenBody = body
+		if ext := strings.ToLower(filepath.Ext(*forbiddenPage)); ext == ".html" || ext == ".htm" {
+			forbiddenType = "text/html; charset=utf-8"
+		}
+	case *forbiddenMessage != "":
+		forbiddenBody = []byte(*forbiddenMessage + "\n")
+	}
+
 	useTLS := *tlsCert != "" && *tlsKey != ""
 	scheme := "http"
 	if useTLS {
 		scheme = "https"
 	}
+	plaintext, err := checkPlaintext(*listen, useTLS, *requireTLS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if plaintext {
+		logger.Warn("serving plain HTTP on a non-loopback address: keystrokes, including passwords typed into the terminal, cross the network unencrypted", "listen", *listen)
+	}
+
+	var runAsCred *session.RunAs
+	if *runAs != "" {
+		runAsCred, err = session.ResolveRunAs(*runAs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --run-as: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	authCfg := auth.Config{
-		Mode:     *authMode,
-		Username: *user,
-		Password: *password,
-		Token:    *token,
-		Secure:   useTLS,
+		Mode:         *authMode,
+		Username:     *user,
+		Password:     *password,
+		PasswordHash: *passwordHash,
+		Token:        *token,
+		ViewToken:    *viewToken,
+		Secure:       useTLS,
+		CookieName:   *cookieName,
+		CookieTTL:    *cookieTTL,
+		BasePath:     *basePath,
+	}
+	switch {
+	case *sessionMaxAge == 0:
+		authCfg.SessionMaxAge = auth.BrowserSessionCookie
+	case *sessionMaxAge > 0:
+		authCfg.SessionMaxAge = *sessionMaxAge
+	}
+
+	var promptRE *regexp.Regexp
+	if *promptRegex != "" {
+		promptRE, err = regexp.Compile(*promptRegex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: --prompt-regex: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// --cmd is a command line, split on spaces; quoting is not supported,
+	// so put anything more involved in a script.
+	var command string
+	var args []string
+	if fields := strings.Fields(*cmd); len(fields) > 0 {
+		command, args = fields[0], fields[1:]
+	}
+	if *persistent {
+		command, args, err = persistentCommand(exec.LookPath, command, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	sessCfg := session.Config{
-		Command:     *cmd,
-		SharedInput: *sharedInput,
-		IdleTimeout: *idleTimeout,
+		Command:              command,
+		Args:                 args,
+		SharedInput:          *sharedInput,
+		ClearEnv:             *clearEnv,
+		KillProcessGroup:     *killGroup,
+		ResourceLimits:       rlimits,
+		RunAs:                runAsCred,
+		IdleTimeout:          *idleTimeout,
+		IdleExtendStep:       *idleExtendStep,
+		IdleExtendMax:        *idleExtendMax,
+		ResizeMode:           *resizeMode,
+		OnExit:               *onExit,
+		ScrollbackBytes:      *scrollback,
+		HistorySpoolDir:      *historySpool,
+		HistorySpoolMaxBytes: int64(*historySpoolMaxMB) << 20,
+		NotifySecurityEvents: *notifySecurity,
+		MaxMessageBytes:      *maxMessageBytes,
+		OutputFlushBytes:     *flushBytes,
+		OutputFlushDelay:     *flushDelay,
+		BroadcastWorkers:     *broadcastWorkers,
+		LatencyStats:         *latencyStats,
+		PromptRegex:          promptRE,
+		ShellIntegration:     *shellIntegration,
+		MOTD:                 motdText,
+		ConsentText:          consentText,
+		ReconnectGrace:       *reconnectGrace,
+		CloseGrace:           *closeGrace,
+		StartupRetries:       *startupRetries,
+		StartupRetryDelay:    *startupRetryDelay,
 	}
 
 	srvCfg := server.Config{
-		ListenAddr:  *listen,
-		TLSCert:     *tlsCert,
-		TLSKey:      *tlsKey,
-		AuthConfig:  authCfg,
-		SessionCfg:  sessCfg,
-		AllowOrigin: *allowOrigin,
-		Logger:      logger,
+		ListenAddr:                   *listen,
+		TLSCert:                      *tlsCert,
+		TLSKey:                       *tlsKey,
+		H2C:                          *h2c,
+		AuthConfig:                   authCfg,
+		SessionCfg:                   sessCfg,
+		AllowOrigins:                 origin.List(allowOrigins),
+		AllowIPs:                     allowIPs,
+		SessionPathPrefix:            *sessionPrefix,
+		Features:                     &features,
+		Title:                        *title,
+		LogoURL:                      *logoURL,
+		RateLimitStore:               rlStore,
+		ForbiddenBody:                forbiddenBody,
+		ForbiddenContentType:         forbiddenType,
+		DenyIPs:                      denyIPs,
+		TrustForwardedProto:          *trustForwardedProto,
+		TrustedProxies:               trustedProxies,
+		ReadHeaderTimeout:            *readHeaderTimeout,
+		ReadTimeout:                  *readTimeout,
+		WriteTimeout:                 *writeTimeout,
+		IdleTimeout:                  *httpIdleTimeout,
+		Logger:                       logger,
+		Authenticator:                authenticator,
+		RequireTOTP:                  *totp,
+		MaxSessions:                  *maxSessions,
+		MaxSessionsPerIP:             *maxPerIP,
+		TokenMaxConnections:          *tokenMaxConns,
+		MaxSessionsPerUser:           *maxSessionsPerUser,
+		UsernameRateLimit:            *loginUserLimit,
+		UsernameRateWindow:           *loginUserWindow,
+		MaxPendingLogins:             *maxPendingLogins,
+		MaxConnections:               *maxConns,
+		MaxConnectionsPerIP:          *maxConnsPerIP,
+		SlowClientLimit:              *slowClientLimit,
+		SlowClientBan:                *slowClientBan,
+		AdminToken:                   *adminToken,
+		ShortURLBase:                 *shortURLBase,
+		WSRateLimitAuthenticatedOnly: *wsLimitAuthOnly,
+		LazyStart:                    *lazyStart,
+		Handoff:                      handoff,
+		Build:                        buildInfo(),
+		VersionRequiresAuth:          *versionAuth,
 	}
 
-	printBanner(scheme, *listen, *authMode, *user, *password, *token, *cmd, *idleTimeout, *sharedInput)
+	usersSource := *htpasswd
+	if *usersFile != "" {
+		usersSource = *usersFile
+	}
+	if *banner == "off" {
+		srvCfg.ReadyOutput = os.Stdout
+	}
 
+	if err := srvCfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 	srv := server.New(srvCfg)
+	// Bind before the banner so it shows the port picked for :0.
+	addr, err := srv.Listen()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: listen on %s: %v\n", *listen, err)
+		os.Exit(1)
+	}
+	switch {
+	case *banner == "off":
+	case *outputFormat == "json":
+		printBannerJSON(os.Stdout, scheme, boundListen(*listen, addr), *authMode, *user, *password, *token, *viewToken, usersSource, *cmd, *idleTimeout, *sharedInput)
+	default:
+		printBanner(scheme, boundListen(*listen, addr), *authMode, *user, *password, *token, *viewToken, usersSource, *cmd, *idleTimeout, *sharedInput, plaintext)
+	}
+
+	if *console {
+		if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			fmt.Fprintln(os.Stderr, "  Console enabled: type ? for commands.")
+			go srv.RunConsole(os.Stdin, os.Stderr)
+		} else {
+			logger.Warn("--console ignored: stdin is not a terminal")
+		}
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	if users != nil {
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				if err := users.Reload(); err != nil {
+					logger.Error("failed to reload users file, keeping previous users", "error", err)
+					continue
+				}
+				logger.Info("reloaded users file", "path", *usersFile, "users", users.Len())
+			}
+		}()
+	}
+
+	// SIGUSR2 hands the session to the binary now at our path; see
+	// server.Handoff. Until it fails, Start returning is not the end.
+	var handingOff atomic.Bool
+	usr2Ch := make(chan os.Signal, 1)
+	signal.Notify(usr2Ch, syscall.SIGUSR2)
 	go func() {
-		<-sigCh
-		fmt.Fprintln(os.Stderr, "\nShutting down...")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		for range usr2Ch {
+			logger.Info("SIGUSR2 received, handing off to new binary")
+			handingOff.Store(true)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			err := srv.Handoff(ctx)
+			cancel()
+			if errors.Is(err, server.ErrHandoffAborted) {
+				logger.Error("handoff failed", "error", err)
+				os.Exit(1)
+			}
+			handingOff.Store(false)
+			logger.Warn("handoff refused", "error", err)
+		}
+	}()
+
+	// The first signal drains connections for up to shutdownTimeout; a
+	// second one, of either kind, stops waiting. SIGTERM usually comes from
+	// an orchestrator that sends SIGKILL after its own grace period.
+	draining := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		sig := <-sigCh
+		close(draining)
+		if sig == syscall.SIGTERM {
+			logger.Info("SIGTERM received, draining connections", "timeout", shutdownTimeout)
+		} else {
+			fmt.Fprintln(os.Stderr, "\nShutting down... (press Ctrl+C again to force)")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
-		if err := srv.Shutdown(ctx); err != nil {
+		go func() {
+			select {
+			case sig := <-sigCh:
+				logger.Warn("second signal received, forcing shutdown", "signal", sig)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
 			logger.Error("shutdown error", "error", err)
 		}
 	}()
@@ -146,11 +721,21 @@ func main() {
 			os.Exit(1)
 		}
 	}
+	if handingOff.Load() {
+		// The handoff execs the new binary or exits.
+		select {}
+	}
+	// Serve returns as soon as shutdown begins; let the drain finish.
+	select {
+	case <-draining:
+		<-drained
+	default:
+	}
 
 	fmt.Fprintln(os.Stderr, "Goodbye.")
 }
 
-func printBanner(scheme, listen, authMode, user, password, token, cmd string, idleTimeout time.Duration, sharedInput bool) {
+func printBanner(scheme, listen, authMode, user, password, token, viewToken, usersSource, cmd string, idleTimeout time.Duration, sharedInput, plaintext bool) {
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "  ┌─────────────────────────────────────────────┐")
 	fmt.Fprintln(os.Stderr, "  │           vexShare — Terminal Sharing       │")
@@ -158,18 +743,40 @@ func printBanner(scheme, listen, authMode, user, password, token, cmd string, id
 	fmt.Fprintln(os.Stderr)
 
 	baseURL := fmt.Sprintf("%s://%s", scheme, listen)
+	// Terminals that understand OSC 8, such as kitty, iTerm2 and most
+	// VTE-based ones, make the URLs clickable; others ignore it.
+	link := func(u string) string { return u }
+	if fi, err := os.Stderr.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 && os.Getenv("TERM") != "dumb" {
+		link = hyperlink
+	}
 
 	fmt.Fprintf(os.Stderr, "  Auth Mode    : %s\n", authMode)
+	if authMode == "none" {
+		fmt.Fprintln(os.Stderr, "  WARNING      : NO AUTHENTICATION. Anyone who can reach this address")
+		fmt.Fprintln(os.Stderr, "                 can watch the terminal (read-only).")
+	}
 
-	if authMode == "password" || authMode == "password+token" {
+	if usersSource != "" {
+		fmt.Fprintf(os.Stderr, "  Users        : %s\n", usersSource)
+	} else if authMode == "password" || authMode == "basic" || authMode == "password+token" {
 		fmt.Fprintf(os.Stderr, "  Username     : %s\n", user)
-		fmt.Fprintf(os.Stderr, "  Password     : %s\n", password)
+		if password != "" {
+			fmt.Fprintf(os.Stderr, "  Password     : %s\n", password)
+		} else {
+			fmt.Fprintln(os.Stderr, "  Password     : (bcrypt hash from --password-hash)")
+		}
 	}
 
-	fmt.Fprintf(os.Stderr, "  URL          : %s\n", baseURL)
+	fmt.Fprintf(os.Stderr, "  URL          : %s\n", link(baseURL))
 
 	if authMode == "token" || authMode == "password+token" {
-		fmt.Fprintf(os.Stderr, "  Token URL    : %s/t/%s/\n", baseURL, token)
+		fmt.Fprintf(os.Stderr, "  Token URL    : %s\n", link(baseURL+"/t/"+token+"/"))
+	}
+	if authMode == "apikey" {
+		fmt.Fprintf(os.Stderr, "  API Key      : %s (send as X-API-Key)\n", token)
+	}
+	if viewToken != "" {
+		fmt.Fprintf(os.Stderr, "  View URL     : %s\n", link(baseURL+"/?vt="+url.QueryEscape(viewToken)))
 	}
 
 	fmt.Fprintf(os.Stderr, "  Command      : %s\n", cmd)
@@ -181,7 +788,114 @@ func printBanner(scheme, listen, authMode, user, password, token, cmd string, id
 		fmt.Fprintln(os.Stderr, "  Input        : single-controller")
 	}
 
+	if plaintext {
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "  WARNING: plain HTTP on a non-loopback address. Everything typed,")
+		fmt.Fprintln(os.Stderr, "  including passwords, crosses the network unencrypted. Use")
+		fmt.Fprintln(os.Stderr, "  --tls-cert/--tls-key, or listen on 127.0.0.1 behind a TLS proxy.")
+	}
+
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "  Press Ctrl+C to stop.")
 	fmt.Fprintln(os.Stderr)
 }
+
+// bannerJSON is the banner for --output-format json. Fields that do not
+// apply to the auth mode are left out.
+type bannerJSON struct {
+	URL         string `json:"url"`
+	TokenURL    string `json:"tokenURL,omitempty"`
+	ViewURL     string `json:"viewURL,omitempty"`
+	APIKey      string `json:"apiKey,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	UsersFile   string `json:"usersFile,omitempty"`
+	Command     string `json:"command"`
+	IdleTimeout string `json:"idleTimeout"`
+	AuthMode    string `json:"authMode"`
+	SharedInput bool   `json:"sharedInput"`
+}
+
+// printBannerJSON writes what printBanner shows as one line of JSON, for
+// wrapper scripts that hand the URLs and credentials out.
+func printBannerJSON(w io.Writer, scheme, listen, authMode, user, password, token, viewToken, usersSource, cmd string, idleTimeout time.Duration, sharedInput bool) {
+	b := bannerJSON{
+		URL:         fmt.Sprintf("%s://%s", scheme, listen),
+		Command:     cmd,
+		IdleTimeout: idleTimeout.String(),
+		AuthMode:    authMode,
+		SharedInput: sharedInput,
+	}
+	if usersSource != "" {
+		b.UsersFile = usersSource
+	} else if authMode == "password" || authMode == "basic" || authMode == "password+token" {
+		b.Username, b.Password = user, password
+	}
+	if authMode == "token" || authMode == "password+token" {
+		b.TokenURL = b.URL + "/t/" + token + "/"
+	}
+	if authMode == "apikey" {
+		b.APIKey = token
+	}
+	if viewToken != "" {
+		b.ViewURL = b.URL + "/?vt=" + url.QueryEscape(viewToken)
+	}
+	line, _ := json.Marshal(b)
+	_, _ = w.Write(append(line, '\n'))
+}
+
+// hyperlink wraps u in an OSC 8 sequence that links the text to itself.
+func hyperlink(u string) string {
+	return "\x1b]8;;" + u + "\x1b\\" + u + "\x1b]8;;\x1b\\"
+}
+
+// rlimitFlag collects repeated --rlimit flags.
+type rlimitFlag []session.RLimit
+
+func (f *rlimitFlag) String() string { return "" }
+
+func (f *rlimitFlag) Set(s string) error {
+	l, err := session.ParseRLimit(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, l)
+	return nil
+}
+
+// originFlag collects repeated --allow-origin flags.
+type originFlag origin.List
+
+func (f *originFlag) String() string { return "" }
+
+func (f *originFlag) Set(s string) error {
+	l, err := origin.Parse(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, l...)
+	return nil
+}
+
+// buildInfo fills in Commit and BuildTime from the VCS stamp go build
+// embeds when they were not set with -ldflags.
+func buildInfo() server.BuildInfo {
+	info := server.BuildInfo{Version: Version, Commit: Commit, BuildTime: BuildTime}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+	return info
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintBannerJSON(t *testing.T) {
+	tests := []struct {
+		authMode, usersSource string
+		want                  bannerJSON
+	}{
+		{"password", "", bannerJSON{Username: "vex", Password: "pw"}},
+		{"password+token", "", bannerJSON{Username: "vex", Password: "pw", TokenURL: "http://127.0.0.1:8080/t/vsx_tok/"}},
+		{"password", "users.json", bannerJSON{UsersFile: "users.json"}},
+		{"token", "", bannerJSON{TokenURL: "http://127.0.0.1:8080/t/vsx_tok/"}},
+		{"apikey", "", bannerJSON{APIKey: "vsx_tok"}},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		printBannerJSON(&out, "http", "127.0.0.1:8080", tt.authMode, "vex", "pw", "vsx_tok", "v t", tt.usersSource, "bash -l", 30*time.Minute, true)
+		if !strings.HasSuffix(out.String(), "}\n") || strings.Count(out.String(), "\n") != 1 {
+			t.Errorf("%s: not one JSON line: %q", tt.authMode, out.String())
+		}
+		var got bannerJSON
+		if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+			t.Fatal(err)
+		}
+		want := tt.want
+		want.URL, want.ViewURL, want.Command, want.IdleTimeout, want.AuthMode, want.SharedInput =
+			"http://127.0.0.1:8080", "http://127.0.0.1:8080/?vt=v+t", "bash -l", "30m0s", tt.authMode, true
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", tt.authMode, got, want)
+		}
+	}
+}
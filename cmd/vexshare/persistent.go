@@ -0,0 +1,21 @@
+package main
+
+import "errors"
+
+// persistentSession is the tmux or screen session name --persistent
+// attaches to.
+const persistentSession = "vexshare"
+
+// persistentCommand wraps command and args in a tmux session, or a screen
+// session if tmux is not installed, that outlives vexShare: the first start
+// creates it running the command, and later starts attach to it, so a
+// restart of vexShare keeps the shell and whatever runs in it.
+func persistentCommand(lookPath func(string) (string, error), command string, args []string) (string, []string, error) {
+	if _, err := lookPath("tmux"); err == nil {
+		return "tmux", append([]string{"new-session", "-A", "-s", persistentSession, command}, args...), nil
+	}
+	if _, err := lookPath("screen"); err == nil {
+		return "screen", append([]string{"-D", "-RR", "-S", persistentSession, command}, args...), nil
+	}
+	return "", nil, errors.New("--persistent needs tmux or screen, and neither is in PATH")
+}
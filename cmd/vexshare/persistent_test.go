@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPersistentCommand(t *testing.T) {
+	tests := []struct {
+		installed []string
+		command   string
+		wantArgs  []string
+		wantErr   bool
+	}{
+		{[]string{"tmux", "screen"}, "tmux", []string{"new-session", "-A", "-s", "vexshare", "htop", "-d", "10"}, false},
+		{[]string{"screen"}, "screen", []string{"-D", "-RR", "-S", "vexshare", "htop", "-d", "10"}, false},
+		{nil, "", nil, true},
+	}
+	for _, tt := range tests {
+		lookPath := func(file string) (string, error) {
+			for _, name := range tt.installed {
+				if name == file {
+					return "/usr/bin/" + file, nil
+				}
+			}
+			return "", errors.New("not found")
+		}
+		command, args, err := persistentCommand(lookPath, "htop", []string{"-d", "10"})
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("installed %v: unexpected error %v", tt.installed, err)
+		}
+		if command != tt.command || !reflect.DeepEqual(args, tt.wantArgs) {
+			t.Errorf("installed %v: got %s %v, want %s %v", tt.installed, command, args, tt.command, tt.wantArgs)
+		}
+	}
+}
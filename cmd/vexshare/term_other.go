@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func makeRaw(*os.File) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+func noEcho(*os.File) (func(), error) {
+	return nil, errors.New("turning off terminal echo is not supported on this platform")
+}
+
+func notifyResize(chan<- os.Signal) {}
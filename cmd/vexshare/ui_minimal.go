@@ -0,0 +1,7 @@
+//go:build minimal_ui
+
+package main
+
+func init() {
+	defaultUI = "minimal"
+}
@@ -5,4 +5,14 @@ go 1.22
 require (
 	github.com/creack/pty v1.1.21
 	github.com/gorilla/websocket v1.5.3
+	github.com/redis/go-redis/v9 v9.18.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.35.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	go.uber.org/atomic v1.11.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 )
@@ -0,0 +1,94 @@
+package ansi
+
+import (
+	"bytes"
+	"io"
+)
+
+type state int
+
+const (
+	stateGround state = iota
+	stateEscape
+	stateEscapeIntermediate
+	stateCSI
+	stateString
+	stateStringEscape
+)
+
+// StripWriter writes the plain text of a terminal output stream to an
+// underlying writer. CSI, OSC, DCS and other escape sequences are dropped
+// along with carriage returns and non-printing control characters.
+// Sequences split across Write calls are handled.
+type StripWriter struct {
+	w     io.Writer
+	state state
+	buf   []byte
+}
+
+func NewStripWriter(w io.Writer) *StripWriter {
+	return &StripWriter{w: w}
+}
+
+func (s *StripWriter) Write(p []byte) (int, error) {
+	out := s.buf[:0]
+	for _, b := range p {
+		switch s.state {
+		case stateGround:
+			switch {
+			case b == 0x1b:
+				s.state = stateEscape
+			case b == '\n' || b == '\t':
+				out = append(out, b)
+			case b < 0x20 || b == 0x7f:
+			default:
+				out = append(out, b)
+			}
+		case stateEscape:
+			switch {
+			case b == '[':
+				s.state = stateCSI
+			case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+				s.state = stateString
+			case b >= 0x20 && b <= 0x2f:
+				s.state = stateEscapeIntermediate
+			default:
+				s.state = stateGround
+			}
+		case stateEscapeIntermediate:
+			if b < 0x20 || b > 0x2f {
+				s.state = stateGround
+			}
+		case stateCSI:
+			if b >= 0x40 && b <= 0x7e {
+				s.state = stateGround
+			}
+		case stateString:
+			switch b {
+			case 0x07:
+				s.state = stateGround
+			case 0x1b:
+				s.state = stateStringEscape
+			}
+		case stateStringEscape:
+			if b == '\\' {
+				s.state = stateGround
+			} else {
+				s.state = stateString
+			}
+		}
+	}
+	s.buf = out
+	if len(out) > 0 {
+		if _, err := s.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func Strip(p []byte) string {
+	var b bytes.Buffer
+	_, _ = NewStripWriter(&b).Write(p)
+	return b.String()
+}
@@ -0,0 +1,46 @@
+package ansi
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStrip(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello world\n", "hello world\n"},
+		{"sgr colors", "\x1b[1;31mred\x1b[0m text", "red text"},
+		{"cursor movement", "a\x1b[2Kb\x1b[10;20Hc", "abc"},
+		{"private mode", "\x1b[?2004hprompt$ \x1b[?2004l", "prompt$ "},
+		{"osc title bel", "\x1b]0;user@host: ~\x07$ ls\n", "$ ls\n"},
+		{"osc st terminator", "\x1b]133;A\x1b\\$ \x1b]133;B\x1b\\", "$ "},
+		{"charset designation", "\x1b(Bplain", "plain"},
+		{"keypad mode", "\x1b=x\x1b>y", "xy"},
+		{"crlf", "line1\r\nline2\r\n", "line1\nline2\n"},
+		{"controls dropped", "a\x07b\x08c\x00d\x7f", "abcd"},
+		{"tabs kept", "a\tb", "a\tb"},
+		{"utf8 preserved", "héllo → wörld ✓", "héllo → wörld ✓"},
+		{"dcs string", "\x1bPq#0;2;0;0;0\x1b\\after", "after"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Strip([]byte(tt.in)); got != tt.want {
+				t.Errorf("Strip(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripWriterSplitSequences(t *testing.T) {
+	in := "\x1b[1;32mgreen\x1b[0m \x1b]0;title\x1b\\done\r\n"
+	for split := 1; split < len(in); split++ {
+		var out strings.Builder
+		w := NewStripWriter(&out)
+		_, _ = w.Write([]byte(in[:split]))
+		_, _ = w.Write([]byte(in[split:]))
+		if got := out.String(); got != "green done\n" {
+			t.Fatalf("split at %d: got %q", split, got)
+		}
+	}
+}
@@ -1,39 +1,72 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/vextm/vexshare/internal/tokens"
 )
 
 type Config struct {
-	Mode     string
-	Username string
-	Password string
-	Token    string
-	Secure   bool
+	Mode         string
+	Username     string
+	Password     string
+	PasswordHash string
+	Token        string
+	ViewToken    string
+	Secure       bool
+	// CookieName names the login session cookie; DefaultCookieName if
+	// empty. With a BasePath other than "/", a short hash of the path is
+	// appended so instances sharing a hostname keep separate cookies.
+	CookieName string
+	// CookieTTL is how long a login lasts, both as the cookie's Max-Age and
+	// in the session store; DefaultCookieTTL if zero.
+	CookieTTL time.Duration
+	// BasePath is the URL path this instance is served under, which scopes
+	// the session cookie. Empty means "/".
+	BasePath string
+	// SessionMaxAge is the session cookie's Max-Age in seconds. Zero
+	// follows CookieTTL, and BrowserSessionCookie leaves Max-Age out so the
+	// browser drops the cookie when it closes. The login still ends after
+	// CookieTTL on the server either way.
+	SessionMaxAge int
 }
 
 type SessionStore struct {
-	mu       sync.RWMutex
-	sessions map[string]sessionEntry
-	ttl      time.Duration
+	mu         sync.RWMutex
+	sessions   map[string]sessionEntry
+	byUser     map[string][]string
+	ttl        time.Duration
+	maxSize    int
+	maxPerUser int
 }
 
 type sessionEntry struct {
 	createdAt time.Time
-	username  string
+	identity  Identity
 }
 
-func NewSessionStore(ttl time.Duration) *SessionStore {
+// NewSessionStore creates a store whose sessions expire after ttl. When
+// maxSize is positive, creating a session in a full store evicts the oldest
+// one; zero means unlimited.
+func NewSessionStore(ttl time.Duration, maxSize int) *SessionStore {
 	s := &SessionStore{
 		sessions: make(map[string]sessionEntry),
+		byUser:   make(map[string][]string),
 		ttl:      ttl,
+		maxSize:  maxSize,
 	}
 	go s.cleanup()
 	return s
@@ -46,98 +79,300 @@ func (s *SessionStore) cleanup() {
 		s.mu.Lock()
 		now := time.Now()
 		for k, v := range s.sessions {
-			if now.Sub(v.createdAt) > s.ttl {
-				delete(s.sessions, k)
+			if now.Sub(v.createdAt) > s.ttl+expireGrace {
+				s.removeLocked(k)
 			}
 		}
 		s.mu.Unlock()
 	}
 }
 
-func (s *SessionStore) Create(username string) (string, error) {
+func (s *SessionStore) Create(identity Identity) (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		return "", fmt.Errorf("generate session id: %w", err)
 	}
 	id := hex.EncodeToString(b)
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	user := identity.Username
+	if s.maxPerUser > 0 {
+		for len(s.byUser[user]) >= s.maxPerUser {
+			s.removeLocked(s.byUser[user][0])
+		}
+	}
+	if s.maxSize > 0 {
+		for len(s.sessions) >= s.maxSize {
+			s.removeLocked(s.oldestLocked())
+		}
+	}
 	s.sessions[id] = sessionEntry{
 		createdAt: time.Now(),
-		username:  username,
+		identity:  identity,
 	}
-	s.mu.Unlock()
+	s.byUser[user] = append(s.byUser[user], id)
 	return id, nil
 }
 
+// SetMaxPerUser caps the number of concurrent sessions per username. When a
+// new session would exceed the cap, that user's oldest session is evicted.
+// Zero means unlimited.
+func (s *SessionStore) SetMaxPerUser(n int) {
+	s.mu.Lock()
+	s.maxPerUser = n
+	s.mu.Unlock()
+}
+
+func (s *SessionStore) oldestLocked() string {
+	var oldest string
+	var oldestAt time.Time
+	for id, entry := range s.sessions {
+		if oldest == "" || entry.createdAt.Before(oldestAt) {
+			oldest, oldestAt = id, entry.createdAt
+		}
+	}
+	return oldest
+}
+
+func (s *SessionStore) removeLocked(id string) {
+	entry, ok := s.sessions[id]
+	if !ok {
+		return
+	}
+	delete(s.sessions, id)
+	user := entry.identity.Username
+	ids := s.byUser[user]
+	for i, v := range ids {
+		if v == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(s.byUser, user)
+	} else {
+		s.byUser[user] = ids
+	}
+}
+
 func (s *SessionStore) Valid(id string) bool {
+	_, ok := s.Lookup(id)
+	return ok
+}
+
+func (s *SessionStore) Lookup(id string) (Identity, bool) {
 	s.mu.RLock()
 	entry, ok := s.sessions[id]
 	s.mu.RUnlock()
+	if !ok || time.Since(entry.createdAt) > s.ttl {
+		return Identity{}, false
+	}
+	return entry.identity, true
+}
+
+func (s *SessionStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+// expireGrace is how long an expired entry lingers before cleanup removes
+// it, so revoking a session does not change the store's shape right away.
+const expireGrace = 1 * time.Minute
+
+// Expire invalidates a session without deleting it; cleanup removes the
+// entry after expireGrace. It reports whether the session existed.
+func (s *SessionStore) Expire(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.sessions[id]
 	if !ok {
 		return false
 	}
-	return time.Since(entry.createdAt) <= s.ttl
+	entry.createdAt = time.Now().Add(-s.ttl - time.Second)
+	s.sessions[id] = entry
+	return true
 }
 
 func (s *SessionStore) Delete(id string) {
 	s.mu.Lock()
-	delete(s.sessions, id)
+	s.removeLocked(id)
 	s.mu.Unlock()
 }
 
+// SavedSession is a login session as Export returns it.
+type SavedSession struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Identity  Identity  `json:"identity"`
+}
+
+// Export returns every session that is still valid, so that a process
+// taking over from this one can keep its users logged in.
+func (s *SessionStore) Export() []SavedSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var saved []SavedSession
+	for id, entry := range s.sessions {
+		if time.Since(entry.createdAt) <= s.ttl {
+			saved = append(saved, SavedSession{ID: id, CreatedAt: entry.createdAt, Identity: entry.identity})
+		}
+	}
+	return saved
+}
+
+// Import adds sessions from Export, keeping their IDs and ages.
+func (s *SessionStore) Import(saved []SavedSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ss := range saved {
+		if _, ok := s.sessions[ss.ID]; ok {
+			continue
+		}
+		s.sessions[ss.ID] = sessionEntry{createdAt: ss.CreatedAt, identity: ss.Identity}
+		s.byUser[ss.Identity.Username] = append(s.byUser[ss.Identity.Username], ss.ID)
+	}
+}
+
+func CheckBearerToken(expected string, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
 func CheckPassword(cfg Config, username, password string) bool {
 	userOk := subtle.ConstantTimeCompare([]byte(cfg.Username), []byte(username)) == 1
-	passOk := subtle.ConstantTimeCompare([]byte(cfg.Password), []byte(password)) == 1
+	var passOk bool
+	if cfg.PasswordHash != "" {
+		passOk = bcrypt.CompareHashAndPassword([]byte(cfg.PasswordHash), []byte(password)) == nil
+	} else {
+		passOk = subtle.ConstantTimeCompare([]byte(cfg.Password), []byte(password)) == 1
+	}
 	return userOk && passOk
 }
 
-func CheckToken(cfg Config, token string) bool {
-	return subtle.ConstantTimeCompare([]byte(cfg.Token), []byte(token)) == 1
+// CheckToken compares token with the control token through tokens.Check,
+// so tokens shorter than tokens.MinTokenLength never match. It returns nil
+// on a match.
+func CheckToken(cfg Config, token string) error {
+	return tokens.Check(cfg.Token, token)
+}
+
+// CheckViewToken is CheckToken for the view token.
+func CheckViewToken(cfg Config, token string) error {
+	if cfg.ViewToken == "" {
+		return tokens.ErrTokenMismatch
+	}
+	return tokens.Check(cfg.ViewToken, token)
+}
+
+// warnBadToken logs a rejected share token with msg, or as too short when
+// tokens.Check said so, since no token vexShare accepts is that short.
+func warnBadToken(r *http.Request, logger *slog.Logger, msg string, err error) {
+	if errors.Is(err, tokens.ErrTokenTooShort) {
+		logger.WarnContext(r.Context(), "rejecting token shorter than minimum length", "min", tokens.MinTokenLength, "path", r.URL.Path, "ip", r.RemoteAddr)
+		return
+	}
+	logger.WarnContext(r.Context(), msg, "ip", r.RemoteAddr)
 }
 
-const sessionCookieName = "vexshare_session"
+const (
+	DefaultCookieName = "vexshare_session"
+	DefaultCookieTTL  = 24 * time.Hour
+	// BrowserSessionCookie as SessionMaxAge makes the session cookie last
+	// until the browser closes.
+	BrowserSessionCookie = -1
+)
+
+// SessionCookieName is the login cookie name, including the base path
+// suffix.
+func (cfg Config) SessionCookieName() string {
+	name := cfg.CookieName
+	if name == "" {
+		name = DefaultCookieName
+	}
+	if p := cfg.cookiePath(); p != "/" {
+		sum := sha256.Sum256([]byte(p))
+		name += "_" + hex.EncodeToString(sum[:4])
+	}
+	return name
+}
 
-func SetSessionCookie(w http.ResponseWriter, sessionID string, secure bool) {
+// SessionTTL is how long a login session stays valid.
+func (cfg Config) SessionTTL() time.Duration {
+	if cfg.CookieTTL > 0 {
+		return cfg.CookieTTL
+	}
+	return DefaultCookieTTL
+}
+
+func (cfg Config) cookiePath() string {
+	p := strings.TrimSuffix(cfg.BasePath, "/")
+	if p == "" {
+		return "/"
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	return p + "/"
+}
+
+func SetSessionCookie(w http.ResponseWriter, cfg Config, sessionID string) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookieName,
+		Name:     cfg.SessionCookieName(),
 		Value:    sessionID,
-		Path:     "/",
+		Path:     cfg.cookiePath(),
 		HttpOnly: true,
-		Secure:   secure,
+		Secure:   cfg.Secure,
 		SameSite: http.SameSiteLaxMode,
-		MaxAge:   86400,
+		MaxAge:   cfg.cookieMaxAge(),
 	})
 }
 
-func ClearSessionCookie(w http.ResponseWriter, secure bool) {
+// cookieMaxAge is the session cookie's Max-Age; 0 omits the attribute.
+func (cfg Config) cookieMaxAge() int {
+	switch {
+	case cfg.SessionMaxAge == BrowserSessionCookie:
+		return 0
+	case cfg.SessionMaxAge > 0:
+		return cfg.SessionMaxAge
+	}
+	return int(cfg.SessionTTL().Seconds())
+}
+
+func ClearSessionCookie(w http.ResponseWriter, cfg Config) {
 	http.SetCookie(w, &http.Cookie{
-		Name:     sessionCookieName,
+		Name:     cfg.SessionCookieName(),
 		Value:    "",
-		Path:     "/",
+		Path:     cfg.cookiePath(),
 		HttpOnly: true,
-		Secure:   secure,
+		Secure:   cfg.Secure,
 		SameSite: http.SameSiteLaxMode,
 		MaxAge:   -1,
 	})
 }
 
-func GetSessionID(r *http.Request) string {
-	c, err := r.Cookie(sessionCookieName)
+func GetSessionID(r *http.Request, cfg Config) string {
+	c, err := r.Cookie(cfg.SessionCookieName())
 	if err != nil {
 		return ""
 	}
 	return c.Value
 }
 
-func PasswordMiddleware(sessions *SessionStore, logger *slog.Logger) func(http.Handler) http.Handler {
+func PasswordMiddleware(cfg Config, sessions *SessionStore, logger *slog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			sid := GetSessionID(r)
-			if sid != "" && sessions.Valid(sid) {
-				next.ServeHTTP(w, r)
-				return
+			sid := GetSessionID(r, cfg)
+			if sid != "" {
+				if identity, ok := sessions.Lookup(sid); ok {
+					next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+					return
+				}
 			}
-			logger.Debug("unauthenticated request, redirecting to login", "path", r.URL.Path, "ip", r.RemoteAddr)
+			logger.DebugContext(r.Context(), "unauthenticated request, redirecting to login", "path", r.URL.Path, "ip", r.RemoteAddr)
 			http.Redirect(w, r, "/login", http.StatusSeeOther)
 		})
 	}
@@ -147,12 +382,139 @@ func TokenMiddleware(cfg Config, logger *slog.Logger) func(http.Handler) http.Ha
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			token := r.PathValue("token")
-			if token == "" || !CheckToken(cfg, token) {
-				logger.Warn("invalid token access attempt", "ip", r.RemoteAddr)
-				http.Error(w, "Forbidden", http.StatusForbidden)
+			err := CheckToken(cfg, token)
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), controlTokenIdentity)))
+				return
+			}
+			if CheckViewToken(cfg, token) == nil {
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), viewTokenIdentity)))
+				return
+			}
+			warnBadToken(r, logger, "invalid token access attempt", err)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+func BearerTokenMiddleware(token string, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !CheckBearerToken(token, r) {
+				logger.WarnContext(r.Context(), "invalid admin token", "path", r.URL.Path, "ip", r.RemoteAddr)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="vexshare-admin"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// BasicRealm is the realm in the WWW-Authenticate challenge of --auth basic.
+const BasicRealm = "vexShare"
+
+// BasicAuthMiddleware lets in requests with HTTP Basic credentials
+// (RFC 7617) matching the configured user, and challenges the rest with a
+// 401. Browsers then prompt for them and resend them with every request,
+// and tools can pass them directly, as with curl -u.
+func BasicAuthMiddleware(cfg Config, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if ok && CheckPassword(cfg, username, password) {
+				identity := Identity{Username: username, DisplayName: username}
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+				return
+			}
+			if ok {
+				logger.WarnContext(r.Context(), "failed basic auth attempt", "username", username, "path", r.URL.Path, "ip", r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+BasicRealm+`", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// APIKeyHeader carries the token in --auth apikey.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyMiddleware lets in requests whose X-API-Key header holds the
+// control token, for API clients that would rather send a header than put
+// the token in the URL path. Everything else gets a 401.
+func APIKeyMiddleware(cfg Config, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(APIKeyHeader)
+			err := CheckToken(cfg, key)
+			if err == nil {
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), controlTokenIdentity)))
+				return
+			}
+			if key != "" {
+				warnBadToken(r, logger, "invalid API key", err)
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// The share tokens, as recorded in Identity.Token.
+const (
+	TokenControl = "control"
+	TokenView    = "view"
+)
+
+var (
+	viewerIdentity       = Identity{Role: RoleViewer}
+	controlTokenIdentity = Identity{Token: TokenControl}
+	viewTokenIdentity    = Identity{Role: RoleViewer, Token: TokenView}
+)
+
+// AnonymousViewerMiddleware lets every request in as a viewer. It backs
+// --auth none, where nobody can type.
+func AnonymousViewerMiddleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), viewerIdentity)))
+		})
+	}
+}
+
+type viewQueryKey struct{}
+
+func ViewTokenQueryAuthenticated(r *http.Request) bool {
+	v, _ := r.Context().Value(viewQueryKey{}).(bool)
+	return v
+}
+
+// ViewTokenQueryMiddleware accepts the view token as a ?vt= query parameter
+// so the read-only terminal can be embedded with a plain URL. The control
+// token is never accepted this way. Requests without the parameter are
+// passed to fallback, or rejected when fallback is nil.
+func ViewTokenQueryMiddleware(cfg Config, fallback func(http.Handler) http.Handler, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		var withFallback http.Handler
+		if fallback != nil {
+			withFallback = fallback(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !r.URL.Query().Has("vt") {
+				if withFallback == nil {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				withFallback.ServeHTTP(w, r)
+				return
+			}
+			if err := CheckViewToken(cfg, r.URL.Query().Get("vt")); err != nil {
+				warnBadToken(r, logger, "invalid view token access attempt", err)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			ctx := WithIdentity(r.Context(), viewTokenIdentity)
+			ctx = context.WithValue(ctx, viewQueryKey{}, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -1,10 +1,18 @@
 package auth
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/vextm/vexshare/internal/tokens"
 )
 
 func TestCheckPassword(t *testing.T) {
@@ -30,19 +38,43 @@ func TestCheckPassword(t *testing.T) {
 	}
 }
 
+func TestCheckPasswordHash(t *testing.T) {
+	// bcrypt of "allmine"
+	cfg := Config{Username: "admin", PasswordHash: "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga"}
+	if !CheckPassword(cfg, "admin", "allmine") {
+		t.Error("expected hashed password to match")
+	}
+	if CheckPassword(cfg, "admin", "wrong") {
+		t.Error("expected wrong password to fail")
+	}
+	if CheckPassword(cfg, "nobody", "allmine") {
+		t.Error("expected wrong user to fail")
+	}
+	if CheckPassword(cfg, "admin", cfg.PasswordHash) {
+		t.Error("the hash itself must not be accepted as the password")
+	}
+	cfg.Password = "plaintext"
+	if CheckPassword(cfg, "admin", "plaintext") {
+		t.Error("PasswordHash should take precedence over Password")
+	}
+}
+
 func TestCheckToken(t *testing.T) {
-	cfg := Config{Token: "my-secret-token"}
-	if !CheckToken(cfg, "my-secret-token") {
-		t.Error("expected valid token to pass")
+	cfg := Config{Token: "my-secret-token-1234"}
+	if err := CheckToken(cfg, "my-secret-token-1234"); err != nil {
+		t.Errorf("expected valid token to pass, got %v", err)
+	}
+	if err := CheckToken(cfg, "wrong-token-123456"); !errors.Is(err, tokens.ErrTokenMismatch) {
+		t.Errorf("wrong token: got %v, want ErrTokenMismatch", err)
 	}
-	if CheckToken(cfg, "wrong-token") {
-		t.Error("expected invalid token to fail")
+	if err := CheckToken(Config{Token: "short"}, "short"); !errors.Is(err, tokens.ErrTokenTooShort) {
+		t.Errorf("short token: got %v, want ErrTokenTooShort", err)
 	}
 }
 
 func TestSessionStore(t *testing.T) {
-	store := NewSessionStore(1 * time.Hour)
-	sid, err := store.Create("testuser")
+	store := NewSessionStore(1*time.Hour, 0)
+	sid, err := store.Create(Identity{Username: "testuser"})
 	if err != nil {
 		t.Fatalf("Create error: %v", err)
 	}
@@ -58,16 +90,62 @@ func TestSessionStore(t *testing.T) {
 	}
 }
 
+func TestSessionStoreMaxPerUser(t *testing.T) {
+	store := NewSessionStore(1*time.Hour, 0)
+	store.SetMaxPerUser(2)
+
+	alice1, _ := store.Create(Identity{Username: "alice"})
+	bob1, _ := store.Create(Identity{Username: "bob"})
+	alice2, _ := store.Create(Identity{Username: "alice"})
+	bob2, _ := store.Create(Identity{Username: "bob"})
+	alice3, _ := store.Create(Identity{Username: "alice"})
+
+	if store.Valid(alice1) {
+		t.Error("oldest alice session should have been evicted")
+	}
+	for name, sid := range map[string]string{"alice2": alice2, "alice3": alice3, "bob1": bob1, "bob2": bob2} {
+		if !store.Valid(sid) {
+			t.Errorf("%s should still be valid", name)
+		}
+	}
+
+	store.Delete(alice2)
+	alice4, _ := store.Create(Identity{Username: "alice"})
+	if !store.Valid(alice3) || !store.Valid(alice4) {
+		t.Error("deleting a session should free a slot without evicting")
+	}
+}
+
+func TestSessionStoreMaxSize(t *testing.T) {
+	store := NewSessionStore(1*time.Hour, 3)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		sid, err := store.Create(Identity{Username: fmt.Sprintf("user%d", i)})
+		if err != nil {
+			t.Fatalf("Create error: %v", err)
+		}
+		ids = append(ids, sid)
+	}
+	for i, sid := range ids {
+		if want := i >= 2; store.Valid(sid) != want {
+			t.Errorf("session %d: valid = %v, want %v", i, !want, want)
+		}
+	}
+	if len(store.sessions) != 3 || len(store.byUser) != 3 {
+		t.Errorf("store holds %d sessions for %d users, want 3/3", len(store.sessions), len(store.byUser))
+	}
+}
+
 func TestSessionCookie(t *testing.T) {
 	w := httptest.NewRecorder()
-	SetSessionCookie(w, "test-id", false)
+	SetSessionCookie(w, Config{}, "test-id")
 	cookies := w.Result().Cookies()
 	if len(cookies) == 0 {
 		t.Fatal("expected cookie")
 	}
 	c := cookies[0]
-	if c.Name != sessionCookieName {
-		t.Errorf("name: got %q, want %q", c.Name, sessionCookieName)
+	if c.Name != DefaultCookieName {
+		t.Errorf("name: got %q, want %q", c.Name, DefaultCookieName)
 	}
 	if c.Value != "test-id" {
 		t.Errorf("value: got %q, want %q", c.Value, "test-id")
@@ -78,11 +156,85 @@ func TestSessionCookie(t *testing.T) {
 	if c.SameSite != http.SameSiteLaxMode {
 		t.Error("expected SameSite=Lax")
 	}
+	if c.MaxAge != int(DefaultCookieTTL.Seconds()) {
+		t.Errorf("MaxAge: got %d, want %d", c.MaxAge, int(DefaultCookieTTL.Seconds()))
+	}
+}
+
+func TestSessionCookieName(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+		path string
+	}{
+		{"default", Config{}, "vexshare_session", "/"},
+		{"custom name", Config{CookieName: "shell"}, "shell", "/"},
+		{"root base path", Config{BasePath: "/"}, "vexshare_session", "/"},
+		{"base path", Config{BasePath: "/one/"}, "vexshare_session_2be13acf", "/one/"},
+		{"base path without slashes", Config{BasePath: "one"}, "vexshare_session_2be13acf", "/one/"},
+		{"custom name and base path", Config{CookieName: "shell", BasePath: "/two"}, "shell_0237984f", "/two/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.SessionCookieName(); got != tt.want {
+				t.Errorf("name = %q, want %q", got, tt.want)
+			}
+			w := httptest.NewRecorder()
+			SetSessionCookie(w, tt.cfg, "sid")
+			c := w.Result().Cookies()[0]
+			if c.Name != tt.want || c.Path != tt.path {
+				t.Errorf("cookie %s with path %s, want %s with path %s", c.Name, c.Path, tt.want, tt.path)
+			}
+		})
+	}
+
+	// Instances on different paths must not share a cookie.
+	if (Config{BasePath: "/one/"}).SessionCookieName() == (Config{BasePath: "/two/"}).SessionCookieName() {
+		t.Error("different base paths produced the same cookie name")
+	}
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"follows ttl", Config{CookieTTL: time.Hour}, "Max-Age=3600"},
+		{"own max age", Config{CookieTTL: time.Hour, SessionMaxAge: 600}, "Max-Age=600"},
+		{"browser session", Config{CookieTTL: time.Hour, SessionMaxAge: BrowserSessionCookie}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			SetSessionCookie(w, tt.cfg, "sid")
+			header := w.Header().Get("Set-Cookie")
+			if tt.want == "" && strings.Contains(header, "Max-Age") {
+				t.Errorf("Set-Cookie = %q, want no Max-Age", header)
+			}
+			if tt.want != "" && !strings.Contains(header, tt.want) {
+				t.Errorf("Set-Cookie = %q, want %s", header, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionTTL(t *testing.T) {
+	cfg := Config{CookieTTL: 2 * time.Hour}
+	w := httptest.NewRecorder()
+	SetSessionCookie(w, cfg, "sid")
+	if got := w.Result().Cookies()[0].MaxAge; got != 7200 {
+		t.Errorf("MaxAge = %d, want 7200", got)
+	}
+	if got := cfg.SessionTTL(); got != 2*time.Hour {
+		t.Errorf("SessionTTL = %v, want 2h", got)
+	}
 }
 
 func TestClearSessionCookie(t *testing.T) {
 	w := httptest.NewRecorder()
-	ClearSessionCookie(w, false)
+	ClearSessionCookie(w, Config{})
 	cookies := w.Result().Cookies()
 	if len(cookies) == 0 {
 		t.Fatal("expected cookie")
@@ -94,12 +246,267 @@ func TestClearSessionCookie(t *testing.T) {
 
 func TestGetSessionID(t *testing.T) {
 	req := httptest.NewRequest("GET", "/", nil)
-	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "my-session"})
-	if got := GetSessionID(req); got != "my-session" {
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: "my-session"})
+	if got := GetSessionID(req, Config{}); got != "my-session" {
 		t.Errorf("got %q, want %q", got, "my-session")
 	}
+	if got := GetSessionID(req, Config{BasePath: "/other/"}); got != "" {
+		t.Errorf("another instance's cookie was accepted: %q", got)
+	}
 	req2 := httptest.NewRequest("GET", "/", nil)
-	if got := GetSessionID(req2); got != "" {
+	if got := GetSessionID(req2, Config{}); got != "" {
 		t.Errorf("got %q, want empty", got)
 	}
 }
+
+func TestStaticAuthenticator(t *testing.T) {
+	a := NewStaticAuthenticator(Config{Username: "admin", Password: "secret123"})
+	identity, err := a.Authenticate(context.Background(), "admin", "secret123")
+	if err != nil {
+		t.Fatalf("Authenticate error: %v", err)
+	}
+	if identity.Username != "admin" || identity.DisplayName != "admin" {
+		t.Errorf("unexpected identity %+v", identity)
+	}
+	if _, err := a.Authenticate(context.Background(), "admin", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestPasswordMiddlewareIdentity(t *testing.T) {
+	store := NewSessionStore(1*time.Hour, 0)
+	sid, err := store.Create(Identity{Username: "alice", DisplayName: "Alice", Groups: []string{"ops"}})
+	if err != nil {
+		t.Fatalf("Create error: %v", err)
+	}
+	var got Identity
+	handler := PasswordMiddleware(Config{}, store, slog.Default())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = IdentityFromContext(r.Context())
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: sid})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got.DisplayName != "Alice" || len(got.Groups) != 1 || got.Groups[0] != "ops" {
+		t.Errorf("unexpected identity in context: %+v", got)
+	}
+}
+
+func TestViewTokenAccess(t *testing.T) {
+	cfg := Config{Mode: "token", Token: "control-token-123456", ViewToken: "view-token-1234567"}
+	var got Identity
+	var gotOK bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, gotOK = IdentityFromContext(r.Context())
+	})
+
+	tests := []struct {
+		name     string
+		handler  http.Handler
+		url      string
+		pathTok  string
+		wantCode int
+		wantRole Role
+	}{
+		{"query view token", ViewTokenQueryMiddleware(cfg, nil, slog.Default())(next), "/?vt=view-token-1234567", "", 200, RoleViewer},
+		{"query control token rejected", ViewTokenQueryMiddleware(cfg, nil, slog.Default())(next), "/?vt=control-token-123456", "", 403, ""},
+		{"query wrong token", ViewTokenQueryMiddleware(cfg, nil, slog.Default())(next), "/?vt=nope", "", 403, ""},
+		{"query missing without fallback", ViewTokenQueryMiddleware(cfg, nil, slog.Default())(next), "/", "", 403, ""},
+		{"path control token", TokenMiddleware(cfg, slog.Default())(next), "/", "control-token-123456", 200, ""},
+		{"path view token", TokenMiddleware(cfg, slog.Default())(next), "/", "view-token-1234567", 200, RoleViewer},
+		{"path wrong token", TokenMiddleware(cfg, slog.Default())(next), "/", "nope", 403, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotOK = Identity{}, false
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.pathTok != "" {
+				req.SetPathValue("token", tt.pathTok)
+			}
+			rec := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == 200 && got.Role != tt.wantRole {
+				t.Errorf("role = %q (identity set: %v), want %q", got.Role, gotOK, tt.wantRole)
+			}
+		})
+	}
+
+	if CheckViewToken(Config{}, "") == nil {
+		t.Error("empty view token must never match")
+	}
+}
+
+func TestShortTokenLogged(t *testing.T) {
+	cfg := Config{Mode: "token", Token: "control-token-123456"}
+	var logs strings.Builder
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	handler := TokenMiddleware(cfg, logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tok := range []string{"nope", "wrong-token-123456"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.SetPathValue("token", tok)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("token %q: got %d, want 403", tok, rec.Code)
+		}
+	}
+	if n := strings.Count(logs.String(), "rejecting token shorter than minimum length"); n != 1 {
+		t.Errorf("short token warnings = %d, want 1:\n%s", n, logs.String())
+	}
+	if n := strings.Count(logs.String(), "invalid token access attempt"); n != 1 {
+		t.Errorf("invalid token warnings = %d, want 1:\n%s", n, logs.String())
+	}
+}
+
+func TestSessionStoreExpire(t *testing.T) {
+	store := NewSessionStore(1*time.Hour, 0)
+	sid, _ := store.Create(Identity{Username: "alice"})
+	other, _ := store.Create(Identity{Username: "bob"})
+	if store.Len() != 2 {
+		t.Fatalf("Len = %d, want 2", store.Len())
+	}
+	if !store.Expire(sid) {
+		t.Fatal("Expire of an existing session returned false")
+	}
+	if store.Valid(sid) {
+		t.Error("expired session is still valid")
+	}
+	if !store.Valid(other) {
+		t.Error("expiring one session affected another")
+	}
+	if store.Len() != 2 {
+		t.Errorf("expired entry should linger until cleanup, Len = %d", store.Len())
+	}
+	if store.Expire("missing") {
+		t.Error("Expire of an unknown session returned true")
+	}
+}
+
+func TestSessionStoreExportImport(t *testing.T) {
+	old := NewSessionStore(1*time.Hour, 0)
+	alice, _ := old.Create(Identity{Username: "alice", Role: RoleOwner})
+	expired, _ := old.Create(Identity{Username: "bob"})
+	old.Expire(expired)
+
+	store := NewSessionStore(1*time.Hour, 0)
+	store.Import(old.Export())
+	if id, ok := store.Lookup(alice); !ok || id.Username != "alice" || id.Role != RoleOwner {
+		t.Errorf("imported session = %+v, %v", id, ok)
+	}
+	if store.Valid(expired) || store.Len() != 1 {
+		t.Errorf("expired session carried over, Len = %d", store.Len())
+	}
+}
+
+func TestBearerTokenMiddleware(t *testing.T) {
+	handler := BearerTokenMiddleware("admin-secret-123456", slog.Default())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		header string
+		want   int
+	}{
+		{"Bearer admin-secret-123456", http.StatusOK},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"admin-secret-123456", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/admin/stats", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: got %d, want %d", tt.header, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestBasicAuthMiddleware(t *testing.T) {
+	cfg := Config{Mode: "basic", Username: "vex", Password: "p:w"}
+	var got Identity
+	handler := BasicAuthMiddleware(cfg, slog.Default())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = IdentityFromContext(r.Context())
+	}))
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		// A colon in the password belongs to the password.
+		{"valid", "Basic " + base64.StdEncoding.EncodeToString([]byte("vex:p:w")), http.StatusOK},
+		{"wrong password", "Basic " + base64.StdEncoding.EncodeToString([]byte("vex:pw")), http.StatusUnauthorized},
+		{"wrong user", "Basic " + base64.StdEncoding.EncodeToString([]byte("root:p:w")), http.StatusUnauthorized},
+		{"no colon", "Basic " + base64.StdEncoding.EncodeToString([]byte("vex")), http.StatusUnauthorized},
+		{"not base64", "Basic vex:p:w", http.StatusUnauthorized},
+		{"bearer", "Bearer p:w", http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = Identity{}
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && got.Username != "vex" {
+				t.Errorf("identity = %+v, want user vex", got)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != `Basic realm="vexShare", charset="UTF-8"` {
+				t.Errorf("WWW-Authenticate = %q", rec.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	cfg := Config{Mode: "apikey", Token: "vsx_0123456789abcdef", ViewToken: "vsx_view0123456789ab"}
+	var got Identity
+	handler := APIKeyMiddleware(cfg, slog.Default())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = IdentityFromContext(r.Context())
+	}))
+	tests := []struct {
+		name string
+		key  string
+		want int
+	}{
+		{"valid", cfg.Token, http.StatusOK},
+		{"wrong", "vsx_fedcba9876543210", http.StatusUnauthorized},
+		{"view token", cfg.ViewToken, http.StatusUnauthorized},
+		{"missing", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = Identity{}
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.key != "" {
+				req.Header.Set(APIKeyHeader, tt.key)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && got.Token != TokenControl {
+				t.Errorf("identity = %+v, want the control token", got)
+			}
+		})
+	}
+
+	// The key is only read from the header, never the query or path.
+	req := httptest.NewRequest("GET", "/?key="+cfg.Token, nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("token outside X-API-Key: got %d, want 401", rec.Code)
+	}
+}
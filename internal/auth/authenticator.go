@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+type Identity struct {
+	Username    string
+	DisplayName string
+	Groups      []string
+	// Role is empty for authenticators without per-user roles, which keeps
+	// the legacy single-controller behaviour.
+	Role Role
+	// Token is TokenControl or TokenView when a share token let the
+	// request in, directly or through a WebSocket ticket.
+	Token string
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) (Identity, error)
+}
+
+type staticAuthenticator struct {
+	cfg Config
+}
+
+func NewStaticAuthenticator(cfg Config) Authenticator {
+	return &staticAuthenticator{cfg: cfg}
+}
+
+func (a *staticAuthenticator) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	if !CheckPassword(a.cfg, username, password) {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Username: username, DisplayName: username}, nil
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
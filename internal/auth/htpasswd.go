@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users so that lookups of
+// missing and existing accounts take roughly the same time.
+const dummyHash = "$2b$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga"
+
+type HtpasswdAuthenticator struct {
+	users map[string][]byte
+}
+
+func LoadHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open htpasswd: %w", err)
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("htpasswd line %d: expected user:hash", lineNo)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("htpasswd line %d: only bcrypt entries are supported: %w", lineNo, err)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read htpasswd: %w", err)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("htpasswd file %s contains no users", path)
+	}
+	return &HtpasswdAuthenticator{users: users}, nil
+}
+
+func (h *HtpasswdAuthenticator) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	hash, ok := h.users[username]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return Identity{}, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Username: username, DisplayName: username}, nil
+}
+
+func (h *HtpasswdAuthenticator) Len() int {
+	return len(h.users)
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeHtpasswd(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	// alice:allmine, bob:correct horse battery staple
+	path := writeHtpasswd(t, `# comment
+alice:$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga
+
+bob:$2y$05$0123456789abcdefghijkesSXn1Ivr1ALp.4I3yvm8FsIF9awXMgS
+`)
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatalf("LoadHtpasswd error: %v", err)
+	}
+	if h.Len() != 2 {
+		t.Errorf("expected 2 users, got %d", h.Len())
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		pass     string
+		expected bool
+	}{
+		{"alice valid", "alice", "allmine", true},
+		{"bob valid", "bob", "correct horse battery staple", true},
+		{"wrong pass", "alice", "wrong", false},
+		{"cross user", "bob", "allmine", false},
+		{"unknown user", "carol", "allmine", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := h.Authenticate(context.Background(), tt.user, tt.pass)
+			if (err == nil) != tt.expected {
+				t.Fatalf("Authenticate(%q) error = %v, want success %v", tt.user, err, tt.expected)
+			}
+			if tt.expected && identity.Username != tt.user {
+				t.Errorf("identity username: got %q, want %q", identity.Username, tt.user)
+			}
+		})
+	}
+}
+
+func TestLoadHtpasswdErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", "# nothing here\n"},
+		{"missing colon", "alice\n"},
+		{"non-bcrypt", "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadHtpasswd(writeHtpasswd(t, tt.content)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+	if _, err := LoadHtpasswd(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vextm/vexshare/internal/tokens"
+)
+
+// TOTPSecrets is implemented by authenticators that keep a TOTP secret per
+// user, which a server requiring TOTP needs.
+type TOTPSecrets interface {
+	// TOTPSecret returns the user's base32 secret, or "" if they have not
+	// enrolled.
+	TOTPSecret(username string) string
+	// SetTOTPSecret saves a newly enrolled secret.
+	SetTOTPSecret(username, secret string) error
+}
+
+// EnrollmentTTL is how long a user who has passed the password check has to
+// set up their authenticator app.
+const EnrollmentTTL = 5 * time.Minute
+
+// EnrollmentStore holds TOTP enrollments between the password check and the
+// first code, so that a user without a secret is not locked out. Unlike a
+// ticket, an enrollment survives a wrong code until it expires.
+type EnrollmentStore struct {
+	mu          sync.Mutex
+	enrollments map[string]Enrollment
+	ttl         time.Duration
+}
+
+// Enrollment is a pending TOTP setup.
+type Enrollment struct {
+	Identity  Identity
+	Secret    string
+	ExpiresAt time.Time
+}
+
+func NewEnrollmentStore(ttl time.Duration) *EnrollmentStore {
+	e := &EnrollmentStore{
+		enrollments: make(map[string]Enrollment),
+		ttl:         ttl,
+	}
+	go e.cleanup()
+	return e
+}
+
+func (e *EnrollmentStore) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		e.mu.Lock()
+		now := time.Now()
+		for k, v := range e.enrollments {
+			if now.After(v.ExpiresAt) {
+				delete(e.enrollments, k)
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// Start records a new secret for identity and returns the enrollment ID.
+func (e *EnrollmentStore) Start(identity Identity, secret string) (string, error) {
+	id, err := tokens.Generate()
+	if err != nil {
+		return "", fmt.Errorf("start enrollment: %w", err)
+	}
+	e.mu.Lock()
+	e.enrollments[id] = Enrollment{Identity: identity, Secret: secret, ExpiresAt: time.Now().Add(e.ttl)}
+	e.mu.Unlock()
+	return id, nil
+}
+
+func (e *EnrollmentStore) Lookup(id string) (Enrollment, bool) {
+	e.mu.Lock()
+	entry, ok := e.enrollments[id]
+	e.mu.Unlock()
+	if !ok || time.Now().After(entry.ExpiresAt) {
+		return Enrollment{}, false
+	}
+	return entry, true
+}
+
+func (e *EnrollmentStore) Delete(id string) {
+	e.mu.Lock()
+	delete(e.enrollments, id)
+	e.mu.Unlock()
+}
+
+// enrollmentCookieName is the session cookie name with a suffix, so that
+// it follows CookieName and BasePath.
+func (cfg Config) enrollmentCookieName() string {
+	return cfg.SessionCookieName() + "_mfa"
+}
+
+func SetEnrollmentCookie(w http.ResponseWriter, cfg Config, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.enrollmentCookieName(),
+		Value:    id,
+		Path:     cfg.cookiePath(),
+		HttpOnly: true,
+		Secure:   cfg.Secure,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(EnrollmentTTL.Seconds()),
+	})
+}
+
+func ClearEnrollmentCookie(w http.ResponseWriter, cfg Config) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.enrollmentCookieName(),
+		Value:    "",
+		Path:     cfg.cookiePath(),
+		HttpOnly: true,
+		Secure:   cfg.Secure,
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
+func GetEnrollmentID(r *http.Request, cfg Config) string {
+	c, err := r.Cookie(cfg.enrollmentCookieName())
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
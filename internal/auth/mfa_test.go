@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentStore(t *testing.T) {
+	store := NewEnrollmentStore(1 * time.Minute)
+	id, err := store.Start(Identity{Username: "alice"}, rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A lookup does not use the enrollment up, so a mistyped code can be
+	// retried.
+	for i := 0; i < 2; i++ {
+		e, ok := store.Lookup(id)
+		if !ok || e.Identity.Username != "alice" || e.Secret != rfc6238Secret {
+			t.Fatalf("lookup %d: %+v, %v", i+1, e, ok)
+		}
+	}
+	store.Delete(id)
+	if _, ok := store.Lookup(id); ok {
+		t.Error("deleted enrollment still found")
+	}
+	if _, ok := store.Lookup(""); ok {
+		t.Error("empty ID found")
+	}
+}
+
+func TestEnrollmentExpiry(t *testing.T) {
+	store := NewEnrollmentStore(20 * time.Millisecond)
+	id, err := store.Start(Identity{}, rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := store.Lookup(id); ok {
+		t.Error("expected expired enrollment to be rejected")
+	}
+}
+
+func TestEnrollmentCookie(t *testing.T) {
+	cfg := Config{CookieName: "vx"}
+	rec := httptest.NewRecorder()
+	SetEnrollmentCookie(rec, cfg, "abc")
+	c := rec.Result().Cookies()[0]
+	if c.Name != "vx_mfa" || !c.HttpOnly || c.MaxAge != int(EnrollmentTTL.Seconds()) {
+		t.Errorf("cookie = %+v", c)
+	}
+	req := httptest.NewRequest("GET", "/mfa/setup", nil)
+	req.AddCookie(c)
+	if got := GetEnrollmentID(req, cfg); got != "abc" {
+		t.Errorf("GetEnrollmentID = %q", got)
+	}
+}
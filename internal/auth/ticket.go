@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vextm/vexshare/internal/tokens"
+)
+
+// TicketStore issues single-use, short-lived tickets that let a client
+// authenticate a WebSocket upgrade without cookies or a token in the URL path.
+type TicketStore struct {
+	mu      sync.Mutex
+	tickets map[string]ticketEntry
+	ttl     time.Duration
+}
+
+type ticketEntry struct {
+	expiresAt time.Time
+	identity  Identity
+}
+
+func NewTicketStore(ttl time.Duration) *TicketStore {
+	t := &TicketStore{
+		tickets: make(map[string]ticketEntry),
+		ttl:     ttl,
+	}
+	go t.cleanup()
+	return t
+}
+
+func (t *TicketStore) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.mu.Lock()
+		now := time.Now()
+		for k, v := range t.tickets {
+			if now.After(v.expiresAt) {
+				delete(t.tickets, k)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *TicketStore) TTL() time.Duration {
+	return t.ttl
+}
+
+func (t *TicketStore) Issue(identity Identity) (string, error) {
+	ticket, err := tokens.Generate()
+	if err != nil {
+		return "", fmt.Errorf("issue ticket: %w", err)
+	}
+	t.mu.Lock()
+	t.tickets[ticket] = ticketEntry{
+		expiresAt: time.Now().Add(t.ttl),
+		identity:  identity,
+	}
+	t.mu.Unlock()
+	return ticket, nil
+}
+
+func (t *TicketStore) Redeem(ticket string) (Identity, bool) {
+	t.mu.Lock()
+	entry, ok := t.tickets[ticket]
+	delete(t.tickets, ticket)
+	t.mu.Unlock()
+	if !ok || time.Now().After(entry.expiresAt) {
+		return Identity{}, false
+	}
+	return entry.identity, true
+}
+
+type ticketKey struct{}
+
+func TicketAuthenticated(r *http.Request) bool {
+	v, _ := r.Context().Value(ticketKey{}).(bool)
+	return v
+}
+
+// TicketMiddleware authenticates requests carrying a ?ticket= query
+// parameter. Requests without one are passed to fallback, or rejected when
+// fallback is nil.
+func TicketMiddleware(tickets *TicketStore, fallback func(http.Handler) http.Handler, logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		var withFallback http.Handler
+		if fallback != nil {
+			withFallback = fallback(next)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ticket := r.URL.Query().Get("ticket")
+			if ticket == "" {
+				if withFallback == nil {
+					http.Error(w, "Forbidden", http.StatusForbidden)
+					return
+				}
+				withFallback.ServeHTTP(w, r)
+				return
+			}
+			identity, ok := tickets.Redeem(ticket)
+			if !ok {
+				logger.WarnContext(r.Context(), "invalid or expired ws ticket", "ip", r.RemoteAddr)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			ctx := WithIdentity(r.Context(), identity)
+			ctx = context.WithValue(ctx, ticketKey{}, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
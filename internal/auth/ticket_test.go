@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTicketSingleUse(t *testing.T) {
+	store := NewTicketStore(1 * time.Minute)
+	ticket, err := store.Issue(Identity{Username: "alice"})
+	if err != nil {
+		t.Fatalf("Issue error: %v", err)
+	}
+	identity, ok := store.Redeem(ticket)
+	if !ok {
+		t.Fatal("expected ticket to be redeemable")
+	}
+	if identity.Username != "alice" {
+		t.Errorf("identity: got %q, want alice", identity.Username)
+	}
+	if _, ok := store.Redeem(ticket); ok {
+		t.Error("expected ticket to be consumed after first use")
+	}
+	if _, ok := store.Redeem("unknown"); ok {
+		t.Error("expected unknown ticket to be rejected")
+	}
+}
+
+func TestTicketExpiry(t *testing.T) {
+	store := NewTicketStore(20 * time.Millisecond)
+	ticket, err := store.Issue(Identity{})
+	if err != nil {
+		t.Fatalf("Issue error: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := store.Redeem(ticket); ok {
+		t.Error("expected expired ticket to be rejected")
+	}
+}
+
+func TestTicketMiddleware(t *testing.T) {
+	store := NewTicketStore(1 * time.Minute)
+	var reached, viaTicket bool
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		viaTicket = TicketAuthenticated(r)
+	})
+	fallbackCalled := false
+	fallback := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fallbackCalled = true
+			h.ServeHTTP(w, r)
+		})
+	}
+	handler := TicketMiddleware(store, fallback, slog.Default())(next)
+
+	ticket, _ := store.Issue(Identity{Username: "alice"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ws?ticket="+ticket, nil))
+	if !reached || !viaTicket || fallbackCalled {
+		t.Errorf("valid ticket: reached=%v viaTicket=%v fallback=%v", reached, viaTicket, fallbackCalled)
+	}
+
+	reached = false
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ws?ticket="+ticket, nil))
+	if reached || w.Code != http.StatusForbidden {
+		t.Errorf("reused ticket: reached=%v code=%d", reached, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/ws", nil))
+	if !fallbackCalled || viaTicket {
+		t.Errorf("no ticket: fallback=%v viaTicket=%v", fallbackCalled, viaTicket)
+	}
+
+	noFallback := TicketMiddleware(store, nil, slog.Default())(next)
+	w = httptest.NewRecorder()
+	noFallback.ServeHTTP(w, httptest.NewRequest("GET", "/ws", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("no ticket without fallback: got %d, want 403", w.Code)
+	}
+}
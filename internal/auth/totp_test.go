@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key from RFC 6238 appendix B, "12345678901234567890".
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// The RFC lists 8-digit codes; these are their last 6 digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(rfc6238Secret, time.Unix(tt.unix, 0))
+		if err != nil || got != tt.want {
+			t.Errorf("TOTPCode at %d = %q, %v; want %q", tt.unix, got, err, tt.want)
+		}
+	}
+	if _, err := TOTPCode("not base32!", time.Now()); err == nil {
+		t.Error("expected an error for an invalid secret")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(rfc6238Secret, now)
+	prev, _ := TOTPCode(rfc6238Secret, now.Add(-totpPeriod))
+	old, _ := TOTPCode(rfc6238Secret, now.Add(-3*totpPeriod))
+
+	if !VerifyTOTP(rfc6238Secret, code, now) {
+		t.Error("current code rejected")
+	}
+	if !VerifyTOTP(rfc6238Secret, code[:3]+" "+code[3:], now) {
+		t.Error("code with a space rejected")
+	}
+	if !VerifyTOTP(rfc6238Secret, prev, now) {
+		t.Error("code from the previous period rejected")
+	}
+	if old != code && VerifyTOTP(rfc6238Secret, old, now) {
+		t.Error("code from three periods ago accepted")
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if VerifyTOTP(rfc6238Secret, bad, now) {
+			t.Errorf("VerifyTOTP(%q) accepted", bad)
+		}
+	}
+}
+
+func TestTOTPReplayGuard(t *testing.T) {
+	g := NewTOTPReplayGuard()
+	now := time.Unix(1234567890, 0)
+	code, _ := TOTPCode(rfc6238Secret, now)
+	prev, _ := TOTPCode(rfc6238Secret, now.Add(-totpPeriod))
+	next, _ := TOTPCode(rfc6238Secret, now.Add(totpPeriod))
+
+	if !g.Verify("alice", rfc6238Secret, code, now) {
+		t.Fatal("current code rejected")
+	}
+	if g.Verify("alice", rfc6238Secret, code, now) {
+		t.Error("the same code accepted twice")
+	}
+	if g.Verify("alice", rfc6238Secret, prev, now) {
+		t.Error("a code older than the last one accepted")
+	}
+	if !g.Verify("bob", rfc6238Secret, code, now) {
+		t.Error("another user's use of the code counted against bob")
+	}
+	if !g.Verify("alice", rfc6238Secret, next, now.Add(totpPeriod)) {
+		t.Error("the next code rejected")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, err := decodeTOTPSecret(secret); err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+}
+
+func TestTOTPURL(t *testing.T) {
+	raw := TOTPURL("vexShare", "alice", rfc6238Secret)
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || !strings.HasSuffix(u.Path, "vexShare:alice") {
+		t.Errorf("TOTPURL = %q", raw)
+	}
+	if q := u.Query(); q.Get("secret") != rfc6238Secret || q.Get("issuer") != "vexShare" || q.Get("digits") != "6" {
+		t.Errorf("TOTPURL query = %v", q)
+	}
+}
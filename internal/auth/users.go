@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Role string
+
+const (
+	RoleOwner  Role = "owner"
+	RoleWriter Role = "writer"
+	RoleViewer Role = "viewer"
+)
+
+type userRecord struct {
+	Username string `json:"username"`
+	Hash     string `json:"hash"`
+	Role     Role   `json:"role"`
+	// TOTP is the user's base32 TOTP secret, once they have enrolled.
+	TOTP string `json:"totp,omitempty"`
+}
+
+// UsersFile authenticates against a JSON file of bcrypt-hashed accounts,
+// each with a role. The file can be re-read at runtime with Reload.
+type UsersFile struct {
+	path  string
+	mu    sync.RWMutex
+	users map[string]userRecord
+	// writeMu serializes SetTOTPSecret's read-modify-write of the file.
+	writeMu sync.Mutex
+}
+
+func LoadUsersFile(path string) (*UsersFile, error) {
+	u := &UsersFile{path: path}
+	if err := u.Reload(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *UsersFile) Reload() error {
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return fmt.Errorf("read users file: %w", err)
+	}
+	var records []userRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parse users file: %w", err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("users file %s contains no users", u.path)
+	}
+	users := make(map[string]userRecord, len(records))
+	for i, rec := range records {
+		if rec.Username == "" {
+			return fmt.Errorf("users file entry %d: missing username", i)
+		}
+		if _, dup := users[rec.Username]; dup {
+			return fmt.Errorf("users file entry %d: duplicate username %q", i, rec.Username)
+		}
+		if _, err := bcrypt.Cost([]byte(rec.Hash)); err != nil {
+			return fmt.Errorf("users file entry %q: invalid bcrypt hash: %w", rec.Username, err)
+		}
+		switch rec.Role {
+		case RoleOwner, RoleWriter, RoleViewer:
+		default:
+			return fmt.Errorf("users file entry %q: invalid role %q (use owner, writer, viewer)", rec.Username, rec.Role)
+		}
+		if rec.TOTP != "" {
+			if _, err := decodeTOTPSecret(rec.TOTP); err != nil {
+				return fmt.Errorf("users file entry %q: %w", rec.Username, err)
+			}
+		}
+		users[rec.Username] = rec
+	}
+
+	u.mu.Lock()
+	u.users = users
+	u.mu.Unlock()
+	return nil
+}
+
+func (u *UsersFile) Len() int {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return len(u.users)
+}
+
+func (u *UsersFile) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	u.mu.RLock()
+	rec, ok := u.users[username]
+	u.mu.RUnlock()
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(password))
+		return Identity{}, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(rec.Hash), []byte(password)); err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Username: rec.Username, DisplayName: rec.Username, Role: rec.Role}, nil
+}
+
+func (u *UsersFile) TOTPSecret(username string) string {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.users[username].TOTP
+}
+
+// SetTOTPSecret saves the user's secret to the file. The file is read again
+// first so that edits made since the last Reload are kept, and replaced
+// atomically with the same permissions.
+func (u *UsersFile) SetTOTPSecret(username, secret string) error {
+	u.writeMu.Lock()
+	defer u.writeMu.Unlock()
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return fmt.Errorf("read users file: %w", err)
+	}
+	var records []userRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("parse users file: %w", err)
+	}
+	found := false
+	for i := range records {
+		if records[i].Username == username {
+			records[i].TOTP = secret
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("users file has no user %q", username)
+	}
+	out, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0o600)
+	if fi, err := os.Stat(u.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), ".users-*.json")
+	if err != nil {
+		return fmt.Errorf("write users file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(out, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write users file: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write users file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write users file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), u.path); err != nil {
+		return fmt.Errorf("write users file: %w", err)
+	}
+	return u.Reload()
+}
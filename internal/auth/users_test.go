@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	// password "allmine"
+	allmineHash = "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga"
+	// password "correct horse battery staple"
+	horseHash = "$2y$05$0123456789abcdefghijkesSXn1Ivr1ALp.4I3yvm8FsIF9awXMgS"
+)
+
+func writeUsersFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUsersFileRoles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsersFile(t, path, `[
+		{"username": "alice", "hash": "`+allmineHash+`", "role": "owner"},
+		{"username": "bob", "hash": "`+horseHash+`", "role": "viewer"}
+	]`)
+	u, err := LoadUsersFile(path)
+	if err != nil {
+		t.Fatalf("LoadUsersFile error: %v", err)
+	}
+
+	alice, err := u.Authenticate(context.Background(), "alice", "allmine")
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	if alice.Role != RoleOwner {
+		t.Errorf("alice role: got %q, want owner", alice.Role)
+	}
+	bob, err := u.Authenticate(context.Background(), "bob", "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("bob: %v", err)
+	}
+	if bob.Role != RoleViewer {
+		t.Errorf("bob role: got %q, want viewer", bob.Role)
+	}
+	if _, err := u.Authenticate(context.Background(), "alice", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("expected ErrInvalidCredentials, got %v", err)
+	}
+}
+
+func TestUsersFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsersFile(t, path, `[{"username": "alice", "hash": "`+allmineHash+`", "role": "writer"}]`)
+	u, err := LoadUsersFile(path)
+	if err != nil {
+		t.Fatalf("LoadUsersFile error: %v", err)
+	}
+	if _, err := u.Authenticate(context.Background(), "carol", "allmine"); err == nil {
+		t.Fatal("carol should not exist yet")
+	}
+
+	writeUsersFile(t, path, `[{"username": "carol", "hash": "`+allmineHash+`", "role": "owner"}]`)
+	if err := u.Reload(); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+	carol, err := u.Authenticate(context.Background(), "carol", "allmine")
+	if err != nil {
+		t.Fatalf("carol after reload: %v", err)
+	}
+	if carol.Role != RoleOwner {
+		t.Errorf("carol role: got %q, want owner", carol.Role)
+	}
+	if _, err := u.Authenticate(context.Background(), "alice", "allmine"); err == nil {
+		t.Error("alice should be gone after reload")
+	}
+
+	writeUsersFile(t, path, `not json`)
+	if err := u.Reload(); err == nil {
+		t.Fatal("expected reload of invalid file to fail")
+	}
+	if _, err := u.Authenticate(context.Background(), "carol", "allmine"); err != nil {
+		t.Errorf("failed reload should keep previous users: %v", err)
+	}
+}
+
+func TestUsersFileValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty list", `[]`},
+		{"bad role", `[{"username": "a", "hash": "` + allmineHash + `", "role": "admin"}]`},
+		{"missing username", `[{"hash": "` + allmineHash + `", "role": "owner"}]`},
+		{"plaintext hash", `[{"username": "a", "hash": "secret", "role": "owner"}]`},
+		{"duplicate", `[{"username": "a", "hash": "` + allmineHash + `", "role": "owner"}, {"username": "a", "hash": "` + allmineHash + `", "role": "viewer"}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			writeUsersFile(t, path, tt.content)
+			if _, err := LoadUsersFile(path); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestUsersFileSetTOTPSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsersFile(t, path, `[
+		{"username": "alice", "hash": "`+allmineHash+`", "role": "owner"},
+		{"username": "bob", "hash": "`+horseHash+`", "role": "viewer"}
+	]`)
+	u, err := LoadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.TOTPSecret("alice"); got != "" {
+		t.Fatalf("alice has secret %q before enrolling", got)
+	}
+	if err := u.SetTOTPSecret("alice", rfc6238Secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := u.TOTPSecret("alice"); got != rfc6238Secret {
+		t.Errorf("alice secret = %q", got)
+	}
+
+	// The secret is in the file, which keeps its mode and other users.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0o600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+	reloaded, err := LoadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.TOTPSecret("alice") != rfc6238Secret || reloaded.Len() != 2 {
+		t.Errorf("reloaded: alice secret %q, %d users", reloaded.TOTPSecret("alice"), reloaded.Len())
+	}
+	if _, err := reloaded.Authenticate(context.Background(), "bob", "correct horse battery staple"); err != nil {
+		t.Errorf("bob: %v", err)
+	}
+
+	if err := u.SetTOTPSecret("carol", rfc6238Secret); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+}
+
+func TestUsersFileInvalidTOTPSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsersFile(t, path, `[{"username": "alice", "hash": "`+allmineHash+`", "role": "owner", "totp": "not base32!"}]`)
+	if _, err := LoadUsersFile(path); err == nil {
+		t.Error("expected an error for an invalid TOTP secret")
+	}
+}
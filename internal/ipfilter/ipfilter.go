@@ -0,0 +1,55 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/vextm/vexshare/internal/ratelimit"
+)
+
+// List is a set of IP ranges. A bare address is treated as a single-host
+// range.
+type List []netip.Prefix
+
+// Parse reads a comma-separated list of CIDR ranges and addresses.
+func Parse(s string) (List, error) {
+	var l List
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", field, err)
+			}
+			l = append(l, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q: %w", field, err)
+		}
+		addr = addr.Unmap()
+		l = append(l, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return l, nil
+}
+
+// Contains reports whether ip falls in any range of l. The address is read
+// with ratelimit.ParseIP, so a port or brackets are fine. Unparseable
+// addresses never match.
+func (l List) Contains(ip string) bool {
+	addr, ok := ratelimit.ParseIP(ip)
+	if !ok {
+		return false
+	}
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
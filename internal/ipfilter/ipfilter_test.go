@@ -0,0 +1,54 @@
+package ipfilter
+
+import "testing"
+
+func TestListContains(t *testing.T) {
+	l, err := Parse("10.0.0.0/8, 192.168.1.7,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.255.255.255", true},
+		{"11.0.0.1", false},
+		{"192.168.1.7", true},
+		{"192.168.1.8", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"[2001:DB8::1]:443", true},
+		{"192.168.1.7:5000", true},
+		{"unknown", false},
+		{"not-an-ip", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := l.Contains(tt.ip); got != tt.want {
+			t.Errorf("Contains(%q) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantLen int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"127.0.0.1", 1, false},
+		{"10.1.2.3/8", 1, false},
+		{"10.0.0.0/8,,::1", 2, false},
+		{"10.0.0.0/33", 0, true},
+		{"example.com", 0, true},
+	}
+	for _, tt := range tests {
+		l, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr || len(l) != tt.wantLen {
+			t.Errorf("Parse(%q) = %v, %v; want %d entries, error %v", tt.in, l, err, tt.wantLen, tt.wantErr)
+		}
+	}
+}
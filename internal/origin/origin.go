@@ -0,0 +1,157 @@
+// Package origin matches browser Origin headers against the allowed origins
+// configured with --allow-origin.
+package origin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Pattern is one allowed origin. It is one of:
+//
+//   - an exact origin, "https://app.example.com" or "http://localhost:3000";
+//   - a host without a scheme, "app.example.com", which allows it over
+//     http and https;
+//   - a wildcard for the leftmost label, "*.preview.example.com" or
+//     "https://*.preview.example.com", which matches
+//     pr-123.preview.example.com but neither preview.example.com nor
+//     a.b.preview.example.com;
+//   - "null", the origin browsers send from file:// pages and sandboxed
+//     frames, which is only allowed when listed.
+//
+// A port in the pattern must match the origin's; without one, the origin
+// must not carry one either.
+type Pattern struct {
+	scheme string // "" for http or https
+	// host is the whole host, or with wildcard what follows "*.".
+	host     string
+	port     string
+	wildcard bool
+	null     bool
+}
+
+// List is a set of patterns.
+type List []Pattern
+
+// Parse reads a comma-separated list of patterns. Empty entries are
+// skipped.
+func Parse(s string) (List, error) {
+	var l List
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		p, err := ParsePattern(field)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, p)
+	}
+	return l, nil
+}
+
+// ParsePattern reads a single pattern.
+func ParsePattern(s string) (Pattern, error) {
+	if s == "null" {
+		return Pattern{null: true}, nil
+	}
+	raw := s
+	if !strings.Contains(s, "://") {
+		raw = "http://" + s
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Pattern{}, fmt.Errorf("invalid origin %q: %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Pattern{}, fmt.Errorf("invalid origin %q: scheme must be http or https", s)
+	}
+	if u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return Pattern{}, fmt.Errorf("invalid origin %q: an origin is only a scheme, host and port", s)
+	}
+	p := Pattern{host: strings.ToLower(u.Hostname()), port: u.Port()}
+	if strings.Contains(s, "://") {
+		p.scheme = u.Scheme
+	}
+	if strings.HasSuffix(u.Host, ":") {
+		return Pattern{}, fmt.Errorf("invalid origin %q: empty port", s)
+	}
+	if rest, ok := strings.CutPrefix(p.host, "*."); ok {
+		p.host, p.wildcard = rest, true
+		// "*.com" would let anyone with a domain in.
+		if !strings.Contains(p.host, ".") {
+			return Pattern{}, fmt.Errorf("invalid origin %q: a wildcard needs at least two labels after it", s)
+		}
+	}
+	if !validHost(p.host) {
+		return Pattern{}, fmt.Errorf("invalid origin %q: a wildcard may only be the whole leftmost label, as in *.example.com", s)
+	}
+	return p, nil
+}
+
+// validHost rejects empty labels and stray wildcards.
+func validHost(host string) bool {
+	if host == "" || strings.Contains(host, "*") {
+		return false
+	}
+	if strings.Contains(host, ":") { // an IPv6 literal
+		return true
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Matches reports whether the Origin header value origin is allowed by p.
+func (p Pattern) Matches(origin string) bool {
+	if p.null || origin == "null" {
+		return p.null && origin == "null"
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Opaque != "" {
+		return false
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if p.scheme != "" && u.Scheme != p.scheme {
+		return false
+	}
+	if u.Port() != p.port {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if !p.wildcard {
+		return host == p.host
+	}
+	label, ok := strings.CutSuffix(host, "."+p.host)
+	return ok && dnsLabel(label)
+}
+
+// dnsLabel reports whether s is a single DNS label.
+func dnsLabel(s string) bool {
+	if s == "" || len(s) > 63 {
+		return false
+	}
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows reports whether any pattern in l matches origin.
+func (l List) Allows(origin string) bool {
+	for _, p := range l {
+		if p.Matches(origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package origin
+
+import "testing"
+
+func TestListAllows(t *testing.T) {
+	l, err := Parse("*.preview.example.com, https://*.example.org,https://app.example.net, localhost:3000,null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		// Wildcard without a scheme: http and https, one label only.
+		{"https://pr-123.preview.example.com", true},
+		{"http://pr-123.preview.example.com", true},
+		{"https://PR-123.Preview.Example.com", true},
+		{"https://preview.example.com", false},
+		{"https://a.b.preview.example.com", false},
+		{"https://.preview.example.com", false},
+		{"https://evilpreview.example.com", false},
+		{"https://evil-preview.example.com.attacker.io", false},
+		{"https://pr-1.preview.example.com.attacker.io", false},
+		{"https://attacker.io/pr-1.preview.example.com", false},
+		{"https://pr-1.preview.example.com@attacker.io", false},
+		{"https://pr-1.preview.example.com:8443", false},
+		{"ws://pr-1.preview.example.com", false},
+		// Wildcard with a scheme.
+		{"https://app.example.org", true},
+		{"http://app.example.org", false},
+		{"https://example.org", false},
+		// Exact origins.
+		{"https://app.example.net", true},
+		{"http://app.example.net", false},
+		{"https://app.example.net:443", false},
+		{"https://app.example.net/", false},
+		{"https://sub.app.example.net", false},
+		{"http://localhost:3000", true},
+		{"https://localhost:3000", true},
+		{"http://localhost", false},
+		{"http://localhost:30000", false},
+		// file:// pages and sandboxed frames.
+		{"null", true},
+		{"", false},
+		{"*", false},
+		{"https://*.preview.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := l.Allows(tt.origin); got != tt.want {
+			t.Errorf("Allows(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+}
+
+func TestNullOnlyWhenListed(t *testing.T) {
+	l, err := Parse("https://app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Allows("null") {
+		t.Error(`"null" allowed without being listed`)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantLen int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"https://app.example.com", 1, false},
+		{"https://app.example.com,, *.example.com ", 2, false},
+		{"http://[::1]:8080", 1, false},
+		{"null", 1, false},
+		{"*", 0, true},
+		{"*.com", 0, true},
+		{"https://*", 0, true},
+		{"pr-*.example.com", 0, true},
+		{"*.*.example.com", 0, true},
+		{"app.*.example.com", 0, true},
+		{"ftp://app.example.com", 0, true},
+		{"https://app.example.com/", 0, true},
+		{"https://app.example.com/path", 0, true},
+		{"https://user@app.example.com", 0, true},
+		{"https://app.example.com:", 0, true},
+		{"https://app..example.com", 0, true},
+		{"https://", 0, true},
+	}
+	for _, tt := range tests {
+		l, err := Parse(tt.in)
+		if (err != nil) != tt.wantErr || len(l) != tt.wantLen {
+			t.Errorf("Parse(%q) = %v, %v; want %d entries, error %v", tt.in, l, err, tt.wantLen, tt.wantErr)
+		}
+	}
+}
@@ -1,81 +1,80 @@
 package ratelimit
 
 import (
-	"net"
+	"log/slog"
 	"net/http"
-	"sync"
+	"net/netip"
+	"strings"
 	"time"
 )
 
 type Limiter struct {
-	mu      sync.Mutex
-	entries map[string]*entry
-	limit   int
-	window  time.Duration
+	store  Store
+	prefix string
+	limit  int
+	window time.Duration
+	logger *slog.Logger
+	reason string
+	// proxies are the peers whose X-Forwarded-For Middleware believes.
+	proxies Proxies
 }
 
-type entry struct {
-	timestamps []time.Time
+// New returns a limiter backed by its own MemoryStore.
+func New(limit int, window time.Duration) *Limiter {
+	return &Limiter{store: NewMemoryStore(), limit: limit, window: window}
 }
 
-func New(limit int, window time.Duration) *Limiter {
-	l := &Limiter{
-		entries: make(map[string]*entry),
-		limit:   limit,
-		window:  window,
-	}
-	go l.cleanup()
-	return l
-}
-
-func (l *Limiter) cleanup() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-	for range ticker.C {
-		l.mu.Lock()
-		now := time.Now()
-		for k, e := range l.entries {
-			e.timestamps = filterRecent(e.timestamps, now, l.window)
-			if len(e.timestamps) == 0 {
-				delete(l.entries, k)
-			}
-		}
-		l.mu.Unlock()
-	}
+// NewWithStore returns a limiter that keeps its counts in store under keys
+// prefixed with name, so several limiters can share one store.
+func NewWithStore(store Store, name string, limit int, window time.Duration) *Limiter {
+	return &Limiter{store: store, prefix: name + ":", limit: limit, window: window}
+}
+
+// SetLogger makes Middleware log each rejected request at warn level,
+// tagged with reason so different limiters can be told apart.
+func (l *Limiter) SetLogger(logger *slog.Logger, reason string) {
+	l.logger = logger
+	l.reason = reason
+}
+
+// SetTrustedProxies makes Middleware key requests from proxies by the
+// client address they forward; see ExtractIP.
+func (l *Limiter) SetTrustedProxies(proxies Proxies) {
+	l.proxies = proxies
+}
+
+func (l *Limiter) Limit() int {
+	return l.limit
+}
+
+func (l *Limiter) Window() time.Duration {
+	return l.window
 }
 
 func (l *Limiter) Allow(ip string) bool {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	now := time.Now()
-	e, ok := l.entries[ip]
-	if !ok {
-		e = &entry{}
-		l.entries[ip] = e
-	}
-	e.timestamps = filterRecent(e.timestamps, now, l.window)
-	if len(e.timestamps) >= l.limit {
-		return false
-	}
-	e.timestamps = append(e.timestamps, now)
-	return true
+	return l.store.Allow(l.prefix+ip, l.limit, l.window)
 }
 
+// Count returns how many requests key made in the current window, or 0 if
+// the store cannot tell.
 func (l *Limiter) Count(ip string) int {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	e, ok := l.entries[ip]
-	if !ok {
-		return 0
+	if in, ok := l.store.(Inspector); ok {
+		return in.Count(l.prefix+ip, l.window)
 	}
-	e.timestamps = filterRecent(e.timestamps, time.Now(), l.window)
-	return len(e.timestamps)
+	return 0
+}
+
+// RetryAfter returns how long until key may make another request, or zero
+// if it is not currently limited or the store cannot tell.
+func (l *Limiter) RetryAfter(key string) time.Duration {
+	if in, ok := l.store.(Inspector); ok {
+		return in.RetryAfter(l.prefix+key, l.limit, l.window)
+	}
+	return 0
 }
 
 func (l *Limiter) Reset(ip string) {
-	l.mu.Lock()
-	delete(l.entries, ip)
-	l.mu.Unlock()
+	l.store.Reset(l.prefix + ip)
 }
 
 func filterRecent(ts []time.Time, now time.Time, window time.Duration) []time.Time {
@@ -89,28 +88,96 @@ func filterRecent(ts []time.Time, now time.Time, window time.Duration) []time.Ti
 	return result
 }
 
-func ExtractIP(r *http.Request) string {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		for i, c := range xff {
-			if c == ',' {
-				return xff[:i]
-			}
-			_ = i
+// RedactPath masks the access token in /t/{token}/ URLs so it never reaches
+// the logs.
+func RedactPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/t/")
+	if !ok {
+		return path
+	}
+	_, after, found := strings.Cut(rest, "/")
+	if !found {
+		return "/t/{token}"
+	}
+	return "/t/{token}/" + after
+}
+
+// UnknownIP stands in for a client address that cannot be parsed, so
+// garbage input shares one rate-limit key instead of minting a new one per
+// request.
+const UnknownIP = "unknown"
+
+// ParseIP parses an address that may carry brackets, a port or an IPv6
+// zone, as in "[fe80::1%eth0]:5000". The zone is dropped and IPv4-mapped
+// IPv6 addresses are unmapped, so each host has exactly one form.
+func ParseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	var addr netip.Addr
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		addr = ap.Addr()
+	} else {
+		var err error
+		if addr, err = netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")); err != nil {
+			return netip.Addr{}, false
 		}
-		return xff
 	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
+	return addr.Unmap().WithZone(""), true
+}
+
+// CanonicalIP returns the canonical text of an address as parsed by
+// ParseIP: dotted IPv4, or lowercase IPv6 in its shortest form. It
+// returns UnknownIP if s is not an address.
+func CanonicalIP(s string) string {
+	addr, ok := ParseIP(s)
+	if !ok {
+		return UnknownIP
+	}
+	return addr.String()
+}
+
+// Proxies reports whether an address is a trusted reverse proxy;
+// ipfilter.List is one.
+type Proxies interface {
+	Contains(addr string) bool
+}
+
+// ExtractIP returns the canonical client address. That is the peer address
+// unless the peer is one of proxies, in which case it is the rightmost
+// X-Forwarded-For entry that is not a proxy too: entries left of it were
+// written by the client and prove nothing. A header from any other peer is
+// ignored, so a client cannot pick its own address.
+func ExtractIP(r *http.Request, proxies Proxies) string {
+	if proxies == nil || !proxies.Contains(r.RemoteAddr) {
+		return CanonicalIP(r.RemoteAddr)
+	}
+	xff := r.Header.Values("X-Forwarded-For")
+	if len(xff) == 0 {
+		return CanonicalIP(r.RemoteAddr)
+	}
+	entries := strings.Split(strings.Join(xff, ","), ",")
+	for i := len(entries) - 1; i > 0; i-- {
+		if !proxies.Contains(entries[i]) {
+			return CanonicalIP(entries[i])
+		}
 	}
-	return host
+	return CanonicalIP(entries[0])
 }
 
 func (l *Limiter) Middleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ip := ExtractIP(r)
+			ip := ExtractIP(r, l.proxies)
 			if !l.Allow(ip) {
+				if l.logger != nil {
+					l.logger.WarnContext(r.Context(), "rate limit exceeded",
+						"reason", l.reason,
+						"ip", ip,
+						"route", r.Method+" "+RedactPath(r.URL.Path),
+						"count", l.Count(ip),
+						"limit", l.limit,
+						"window", l.window,
+					)
+				}
 				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
 				return
 			}
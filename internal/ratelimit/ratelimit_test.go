@@ -1,8 +1,11 @@
 package ratelimit
 
 import (
+	"bytes"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,14 +55,57 @@ func TestLimiterWindowExpiry(t *testing.T) {
 	}
 }
 
+func TestLimiterRetryAfter(t *testing.T) {
+	l := New(2, 1*time.Minute)
+	key := "alice"
+	if d := l.RetryAfter(key); d != 0 {
+		t.Errorf("unknown key: RetryAfter = %v, want 0", d)
+	}
+	l.Allow(key)
+	if d := l.RetryAfter(key); d != 0 {
+		t.Errorf("under limit: RetryAfter = %v, want 0", d)
+	}
+	l.Allow(key)
+	if d := l.RetryAfter(key); d <= 59*time.Second || d > time.Minute {
+		t.Errorf("at limit: RetryAfter = %v, want just under 1m", d)
+	}
+}
+
+// proxyList trusts the addresses in it.
+type proxyList []string
+
+func (l proxyList) Contains(addr string) bool {
+	for _, p := range l {
+		if CanonicalIP(addr) == p {
+			return true
+		}
+	}
+	return false
+}
+
 func TestExtractIP(t *testing.T) {
+	proxies := proxyList{"10.0.0.1", "10.0.0.2"}
 	tests := []struct {
 		name, addr, xff, want string
 	}{
 		{"ip:port", "192.168.1.1:12345", "", "192.168.1.1"},
 		{"just ip", "192.168.1.1", "", "192.168.1.1"},
 		{"xff single", "10.0.0.1:1234", "203.0.113.50", "203.0.113.50"},
-		{"xff multi", "10.0.0.1:1234", "203.0.113.50, 70.41.3.18", "203.0.113.50"},
+		{"xff multi", "10.0.0.1:1234", "203.0.113.50, 70.41.3.18", "70.41.3.18"},
+		{"xff through two proxies", "10.0.0.1:1234", "203.0.113.50 ,10.0.0.2", "203.0.113.50"},
+		{"xff only proxies", "10.0.0.1:1234", "10.0.0.2", "10.0.0.2"},
+		{"xff from untrusted peer", "198.51.100.4:1234", "203.0.113.50", "198.51.100.4"},
+		{"ipv6 bracketed port", "[::1]:5000", "", "::1"},
+		{"ipv6 bracketed", "[::1]", "", "::1"},
+		{"ipv6 long form", "[0:0:0:0:0:0:0:1]:5000", "", "::1"},
+		{"ipv6 uppercase", "[2001:DB8:0:0::1]:443", "", "2001:db8::1"},
+		{"ipv6 zoned", "[fe80::1%eth0]:5000", "", "fe80::1"},
+		{"ipv6 zoned bare", "fe80::1%eth0", "", "fe80::1"},
+		{"ipv4 mapped", "[::ffff:192.0.2.7]:80", "", "192.0.2.7"},
+		{"xff ipv6 with port", "10.0.0.1:1234", "[2001:db8::1]:8443", "2001:db8::1"},
+		{"xff garbage", "10.0.0.1:1234", "203.0.113.50, not-an-ip", UnknownIP},
+		{"xff empty entry", "10.0.0.1:1234", "203.0.113.50, ", UnknownIP},
+		{"garbage peer", "pipe", "", UnknownIP},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -68,11 +114,17 @@ func TestExtractIP(t *testing.T) {
 			if tt.xff != "" {
 				req.Header.Set("X-Forwarded-For", tt.xff)
 			}
-			if got := ExtractIP(req); got != tt.want {
+			if got := ExtractIP(req, proxies); got != tt.want {
 				t.Errorf("got %q, want %q", got, tt.want)
 			}
 		})
 	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.50")
+	if got := ExtractIP(req, nil); got != "10.0.0.1" {
+		t.Errorf("without proxies: got %q, want the peer", got)
+	}
 }
 
 func TestMiddleware(t *testing.T) {
@@ -97,3 +149,39 @@ func TestMiddleware(t *testing.T) {
 		t.Errorf("expected 429, got %d", w.Code)
 	}
 }
+
+func TestMiddlewareLogsRejection(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(1, 1*time.Minute)
+	l.SetLogger(slog.New(slog.NewTextHandler(&buf, nil)), "ws_ip_limit")
+	handler := l.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/t/secret-token/ws", nil)
+		req.RemoteAddr = "2.2.2.2:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	out := buf.String()
+	for _, want := range []string{"level=WARN", "reason=ws_ip_limit", "ip=2.2.2.2", `route="GET /t/{token}/ws"`, "count=1", "limit=1", "window=1m0s"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log %q missing %q", out, want)
+		}
+	}
+	if strings.Contains(out, "secret-token") {
+		t.Error("token leaked into the log")
+	}
+}
+
+func TestRedactPath(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/ws", "/ws"},
+		{"/t/abc/ws", "/t/{token}/ws"},
+		{"/t/abc/", "/t/{token}/"},
+		{"/t/abc", "/t/{token}"},
+		{"/login", "/login"},
+	}
+	for _, tt := range tests {
+		if got := RedactPath(tt.in); got != tt.want {
+			t.Errorf("RedactPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix = "vexshare:ratelimit:"
+	redisTimeout   = 2 * time.Second
+)
+
+// RedisStore is a fixed-window Store shared by every instance that points
+// at the same Redis. Each window is one key, counted with INCR and given
+// its expiry by PEXPIRE ... NX in the same pipeline, so only the request
+// that creates the key starts the window. PEXPIRE NX needs Redis 7.0. If
+// Redis cannot be reached, requests are allowed and the error is logged, so
+// an outage does not lock everyone out.
+type RedisStore struct {
+	client *redis.Client
+	logger *slog.Logger
+}
+
+// NewRedisStore connects to a redis:// or rediss:// URL of the form
+// redis://[user:password@]host[:port][/db] and checks that the server
+// answers.
+func NewRedisStore(rawURL string, logger *slog.Logger) (*RedisStore, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis URL: %w", err)
+	}
+	opts.DialTimeout = redisTimeout
+	opts.ReadTimeout = redisTimeout
+	opts.WriteTimeout = redisTimeout
+	opts.DisableIdentity = true
+	if logger == nil {
+		logger = slog.Default()
+	}
+	r := &RedisStore{client: redis.NewClient(opts), logger: logger}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := r.client.Ping(ctx).Err(); err != nil {
+		r.client.Close()
+		return nil, fmt.Errorf("redis %s: %w", opts.Addr, err)
+	}
+	return r, nil
+}
+
+func (r *RedisStore) Allow(key string, limit int, window time.Duration) bool {
+	key = redisKeyPrefix + key
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	var incr *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Do(ctx, "PEXPIRE", key, window.Milliseconds(), "NX")
+		return nil
+	})
+	if err != nil {
+		r.logger.Warn("redis rate limit unavailable, allowing request", "error", err)
+		return true
+	}
+	return incr.Val() <= int64(limit)
+}
+
+func (r *RedisStore) Count(key string, window time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := r.client.Get(ctx, redisKeyPrefix+key).Int()
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func (r *RedisStore) RetryAfter(key string, limit int, window time.Duration) time.Duration {
+	if r.Count(key, window) < limit {
+		return 0
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	d, err := r.client.PTTL(ctx, redisKeyPrefix+key).Result()
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (r *RedisStore) Reset(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := r.client.Del(ctx, redisKeyPrefix+key).Err(); err != nil && !errors.Is(err, redis.Nil) {
+		r.logger.Warn("redis rate limit reset failed", "error", err)
+	}
+}
+
+// Close closes the connection pool.
+func (r *RedisStore) Close() error {
+	return r.client.Close()
+}
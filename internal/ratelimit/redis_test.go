@@ -0,0 +1,228 @@
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis speaks just enough RESP2 for RedisStore. Commands it does not
+// know, such as HELLO, get an error, and the client falls back to AUTH.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{ln: ln, password: password, values: map[string]int64{}, expires: map[string]time.Time{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		args[0] = strings.ToUpper(args[0])
+		if !authed && args[0] != "AUTH" {
+			io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		if args[0] == "AUTH" {
+			if args[len(args)-1] != f.password {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+		}
+		io.WriteString(conn, f.exec(args))
+	}
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(args) > 1 {
+		if exp, ok := f.expires[args[1]]; ok && time.Now().After(exp) {
+			delete(f.values, args[1])
+			delete(f.expires, args[1])
+		}
+	}
+	switch args[0] {
+	case "PING", "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "INCR":
+		f.values[args[1]]++
+		return fmt.Sprintf(":%d\r\n", f.values[args[1]])
+	case "PEXPIRE":
+		if _, ok := f.expires[args[1]]; ok && len(args) > 3 && args[3] == "NX" {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		s := strconv.FormatInt(v, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	case "PTTL":
+		exp, ok := f.expires[args[1]]
+		if !ok {
+			return ":-2\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(exp).Milliseconds())
+	case "DEL":
+		delete(f.values, args[1])
+		delete(f.expires, args[1])
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if _, err := rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+	store, err := NewRedisStore("redis://:s3cret@"+f.ln.Addr().String()+"/2", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	login := NewWithStore(store, "login", 2, time.Minute)
+	ws := NewWithStore(store, "ws", 1, 50*time.Millisecond)
+	ip := "192.0.2.1"
+	if !login.Allow(ip) || !login.Allow(ip) {
+		t.Fatal("requests within the limit were denied")
+	}
+	if login.Allow(ip) {
+		t.Error("third request was allowed")
+	}
+	if n := login.Count(ip); n != 3 {
+		t.Errorf("count = %d, want 3", n)
+	}
+	if d := login.RetryAfter(ip); d <= 59*time.Second || d > time.Minute {
+		t.Errorf("RetryAfter = %v, want just under 1m", d)
+	}
+
+	// Limiters sharing the store keep separate counts.
+	if !ws.Allow(ip) {
+		t.Error("another limiter's count leaked into ws")
+	}
+	if ws.Allow(ip) {
+		t.Error("second ws request within the window was allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !ws.Allow(ip) {
+		t.Error("ws request after the window expired was denied")
+	}
+
+	login.Reset(ip)
+	if !login.Allow(ip) {
+		t.Error("request after reset was denied")
+	}
+	if n := login.Count("198.51.100.1"); n != 0 {
+		t.Errorf("unknown key count = %d", n)
+	}
+}
+
+func TestRedisStoreWindowStartsAtFirstRequest(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store, err := NewRedisStore("redis://"+f.ln.Addr().String(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// A denied request must not push the window's expiry back, or a client
+	// that keeps trying would stay limited forever.
+	l := NewWithStore(store, "login", 1, 100*time.Millisecond)
+	l.Allow("a")
+	time.Sleep(60 * time.Millisecond)
+	if l.Allow("a") {
+		t.Fatal("second request within the window was allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !l.Allow("a") {
+		t.Error("request after the first window ended was denied")
+	}
+}
+
+func TestRedisStoreFailsOpen(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store, err := NewRedisStore("redis://"+f.ln.Addr().String(), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewWithStore(store, "login", 1, time.Minute)
+	l.Allow("a")
+
+	f.ln.Close()
+	store.Close()
+	if !l.Allow("a") {
+		t.Error("request denied while Redis is unreachable")
+	}
+}
+
+func TestNewRedisStoreErrors(t *testing.T) {
+	f := newFakeRedis(t, "right")
+	for _, u := range []string{
+		"http://" + f.ln.Addr().String(),
+		"redis://" + f.ln.Addr().String() + "/db",
+		"redis://:wrong@" + f.ln.Addr().String(),
+	} {
+		if _, err := NewRedisStore(u, nil); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps request counts for limiters. Allow records a request for key
+// and reports whether it is within limit requests per window.
+type Store interface {
+	Allow(key string, limit int, window time.Duration) bool
+	Reset(key string)
+}
+
+// Inspector is implemented by stores that can report a key's state without
+// recording a request, for logs and Retry-After headers.
+type Inspector interface {
+	Count(key string, window time.Duration) int
+	RetryAfter(key string, limit int, window time.Duration) time.Duration
+}
+
+// MemoryStore is a sliding-window Store local to this process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+type entry struct {
+	timestamps []time.Time
+	window     time.Duration
+}
+
+func NewMemoryStore() *MemoryStore {
+	m := &MemoryStore{entries: make(map[string]*entry)}
+	go m.cleanup()
+	return m
+}
+
+func (m *MemoryStore) cleanup() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		now := time.Now()
+		for k, e := range m.entries {
+			e.timestamps = filterRecent(e.timestamps, now, e.window)
+			if len(e.timestamps) == 0 {
+				delete(m.entries, k)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *MemoryStore) Allow(key string, limit int, window time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e, ok := m.entries[key]
+	if !ok {
+		e = &entry{}
+		m.entries[key] = e
+	}
+	e.window = window
+	e.timestamps = filterRecent(e.timestamps, now, window)
+	if len(e.timestamps) >= limit {
+		return false
+	}
+	e.timestamps = append(e.timestamps, now)
+	return true
+}
+
+func (m *MemoryStore) Count(key string, window time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return 0
+	}
+	e.timestamps = filterRecent(e.timestamps, time.Now(), window)
+	return len(e.timestamps)
+}
+
+func (m *MemoryStore) RetryAfter(key string, limit int, window time.Duration) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[key]
+	if !ok {
+		return 0
+	}
+	now := time.Now()
+	e.timestamps = filterRecent(e.timestamps, now, window)
+	if len(e.timestamps) < limit {
+		return 0
+	}
+	return e.timestamps[len(e.timestamps)-limit].Add(window).Sub(now)
+}
+
+func (m *MemoryStore) Reset(key string) {
+	m.mu.Lock()
+	delete(m.entries, key)
+	m.mu.Unlock()
+}
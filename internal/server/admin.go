@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/vextm/vexshare/internal/auth"
+	"github.com/vextm/vexshare/internal/session"
+)
+
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	if s.cfg.AdminToken == "" {
+		return
+	}
+	admin := auth.BearerTokenMiddleware(s.cfg.AdminToken, s.logger)
+	mux.Handle("GET /admin/stats", admin(http.HandlerFunc(s.handleAdminStats)))
+	mux.Handle("GET /admin/metrics", admin(http.HandlerFunc(s.handleAdminMetrics)))
+	mux.Handle("DELETE /admin/logins/{id}", admin(http.HandlerFunc(s.handleAdminExpireSession)))
+	mux.Handle("GET /admin/sessions", admin(http.HandlerFunc(s.handleAdminListSessions)))
+	mux.Handle("POST /admin/sessions", admin(http.HandlerFunc(s.handleAdminCreateSession)))
+	// DELETE /admin/sessions/{id} expired login sessions before named
+	// sessions shared the path, and still does for an id that names none.
+	mux.Handle("DELETE /admin/sessions/{name}", admin(http.HandlerFunc(s.handleAdminDeleteSession)))
+	mux.Handle("GET /admin/clients", admin(http.HandlerFunc(s.handleAdminListClients)))
+	mux.Handle("DELETE /admin/clients/{id}", admin(http.HandlerFunc(s.handleAdminKickClient)))
+	mux.Handle("GET /admin/connections-by-ip", admin(http.HandlerFunc(s.handleAdminConnectionsByIP)))
+	mux.Handle("GET /admin/bans", admin(http.HandlerFunc(s.handleAdminListBans)))
+	mux.Handle("POST /admin/ban", admin(http.HandlerFunc(s.handleAdminBan)))
+	mux.Handle("DELETE /admin/ban/{ip}", admin(http.HandlerFunc(s.handleAdminUnban)))
+	mux.Handle("GET /admin/timeline", admin(http.HandlerFunc(s.handleAdminTimeline)))
+	if s.cfg.ShortURLBase != "" {
+		mux.Handle("GET /admin/shorten", admin(http.HandlerFunc(s.handleAdminShorten)))
+	}
+	// The page itself holds no data; its API calls carry the token.
+	mux.HandleFunc("GET /admin/{$}", s.handleAdminPage)
+}
+
+type adminStatsResponse struct {
+	LoginSessions int        `json:"loginSessions"`
+	Clients       int        `json:"clients"`
+	Running       bool       `json:"running"`
+	Connections   *ConnStats `json:"connections,omitempty"`
+	// OutputBytesPerSecond is the default session's PTY output rate,
+	// averaged over 5 seconds.
+	OutputBytesPerSecond int64 `json:"outputBytesPerSecond"`
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	resp := adminStatsResponse{LoginSessions: s.sessions.Len()}
+	if s.conns != nil {
+		stats := s.conns.stats()
+		resp.Connections = &stats
+	}
+	if sess := s.currentSession(); sess != nil {
+		resp.Clients = sess.ClientCount()
+		resp.OutputBytesPerSecond = sess.OutputRate()
+		select {
+		case <-sess.Done():
+		default:
+			resp.Running = true
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// handleAdminMetrics serves the output rate of every running session in
+// the Prometheus text format, for scraping with the admin token as a
+// bearer token. The default session has an empty session label. With a
+// connection guard, its counters follow as vexshare_connections_*.
+func (s *Server) handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	live := s.liveSessions()
+	names := make([]string, 0, len(live))
+	for name := range live {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, "# HELP vexshare_pty_output_bytes_per_second PTY output sent to clients, averaged over 5 seconds.")
+	fmt.Fprintln(w, "# TYPE vexshare_pty_output_bytes_per_second gauge")
+	for _, name := range names {
+		fmt.Fprintf(w, "vexshare_pty_output_bytes_per_second{session=%q} %d\n", name, live[name].OutputRate())
+	}
+	if s.conns == nil {
+		return
+	}
+	stats := s.conns.stats()
+	for _, m := range []struct {
+		name, typ, help string
+		value           int64
+	}{
+		{"vexshare_connections_open", "gauge", "TCP connections open now.", int64(stats.Open)},
+		{"vexshare_connections_refused_total", "counter", "TCP connections closed on accept for a connection limit or a ban.", stats.Refused},
+		{"vexshare_connections_slow_timeouts_total", "counter", "TCP connections that timed out before sending a whole request.", stats.Timeouts},
+		{"vexshare_connections_slow_client_bans_total", "counter", "Peers banned for timing out too often.", stats.Bans},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.typ, m.name, m.value)
+	}
+}
+
+func (s *Server) handleAdminExpireSession(w http.ResponseWriter, r *http.Request) {
+	if !s.sessions.Expire(r.PathValue("id")) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	s.logger.InfoContext(r.Context(), "login session expired by admin", "ip", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminClientInfo struct {
+	session.ClientInfo
+	// Session is the named session the client is in, or "" for the
+	// default one.
+	Session string `json:"session"`
+}
+
+// liveSessions returns the default session under the name "" and every
+// running named session.
+func (s *Server) liveSessions() map[string]*session.Session {
+	all := make(map[string]*session.Session)
+	if sess := s.currentSession(); sess != nil {
+		all[""] = sess
+	}
+	s.namedMu.Lock()
+	for name, ns := range s.named {
+		if ns.closedAt.IsZero() {
+			all[name] = ns.sess
+		}
+	}
+	s.namedMu.Unlock()
+	return all
+}
+
+func (s *Server) handleAdminListClients(w http.ResponseWriter, r *http.Request) {
+	list := []adminClientInfo{}
+	for name, sess := range s.liveSessions() {
+		for _, c := range sess.Clients() {
+			list = append(list, adminClientInfo{ClientInfo: c, Session: name})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Session != list[j].Session {
+			return list[i].Session < list[j].Session
+		}
+		return list[i].ID < list[j].ID
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+func (s *Server) handleAdminKickClient(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	for _, sess := range s.liveSessions() {
+		if sess.Kick(id) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.Error(w, "Not Found", http.StatusNotFound)
+}
+
+// wsConnsPerIP counts the open WebSocket connections in every session by
+// the IP they came from. Clients held for a reconnect are not counted.
+func (s *Server) wsConnsPerIP() map[string]int {
+	counts := make(map[string]int)
+	for _, sess := range s.liveSessions() {
+		for _, c := range sess.Clients() {
+			if !c.Reconnecting {
+				counts[c.IP]++
+			}
+		}
+	}
+	return counts
+}
+
+func (s *Server) handleAdminConnectionsByIP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(s.wsConnsPerIP())
+}
+
+// handleAdminTimeline returns the timeline of the session named by
+// ?session=, or of the default session when it is empty.
+func (s *Server) handleAdminTimeline(w http.ResponseWriter, r *http.Request) {
+	sess := s.liveSessions()[r.URL.Query().Get("session")]
+	if sess == nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(append([]session.TimelineEvent{}, sess.Timeline()...))
+}
+
+func (s *Server) handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	s.servePage(w, r, "admin.html")
+}
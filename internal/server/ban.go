@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/vextm/vexshare/internal/ratelimit"
+)
+
+type banRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+}
+
+type banInfo struct {
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// banned reports whether ip is banned now, and forgets an expired ban.
+func (s *Server) banned(ip string) bool {
+	v, ok := s.bans.Load(ip)
+	if !ok {
+		return false
+	}
+	if time.Now().Before(v.(time.Time)) {
+		return true
+	}
+	s.bans.CompareAndDelete(ip, v)
+	return false
+}
+
+// ipBanMiddleware refuses banned IPs. It runs before rate limiting and
+// authentication, so banned requests are not counted against anything.
+func (s *Server) ipBanMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip := s.clientIP(r); s.banned(ip) {
+			s.logger.WarnContext(r.Context(), "client IP refused", "reason", "banned", "ip", ip, "route", r.Method+" "+ratelimit.RedactPath(r.URL.Path))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAdminBan(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	addr, ok := ratelimit.ParseIP(req.IP)
+	if !ok {
+		http.Error(w, "ip must be an IPv4 or IPv6 address", http.StatusBadRequest)
+		return
+	}
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		http.Error(w, "duration must be a positive Go duration such as 1h", http.StatusBadRequest)
+		return
+	}
+	ban := banInfo{IP: addr.String(), ExpiresAt: time.Now().Add(d).UTC()}
+	s.bans.Store(ban.IP, ban.ExpiresAt)
+
+	// Connections already open from the IP are closed too.
+	kicked := 0
+	for _, sess := range s.liveSessions() {
+		for _, c := range sess.Clients() {
+			if c.IP == ban.IP && sess.Kick(c.ID) {
+				kicked++
+			}
+		}
+	}
+	s.logger.InfoContext(r.Context(), "IP banned by admin", "ip", ban.IP, "duration", d, "kicked", kicked)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(ban)
+}
+
+func (s *Server) handleAdminUnban(w http.ResponseWriter, r *http.Request) {
+	ip := ratelimit.CanonicalIP(r.PathValue("ip"))
+	if !s.banned(ip) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	s.bans.Delete(ip)
+	s.logger.InfoContext(r.Context(), "IP ban lifted by admin", "ip", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminListBans(w http.ResponseWriter, r *http.Request) {
+	list := []banInfo{}
+	now := time.Now()
+	s.bans.Range(func(k, v any) bool {
+		if expires := v.(time.Time); now.Before(expires) {
+			list = append(list, banInfo{IP: k.(string), ExpiresAt: expires})
+		} else {
+			s.bans.CompareAndDelete(k, v)
+		}
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(list)
+}
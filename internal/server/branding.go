@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// DefaultTitle names the product in the login and terminal pages unless
+// Config.Title replaces it.
+const DefaultTitle = "vexShare"
+
+// maxTitleRunes caps the title so a long one cannot push the toolbar
+// buttons off the page.
+const maxTitleRunes = 64
+
+// Placeholders in the login and terminal pages for the branding. They are
+// filled in one pass, so a title that contains a placeholder stays text.
+const (
+	titlePlaceholder = "{{VEXSHARE_TITLE}}"
+	logoPlaceholder  = "{{VEXSHARE_LOGO}}"
+)
+
+// brandTitle returns the configured title without control characters and
+// cut to maxTitleRunes, or DefaultTitle if nothing is left.
+func (s *Server) brandTitle() string {
+	title := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s.cfg.Title)
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return DefaultTitle
+	}
+	if r := []rune(title); len(r) > maxTitleRunes {
+		title = strings.TrimSpace(string(r[:maxTitleRunes]))
+	}
+	return title
+}
+
+// checkLogoURL accepts an http or https URL, or a path on this host. Other
+// schemes, such as javascript: or data:, are refused.
+func checkLogoURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("logo URL: %w", err)
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		if u.Host == "" {
+			return fmt.Errorf("logo URL %q has no host", raw)
+		}
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/"):
+	default:
+		return fmt.Errorf("logo URL %q must be http, https or a path starting with /", raw)
+	}
+	return nil
+}
+
+// brandPage fills in the title and logo. Without a logo, the logo slot gets
+// fallback, which is already HTML.
+func (s *Server) brandPage(page []byte, fallback string) []byte {
+	logo := fallback
+	if s.cfg.LogoURL != "" && checkLogoURL(s.cfg.LogoURL) == nil {
+		logo = `<img class="brand-logo" src="` + html.EscapeString(s.cfg.LogoURL) + `" alt="">`
+	}
+	r := strings.NewReplacer(
+		titlePlaceholder, html.EscapeString(s.brandTitle()),
+		logoPlaceholder, logo,
+	)
+	return []byte(r.Replace(string(page)))
+}
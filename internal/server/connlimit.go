@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vextm/vexshare/internal/ipfilter"
+	"github.com/vextm/vexshare/internal/ratelimit"
+)
+
+// connGuard tracks the connections a listener has open, below HTTP, and
+// closes those over its caps as soon as they are accepted. It keys them by
+// TCP peer, so peers in TrustedProxies, which carry many clients, are
+// exempt from the per-IP cap.
+type connGuard struct {
+	maxTotal int
+	maxPerIP int
+	exempt   ipfilter.List
+	// slowRL counts read timeouts per peer, and ban is called for a peer
+	// over its limit; both are nil without SlowClientLimit.
+	slowRL *ratelimit.Limiter
+	ban    func(ip string)
+	// banned reports whether a peer is banned now.
+	banned func(ip string) bool
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+
+	refused  atomic.Int64
+	timeouts atomic.Int64
+	bans     atomic.Int64
+}
+
+// ConnStats are the connection guard's counters, for /admin/stats.
+type ConnStats struct {
+	Open     int   `json:"open"`
+	Refused  int64 `json:"refused"`
+	Timeouts int64 `json:"slowTimeouts"`
+	Bans     int64 `json:"slowClientBans"`
+}
+
+func (g *connGuard) stats() ConnStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return ConnStats{Open: g.total, Refused: g.refused.Load(), Timeouts: g.timeouts.Load(), Bans: g.bans.Load()}
+}
+
+// admit takes a slot for a connection from ip, or returns why it cannot.
+func (g *connGuard) admit(ip string) string {
+	if g.banned != nil && g.banned(ip) {
+		return "banned"
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.maxTotal > 0 && g.total >= g.maxTotal {
+		return "connection limit"
+	}
+	if g.maxPerIP > 0 && !g.exempt.Contains(ip) && g.perIP[ip] >= g.maxPerIP {
+		return "per-IP connection limit"
+	}
+	g.total++
+	g.perIP[ip]++
+	return ""
+}
+
+func (g *connGuard) release(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.total--
+	if g.perIP[ip]--; g.perIP[ip] <= 0 {
+		delete(g.perIP, ip)
+	}
+}
+
+// timedOut notes that a connection from ip timed out before its first
+// request was served, and bans ip once that happens too often.
+func (g *connGuard) timedOut(ip string) {
+	g.timeouts.Add(1)
+	if g.slowRL == nil || g.exempt.Contains(ip) || g.slowRL.Allow(ip) {
+		return
+	}
+	g.bans.Add(1)
+	g.slowRL.Reset(ip)
+	g.ban(ip)
+}
+
+// connState marks connections that got a request through, so that an idle
+// keep-alive connection timing out is not taken for a slow client. It is
+// the http.Server's ConnState hook.
+func (g *connGuard) connState(c net.Conn, state http.ConnState) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if gc, ok := c.(*guardedConn); ok && (state == http.StateIdle || state == http.StateHijacked) {
+		gc.served.Store(true)
+	}
+}
+
+// guardedListener applies a connGuard to the connections it accepts.
+type guardedListener struct {
+	net.Listener
+	g *connGuard
+}
+
+func (l *guardedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := ratelimit.CanonicalIP(c.RemoteAddr().String())
+		if reason := l.g.admit(ip); reason != "" {
+			l.g.refused.Add(1)
+			l.g.logger.Debug("connection refused", "reason", reason, "ip", ip)
+			c.Close()
+			continue
+		}
+		return &guardedConn{Conn: c, g: l.g, ip: ip}, nil
+	}
+}
+
+type guardedConn struct {
+	net.Conn
+	g      *connGuard
+	ip     string
+	served atomic.Bool
+	// flagged is set once a timeout has been counted for the connection.
+	flagged   atomic.Bool
+	closeOnce sync.Once
+}
+
+func (c *guardedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && !c.served.Load() && c.flagged.CompareAndSwap(false, true) {
+		c.g.timedOut(c.ip)
+	}
+	return n, err
+}
+
+func (c *guardedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { c.g.release(c.ip) })
+	return err
+}
+
+// newConnGuard returns the guard for cfg, or nil if it sets no limits.
+func (s *Server) newConnGuard() *connGuard {
+	cfg := s.cfg
+	if cfg.MaxConnections <= 0 && cfg.MaxConnectionsPerIP <= 0 && cfg.SlowClientLimit <= 0 {
+		return nil
+	}
+	g := &connGuard{
+		maxTotal: cfg.MaxConnections,
+		maxPerIP: cfg.MaxConnectionsPerIP,
+		exempt:   cfg.TrustedProxies,
+		banned:   s.banned,
+		logger:   s.logger,
+		perIP:    make(map[string]int),
+	}
+	if cfg.SlowClientLimit > 0 {
+		banFor := cfg.SlowClientBan
+		if banFor <= 0 {
+			banFor = 10 * time.Minute
+		}
+		g.slowRL = ratelimit.New(cfg.SlowClientLimit, 10*time.Minute)
+		g.ban = func(ip string) {
+			s.logger.Warn("banning slow client", "ip", ip, "duration", banFor)
+			s.bans.Store(ip, time.Now().Add(banFor).UTC())
+		}
+	}
+	return g
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vextm/vexshare/internal/ipfilter"
+	"github.com/vextm/vexshare/internal/ratelimit"
+)
+
+// fakeConn is a connection from addr whose reads time out.
+type fakeConn struct {
+	net.Conn
+	addr   net.Addr
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *fakeConn) Read([]byte) (int, error) { return 0, os.ErrDeadlineExceeded }
+
+func (c *fakeConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// fakeListener hands out the connections sent on conns, and a guarded
+// listener on top of it passes what it accepts on to accepted.
+type fakeListener struct {
+	net.Listener
+	conns    chan net.Conn
+	accepted chan net.Conn
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, errors.New("closed")
+	}
+	return c, nil
+}
+
+func newFakeConn(ip string) *fakeConn {
+	return &fakeConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+// dial offers c to the guarded listener and returns what it accepted, or
+// nil if c was refused and closed.
+func (l *fakeListener) dial(t *testing.T, c *fakeConn) net.Conn {
+	t.Helper()
+	l.conns <- c
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case ac := <-l.accepted:
+			return ac
+		case <-deadline:
+			t.Fatal("connection neither accepted nor refused")
+		case <-time.After(time.Millisecond):
+			if c.isClosed() {
+				return nil
+			}
+		}
+	}
+}
+
+func newTestGuard(t *testing.T, g *connGuard) (*fakeListener, *guardedListener) {
+	g.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	g.perIP = make(map[string]int)
+	fl := &fakeListener{conns: make(chan net.Conn), accepted: make(chan net.Conn)}
+	gl := &guardedListener{Listener: fl, g: g}
+	go func() {
+		for {
+			c, err := gl.Accept()
+			if err != nil {
+				return
+			}
+			fl.accepted <- c
+		}
+	}()
+	t.Cleanup(func() { close(fl.conns) })
+	return fl, gl
+}
+
+func TestConnGuardCaps(t *testing.T) {
+	proxy, _ := ipfilter.Parse("10.0.0.5")
+	fl, gl := newTestGuard(t, &connGuard{maxTotal: 4, maxPerIP: 2, exempt: proxy})
+
+	a1 := fl.dial(t, newFakeConn("203.0.113.1"))
+	a2 := fl.dial(t, newFakeConn("203.0.113.1"))
+	refused := newFakeConn("203.0.113.1")
+	if a1 == nil || a2 == nil || fl.dial(t, refused) != nil {
+		t.Fatal("per-IP cap of 2 not enforced")
+	}
+	if !refused.isClosed() {
+		t.Error("refused connection left open")
+	}
+	// Closing one frees a slot for that IP, twice over if closed twice.
+	a1.Close()
+	a1.Close()
+	if fl.dial(t, newFakeConn("203.0.113.1")) == nil {
+		t.Error("slot not released on close")
+	}
+	if fl.dial(t, newFakeConn("203.0.113.1")) != nil {
+		t.Error("double close released two slots")
+	}
+
+	// The trusted proxy is only held to the total.
+	if fl.dial(t, newFakeConn("10.0.0.5")) == nil || fl.dial(t, newFakeConn("10.0.0.5")) == nil {
+		t.Fatal("trusted proxy limited per IP")
+	}
+	if fl.dial(t, newFakeConn("10.0.0.5")) != nil {
+		t.Error("total cap of 4 not enforced")
+	}
+	if st := gl.g.stats(); st.Open != 4 || st.Refused != 3 {
+		t.Errorf("stats = %+v, want 4 open and 3 refused", st)
+	}
+}
+
+func TestConnGuardBansSlowClients(t *testing.T) {
+	var bans sync.Map
+	banned := func(ip string) bool { _, ok := bans.Load(ip); return ok }
+	fl, gl := newTestGuard(t, &connGuard{
+		slowRL: ratelimit.New(2, time.Minute),
+		ban:    func(ip string) { bans.Store(ip, true) },
+		banned: banned,
+	})
+	buf := make([]byte, 1)
+
+	// A connection that served a request may time out while idle.
+	idle := fl.dial(t, newFakeConn("203.0.113.7"))
+	gl.g.connState(idle, http.StateIdle)
+	for i := 0; i < 5; i++ {
+		_, _ = idle.Read(buf)
+	}
+	if gl.g.stats().Timeouts != 0 {
+		t.Fatal("idle keep-alive timeout counted")
+	}
+
+	// Each slow connection counts once, however often it is read.
+	for i := 0; i < 3; i++ {
+		c := fl.dial(t, newFakeConn("203.0.113.9"))
+		if c == nil {
+			t.Fatalf("connection %d refused before the ban", i+1)
+		}
+		_, _ = c.Read(buf)
+		_, _ = c.Read(buf)
+		c.Close()
+	}
+	if !banned("203.0.113.9") || banned("203.0.113.7") {
+		t.Fatal("slow client not banned after 3 timeouts")
+	}
+	if fl.dial(t, newFakeConn("203.0.113.9")) != nil {
+		t.Error("banned client accepted")
+	}
+	if st := gl.g.stats(); st.Timeouts != 3 || st.Bans != 1 {
+		t.Errorf("stats = %+v, want 3 timeouts and 1 ban", st)
+	}
+}
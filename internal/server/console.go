@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const consoleHelp = `console commands:
+  !message   show message to every connected client
+  >text      type text into the session, followed by Enter
+  ?          show this help`
+
+// RunConsole reads operator commands line by line from r until EOF. Replies
+// and errors are written to out.
+func (s *Server) RunConsole(r io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s.consoleCommand(scanner.Text(), out)
+	}
+	if err := scanner.Err(); err != nil {
+		s.logger.Warn("console input closed", "error", err)
+	}
+}
+
+func (s *Server) consoleCommand(line string, out io.Writer) {
+	line = strings.TrimRight(line, "\r")
+	if line == "" {
+		return
+	}
+	switch line[0] {
+	case '?':
+		fmt.Fprintln(out, consoleHelp)
+		return
+	case '!', '>':
+	default:
+		fmt.Fprintln(out, "unknown console command, type ? for help")
+		return
+	}
+
+	sess := s.currentSession()
+	if sess == nil {
+		fmt.Fprintln(out, "no session is running")
+		return
+	}
+	text := line[1:]
+	if line[0] == '!' {
+		sess.Notify(strings.TrimSpace(text))
+		s.logger.Info("console notice sent", "text", text)
+		return
+	}
+	if err := sess.Inject([]byte(text + "\r")); err != nil {
+		fmt.Fprintf(out, "inject failed: %v\n", err)
+		return
+	}
+	s.logger.Info("console input injected", "bytes", len(text)+1)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Features selects the optional parts of the web UI. A disabled feature's
+// API routes are not registered at all, so turning it off removes the
+// endpoint and not just the button.
+type Features struct {
+	// Status serves /api/status, which the page header uses to show the
+	// command and its uptime.
+	Status bool `json:"status"`
+	// History serves /api/history, the full output download.
+	History bool `json:"history"`
+}
+
+// FullFeatures enables everything; it is what a nil Config.Features means.
+func FullFeatures() Features {
+	return Features{Status: true, History: true}
+}
+
+// MinimalFeatures serves only the terminal page and its WebSocket.
+func MinimalFeatures() Features {
+	return Features{}
+}
+
+// ParseUI maps the --ui flag to a feature set.
+func ParseUI(name string) (Features, error) {
+	switch name {
+	case "full":
+		return FullFeatures(), nil
+	case "minimal":
+		return MinimalFeatures(), nil
+	}
+	return Features{}, fmt.Errorf("unknown UI %q (use full or minimal)", name)
+}
+
+func (s *Server) features() Features {
+	if s.cfg.Features == nil {
+		return FullFeatures()
+	}
+	return *s.cfg.Features
+}
+
+// uiConfigPlaceholder marks where the terminal page expects its JSON
+// config.
+var uiConfigPlaceholder = []byte("{{VEXSHARE_CONFIG}}")
+
+// injectUIConfig fills in the page's config blob. json.Marshal escapes <
+// and >, so the result is safe inside a script element.
+func (s *Server) injectUIConfig(page []byte) []byte {
+	blob, _ := json.Marshal(struct {
+		Features Features `json:"features"`
+	}{s.features()})
+	return bytes.Replace(page, uiConfigPlaceholder, blob, 1)
+}
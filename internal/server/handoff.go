@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/vextm/vexshare/internal/auth"
+	"github.com/vextm/vexshare/internal/session"
+)
+
+// handoffEnv names the inherited descriptors, as
+// "listener=N,pty=N,state=N", for the new binary.
+const handoffEnv = "VEXSHARE_HANDOFF"
+
+// ErrHandoffAborted is returned when a handoff fails after the server has
+// stopped serving. The session has been closed and the caller should exit.
+var ErrHandoffAborted = errors.New("handoff failed after the server stopped serving")
+
+// Handoff is what a vexShare process inherits from the one it replaced.
+type Handoff struct {
+	Listener net.Listener
+	// Session is nil if the old process had not started one.
+	Session *session.Inherited
+	Logins  []auth.SavedSession
+	// Password and Token are the credentials the old process used, which
+	// it may have generated itself.
+	Password string
+	Token    string
+}
+
+// handoffState is passed to the new binary in a file.
+type handoffState struct {
+	Session  *session.HandoffState `json:"session,omitempty"`
+	Logins   []auth.SavedSession   `json:"logins,omitempty"`
+	Password string                `json:"password,omitempty"`
+	Token    string                `json:"token,omitempty"`
+}
+
+// checkHandoff reports why the server cannot hand off, if it cannot.
+func (s *Server) checkHandoff() error {
+	if _, ok := s.listener().(*net.TCPListener); !ok {
+		return errors.New("the server is not listening on TCP")
+	}
+	sessions := s.liveSessions()
+	delete(sessions, "")
+	if len(sessions) > 0 {
+		return errors.New("named sessions are running; only the default session can be handed off")
+	}
+	if sess := s.currentSession(); sess != nil {
+		if err := sess.CanDetach(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vextm/vexshare/internal/session"
+)
+
+// Handoff replaces this process with the binary at its own path, passing it
+// the listening socket, the default session's command and the login
+// sessions, so the binary can be upgraded without restarting the command.
+// WebSockets are closed with code 1012 so that browsers reconnect, and new
+// connections wait on the socket. On success it does not return. An error
+// wrapping ErrHandoffAborted means the server had already stopped serving;
+// any other error means nothing happened and the server carries on.
+func (s *Server) Handoff(ctx context.Context) error {
+	if err := s.checkHandoff(); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find own binary: %w", err)
+	}
+	if _, err := os.Stat(exe); err != nil {
+		return fmt.Errorf("find own binary: %w", err)
+	}
+	lnFile, err := s.listener().(*net.TCPListener).File()
+	if err != nil {
+		return fmt.Errorf("duplicate listener: %w", err)
+	}
+	defer lnFile.Close()
+
+	s.logger.Info("handing off to new binary", "path", exe)
+	// Connections arriving from here on wait in the socket's backlog.
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.logger.Warn("handoff: requests still running", "error", err)
+	}
+	sess := s.currentSession()
+	abort := func(err error) error {
+		if sess != nil {
+			sess.Close()
+		}
+		return fmt.Errorf("%w: %w", ErrHandoffAborted, err)
+	}
+
+	state := handoffState{
+		Logins:   s.sessions.Export(),
+		Password: s.cfg.AuthConfig.Password,
+		Token:    s.cfg.AuthConfig.Token,
+	}
+	fds := []string{"listener=" + strconv.Itoa(int(lnFile.Fd()))}
+	if sess != nil {
+		ptmx, st, err := sess.Detach()
+		if err != nil {
+			return abort(err)
+		}
+		state.Session = &st
+		if err := clearCloseOnExec(ptmx); err != nil {
+			return abort(err)
+		}
+		fd, err := fileFd(ptmx)
+		if err != nil {
+			return abort(err)
+		}
+		fds = append(fds, "pty="+strconv.Itoa(fd))
+	}
+
+	stateFile, err := os.CreateTemp("", "vexshare-handoff-*")
+	if err != nil {
+		return abort(err)
+	}
+	defer stateFile.Close()
+	// The descriptor is all the new binary needs; nothing is left on disk.
+	_ = os.Remove(stateFile.Name())
+	if err := json.NewEncoder(stateFile).Encode(state); err != nil {
+		return abort(err)
+	}
+	if _, err := stateFile.Seek(0, 0); err != nil {
+		return abort(err)
+	}
+	fds = append(fds, "state="+strconv.Itoa(int(stateFile.Fd())))
+	for _, f := range []*os.File{lnFile, stateFile} {
+		if err := clearCloseOnExec(f); err != nil {
+			return abort(err)
+		}
+	}
+
+	env := []string{handoffEnv + "=" + strings.Join(fds, ",")}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, handoffEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	err = syscall.Exec(exe, os.Args, env)
+	return abort(fmt.Errorf("exec %s: %w", exe, err))
+}
+
+// InheritedHandoff returns what the process this one replaced handed over,
+// or nil if it was started normally.
+func InheritedHandoff() (*Handoff, error) {
+	v, ok := os.LookupEnv(handoffEnv)
+	if !ok {
+		return nil, nil
+	}
+	_ = os.Unsetenv(handoffEnv)
+	fds := make(map[string]int)
+	for _, field := range strings.Split(v, ",") {
+		name, n, _ := strings.Cut(field, "=")
+		fd, err := strconv.Atoi(n)
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid %s %q", handoffEnv, v)
+		}
+		// Keep them from leaking into the command or a later handoff.
+		syscall.CloseOnExec(fd)
+		fds[name] = fd
+	}
+	lnFd, ok1 := fds["listener"]
+	stateFd, ok2 := fds["state"]
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("invalid %s %q", handoffEnv, v)
+	}
+
+	stateFile := os.NewFile(uintptr(stateFd), "handoff-state")
+	var state handoffState
+	err := json.NewDecoder(stateFile).Decode(&state)
+	stateFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read handoff state: %w", err)
+	}
+
+	lnFile := os.NewFile(uintptr(lnFd), "listener")
+	ln, err := net.FileListener(lnFile)
+	lnFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("inherit listener: %w", err)
+	}
+	h := &Handoff{Listener: ln, Logins: state.Logins, Password: state.Password, Token: state.Token}
+
+	if state.Session != nil {
+		ptyFd, ok := fds["pty"]
+		if !ok {
+			ln.Close()
+			return nil, fmt.Errorf("invalid %s %q: no PTY for the session", handoffEnv, v)
+		}
+		// Non-blocking before os.NewFile, so that the PTY is pollable.
+		if err := syscall.SetNonblock(ptyFd, true); err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("inherit PTY: %w", err)
+		}
+		h.Session = &session.Inherited{PTY: os.NewFile(uintptr(ptyFd), "/dev/ptmx"), State: *state.Session}
+	}
+	return h, nil
+}
+
+// clearCloseOnExec lets f survive the exec. It goes through SyscallConn
+// because f.Fd would put a PTY back in blocking mode.
+func clearCloseOnExec(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_SETFD, 0)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func fileFd(f *os.File) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	if err := rc.Control(func(fd uintptr) { n = int(fd) }); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestHandoff runs the real binary, hands it off to itself with SIGUSR2 and
+// checks that the command survives and browsers can reconnect.
+func TestHandoff(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the binary")
+	}
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	bin := filepath.Join(t.TempDir(), "vexshare")
+	if out, err := exec.Command(goBin, "build", "-o", bin, "github.com/vextm/vexshare/cmd/vexshare").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+
+	const token = "handoff-test-token-0123456789"
+	cmd := exec.Command(bin, "--listen", "127.0.0.1:0", "--auth", "token", "--token", token, "--banner", "off", "--cmd", "cat")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Signal(syscall.SIGTERM)
+		_ = cmd.Wait()
+	})
+	events := make(chan listeningEvent, 2)
+	go func() {
+		sc := bufio.NewScanner(stdout)
+		for sc.Scan() {
+			var ev listeningEvent
+			if json.Unmarshal(sc.Bytes(), &ev) == nil && ev.Event == "listening" {
+				events <- ev
+			}
+		}
+	}()
+	waitListening := func() listeningEvent {
+		t.Helper()
+		select {
+		case ev := <-events:
+			return ev
+		case <-time.After(10 * time.Second):
+			t.Fatal("no listening event")
+			return listeningEvent{}
+		}
+	}
+	addr := waitListening().Addr
+	dial := func() *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/t/"+token+"/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	conn := dial()
+	readUntil(t, conn, "role")
+	sendInput(t, conn, "before\n")
+	readOutputUntil(t, conn, "before")
+	children := childPids(cmd.Process.Pid)
+
+	if err := cmd.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Fatalf("old connection: got %v, want close 1012", err)
+			}
+			break
+		}
+	}
+	if ev := waitListening(); ev.Addr != addr {
+		t.Fatalf("new binary listens on %s, want %s", ev.Addr, addr)
+	}
+
+	conn = dial()
+	readUntil(t, conn, "role")
+	sendInput(t, conn, "after\n")
+	readOutputUntil(t, conn, "after")
+	if after := childPids(cmd.Process.Pid); children != "" && after != children {
+		t.Errorf("command pids %q after handoff, want %q", after, children)
+	}
+}
+
+// childPids lists the children of pid, or "" if the kernel does not say.
+func childPids(pid int) string {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/task/" + strconv.Itoa(pid) + "/children")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+// Handoff is only supported on Linux.
+func (s *Server) Handoff(ctx context.Context) error {
+	return errors.New("handoff is only supported on Linux")
+}
+
+// InheritedHandoff always returns nil: only Linux hands off.
+func InheritedHandoff() (*Handoff, error) {
+	return nil, nil
+}
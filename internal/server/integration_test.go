@@ -0,0 +1,290 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/vextm/vexshare/client"
+	"github.com/vextm/vexshare/internal/auth"
+	"github.com/vextm/vexshare/internal/session"
+)
+
+// These tests run the whole stack: HTTP routing and auth, the WebSocket
+// protocol, and a real PTY running cat.
+
+func sendInput(t *testing.T, conn *websocket.Conn, input string) {
+	t.Helper()
+	if err := conn.WriteJSON(map[string]any{"type": "input", "data": input}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func roleOf(t *testing.T, msg testMessage) string {
+	t.Helper()
+	var role struct {
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(msg.Data, &role); err != nil {
+		t.Fatalf("decode role: %v", err)
+	}
+	return role.Role
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  auth.Config
+	}{
+		{"password", auth.Config{Mode: "password", Username: "vex", Password: "pw"}},
+		{"token", auth.Config{Mode: "token", Token: "tok-0123456789abcdef"}},
+		{"password+token via token URL", auth.Config{Mode: "password+token", Username: "vex", Password: "pw", Token: "tok-0123456789abcdef"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, Config{AuthConfig: tt.cfg})
+
+			var client *http.Client
+			page, wsPath := "/t/tok-0123456789abcdef/", "/t/tok-0123456789abcdef/ws"
+			if tt.cfg.Mode == "password" {
+				client = login(t, ts, "vex", "pw")
+				page, wsPath = "/", "/ws"
+			} else {
+				client = &http.Client{}
+			}
+
+			resp, err := client.Get(ts.URL + page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("GET %s: expected 200, got %d", page, resp.StatusCode)
+			}
+
+			conn := dialWS(t, ts, wsPath, client)
+			if role := roleOf(t, readUntil(t, conn, "role")); role != "controller" {
+				t.Errorf("first client role = %q, want controller", role)
+			}
+			sendInput(t, conn, "round trip\n")
+			readOutputUntil(t, conn, "round trip")
+		})
+	}
+}
+
+func TestRoundTripRejections(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:     auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		TrustedProxies: loopbackProxy,
+	})
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	t.Run("origin", func(t *testing.T) {
+		client := login(t, ts, "vex", "pw")
+		u, _ := url.Parse(ts.URL)
+		header := http.Header{"Origin": {"http://evil.example"}}
+		for _, c := range client.Jar.Cookies(u) {
+			header.Add("Cookie", c.String())
+		}
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+"/ws", header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("cross-origin upgrade: expected 403, got %v", err)
+		}
+	})
+
+	t.Run("no session", func(t *testing.T) {
+		_, resp, err := websocket.DefaultDialer.Dial(wsURL+"/ws", nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusSeeOther {
+			t.Fatalf("unauthenticated upgrade: expected redirect to login, got %v", err)
+		}
+	})
+
+	t.Run("login rate limit", func(t *testing.T) {
+		var last int
+		for i := 0; i < 6; i++ {
+			form := url.Values{"username": {"vex"}, "password": {"wrong"}}
+			req, _ := http.NewRequest("POST", ts.URL+"/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("X-Forwarded-For", "198.51.100.7")
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			last = resp.StatusCode
+		}
+		if last != http.StatusTooManyRequests {
+			t.Errorf("sixth failed login: expected 429, got %d", last)
+		}
+	})
+}
+
+func TestControllerPromotion(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	first := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	if role := roleOf(t, readUntil(t, first, "role")); role != "controller" {
+		t.Fatalf("first client role = %q", role)
+	}
+	second := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	if role := roleOf(t, readUntil(t, second, "role")); role != "viewer" {
+		t.Fatalf("second client role = %q", role)
+	}
+
+	// The viewer sees the controller's input but cannot type.
+	sendInput(t, second, "from viewer\n")
+	sendInput(t, first, "from controller\n")
+	if out := readOutputUntil(t, second, "from controller"); strings.Contains(out, "from viewer") {
+		t.Errorf("viewer input reached the PTY: %q", out)
+	}
+
+	first.Close()
+	if role := roleOf(t, readUntil(t, second, "role")); role != "controller" {
+		t.Fatalf("after the controller left, role = %q", role)
+	}
+	sendInput(t, second, "promoted\n")
+	readOutputUntil(t, second, "promoted")
+}
+
+func TestShutdownNotifiesClients(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	readUntil(t, conn, "summary")
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure || closeErr.Text != "session closed" {
+		t.Errorf("expected a normal close with reason, got %v", err)
+	}
+}
+
+// TestClientPackage drives the server through the public client package,
+// the way a bot would.
+func TestClientPackage(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  auth.Config
+		opts client.Options
+	}{
+		{"password", auth.Config{Mode: "password", Username: "vex", Password: "pw"}, client.Options{Username: "vex", Password: "pw"}},
+		{"token", auth.Config{Mode: "token", Token: "tok-0123456789abcdef"}, client.Options{Token: "tok-0123456789abcdef"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ts := newTestServer(t, Config{AuthConfig: tt.cfg})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			bot, err := client.Dial(ctx, ts.URL, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer bot.Close()
+			if role := bot.Role(); role.Role != "controller" {
+				t.Fatalf("role = %+v, want controller", role)
+			}
+
+			viewer, err := client.Dial(ctx, ts.URL, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer viewer.Close()
+			if role := viewer.Role(); role.Role != "viewer" {
+				t.Errorf("second client role = %+v, want viewer", role)
+			}
+
+			if err := bot.Resize(100, 30); err != nil {
+				t.Fatal(err)
+			}
+			if err := bot.Send("hello 42\n"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := viewer.WaitFor(ctx, regexp.MustCompile(`hello \d+`))
+			if err != nil || got != "hello 42" {
+				t.Fatalf("WaitFor = %q, %v", got, err)
+			}
+			// Input from a viewer never reaches the terminal.
+			_ = viewer.Send("ignored\n")
+			_ = bot.Send("done\n")
+			if _, err := bot.WaitFor(ctx, regexp.MustCompile(`done`)); err != nil {
+				t.Fatal(err)
+			}
+
+			for msg := range bot.Messages() {
+				if msg.Type == "clients" {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestClientPackageRejections(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.Dial(ctx, ts.URL, client.Options{Username: "vex", Password: "wrong"}); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong password: %v", err)
+	}
+	if _, err := client.Dial(ctx, ts.URL, client.Options{}); err == nil {
+		t.Error("dial without credentials succeeded")
+	}
+
+	bot, err := client.Dial(ctx, ts.URL, client.Options{Username: "vex", Password: "pw"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancelShort := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancelShort()
+	if _, err := bot.WaitFor(short, regexp.MustCompile(`never`)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitFor past the deadline: %v", err)
+	}
+	bot.Close()
+	<-bot.Done()
+	if _, err := io.ReadAll(bot.Output()); err != nil {
+		t.Errorf("reading output after close: %v", err)
+	}
+}
+
+func TestClientPackageConsent(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg: session.Config{ConsentText: "This session is recorded."},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.Dial(ctx, ts.URL, client.Options{Token: "tok-0123456789abcdef"}); err == nil || !strings.Contains(err.Error(), "consent declined") {
+		t.Errorf("dial without consent: %v", err)
+	}
+	bot, err := client.Dial(ctx, ts.URL, client.Options{Token: "tok-0123456789abcdef", Consent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	if role := bot.Role(); role.Role != "controller" {
+		t.Errorf("role = %+v, want controller", role)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vextm/vexshare/internal/auth"
+)
+
+// mfaMessage is the JSON answer to a login that needs a second step.
+type mfaMessage struct {
+	Type string   `json:"type"`
+	Data *mfaData `json:"data,omitempty"`
+}
+
+type mfaData struct {
+	SetupURL string `json:"setupURL"`
+}
+
+func writeMFAMessage(w http.ResponseWriter, status int, msg mfaMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(msg)
+}
+
+// checkTOTP runs after a successful password check when RequireTOTP is set.
+// It reports whether the login may go ahead, and otherwise has answered the
+// request. A user who has not enrolled yet is given a new secret instead.
+func (s *Server) checkTOTP(w http.ResponseWriter, r *http.Request, identity auth.Identity, ip string) bool {
+	secrets := s.authn.(auth.TOTPSecrets)
+	secret := secrets.TOTPSecret(identity.Username)
+	if secret == "" {
+		s.startEnrollment(w, r, identity)
+		return false
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		writeMFAMessage(w, http.StatusUnauthorized, mfaMessage{Type: "mfa_code_required"})
+		return false
+	}
+	if !s.totpUsed.Verify(identity.Username, secret, code, time.Now()) {
+		s.logger.WarnContext(r.Context(), "failed TOTP code", "username", identity.Username, "ip", ip)
+		if sess := s.currentSession(); sess != nil {
+			sess.SecurityEvent("failed_login", ip, identity.Username)
+		}
+		http.Error(w, "Invalid authentication code", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *Server) startEnrollment(w http.ResponseWriter, r *http.Request, identity auth.Identity) {
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "generate TOTP secret", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	id, err := s.enrollments.Start(identity, secret)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "start TOTP enrollment", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	auth.SetEnrollmentCookie(w, s.cookieConfig(r), id)
+	s.logger.InfoContext(r.Context(), "TOTP enrollment started", "username", identity.Username, "ip", s.clientIP(r))
+	writeMFAMessage(w, http.StatusOK, mfaMessage{
+		Type: "mfa_required",
+		Data: &mfaData{SetupURL: auth.TOTPURL(s.brandTitle(), identity.Username, secret)},
+	})
+}
+
+// handleMFAEnrollment returns the pending enrollment's secret for the setup
+// page to show.
+func (s *Server) handleMFAEnrollment(w http.ResponseWriter, r *http.Request) {
+	e, ok := s.enrollments.Lookup(auth.GetEnrollmentID(r, s.cfg.AuthConfig))
+	if !ok {
+		http.Error(w, "Enrollment expired; log in again", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(struct {
+		SetupURL  string    `json:"setupURL"`
+		Secret    string    `json:"secret"`
+		Username  string    `json:"username"`
+		ExpiresAt time.Time `json:"expiresAt"`
+	}{auth.TOTPURL(s.brandTitle(), e.Identity.Username, e.Secret), e.Secret, e.Identity.Username, e.ExpiresAt.UTC()})
+}
+
+// handleMFASetup confirms an enrollment with the first code, saves the
+// secret and logs the user in. Wrong codes count against the per-IP login
+// limit.
+func (s *Server) handleMFASetup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginFormBytes)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	ip := s.clientIP(r)
+	if !s.loginRL.Allow(ip) {
+		retry := int(math.Ceil(s.loginRL.RetryAfter(ip).Seconds()))
+		s.logger.WarnContext(r.Context(), "rate limit exceeded",
+			"reason", "login_ip_limit",
+			"ip", ip,
+			"route", r.Method+" "+r.URL.Path,
+			"count", s.loginRL.Count(ip),
+			"limit", s.loginRL.Limit(),
+			"window", s.loginRL.Window(),
+			"retryAfter", retry,
+		)
+		w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	id := auth.GetEnrollmentID(r, s.cfg.AuthConfig)
+	e, ok := s.enrollments.Lookup(id)
+	if !ok {
+		http.Error(w, "Enrollment expired; log in again", http.StatusUnauthorized)
+		return
+	}
+	if !s.totpUsed.Verify(e.Identity.Username, e.Secret, r.FormValue("code"), time.Now()) {
+		s.logger.WarnContext(r.Context(), "failed TOTP enrollment code", "username", e.Identity.Username, "ip", ip)
+		http.Error(w, "Invalid authentication code", http.StatusUnauthorized)
+		return
+	}
+	if err := s.authn.(auth.TOTPSecrets).SetTOTPSecret(e.Identity.Username, e.Secret); err != nil {
+		s.logger.ErrorContext(r.Context(), "save TOTP secret", "username", e.Identity.Username, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.enrollments.Delete(id)
+
+	sid, err := s.sessions.Create(e.Identity)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "create session", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	s.usernameRL.Reset(e.Identity.Username)
+	cfg := s.cookieConfig(r)
+	auth.ClearEnrollmentCookie(w, cfg)
+	auth.SetSessionCookie(w, cfg, sid)
+	s.logger.InfoContext(r.Context(), "TOTP enrolled, user logged in", "username", e.Identity.Username, "ip", ip)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -3,41 +3,203 @@ package server
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"io/fs"
+	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
+	"github.com/vextm/vexshare/internal/ansi"
 	"github.com/vextm/vexshare/internal/auth"
+	"github.com/vextm/vexshare/internal/ipfilter"
+	"github.com/vextm/vexshare/internal/origin"
 	"github.com/vextm/vexshare/internal/ratelimit"
 	"github.com/vextm/vexshare/internal/session"
 	"github.com/vextm/vexshare/internal/ui"
 )
 
+// The server has no overall read timeout by default, so the login form body
+// is bounded here instead: generously in time for slow links, and in size.
+const (
+	maxLoginFormBytes = 64 << 10
+	loginBodyTimeout  = 2 * time.Minute
+)
+
 type Config struct {
-	ListenAddr  string
-	TLSCert     string
-	TLSKey      string
-	AuthConfig  auth.Config
-	SessionCfg  session.Config
-	AllowOrigin string
-	Logger      *slog.Logger
+	ListenAddr string
+	TLSCert    string
+	TLSKey     string
+	AuthConfig auth.Config
+	SessionCfg session.Config
+	Logger     *slog.Logger
+	// Authenticator validates login credentials. Defaults to comparing
+	// against AuthConfig's static username and password.
+	Authenticator auth.Authenticator
+	// MaxSessions caps the number of login sessions held in memory; the
+	// oldest is evicted when it is reached. Zero means unlimited.
+	MaxSessions        int
+	MaxSessionsPerUser int
+	// UsernameRateLimit caps login attempts per username within
+	// UsernameRateWindow, whatever IPs they come from. Defaults to 5 per 5m.
+	UsernameRateLimit  int
+	UsernameRateWindow time.Duration
+	// MaxConnections and MaxConnectionsPerIP cap open TCP connections, in
+	// total and per peer address; zero means unlimited. With
+	// SlowClientLimit, a peer whose connections time out before sending a
+	// whole request more than that many times in 10 minutes is banned for
+	// SlowClientBan (10 minutes if zero). Peers in TrustedProxies are only
+	// held to MaxConnections. See connGuard.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	SlowClientLimit     int
+	SlowClientBan       time.Duration
+	// MaxPendingLogins caps login requests being handled at once, so slow
+	// request bodies cannot tie up goroutines within the rate limits.
+	// Requests beyond it get a 503. Zero means unlimited.
+	MaxPendingLogins int
+	// WSRateLimitAuthenticatedOnly counts only authenticated WebSocket
+	// upgrades against the per-IP limit.
+	WSRateLimitAuthenticatedOnly bool
+	// AllowIPs, when non-empty, restricts every route to clients whose
+	// address falls in one of its ranges. DenyIPs is checked first and
+	// refuses matching clients even if AllowIPs covers them.
+	AllowIPs ipfilter.List
+	DenyIPs  ipfilter.List
+	// TrustForwardedProto marks login cookies Secure when a proxy in
+	// TrustedProxies says, with X-Forwarded-Proto: https, that it
+	// terminated TLS. The header is ignored from any other peer.
+	TrustForwardedProto bool
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For gives
+	// the client address for the IP filters, bans and per-IP limits; from
+	// any other peer the header is ignored.
+	TrustedProxies ipfilter.List
+	// AllowOrigins, when non-empty, replaces the same-origin check on
+	// WebSocket upgrades with these patterns; see origin.Pattern.
+	AllowOrigins origin.List
+	// MaxSessionsPerIP caps concurrent WebSocket connections from one IP.
+	// Zero means unlimited.
+	MaxSessionsPerIP int
+	// TokenMaxConnections caps concurrent WebSocket connections made with
+	// each share token, so that a leaked token URL cannot bring in an
+	// unlimited audience. The control and view tokens are counted
+	// separately. Zero means unlimited.
+	TokenMaxConnections int
+	// AdminToken enables the /admin API for requests carrying it as a
+	// bearer token.
+	AdminToken string
+	// ShortURLBase enables short links for token URLs: the admin API hands
+	// out ShortURLBase + SessionPathPrefix + code, and that path redirects
+	// to the token URL.
+	ShortURLBase string
+	// ReadHeaderTimeout, WriteTimeout and IdleTimeout configure the HTTP
+	// server; zero picks 15s, 15s and 60s. ReadTimeout additionally bounds
+	// reading a whole request and is off when zero, so slow links can still
+	// post small bodies; those are capped in size per handler instead.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// H2C also serves HTTP/2 without TLS to clients that speak it from the
+	// start. WebSocket connections still need HTTP/1.1.
+	H2C bool
+	// SessionPathPrefix is where named sessions are mounted: the terminal at
+	// {prefix}{name}/ and its WebSocket at {prefix}{name}/ws. Defaults to
+	// "/s/". It must start and end with a slash and may not be "/", which
+	// would put sessions alongside /healthz, /login and the other routes.
+	SessionPathPrefix string
+	// ForbiddenBody replaces the plain-text 403 served at / in token mode,
+	// with ForbiddenContentType as its type (text/plain if empty).
+	ForbiddenBody        []byte
+	ForbiddenContentType string
+	// RateLimitStore holds the login and WebSocket rate limit counts. Nil
+	// keeps them in memory; a shared store such as ratelimit.RedisStore
+	// makes the limits hold across instances behind a load balancer.
+	RateLimitStore ratelimit.Store
+	// Features selects the optional UI features and their API routes; nil
+	// enables all of them.
+	Features *Features
+	// LazyStart defers starting the PTY until the first WebSocket client
+	// connects, and keeps the server up when the PTY exits.
+	LazyStart bool
+	// Title replaces "vexShare" in the login and terminal pages' tab title
+	// and header. LogoURL, if set, is shown next to it; it must be an http
+	// or https URL or a path on this host.
+	Title   string
+	LogoURL string
+	// ReadyOutput receives the listening event as a JSON line instead of
+	// the log, for wrapper scripts that wait until the server is up.
+	ReadyOutput io.Writer
+	// RequireTOTP asks password logins for a code from the user's
+	// authenticator app, enrolling users who have none on their first
+	// login. The Authenticator must implement auth.TOTPSecrets.
+	RequireTOTP bool
+	// Build is reported at GET /version. The endpoint needs no auth unless
+	// VersionRequiresAuth is set, when it takes the same credentials as
+	// /api/status.
+	Build               BuildInfo
+	VersionRequiresAuth bool
+	// Handoff, from InheritedHandoff, takes over the listener, command and
+	// logins of the vexShare process this one replaced.
+	Handoff *Handoff
+}
+
+// listeningEvent is emitted once the listener is bound.
+type listeningEvent struct {
+	Event  string `json:"event"`
+	Addr   string `json:"addr"`
+	Scheme string `json:"scheme"`
 }
 
 type Server struct {
 	cfg        Config
 	httpServer *http.Server
 	sessions   *auth.SessionStore
-	sess       *session.Session
-	loginRL    *ratelimit.Limiter
-	wsRL       *ratelimit.Limiter
-	logger     *slog.Logger
-	upgrader   websocket.Upgrader
+	tickets    *auth.TicketStore
+	// enrollments holds pending TOTP setups and totpUsed the last code
+	// accepted for each user; both are nil without RequireTOTP.
+	enrollments *auth.EnrollmentStore
+	totpUsed    *auth.TOTPReplayGuard
+	sess        *session.Session
+	sessMu      sync.Mutex
+	named       map[string]*namedSession
+	namedMu     sync.Mutex
+	authn       auth.Authenticator
+	loginRL     *ratelimit.Limiter
+	usernameRL  *ratelimit.Limiter
+	wsRL        *ratelimit.Limiter
+	wsPerIP     slotCounter // by IP
+	wsPerToken  slotCounter // by auth.TokenControl or auth.TokenView
+	bans        sync.Map    // IP -> time.Time the ban expires
+	shortLinks  sync.Map    // code -> shortLink
+	ln          net.Listener
+	lnMu        sync.Mutex
+	pages       map[string]ui.Asset
+	pagesMu     sync.Mutex
+	version     ui.Asset
+	logger      *slog.Logger
+	upgrader    websocket.Upgrader
+	// loginSlots holds one entry per login being handled; nil without
+	// MaxPendingLogins.
+	loginSlots chan struct{}
+	// conns guards the listener; nil without connection limits.
+	conns *connGuard
+	// inherit is the command taken over from the previous process, until
+	// the first session adopts it. Guarded by sessMu.
+	inherit *session.Inherited
 }
 
 func New(cfg Config) *Server {
@@ -45,124 +207,559 @@ func New(cfg Config) *Server {
 	if logger == nil {
 		logger = slog.Default()
 	}
+	logger = slog.New(requestIDHandler{logger.Handler()})
+
+	authn := cfg.Authenticator
+	if authn == nil {
+		authn = auth.NewStaticAuthenticator(cfg.AuthConfig)
+	}
+
+	userLimit, userWindow := cfg.UsernameRateLimit, cfg.UsernameRateWindow
+	if userLimit <= 0 {
+		userLimit = 5
+	}
+	if userWindow <= 0 {
+		userWindow = 5 * time.Minute
+	}
 
 	s := &Server{
 		cfg:      cfg,
-		sessions: auth.NewSessionStore(24 * time.Hour),
-		loginRL:  ratelimit.New(5, 1*time.Minute),
-		wsRL:     ratelimit.New(20, 1*time.Minute),
+		authn:    authn,
+		sessions: auth.NewSessionStore(cfg.AuthConfig.SessionTTL(), cfg.MaxSessions),
+		tickets:  auth.NewTicketStore(30 * time.Second),
+		named:    make(map[string]*namedSession),
+		pages:    make(map[string]ui.Asset),
 		logger:   logger,
 	}
+	if store := cfg.RateLimitStore; store != nil {
+		s.loginRL = ratelimit.NewWithStore(store, "login_ip", 5, 1*time.Minute)
+		s.usernameRL = ratelimit.NewWithStore(store, "login_user", userLimit, userWindow)
+		s.wsRL = ratelimit.NewWithStore(store, "ws_ip", 20, 1*time.Minute)
+	} else {
+		s.loginRL = ratelimit.New(5, 1*time.Minute)
+		s.usernameRL = ratelimit.New(userLimit, userWindow)
+		s.wsRL = ratelimit.New(20, 1*time.Minute)
+	}
+
+	s.conns = s.newConnGuard()
+	if cfg.MaxPendingLogins > 0 {
+		s.loginSlots = make(chan struct{}, cfg.MaxPendingLogins)
+	}
+	s.sessions.SetMaxPerUser(cfg.MaxSessionsPerUser)
+	if cfg.RequireTOTP {
+		s.enrollments = auth.NewEnrollmentStore(auth.EnrollmentTTL)
+		s.totpUsed = auth.NewTOTPReplayGuard()
+	}
+	s.version = s.versionAsset()
+	if h := cfg.Handoff; h != nil {
+		s.sessions.Import(h.Logins)
+		s.inherit = h.Session
+	}
+	s.loginRL.SetLogger(logger, "login_ip_limit")
+	s.usernameRL.SetLogger(logger, "login_username_limit")
+	s.wsRL.SetLogger(logger, "ws_ip_limit")
+	s.loginRL.SetTrustedProxies(cfg.TrustedProxies)
+	s.wsRL.SetTrustedProxies(cfg.TrustedProxies)
 
 	s.upgrader = websocket.Upgrader{
 		ReadBufferSize:  4096,
 		WriteBufferSize: 4096,
-		CheckOrigin:     s.checkOrigin,
+		// Origins are checked by originMiddleware before the upgrade.
+		CheckOrigin: func(*http.Request) bool { return true },
 	}
 
 	return s
 }
 
+// clientIP is the address requests from r's client are counted, filtered
+// and banned under. X-Forwarded-For is only believed from TrustedProxies.
+func (s *Server) clientIP(r *http.Request) string {
+	return ratelimit.ExtractIP(r, s.cfg.TrustedProxies)
+}
+
 func (s *Server) checkOrigin(r *http.Request) bool {
-	if s.cfg.AllowOrigin == "" {
+	// A ticket is an explicit credential rather than an ambient cookie, so
+	// cross-site WebSocket hijacking is not a concern for ticket upgrades.
+	if auth.TicketAuthenticated(r) {
+		return true
+	}
+	if len(s.cfg.AllowOrigins) == 0 {
 		origin := r.Header.Get("Origin")
 		if origin == "" {
 			return true
 		}
-		host := r.Host
-		return strings.Contains(origin, host)
+		// Only the same host and port, not any origin that mentions them.
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
 	}
-	origin := r.Header.Get("Origin")
-	for _, allowed := range strings.Split(s.cfg.AllowOrigin, ",") {
-		if strings.TrimSpace(allowed) == origin {
-			return true
+	return s.cfg.AllowOrigins.Allows(r.Header.Get("Origin"))
+}
+
+// originMiddleware rejects cross-origin WebSocket upgrades before they reach
+// the rate limiter or any authentication. With deferTickets an upgrade
+// carrying a ticket gets through, to be checked again once the ticket has
+// been redeemed: only then is it known not to ride on the cookie.
+func (s *Server) originMiddleware(next http.Handler, deferTickets bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deferTickets && r.URL.Query().Get("ticket") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.checkOrigin(r) {
+			s.logger.WarnContext(r.Context(), "websocket origin rejected", "origin", r.Header.Get("Origin"), "host", r.Host, "ip", s.clientIP(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipFilterMiddleware refuses clients in DenyIPs or outside AllowIPs before
+// any other handling, including authentication.
+func (s *Server) ipFilterMiddleware(next http.Handler) http.Handler {
+	if len(s.cfg.AllowIPs) == 0 && len(s.cfg.DenyIPs) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		var reason string
+		switch {
+		case s.cfg.DenyIPs.Contains(ip):
+			reason = "denied"
+		case len(s.cfg.AllowIPs) > 0 && !s.cfg.AllowIPs.Contains(ip):
+			reason = "not allowed"
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.logger.WarnContext(r.Context(), "client IP refused", "reason", reason, "ip", ip, "route", r.Method+" "+ratelimit.RedactPath(r.URL.Path))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// basicAuthMiddleware is auth.BasicAuthMiddleware under the per-IP login
+// limit. Every request carries the credentials, so only wrong ones count.
+func (s *Server) basicAuthMiddleware() func(http.Handler) http.Handler {
+	return s.loginLimited(auth.BasicAuthMiddleware(s.cfg.AuthConfig, s.logger), func(r *http.Request) bool {
+		username, password, ok := r.BasicAuth()
+		return ok && !auth.CheckPassword(s.cfg.AuthConfig, username, password)
+	})
+}
+
+// apiKeyMiddleware is auth.APIKeyMiddleware under the per-IP login limit,
+// counting requests with a wrong key.
+func (s *Server) apiKeyMiddleware() func(http.Handler) http.Handler {
+	return s.loginLimited(auth.APIKeyMiddleware(s.cfg.AuthConfig, s.logger), func(r *http.Request) bool {
+		key := r.Header.Get(auth.APIKeyHeader)
+		return key != "" && auth.CheckToken(s.cfg.AuthConfig, key) != nil
+	})
+}
+
+// pendingLoginLimit refuses a login with a 503 while MaxPendingLogins are
+// already being handled. It runs before the body is read, which is where a
+// slow client would hold on.
+func (s *Server) pendingLoginLimit(next http.Handler) http.Handler {
+	if s.loginSlots == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.loginSlots <- struct{}{}:
+		default:
+			s.logger.WarnContext(r.Context(), "rate limit exceeded",
+				"reason", "pending_login_limit",
+				"ip", s.clientIP(r),
+				"route", r.Method+" "+r.URL.Path,
+				"limit", cap(s.loginSlots),
+			)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			return
 		}
+		defer func() { <-s.loginSlots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loginLimited puts a middleware that checks credentials on every request
+// under the per-IP login limit: requests for which failed reports true are
+// counted, and an IP over the limit gets a 429 before its credentials are
+// checked.
+func (s *Server) loginLimited(authenticate func(http.Handler) http.Handler, failed func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		h := authenticate(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := s.clientIP(r)
+			if s.loginRL.Count(ip) >= s.loginRL.Limit() {
+				retry := int(math.Ceil(s.loginRL.RetryAfter(ip).Seconds()))
+				s.logger.WarnContext(r.Context(), "rate limit exceeded",
+					"reason", "login_ip_limit",
+					"ip", ip,
+					"route", r.Method+" "+ratelimit.RedactPath(r.URL.Path),
+					"count", s.loginRL.Count(ip),
+					"limit", s.loginRL.Limit(),
+					"window", s.loginRL.Window(),
+					"retryAfter", retry,
+				)
+				w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+			if failed(r) {
+				s.loginRL.Allow(ip)
+			}
+			h.ServeHTTP(w, r)
+		})
 	}
-	return false
+}
+
+// wsRoute applies the WebSocket middlewares in a fixed order: origin check,
+// then rate limit, then authentication. With WSRateLimitAuthenticatedOnly
+// the limiter runs after authentication so rejected requests are not
+// counted. Ticket upgrades have their origin checked after authentication.
+func (s *Server) wsRoute(authenticate func(http.Handler) http.Handler) http.Handler {
+	h := s.originMiddleware(http.HandlerFunc(s.handleWS), false)
+	if s.cfg.WSRateLimitAuthenticatedOnly {
+		h = authenticate(s.wsRL.Middleware()(h))
+	} else {
+		h = s.wsRL.Middleware()(authenticate(h))
+	}
+	return s.originMiddleware(h, true)
 }
 
 func (s *Server) buildRouter() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	if !s.cfg.VersionRequiresAuth {
+		mux.HandleFunc("GET /version", s.handleVersion)
+	}
 
-	loginHandler := s.loginRL.Middleware()(http.HandlerFunc(s.handleLoginPost))
 	mux.HandleFunc("GET /login", s.handleLoginPage)
-	mux.Handle("POST /login", loginHandler)
+	mux.Handle("POST /login", s.pendingLoginLimit(http.HandlerFunc(s.handleLoginPost)))
 	mux.HandleFunc("POST /logout", s.handleLogout)
+	if s.cfg.RequireTOTP {
+		mux.HandleFunc("GET /mfa/setup", s.handleLoginPage)
+		mux.HandleFunc("GET /mfa/enrollment", s.handleMFAEnrollment)
+		mux.Handle("POST /mfa/setup", s.pendingLoginLimit(http.HandlerFunc(s.handleMFASetup)))
+	}
+
+	s.registerAdminRoutes(mux)
 
 	authMode := s.cfg.AuthConfig.Mode
 
-	if authMode == "password" || authMode == "password+token" {
-		pwMiddleware := auth.PasswordMiddleware(s.sessions, s.logger)
-		mux.Handle("GET /", pwMiddleware(http.HandlerFunc(s.handleTerminal)))
-		wsHandler := s.wsRL.Middleware()(pwMiddleware(http.HandlerFunc(s.handleWS)))
-		mux.Handle("GET /ws", wsHandler)
+	features := s.features()
+	// Unknown and disabled API routes are a 404 rather than the terminal
+	// page that the catch-all routes would serve.
+	mux.Handle("GET /api/", http.NotFoundHandler())
+
+	var pwMiddleware func(http.Handler) http.Handler
+	switch authMode {
+	case "password", "password+token":
+		pwMiddleware = auth.PasswordMiddleware(s.cfg.AuthConfig, s.sessions, s.logger)
+	case "basic":
+		pwMiddleware = s.basicAuthMiddleware()
+	case "apikey":
+		pwMiddleware = s.apiKeyMiddleware()
+	}
+	if pwMiddleware != nil && features.History {
+		mux.Handle("GET /api/history", pwMiddleware(http.HandlerFunc(s.handleHistory)))
 	}
 
+	// rootAuth guards the unprefixed routes: a login session, and the view
+	// token as a ?vt= query parameter when one is configured. With no auth
+	// at all, everyone is let in read-only.
+	rootAuth := pwMiddleware
+	if authMode == "none" {
+		rootAuth = auth.AnonymousViewerMiddleware()
+	}
+	if s.cfg.AuthConfig.ViewToken != "" {
+		// Without a login to fall back on, a request with no ?vt= gets the
+		// same explanation as / does in token mode.
+		fallback := pwMiddleware
+		if fallback == nil {
+			fallback = func(http.Handler) http.Handler { return http.HandlerFunc(s.handleForbidden) }
+		}
+		rootAuth = auth.ViewTokenQueryMiddleware(s.cfg.AuthConfig, fallback, s.logger)
+	}
+	if rootAuth != nil {
+		mux.Handle("GET /", rootAuth(http.HandlerFunc(s.handleTerminal)))
+		if features.Status {
+			mux.Handle("GET /api/status", rootAuth(http.HandlerFunc(s.handleStatus)))
+		}
+		if s.cfg.VersionRequiresAuth {
+			mux.Handle("GET /version", rootAuth(http.HandlerFunc(s.handleVersion)))
+		}
+		mux.Handle("POST /ws-ticket", s.wsRL.Middleware()(rootAuth(http.HandlerFunc(s.handleWSTicket))))
+	}
+
+	ticketMiddleware := auth.TicketMiddleware(s.tickets, rootAuth, s.logger)
+	mux.Handle("GET /ws", s.wsRoute(ticketMiddleware))
+	prefix := s.sessionPathPrefix()
+	mux.Handle("GET "+prefix, http.StripPrefix(strings.TrimSuffix(prefix, "/"), s.namedSessionRouter(rootAuth, ticketMiddleware)))
+
 	if authMode == "token" || authMode == "password+token" {
 		tokenMiddleware := auth.TokenMiddleware(s.cfg.AuthConfig, s.logger)
 		mux.Handle("GET /t/{token}/", tokenMiddleware(http.HandlerFunc(s.handleTerminal)))
-		wsHandler := s.wsRL.Middleware()(tokenMiddleware(http.HandlerFunc(s.handleWS)))
-		mux.Handle("GET /t/{token}/ws", wsHandler)
+		mux.Handle("GET /t/{token}/ws", s.wsRoute(tokenMiddleware))
+		mux.Handle("GET /t/{token}/api/", http.NotFoundHandler())
+		if features.Status {
+			mux.Handle("GET /t/{token}/api/status", tokenMiddleware(http.HandlerFunc(s.handleStatus)))
+		}
+		if s.cfg.VersionRequiresAuth {
+			mux.Handle("GET /t/{token}/version", tokenMiddleware(http.HandlerFunc(s.handleVersion)))
+		}
+		mux.Handle("POST /t/{token}/ws-ticket", s.wsRL.Middleware()(tokenMiddleware(http.HandlerFunc(s.handleWSTicket))))
 	}
 
-	if authMode == "token" {
-		mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "Access requires a valid token URL.", http.StatusForbidden)
-		})
+	if rootAuth == nil {
+		mux.HandleFunc("GET /", s.handleForbidden)
 	}
 
-	return mux
+	return requestIDMiddleware(s.ipFilterMiddleware(s.ipBanMiddleware(gzipMiddleware(mux))))
 }
 
-func (s *Server) Start() error {
+func (s *Server) newSession() (*session.Session, error) {
 	sessCfg := s.cfg.SessionCfg
 	sessCfg.Logger = s.logger
+	sessCfg.Inherit, s.inherit = s.inherit, nil
 	sessCfg.OnClose = func() {
+		if s.cfg.LazyStart {
+			s.logger.Info("PTY session ended, waiting for the next client")
+			return
+		}
 		s.logger.Info("PTY session ended, shutting down server")
 		go func() {
 			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			defer cancel()
-			_ = s.httpServer.Shutdown(ctx)
+			if s.httpServer != nil {
+				_ = s.httpServer.Shutdown(ctx)
+			}
 		}()
 	}
+	return session.New(sessCfg)
+}
 
-	var err error
-	s.sess, err = session.New(sessCfg)
+// session returns the PTY session for a new client. In lazy-start mode the
+// first caller creates it, and a new one replaces it once it has ended.
+func (s *Server) session() (*session.Session, error) {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+	if s.sess != nil {
+		select {
+		case <-s.sess.Done():
+			if !s.cfg.LazyStart {
+				return s.sess, nil
+			}
+		default:
+			return s.sess, nil
+		}
+	}
+	sess, err := s.newSession()
 	if err != nil {
-		return fmt.Errorf("start session: %w", err)
+		return nil, err
 	}
+	s.sess = sess
+	return sess, nil
+}
 
-	handler := s.buildRouter()
+func (s *Server) currentSession() *session.Session {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+	return s.sess
+}
 
-	s.httpServer = &http.Server{
-		Addr:         s.cfg.ListenAddr,
-		Handler:      handler,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+func (s *Server) newHTTPServer(handler http.Handler) *http.Server {
+	orDefault := func(d, def time.Duration) time.Duration {
+		if d <= 0 {
+			return def
+		}
+		return d
+	}
+	srv := &http.Server{
+		Addr:              s.cfg.ListenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: orDefault(s.cfg.ReadHeaderTimeout, 15*time.Second),
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      orDefault(s.cfg.WriteTimeout, 15*time.Second),
+		IdleTimeout:       orDefault(s.cfg.IdleTimeout, 60*time.Second),
 	}
+	if s.cfg.H2C {
+		// Prior knowledge only: an HTTP/1.1 request asking to upgrade to h2c
+		// is served as HTTP/1.1, as it would be without H2C.
+		h2 := h2c.NewHandler(handler, &http2.Server{})
+		srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if httpguts.HeaderValuesContainsToken(r.Header["Upgrade"], "h2c") {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			h2.ServeHTTP(w, r)
+		})
+	}
+	return srv
+}
 
-	if s.cfg.TLSCert != "" && s.cfg.TLSKey != "" {
-		s.logger.Info("starting HTTPS server", "addr", s.cfg.ListenAddr)
-		return s.httpServer.ListenAndServeTLS(s.cfg.TLSCert, s.cfg.TLSKey)
+// Validate reports configuration errors that would break routing.
+func (cfg Config) Validate() error {
+	if cfg.RequireTOTP {
+		if _, ok := cfg.Authenticator.(auth.TOTPSecrets); !ok {
+			return fmt.Errorf("TOTP needs an authenticator that stores secrets, such as a users file")
+		}
+	}
+	if cfg.H2C && cfg.TLSCert != "" {
+		return fmt.Errorf("h2c is for plain HTTP; with TLS, HTTP/2 is negotiated already")
+	}
+	if p := cfg.SessionPathPrefix; p != "" {
+		if !strings.HasPrefix(p, "/") || !strings.HasSuffix(p, "/") {
+			return fmt.Errorf("session path prefix %q must start and end with /", p)
+		}
+		if p == "/" {
+			return fmt.Errorf("session path prefix / would mount sessions over /healthz, /login and the other routes")
+		}
+	}
+	if name := cfg.AuthConfig.CookieName; name != "" {
+		if err := (&http.Cookie{Name: name}).Valid(); err != nil {
+			return fmt.Errorf("cookie name %q: %w", name, err)
+		}
+	}
+	if cfg.LogoURL != "" {
+		if err := checkLogoURL(cfg.LogoURL); err != nil {
+			return err
+		}
+	}
+	if cfg.AuthConfig.CookieTTL < 0 {
+		return fmt.Errorf("cookie TTL must not be negative")
+	}
+	if cfg.AuthConfig.SessionMaxAge < auth.BrowserSessionCookie {
+		return fmt.Errorf("session cookie max age must not be negative")
+	}
+	if cfg.ShortURLBase != "" {
+		u, err := url.Parse(cfg.ShortURLBase)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("short URL base %q must be an http or https URL without a query", cfg.ShortURLBase)
+		}
+	}
+	if cfg.TrustForwardedProto && len(cfg.TrustedProxies) == 0 {
+		return fmt.Errorf("trusting X-Forwarded-Proto needs the addresses of the trusted proxies")
+	}
+	return nil
+}
+
+func (s *Server) sessionPathPrefix() string {
+	if s.cfg.SessionPathPrefix == "" {
+		return "/s/"
+	}
+	return s.cfg.SessionPathPrefix
+}
+
+// Listen binds ListenAddr, or takes over the handed-off listener, without
+// serving yet, and returns the address it is bound to. With port 0 that
+// holds the port the system picked. Start calls it if it was not called.
+func (s *Server) Listen() (net.Addr, error) {
+	s.lnMu.Lock()
+	defer s.lnMu.Unlock()
+	if s.ln == nil {
+		if h := s.cfg.Handoff; h != nil && h.Listener != nil {
+			s.ln = h.Listener
+		} else {
+			ln, err := net.Listen("tcp", s.cfg.ListenAddr)
+			if err != nil {
+				return nil, err
+			}
+			s.ln = ln
+		}
+	}
+	return s.ln.Addr(), nil
+}
+
+func (s *Server) Start() error {
+	if err := s.cfg.Validate(); err != nil {
+		return err
+	}
+	// Bind first so a port that is taken fails before the command starts.
+	if _, err := s.Listen(); err != nil {
+		return err
+	}
+	ln := s.listener()
+	// An inherited command is already running, so adopt it straight away.
+	if !s.cfg.LazyStart || (s.cfg.Handoff != nil && s.cfg.Handoff.Session != nil) {
+		if _, err := s.session(); err != nil {
+			ln.Close()
+			return fmt.Errorf("start session: %w", err)
+		}
+	}
+
+	s.httpServer = s.newHTTPServer(s.buildRouter())
+
+	scheme := "http"
+	useTLS := s.cfg.TLSCert != "" && s.cfg.TLSKey != ""
+	if useTLS {
+		// Load the key pair before serving so a bad certificate fails
+		// before anyone is told the server is ready.
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLSCert, s.cfg.TLSKey)
+		if err != nil {
+			ln.Close()
+			return fmt.Errorf("load TLS key pair: %w", err)
+		}
+		s.httpServer.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		scheme = "https"
 	}
 
-	s.logger.Info("starting HTTP server", "addr", s.cfg.ListenAddr)
-	return s.httpServer.ListenAndServe()
+	s.announceListening(ln.Addr().String(), scheme)
+
+	// The handoff needs the bare listener, so only what is served is
+	// wrapped.
+	if s.conns != nil {
+		ln = &guardedListener{Listener: ln, g: s.conns}
+		s.httpServer.ConnState = s.conns.connState
+	}
+	if useTLS {
+		return s.httpServer.ServeTLS(ln, "", "")
+	}
+	return s.httpServer.Serve(ln)
+}
+
+func (s *Server) listener() net.Listener {
+	s.lnMu.Lock()
+	defer s.lnMu.Unlock()
+	return s.ln
+}
+
+func (s *Server) announceListening(addr, scheme string) {
+	if s.cfg.ReadyOutput == nil {
+		s.logger.Info("listening", "event", "listening", "addr", addr, "scheme", scheme)
+		return
+	}
+	line, _ := json.Marshal(listeningEvent{Event: "listening", Addr: addr, Scheme: scheme})
+	_, _ = s.cfg.ReadyOutput.Write(append(line, '\n'))
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
-	if s.sess != nil {
-		s.sess.Close()
+	if sess := s.currentSession(); sess != nil {
+		sess.Close()
 	}
+	s.closeNamedSessions()
 	if s.httpServer != nil {
 		return s.httpServer.Shutdown(ctx)
 	}
 	return nil
 }
 
+func (s *Server) handleForbidden(w http.ResponseWriter, r *http.Request) {
+	if len(s.cfg.ForbiddenBody) == 0 {
+		http.Error(w, "Access requires a valid token URL.", http.StatusForbidden)
+		return
+	}
+	contentType := s.cfg.ForbiddenContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write(s.cfg.ForbiddenBody)
+}
+
 func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
@@ -170,21 +767,18 @@ func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleLoginPage(w http.ResponseWriter, r *http.Request) {
-	staticFS, err := fs.Sub(ui.StaticFS, "static")
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	data, err := fs.ReadFile(staticFS, "login.html")
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write(data)
+	s.servePage(w, r, "login.html")
 }
 
 func (s *Server) handleLoginPost(w http.ResponseWriter, r *http.Request) {
+	// The write deadline runs from the end of the headers, so a slow body
+	// would otherwise use it up before the response is sent.
+	rc := http.NewResponseController(w)
+	if s.cfg.ReadTimeout <= 0 {
+		_ = rc.SetReadDeadline(time.Now().Add(loginBodyTimeout))
+	}
+	_ = rc.SetWriteDeadline(time.Now().Add(loginBodyTimeout))
+	r.Body = http.MaxBytesReader(w, r.Body, maxLoginFormBytes)
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
@@ -193,65 +787,389 @@ func (s *Server) handleLoginPost(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 
-	ip := ratelimit.ExtractIP(r)
-	s.logger.Debug("login attempt", "username", username, "ip", ip)
+	ip := s.clientIP(r)
+	s.logger.DebugContext(r.Context(), "login attempt", "username", username, "ip", ip)
 
-	if !auth.CheckPassword(s.cfg.AuthConfig, username, password) {
-		s.logger.Warn("failed login attempt", "username", username, "ip", ip)
+	// The per-username limit stops a distributed guess at one account that
+	// the per-IP limit cannot see.
+	limiter, key := s.loginRL, ip
+	allowed := s.loginRL.Allow(ip)
+	if allowed {
+		limiter, key = s.usernameRL, username
+		allowed = s.usernameRL.Allow(username)
+	}
+	if !allowed {
+		retry := int(math.Ceil(limiter.RetryAfter(key).Seconds()))
+		reason := "login_ip_limit"
+		if limiter == s.usernameRL {
+			reason = "login_username_limit"
+		}
+		s.logger.WarnContext(r.Context(), "rate limit exceeded",
+			"reason", reason,
+			"ip", ip,
+			"username", username,
+			"route", r.Method+" "+r.URL.Path,
+			"count", limiter.Count(key),
+			"limit", limiter.Limit(),
+			"window", limiter.Window(),
+			"retryAfter", retry,
+		)
+		w.Header().Set("Retry-After", strconv.Itoa(max(retry, 1)))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	identity, err := s.authn.Authenticate(r.Context(), username, password)
+	if err != nil {
+		s.logger.WarnContext(r.Context(), "failed login attempt", "username", username, "ip", ip, "error", err)
+		if sess := s.currentSession(); sess != nil {
+			sess.SecurityEvent("failed_login", ip, username)
+		}
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
+	if s.cfg.RequireTOTP && !s.checkTOTP(w, r, identity, ip) {
+		return
+	}
 
-	sid, err := s.sessions.Create(username)
+	sid, err := s.sessions.Create(identity)
 	if err != nil {
-		s.logger.Error("create session", "error", err)
+		s.logger.ErrorContext(r.Context(), "create session", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	auth.SetSessionCookie(w, sid, s.cfg.AuthConfig.Secure)
-	s.logger.Info("user logged in", "username", username, "ip", ip)
+	s.usernameRL.Reset(username)
+	auth.SetSessionCookie(w, s.cookieConfig(r), sid)
+	s.logger.InfoContext(r.Context(), "user logged in", "username", username, "ip", ip)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
-	sid := auth.GetSessionID(r)
+	sid := auth.GetSessionID(r, s.cfg.AuthConfig)
 	if sid != "" {
 		s.sessions.Delete(sid)
 	}
-	auth.ClearSessionCookie(w, s.cfg.AuthConfig.Secure)
+	auth.ClearSessionCookie(w, s.cookieConfig(r))
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// cookieConfig is the auth config for setting cookies on r's response. It
+// marks them Secure when a trusted proxy terminated TLS for r.
+func (s *Server) cookieConfig(r *http.Request) auth.Config {
+	cfg := s.cfg.AuthConfig
+	if !cfg.Secure && s.forwardedHTTPS(r) {
+		cfg.Secure = true
+	}
+	return cfg
+}
+
+// forwardedHTTPS reports whether r came through a trusted proxy that
+// received it over HTTPS. The peer address is checked rather than
+// X-Forwarded-For, which the client controls.
+func (s *Server) forwardedHTTPS(r *http.Request) bool {
+	if !s.cfg.TrustForwardedProto || !s.cfg.TrustedProxies.Contains(r.RemoteAddr) {
+		return false
+	}
+	// A chain of proxies lists the scheme each one saw; the first is the
+	// client's.
+	proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
 func (s *Server) handleTerminal(w http.ResponseWriter, r *http.Request) {
-	staticFS, err := fs.Sub(ui.StaticFS, "static")
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The ?vt= form exists for embedding the read-only view in an iframe.
+	if !auth.ViewTokenQueryAuthenticated(r) {
+		w.Header().Set("X-Frame-Options", "DENY")
+	}
+	s.servePage(w, r, "terminal.html")
+}
+
+type statusResponse struct {
+	Command       string     `json:"command"`
+	Running       bool       `json:"running"`
+	StartedAt     *time.Time `json:"startedAt,omitempty"`
+	UptimeSeconds int64      `json:"uptimeSeconds"`
+	Clients       int        `json:"clients"`
+	// Latency is set when the session keeps latency stats.
+	Latency *session.LatencyStats `json:"latency,omitempty"`
+	// Deadline is set when the session has an idle timeout.
+	Deadline *session.Deadline `json:"deadline,omitempty"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	resp := statusResponse{Command: s.cfg.SessionCfg.Command}
+	if sess := s.currentSession(); sess != nil {
+		startedAt := sess.StartedAt().UTC()
+		resp.Command = sess.Command()
+		resp.StartedAt = &startedAt
+		resp.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+		resp.Clients = sess.ClientCount()
+		if st, ok := sess.LatencyStats(); ok {
+			resp.Latency = &st
+		}
+		if d, ok := sess.Deadline(); ok {
+			resp.Deadline = &d
+		}
+		select {
+		case <-sess.Done():
+		default:
+			resp.Running = true
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	if identity.Role != "" && identity.Role != auth.RoleOwner {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ansi"
+	}
+	if format != "ansi" && format != "txt" {
+		http.Error(w, "format must be ansi or txt", http.StatusBadRequest)
+		return
+	}
+
+	sess := s.currentSession()
+	if sess == nil {
+		http.Error(w, "No session has been started", http.StatusNotFound)
+		return
+	}
+
+	// A large spool can take longer than the server's write timeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="vexshare-history.%s"`, format))
+
+	var out io.Writer = w
+	if format == "txt" {
+		out = ansi.NewStripWriter(w)
+	}
+	if _, err := sess.WriteHistory(out); err != nil {
+		s.logger.DebugContext(r.Context(), "history download interrupted", "error", err)
 		return
 	}
-	data, err := fs.ReadFile(staticFS, "terminal.html")
+	s.logger.InfoContext(r.Context(), "history downloaded", "user", identity.Username, "format", format)
+}
+
+func (s *Server) handleWSTicket(w http.ResponseWriter, r *http.Request) {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	ticket, err := s.tickets.Issue(identity)
 	if err != nil {
+		s.logger.ErrorContext(r.Context(), "issue ws ticket", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.Header().Set("X-Frame-Options", "DENY")
-	w.Write(data)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"ticket":    ticket,
+		"expiresIn": int(s.tickets.TTL().Seconds()),
+	})
 }
 
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	// WebSockets over HTTP/2 (RFC 8441) are not supported, so an h2c
+	// request here gets a clear answer rather than a failed handshake.
+	if r.ProtoMajor != 1 {
+		s.logger.WarnContext(r.Context(), "websocket request over HTTP/2 rejected", "proto", r.Proto, "path", ratelimit.RedactPath(r.URL.Path))
+		http.Error(w, "WebSocket connections need HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	ip := s.clientIP(r)
+	if !s.acquireIPSlot(ip) {
+		s.logger.WarnContext(r.Context(), "rate limit exceeded",
+			"reason", "ws_ip_sessions",
+			"ip", ip,
+			"route", r.Method+" "+ratelimit.RedactPath(r.URL.Path),
+			"limit", s.cfg.MaxSessionsPerIP,
+		)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	identity, _ := auth.IdentityFromContext(r.Context())
+	if !s.wsPerToken.acquire(identity.Token, s.cfg.TokenMaxConnections) {
+		s.releaseIPSlot(ip)
+		s.logger.WarnContext(r.Context(), "rate limit exceeded",
+			"reason", "ws_token_connections",
+			"ip", ip,
+			"token", identity.Token,
+			"route", r.Method+" "+ratelimit.RedactPath(r.URL.Path),
+			"limit", s.cfg.TokenMaxConnections,
+		)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+	upgraded := false
+	defer func() {
+		if !upgraded {
+			s.releaseIPSlot(ip)
+			s.releaseTokenSlot(identity.Token)
+		}
+	}()
+
+	// A named session must already exist. The default one may still have
+	// to be started, which waits until the upgrade has succeeded so that a
+	// rejected request cannot spawn the command.
+	var sess *session.Session
+	if name := r.PathValue("name"); name != "" {
+		if sess = s.namedSession(name); sess == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+	}
+
+	// The connection outlives the request, so the server's write timeout
+	// must not apply to it.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	// status stays 0 if the handshake failed after the 101 was sent.
+	var status int
+	upgrader := s.upgrader
+	upgrader.Error = func(w http.ResponseWriter, r *http.Request, code int, reason error) {
+		status = code
+		if code == http.StatusBadRequest {
+			w.Header().Set("Sec-WebSocket-Version", "13")
+		}
+		http.Error(w, reason.Error(), code)
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		s.logger.Error("websocket upgrade failed", "error", err, "ip", ratelimit.ExtractIP(r))
+		s.logger.ErrorContext(r.Context(), "websocket upgrade failed",
+			"error", err,
+			"status", status,
+			"ip", ip,
+			"origin", r.Header.Get("Origin"),
+			"path", ratelimit.RedactPath(r.URL.Path),
+		)
 		return
 	}
+	upgraded = true
+	if sess == nil {
+		if sess, err = s.session(); err != nil {
+			s.logger.ErrorContext(r.Context(), "start session", "error", err)
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "cannot start session"),
+				time.Now().Add(time.Second),
+			)
+			conn.Close()
+			s.releaseIPSlot(ip)
+			s.releaseTokenSlot(identity.Token)
+			return
+		}
+	}
 
 	clientID := generateClientID()
-	ip := ratelimit.ExtractIP(r)
-	s.logger.Info("websocket connection", "client", clientID, "ip", ip)
+	s.logger.InfoContext(r.Context(), "websocket connection", "client", clientID, "ip", ip)
 
-	s.sess.AddClient(clientID, conn)
+	info := session.AuthInfo{
+		RequestID:   requestID(r.Context()),
+		Username:    identity.Username,
+		DisplayName: identity.DisplayName,
+		Groups:      identity.Groups,
+		Role:        string(identity.Role),
+		IP:          ip,
+	}
+	var c *session.Client
+	if token := r.URL.Query().Get("resume"); token != "" {
+		c, _ = sess.Resume(token, conn, info)
+	}
+	if c == nil {
+		if !sess.AwaitConsent(clientID, conn, info) {
+			s.releaseIPSlot(ip)
+			s.releaseTokenSlot(identity.Token)
+			return
+		}
+		c = sess.AddClient(clientID, conn, info)
+	}
+	if c == nil {
+		_ = conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "session closed"),
+			time.Now().Add(time.Second),
+		)
+		conn.Close()
+		s.releaseIPSlot(ip)
+		s.releaseTokenSlot(identity.Token)
+		return
+	}
+	go func() {
+		<-c.Done()
+		s.releaseIPSlot(ip)
+		s.releaseTokenSlot(identity.Token)
+	}()
+}
+
+// acquireIPSlot counts a WebSocket connection from ip, failing when ip
+// already holds MaxSessionsPerIP of them.
+func (s *Server) acquireIPSlot(ip string) bool {
+	return s.wsPerIP.acquire(ip, s.cfg.MaxSessionsPerIP)
+}
+
+func (s *Server) releaseIPSlot(ip string) {
+	s.wsPerIP.release(ip)
+}
+
+// releaseTokenSlot gives back the slot handleWS took for token, which is
+// empty when no share token was used.
+func (s *Server) releaseTokenSlot(token string) {
+	if token != "" {
+		s.wsPerToken.release(token)
+	}
+}
+
+// slotCounter counts open connections by key. A key's entry is deleted
+// when its count drops to zero, so the map holds only keys with open
+// connections.
+type slotCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// acquire counts a connection under key, failing when key already holds
+// limit of them. An empty key or a limit of zero always succeeds without
+// counting.
+func (sc *slotCounter) acquire(key string, limit int) bool {
+	if limit <= 0 || key == "" {
+		return true
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.counts[key] >= limit {
+		return false
+	}
+	if sc.counts == nil {
+		sc.counts = make(map[string]int)
+	}
+	sc.counts[key]++
+	return true
+}
+
+// release gives back a connection acquire counted under key.
+func (sc *slotCounter) release(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	n, ok := sc.counts[key]
+	if !ok {
+		return
+	}
+	if n <= 1 {
+		delete(sc.counts, key)
+		return
+	}
+	sc.counts[key] = n - 1
 }
 
 func generateClientID() string {
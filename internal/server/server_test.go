@@ -0,0 +1,2689 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+
+	"github.com/vextm/vexshare/internal/auth"
+	"github.com/vextm/vexshare/internal/ipfilter"
+	"github.com/vextm/vexshare/internal/origin"
+	"github.com/vextm/vexshare/internal/ratelimit"
+	"github.com/vextm/vexshare/internal/session"
+)
+
+type fixedAuthenticator struct {
+	identity auth.Identity
+	password string
+}
+
+func (f fixedAuthenticator) Authenticate(ctx context.Context, username, password string) (auth.Identity, error) {
+	if username != f.identity.Username || password != f.password {
+		return auth.Identity{}, auth.ErrInvalidCredentials
+	}
+	return f.identity, nil
+}
+
+// loopbackProxy trusts the test client as a reverse proxy, so a test can
+// pick its client address with X-Forwarded-For.
+var loopbackProxy, _ = ipfilter.Parse("127.0.0.1")
+
+func newTestServer(t *testing.T, cfg Config) (*Server, *httptest.Server) {
+	t.Helper()
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if cfg.SessionCfg.Command == "" {
+		cfg.SessionCfg.Command = "cat"
+	}
+	s := New(cfg)
+	if !cfg.LazyStart {
+		if _, err := s.session(); err != nil {
+			t.Fatalf("start session: %v", err)
+		}
+	}
+	ts := httptest.NewServer(s.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		if sess := s.currentSession(); sess != nil {
+			sess.Close()
+		}
+		s.closeNamedSessions()
+	})
+	return s, ts
+}
+
+func login(t *testing.T, ts *httptest.Server, username, password string) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	form := url.Values{"username": {username}, "password": {password}}
+	resp, err := client.PostForm(ts.URL+"/login", form)
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login: expected 303, got %d", resp.StatusCode)
+	}
+	return client
+}
+
+func dialWS(t *testing.T, ts *httptest.Server, path string, client *http.Client) *websocket.Conn {
+	t.Helper()
+	u, _ := url.Parse(ts.URL)
+	header := http.Header{}
+	if client != nil && client.Jar != nil {
+		for _, c := range client.Jar.Cookies(u) {
+			header.Add("Cookie", c.String())
+		}
+	}
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + path
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v (status %d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+type testMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func readUntil(t *testing.T, conn *websocket.Conn, msgType string) testMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg testMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %q message: %v", msgType, err)
+		}
+		if msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+func TestLoginIdentityPropagatesToWebSocket(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password"},
+		Authenticator: fixedAuthenticator{
+			identity: auth.Identity{Username: "alice", DisplayName: "Alice Liddell", Groups: []string{"ops"}},
+			password: "wonderland",
+		},
+	})
+
+	client := login(t, ts, "alice", "wonderland")
+	conn := dialWS(t, ts, "/ws", client)
+
+	msg := readUntil(t, conn, "role")
+	var role struct {
+		Role   string   `json:"role"`
+		User   string   `json:"user"`
+		Groups []string `json:"groups"`
+	}
+	if err := json.Unmarshal(msg.Data, &role); err != nil {
+		t.Fatalf("decode role: %v", err)
+	}
+	if role.Role != "controller" {
+		t.Errorf("role: got %q, want controller", role.Role)
+	}
+	if role.User != "Alice Liddell" {
+		t.Errorf("user: got %q, want %q", role.User, "Alice Liddell")
+	}
+	if len(role.Groups) != 1 || role.Groups[0] != "ops" {
+		t.Errorf("groups: got %v", role.Groups)
+	}
+}
+
+func TestLoginRejectedByAuthenticator(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password"},
+		Authenticator: fixedAuthenticator{
+			identity: auth.Identity{Username: "alice"},
+			password: "wonderland",
+		},
+	})
+	resp, err := http.PostForm(ts.URL+"/login", url.Values{"username": {"alice"}, "password": {"nope"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func requestTicket(t *testing.T, client *http.Client, ticketURL string) string {
+	t.Helper()
+	resp, err := client.Post(ticketURL, "", nil)
+	if err != nil {
+		t.Fatalf("ws-ticket: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("ws-ticket: expected 200, got %d", resp.StatusCode)
+	}
+	var body struct {
+		Ticket    string `json:"ticket"`
+		ExpiresIn int    `json:"expiresIn"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode ticket: %v", err)
+	}
+	if body.Ticket == "" || body.ExpiresIn <= 0 {
+		t.Fatalf("unexpected ticket response %+v", body)
+	}
+	return body.Ticket
+}
+
+func TestWSTicketPasswordMode(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+	})
+	client := login(t, ts, "vex", "pw")
+	ticket := requestTicket(t, client, ts.URL+"/ws-ticket")
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?ticket=" + url.QueryEscape(ticket)
+	header := http.Header{"Origin": {"https://elsewhere.example"}}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("dial with ticket: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, "role")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("expected reused ticket to be rejected")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("reused ticket: expected 403, got %v", resp)
+	}
+}
+
+func TestWSEmptyTicketChecksOrigin(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+	})
+	client := login(t, ts, "vex", "pw")
+	u, _ := url.Parse(ts.URL)
+	// An empty ticket falls back to the cookie, so a foreign page must not
+	// get past the origin check with it.
+	for _, path := range []string{"/ws", "/ws?ticket="} {
+		header := http.Header{"Origin": {"https://evil.example"}}
+		for _, c := range client.Jar.Cookies(u) {
+			header.Add("Cookie", c.String())
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, header)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: cross-origin upgrade with the cookie accepted", path)
+		}
+		if resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %v", path, resp)
+		}
+	}
+}
+
+func TestWSTicketRequiresAuth(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	resp, err := http.Post(ts.URL+"/ws-ticket", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected unauthenticated ticket request to fail")
+	}
+
+	ticket := requestTicket(t, http.DefaultClient, ts.URL+"/t/tok-0123456789abcdef/ws-ticket")
+	conn := dialWS(t, ts, "/ws?ticket="+url.QueryEscape(ticket), nil)
+	readUntil(t, conn, "role")
+
+	_, resp, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected ticketless /ws to be forbidden in token mode")
+	}
+}
+
+func TestBasicAuthMode(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "basic", Username: "vex", Password: "pw"},
+	})
+	do := func(method, path, user, pass string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := do("GET", "/", "", "")
+	if resp.StatusCode != http.StatusUnauthorized || !strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), `Basic realm="vexShare"`) {
+		t.Errorf("no credentials: got %d, WWW-Authenticate %q", resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+	}
+	if resp := do("GET", "/", "vex", "pw"); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid credentials: got %d", resp.StatusCode)
+	}
+
+	resp = do("POST", "/ws-ticket", "vex", "pw")
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Ticket == "" {
+		t.Fatalf("ws-ticket: status %d, %v", resp.StatusCode, err)
+	}
+	conn := dialWS(t, ts, "/ws?ticket="+url.QueryEscape(body.Ticket), nil)
+	if role := roleOf(t, readUntil(t, conn, "role")); role != "controller" {
+		t.Errorf("role = %q, want controller", role)
+	}
+
+	// Wrong passwords count against the login limit; good ones do not.
+	for i := 0; i < 5; i++ {
+		if resp := do("GET", "/", "vex", "guess"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d: got %d", i+1, resp.StatusCode)
+		}
+	}
+	if resp := do("GET", "/", "vex", "pw"); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("after 5 wrong passwords: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestAPIKeyMode(t *testing.T) {
+	const key = "vsx_apikey0123456789"
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "apikey", Token: key},
+	})
+	do := func(method, path, key string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	if resp := do("GET", "/api/status", ""); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no key: got %d, want 401", resp.StatusCode)
+	}
+	if resp := do("GET", "/api/status", key); resp.StatusCode != http.StatusOK {
+		t.Errorf("valid key: got %d", resp.StatusCode)
+	}
+	// The path-based token URLs belong to --auth token.
+	if resp := do("GET", "/t/"+key+"/", ""); resp.StatusCode == http.StatusOK {
+		t.Errorf("token URL served in apikey mode")
+	}
+
+	resp := do("POST", "/ws-ticket", key)
+	var body struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Ticket == "" {
+		t.Fatalf("ws-ticket: status %d, %v", resp.StatusCode, err)
+	}
+	conn := dialWS(t, ts, "/ws?ticket="+url.QueryEscape(body.Ticket), nil)
+	if role := roleOf(t, readUntil(t, conn, "role")); role != "controller" {
+		t.Errorf("role = %q, want controller", role)
+	}
+
+	// Wrong keys count against the login limit; requests without one do not.
+	do("GET", "/", "")
+	for i := 0; i < 5; i++ {
+		if resp := do("GET", "/", "vsx_wrong0123456789ab"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("wrong key %d: got %d", i+1, resp.StatusCode)
+		}
+	}
+	if resp := do("GET", "/", key); resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("after 5 wrong keys: got %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	get := func(ts *httptest.Server, path string, header http.Header) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		Build:      BuildInfo{Version: "1.2.3", Commit: "abc123"},
+	})
+	resp := get(ts, "/version", nil)
+	var info BuildInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /version: %d, %v", resp.StatusCode, err)
+	}
+	if info.Version != "1.2.3" || info.Commit != "abc123" || info.GoVersion != runtime.Version() {
+		t.Errorf("build info = %+v", info)
+	}
+	tag := resp.Header.Get("ETag")
+	if tag == "" || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("ETag %q, Content-Type %q", tag, resp.Header.Get("Content-Type"))
+	}
+	if resp := get(ts, "/version", http.Header{"If-None-Match": {tag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("revalidation: got %d, want 304", resp.StatusCode)
+	}
+
+	_, ts = newTestServer(t, Config{
+		AuthConfig:          auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		VersionRequiresAuth: true,
+	})
+	if resp := get(ts, "/version", nil); resp.StatusCode == http.StatusOK {
+		t.Errorf("GET /version without auth: got 200")
+	}
+	if resp := get(ts, "/t/tok-0123456789abcdef/version", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /t/tok-0123456789abcdef/version: got %d", resp.StatusCode)
+	}
+}
+
+func TestTOTPEnrollmentAndLogin(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	// Password "allmine".
+	content := `[{"username": "alice", "hash": "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "role": "owner"}]`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := auth.LoadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		AuthConfig:    auth.Config{Mode: "password"},
+		Authenticator: users,
+		RequireTOTP:   true,
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, ts := newTestServer(t, cfg)
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	post := func(path string, form url.Values) *http.Response {
+		t.Helper()
+		resp, err := client.PostForm(ts.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	loggedIn := func() bool {
+		resp, err := client.Get(ts.URL + "/api/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}
+
+	// The first login hands out a secret instead of a session.
+	resp := post("/login", url.Values{"username": {"alice"}, "password": {"allmine"}})
+	var msg struct {
+		Type string `json:"type"`
+		Data struct {
+			SetupURL string `json:"setupURL"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil || msg.Type != "mfa_required" || !strings.HasPrefix(msg.Data.SetupURL, "otpauth://totp/") {
+		t.Fatalf("first login: %d %+v, %v", resp.StatusCode, msg, err)
+	}
+	if loggedIn() {
+		t.Fatal("logged in before confirming TOTP")
+	}
+	setup, _ := url.Parse(msg.Data.SetupURL)
+	secret := setup.Query().Get("secret")
+
+	resp, err = client.Get(ts.URL + "/mfa/enrollment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&enrollment)
+	resp.Body.Close()
+	if enrollment.Secret != secret {
+		t.Errorf("enrollment secret %q, want %q", enrollment.Secret, secret)
+	}
+
+	if resp := post("/mfa/setup", url.Values{"code": {"000000"}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong setup code: got %d", resp.StatusCode)
+	}
+	code, _ := auth.TOTPCode(secret, time.Now())
+	if resp := post("/mfa/setup", url.Values{"code": {code}}); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("setup: got %d", resp.StatusCode)
+	}
+	if !loggedIn() {
+		t.Fatal("not logged in after enrolling")
+	}
+	if users.TOTPSecret("alice") != secret {
+		t.Error("secret not saved to the users file")
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), secret) {
+		t.Errorf("users file = %s", data)
+	}
+
+	// Later logins need a code. Every attempt counts against the login
+	// limit of 5 a minute, so this stays under it.
+	jar, _ = cookiejar.New(nil)
+	client.Jar = jar
+	resp = post("/login", url.Values{"username": {"alice"}, "password": {"allmine"}})
+	msg.Type = ""
+	_ = json.NewDecoder(resp.Body).Decode(&msg)
+	if resp.StatusCode != http.StatusUnauthorized || msg.Type != "mfa_code_required" {
+		t.Errorf("login without code: %d %q", resp.StatusCode, msg.Type)
+	}
+	// The code that confirmed the setup cannot be used again, but the next
+	// one can. That is one attempt more than the limit allows.
+	s.loginRL.Reset("127.0.0.1")
+	if resp := post("/login", url.Values{"username": {"alice"}, "password": {"allmine"}, "code": {code}}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("login with the setup code again: %d", resp.StatusCode)
+	}
+	next, _ := auth.TOTPCode(secret, time.Now().Add(30*time.Second))
+	if resp := post("/login", url.Values{"username": {"alice"}, "password": {"allmine"}, "code": {next}}); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("login with code: %d", resp.StatusCode)
+	}
+	if !loggedIn() {
+		t.Error("not logged in with a code")
+	}
+}
+
+func TestTOTPNeedsSecretStore(t *testing.T) {
+	cfg := Config{AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"}, RequireTOTP: true}
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected RequireTOTP without a users file to be rejected")
+	}
+}
+
+func TestAdminShortLinks(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:     auth.Config{Mode: "token", Token: "tok-1234567890abcdef", ViewToken: "view-1234567890abcdef"},
+		TrustedProxies: loopbackProxy,
+		AdminToken:     "admin-secret-123456",
+		ShortURLBase:   "https://vshr.example.com/",
+	})
+	shorten := func(query string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/admin/shorten?"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	follow := func(path, ip string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, err := noRedirect.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for _, q := range []string{"token=wrong", "token=", "token=tok-1234567890abcdef&ttl=-1h"} {
+		if resp := shorten(q); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("shorten %s: got %d, want 400", q, resp.StatusCode)
+		}
+	}
+
+	for _, tt := range []struct{ token, target string }{
+		{"tok-1234567890abcdef", "/t/tok-1234567890abcdef/"},
+		{"view-1234567890abcdef", "/t/view-1234567890abcdef/"},
+	} {
+		resp := shorten("token=" + tt.token)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("shorten: got %d, want 201", resp.StatusCode)
+		}
+		var link shortenResponse
+		_ = json.NewDecoder(resp.Body).Decode(&link)
+		if link.ShortURL != "https://vshr.example.com/s/"+link.Code || len(link.Code) != 12 || link.ExpiresAt != nil {
+			t.Fatalf("unexpected shorten response %+v", link)
+		}
+		resp = follow("/s/"+link.Code, "198.51.100.1")
+		if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != tt.target {
+			t.Errorf("short link: got %d to %q, want 302 to %s", resp.StatusCode, resp.Header.Get("Location"), tt.target)
+		}
+	}
+
+	resp := shorten("token=tok-1234567890abcdef&ttl=1h")
+	var link shortenResponse
+	_ = json.NewDecoder(resp.Body).Decode(&link)
+	if link.ExpiresAt == nil || time.Until(*link.ExpiresAt) > time.Hour {
+		t.Errorf("ttl: expiresAt = %v", link.ExpiresAt)
+	}
+
+	// Guessing codes counts against the login limit.
+	for i := 0; i < 5; i++ {
+		if resp := follow("/s/guess"+strconv.Itoa(i), "203.0.113.9"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("unknown code: got %d, want 404", resp.StatusCode)
+		}
+	}
+	if resp := follow("/s/"+link.Code, "203.0.113.9"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("after 5 misses: got %d, want 429", resp.StatusCode)
+	}
+}
+
+func TestMaxPendingLogins(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:       auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		MaxPendingLogins: 2,
+	})
+	// Two logins whose bodies never arrive hold both slots.
+	var slow []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		slow = append(slow, conn)
+		fmt.Fprintf(conn, "POST /login HTTP/1.1\r\nHost: x\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 100\r\n\r\nuser")
+	}
+
+	post := func() int {
+		resp, err := http.PostForm(ts.URL+"/login", url.Values{"username": {"vex"}, "password": {"pw"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// The slow requests reach the handler in their own time.
+	deadline := time.Now().Add(5 * time.Second)
+	for post() != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("login beyond the limit was not refused with 503")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Hanging up frees the slots.
+	for _, conn := range slow {
+		conn.Close()
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for post() == http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("slots not released after the slow clients left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminMetrics(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:     auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		AdminToken:     "admin-secret-123456",
+		MaxConnections: 100,
+	})
+
+	resp, err := http.Get(ts.URL + "/admin/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("without the admin token: %d, want 401", resp.StatusCode)
+	}
+
+	for path, wants := range map[string][]string{
+		"/admin/metrics": {
+			"# TYPE vexshare_pty_output_bytes_per_second gauge\nvexshare_pty_output_bytes_per_second{session=\"\"} ",
+			"# TYPE vexshare_connections_open gauge\nvexshare_connections_open ",
+			"# TYPE vexshare_connections_refused_total counter\nvexshare_connections_refused_total 0\n",
+			"# TYPE vexshare_connections_slow_timeouts_total counter\nvexshare_connections_slow_timeouts_total 0\n",
+			"# TYPE vexshare_connections_slow_client_bans_total counter\nvexshare_connections_slow_client_bans_total 0\n",
+		},
+		"/admin/stats": {`"outputBytesPerSecond":`},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		for _, want := range wants {
+			if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), want) {
+				t.Errorf("GET %s: %d %q, want %q", path, resp.StatusCode, body, want)
+			}
+		}
+		if path == "/admin/metrics" && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Errorf("metrics Content-Type = %q", resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func readOutputUntil(t *testing.T, conn *websocket.Conn, want string) string {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var out strings.Builder
+	for !strings.Contains(out.String(), want) {
+		var msg testMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for output %q (got %q): %v", want, out.String(), err)
+		}
+		if msg.Type != "output" {
+			continue
+		}
+		var chunk string
+		_ = json.Unmarshal(msg.Data, &chunk)
+		out.WriteString(chunk)
+	}
+	return out.String()
+}
+
+func TestDuplicateInputSeqDropped(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+
+	for _, m := range []map[string]any{
+		{"type": "input", "data": "first\n", "seq": 1},
+		{"type": "input", "data": "dup\n", "seq": 1},
+		{"type": "input", "data": "last\n", "seq": 2},
+	} {
+		if err := conn.WriteJSON(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out := readOutputUntil(t, conn, "last")
+	if strings.Contains(out, "dup") {
+		t.Errorf("duplicate seq reached the PTY: %q", out)
+	}
+	if !strings.Contains(out, "first") {
+		t.Errorf("expected first input in output: %q", out)
+	}
+}
+
+func TestUsersFileRolesMapToSessionPermissions(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	// Both accounts use the password "allmine".
+	content := `[
+		{"username": "alice", "hash": "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "role": "owner"},
+		{"username": "bob", "hash": "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "role": "viewer"}
+	]`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := auth.LoadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTestServer(t, Config{
+		AuthConfig:    auth.Config{Mode: "password"},
+		Authenticator: users,
+	})
+
+	roleOf := func(conn *websocket.Conn) (string, string) {
+		var role struct {
+			Role   string `json:"role"`
+			Access string `json:"access"`
+		}
+		_ = json.Unmarshal(readUntil(t, conn, "role").Data, &role)
+		return role.Role, role.Access
+	}
+
+	bob := dialWS(t, ts, "/ws", login(t, ts, "bob", "allmine"))
+	if role, access := roleOf(bob); role != "viewer" || access != "viewer" {
+		t.Errorf("bob: got role=%q access=%q, want viewer/viewer", role, access)
+	}
+	alice := dialWS(t, ts, "/ws", login(t, ts, "alice", "allmine"))
+	if role, access := roleOf(alice); role != "controller" || access != "owner" {
+		t.Errorf("alice: got role=%q access=%q, want controller/owner", role, access)
+	}
+
+	_ = bob.WriteJSON(map[string]any{"type": "input", "data": "from-bob\n"})
+	_ = alice.WriteJSON(map[string]any{"type": "input", "data": "from-alice\n"})
+	out := readOutputUntil(t, alice, "from-alice")
+	if strings.Contains(out, "from-bob") {
+		t.Errorf("viewer input reached the PTY: %q", out)
+	}
+}
+
+func TestStatusEndpoint(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password+token", Username: "vex", Password: "pw", Token: "tok-0123456789abcdef"},
+	})
+
+	resp, err := http.Get(ts.URL + "/t/wrong/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("bad token: expected 403, got %d", resp.StatusCode)
+	}
+
+	for _, get := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return http.Get(ts.URL + "/t/tok-0123456789abcdef/api/status") },
+		func() (*http.Response, error) { return login(t, ts, "vex", "pw").Get(ts.URL + "/api/status") },
+	} {
+		resp, err := get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status statusResponse
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("decode status: %v", err)
+		}
+		if status.Command != "cat" {
+			t.Errorf("command: got %q, want cat", status.Command)
+		}
+		if !status.Running || status.StartedAt == nil || time.Since(*status.StartedAt) > time.Minute {
+			t.Errorf("unexpected startedAt %v", status.StartedAt)
+		}
+		if status.Latency != nil {
+			t.Errorf("latency reported without latency stats: %+v", status.Latency)
+		}
+		if status.Deadline != nil {
+			t.Errorf("deadline reported without an idle timeout: %+v", status.Deadline)
+		}
+	}
+}
+
+func TestStatusDeadline(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg: session.Config{IdleTimeout: 30 * time.Minute},
+	})
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	var role struct {
+		Deadline *session.Deadline `json:"deadline"`
+	}
+	_ = json.Unmarshal(readUntil(t, conn, "role").Data, &role)
+	if role.Deadline == nil || role.Deadline.IdleTimeoutSeconds != 1800 || role.Deadline.RemainingSeconds > 1800 {
+		t.Errorf("role message deadline = %+v", role.Deadline)
+	}
+
+	resp, err := http.Get(ts.URL + "/t/tok-0123456789abcdef/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status statusResponse
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if d := status.Deadline; d == nil || d.IdleTimeoutSeconds != 1800 || d.RemainingSeconds+d.IdleSeconds > 1800 {
+		t.Errorf("status deadline = %+v", status.Deadline)
+	}
+}
+
+func TestStatusLatency(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg: session.Config{LatencyStats: true},
+	})
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+	sendInput(t, conn, "hello\n")
+	readOutputUntil(t, conn, "hello")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(ts.URL + "/t/tok-0123456789abcdef/api/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status statusResponse
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		if status.Latency == nil {
+			t.Fatal("status has no latency")
+		}
+		if status.Latency.Enqueue.Samples > 0 && status.Latency.Write.Samples > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("latency never sampled: %+v", status.Latency)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLazyStartCreatesExactlyOneSession(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		LazyStart:  true,
+	})
+	if s.currentSession() != nil {
+		t.Fatal("lazy server should not start a session before the first client")
+	}
+
+	// Requests that never become a WebSocket do not start the command.
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/t/tok-0123456789abcdef/ws"
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.example"}}); err == nil {
+		t.Fatal("cross-origin upgrade succeeded")
+	}
+	if resp, err := http.Get(ts.URL + "/t/tok-0123456789abcdef/ws"); err == nil {
+		resp.Body.Close()
+	}
+	if s.currentSession() != nil {
+		t.Fatal("a rejected upgrade started the session")
+	}
+
+	resp, err := http.Get(ts.URL + "/t/tok-0123456789abcdef/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status statusResponse
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Running || status.Command != "cat" {
+		t.Errorf("status before first client: %+v", status)
+	}
+
+	const racers = 8
+	conns := make(chan *websocket.Conn, racers)
+	errs := make(chan error, racers)
+	for i := 0; i < racers; i++ {
+		go func() {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conns <- conn
+		}()
+	}
+	controllers := 0
+	for i := 0; i < racers; i++ {
+		select {
+		case err := <-errs:
+			t.Fatalf("dial: %v", err)
+		case conn := <-conns:
+			defer conn.Close()
+			var role struct {
+				Role string `json:"role"`
+			}
+			_ = json.Unmarshal(readUntil(t, conn, "role").Data, &role)
+			if role.Role == "controller" {
+				controllers++
+			}
+		}
+	}
+	if controllers != 1 {
+		t.Errorf("expected exactly one controller across racing clients, got %d", controllers)
+	}
+	sess := s.currentSession()
+	if sess == nil || sess.ClientCount() != racers {
+		t.Fatalf("expected one session holding all %d clients", racers)
+	}
+
+	sess.Close()
+	next, err := s.session()
+	if err != nil {
+		t.Fatalf("session after close: %v", err)
+	}
+	if next == sess {
+		t.Error("expected a fresh session after the previous one closed")
+	}
+}
+
+func TestHistoryEndpoint(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	content := `[
+		{"username": "alice", "hash": "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "role": "owner"},
+		{"username": "bob", "hash": "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", "role": "viewer"}
+	]`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := auth.LoadUsersFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTestServer(t, Config{
+		AuthConfig:    auth.Config{Mode: "password"},
+		Authenticator: users,
+	})
+
+	alice := login(t, ts, "alice", "allmine")
+	conn := dialWS(t, ts, "/ws", alice)
+	readUntil(t, conn, "role")
+	_ = conn.WriteJSON(map[string]any{"type": "input", "data": "\x1b[31mred\x1b[0m\n"})
+	readOutputUntil(t, conn, "\x1b[31mred\x1b[0m\r\n")
+
+	get := func(client *http.Client, query string) (int, string) {
+		resp, err := client.Get(ts.URL + "/api/history" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := get(alice, "?format=ansi"); code != http.StatusOK || !strings.Contains(body, "\x1b[31mred") {
+		t.Errorf("ansi: got %d %q", code, body)
+	}
+	if code, body := get(alice, "?format=txt"); code != http.StatusOK || strings.Contains(body, "\x1b") || !strings.Contains(body, "red\n") {
+		t.Errorf("txt: got %d %q", code, body)
+	}
+	if code, _ := get(alice, "?format=html"); code != http.StatusBadRequest {
+		t.Errorf("bad format: expected 400, got %d", code)
+	}
+	if code, _ := get(login(t, ts, "bob", "allmine"), ""); code != http.StatusForbidden {
+		t.Errorf("viewer: expected 403, got %d", code)
+	}
+	anonymous := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	if code, _ := get(anonymous, ""); code != http.StatusSeeOther {
+		t.Errorf("anonymous: expected redirect to login, got %d", code)
+	}
+}
+
+func TestViewTokenQueryParam(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "control-token-123456", ViewToken: "view-token-1234567"},
+	})
+
+	for _, tt := range []struct {
+		query    string
+		wantCode int
+	}{
+		{"?vt=view-token-1234567", http.StatusOK},
+		{"?vt=control-token-123456", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	} {
+		resp, err := http.Get(ts.URL + "/" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantCode {
+			t.Errorf("GET /%s: expected %d, got %d", tt.query, tt.wantCode, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK && resp.Header.Get("X-Frame-Options") != "" {
+			t.Error("embeddable view should not set X-Frame-Options")
+		}
+	}
+
+	conn := dialWS(t, ts, "/ws?vt=view-token-1234567", nil)
+	var role struct {
+		Role   string `json:"role"`
+		Access string `json:"access"`
+	}
+	_ = json.Unmarshal(readUntil(t, conn, "role").Data, &role)
+	if role.Role != "viewer" || role.Access != "viewer" {
+		t.Errorf("view token client: got role=%q access=%q, want viewer/viewer", role.Role, role.Access)
+	}
+}
+
+func TestNoAuthIsReadOnly(t *testing.T) {
+	_, ts := newTestServer(t, Config{AuthConfig: auth.Config{Mode: "none"}})
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /: expected 200, got %d", resp.StatusCode)
+	}
+
+	conn := dialWS(t, ts, "/ws", nil)
+	if role := roleOf(t, readUntil(t, conn, "role")); role != "viewer" {
+		t.Errorf("anonymous client role = %q, want viewer", role)
+	}
+	sendInput(t, conn, "typed\n")
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	for {
+		var msg testMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Type == "output" && strings.Contains(string(msg.Data), "typed") {
+			t.Fatal("input from an anonymous client reached the terminal")
+		}
+	}
+}
+
+func TestAdminExpireSession(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		AdminToken: "admin-secret-123456",
+	})
+	client := login(t, ts, "vex", "pw")
+
+	adminDo := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := adminDo("GET", "/admin/stats")
+	var stats adminStatsResponse
+	_ = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if stats.LoginSessions != 1 || !stats.Running {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	sid := client.Jar.Cookies(u)[0].Value
+	resp = adminDo("DELETE", "/admin/logins/"+sid)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expire: expected 204, got %d", resp.StatusCode)
+	}
+	if s.sessions.Valid(sid) {
+		t.Error("session still valid after admin expiry")
+	}
+	resp, _ = client.Get(ts.URL + "/api/status")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("expired session: expected redirect to login, got %d", resp.StatusCode)
+	}
+
+	// The path the admin API first had works too.
+	other := login(t, ts, "vex", "pw")
+	sid = other.Jar.Cookies(u)[0].Value
+	resp = adminDo("DELETE", "/admin/sessions/"+sid)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || s.sessions.Valid(sid) {
+		t.Errorf("expire through /admin/sessions: got %d, still valid %v", resp.StatusCode, s.sessions.Valid(sid))
+	}
+	resp = adminDo("DELETE", "/admin/sessions/no-such-login")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown id: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestAdminNamedSessions(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		AdminToken: "admin-secret-123456",
+	})
+	client := login(t, ts, "vex", "pw")
+
+	adminDo := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := adminDo("POST", "/admin/sessions", `{"name":"myshell","command":"cat","args":[],"env":["FOO=bar"]}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", resp.StatusCode)
+	}
+	var created createSessionResponse
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	if created.Name != "myshell" || created.WSPath != "/s/myshell/ws" || created.Created.IsZero() {
+		t.Errorf("unexpected create response %+v", created)
+	}
+
+	for _, tt := range []struct {
+		body string
+		want int
+	}{
+		{`{"name":"myshell","command":"cat"}`, http.StatusConflict},
+		{`{"name":"../etc","command":"cat"}`, http.StatusBadRequest},
+		{`{"name":`, http.StatusBadRequest},
+	} {
+		if resp := adminDo("POST", "/admin/sessions", tt.body); resp.StatusCode != tt.want {
+			t.Errorf("create %s: expected %d, got %d", tt.body, tt.want, resp.StatusCode)
+		}
+	}
+
+	conn := dialWS(t, ts, created.WSPath, client)
+	readUntil(t, conn, "role")
+	if err := conn.WriteJSON(map[string]any{"type": "input", "data": "named\n"}); err != nil {
+		t.Fatal(err)
+	}
+	readOutputUntil(t, conn, "named")
+
+	if resp := adminDo("DELETE", "/admin/sessions/myshell", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if resp := adminDo("DELETE", "/admin/sessions/myshell", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second delete: expected 404, got %d", resp.StatusCode)
+	}
+
+	u, _ := url.Parse(ts.URL)
+	header := http.Header{}
+	for _, c := range client.Jar.Cookies(u) {
+		header.Add("Cookie", c.String())
+	}
+	_, wsResp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+created.WSPath, header)
+	if err == nil || wsResp == nil || wsResp.StatusCode != http.StatusNotFound {
+		t.Errorf("dial deleted session: expected 404, got %v", err)
+	}
+}
+
+func TestAdminListSessions(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		AdminToken: "admin-secret-123456",
+	})
+	adminDo := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	list := func(query string) []sessionInfo {
+		resp := adminDo("GET", "/admin/sessions"+query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("list%s: expected 200, got %d", query, resp.StatusCode)
+		}
+		var infos []sessionInfo
+		_ = json.NewDecoder(resp.Body).Decode(&infos)
+		return infos
+	}
+
+	for _, body := range []string{
+		`{"name":"first","command":"cat"}`,
+		`{"name":"second","command":"cat","readOnly":true}`,
+		`{"name":"third","command":"cat"}`,
+	} {
+		if resp := adminDo("POST", "/admin/sessions", body); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create %s: got %d", body, resp.StatusCode)
+		}
+	}
+	if resp := adminDo("DELETE", "/admin/sessions/first", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: got %d", resp.StatusCode)
+	}
+
+	all := list("")
+	var names []string
+	for _, info := range all {
+		names = append(names, info.Name+":"+info.Status)
+	}
+	if got := strings.Join(names, ","); got != "first:closed,second:running,third:running" {
+		t.Errorf("sessions = %s", got)
+	}
+	if len(all) == 3 && (!all[1].ReadOnly || all[1].Command != "cat") {
+		t.Errorf("unexpected entry %+v", all[1])
+	}
+
+	if page := list("?limit=1&offset=1"); len(page) != 1 || page[0].Name != "second" {
+		t.Errorf("page = %+v, want only second", page)
+	}
+	if page := list("?offset=10"); len(page) != 0 {
+		t.Errorf("offset past the end returned %d entries", len(page))
+	}
+	if resp := adminDo("GET", "/admin/sessions?limit=-1", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative limit: expected 400, got %d", resp.StatusCode)
+	}
+
+	// A closed name can be reused at once, and expired entries drop out.
+	if resp := adminDo("POST", "/admin/sessions", `{"name":"first","command":"cat"}`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("reuse closed name: got %d", resp.StatusCode)
+	}
+	adminDo("DELETE", "/admin/sessions/second", "")
+	s.namedMu.Lock()
+	s.named["second"].closedAt = time.Now().Add(-closedSessionRetention - time.Second)
+	s.namedMu.Unlock()
+	if got := len(list("")); got != 2 {
+		t.Errorf("after expiry: %d sessions listed, want 2", got)
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		AdminToken: "admin-secret-123456",
+	})
+	adminDo := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	// The page loads without the token; everything it fetches needs it.
+	resp, err := http.Get(ts.URL + "/admin/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /admin/: got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	resp, err = http.Get(ts.URL + "/admin/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("clients without token: expected 401, got %d", resp.StatusCode)
+	}
+
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+	var clients []adminClientInfo
+	_ = json.NewDecoder(adminDo("GET", "/admin/clients").Body).Decode(&clients)
+	if len(clients) != 1 || clients[0].Session != "" || !clients[0].Controller || clients[0].IP != "127.0.0.1" {
+		t.Fatalf("clients = %+v, want the one controller in the default session", clients)
+	}
+	second := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, second, "role")
+	var byIP map[string]int
+	_ = json.NewDecoder(adminDo("GET", "/admin/connections-by-ip").Body).Decode(&byIP)
+	if len(byIP) != 1 || byIP["127.0.0.1"] != 2 {
+		t.Errorf("connections by IP = %v, want 2 from 127.0.0.1", byIP)
+	}
+	second.Close()
+
+	if resp := adminDo("DELETE", "/admin/clients/"+clients[0].ID); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick: expected 204, got %d", resp.StatusCode)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("kicked client: expected close 1008, got %v", err)
+			}
+			break
+		}
+	}
+	if resp := adminDo("DELETE", "/admin/clients/"+clients[0].ID); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("kick again: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestSessionPathPrefix(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:        auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		AdminToken:        "admin-secret-123456",
+		SessionPathPrefix: "/sessions/",
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/admin/sessions", strings.NewReader(`{"name":"build","command":"cat"}`))
+	req.Header.Set("Authorization", "Bearer admin-secret-123456")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created createSessionResponse
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if created.WSPath != "/sessions/build/ws" {
+		t.Fatalf("wsPath = %q", created.WSPath)
+	}
+
+	client := login(t, ts, "vex", "pw")
+	for path, want := range map[string]int{
+		"/sessions/build/":   http.StatusOK,
+		"/sessions/missing/": http.StatusNotFound,
+	} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+
+	conn := dialWS(t, ts, created.WSPath, client)
+	readUntil(t, conn, "role")
+	if err := conn.WriteJSON(map[string]any{"type": "input", "data": "prefixed\n"}); err != nil {
+		t.Fatal(err)
+	}
+	readOutputUntil(t, conn, "prefixed")
+}
+
+func TestConfigValidateSessionPathPrefix(t *testing.T) {
+	for prefix, wantErr := range map[string]bool{
+		"":          false,
+		"/s/":       false,
+		"/a/b/":     false,
+		"/":         true,
+		"s/":        true,
+		"/sessions": true,
+	} {
+		if err := (Config{SessionPathPrefix: prefix}).Validate(); (err != nil) != wantErr {
+			t.Errorf("prefix %q: error = %v, want error %v", prefix, err, wantErr)
+		}
+	}
+}
+
+func TestAdminTimeline(t *testing.T) {
+	cfg := Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		AdminToken: "admin-secret-123456",
+	}
+	cfg.SessionCfg.IdleTimeout = time.Hour
+	cfg.SessionCfg.IdleExtendStep = 15 * time.Minute
+	_, ts := newTestServer(t, cfg)
+	adminGet := func(path string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+	_ = conn.WriteJSON(map[string]string{"type": "extend"})
+	readUntil(t, conn, "idle")
+
+	var events []session.TimelineEvent
+	_ = json.NewDecoder(adminGet("/admin/timeline").Body).Decode(&events)
+	if len(events) != 1 || events[0].Type != "idle_extend" || events[0].Client == "" {
+		t.Errorf("timeline = %+v", events)
+	}
+	if resp := adminGet("/admin/timeline?session=nope"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown session: got %d", resp.StatusCode)
+	}
+}
+
+// syncBuffer collects log output written from handler goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWSUpgradeFailure(t *testing.T) {
+	logs := &syncBuffer{}
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "secret-tok-0123456789"},
+		Logger:     slog.New(slog.NewJSONHandler(logs, nil)),
+	})
+
+	// A plain GET carrying an Origin but no Upgrade headers.
+	req, _ := http.NewRequest("GET", ts.URL+"/t/secret-tok-0123456789/ws", nil)
+	req.Header.Set("Origin", ts.URL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "'upgrade' token not found") {
+		t.Errorf("got %d %q, want 400 naming the missing header", resp.StatusCode, body)
+	}
+
+	var entry map[string]any
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "websocket upgrade failed") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if entry == nil {
+		t.Fatalf("no upgrade failure logged:\n%s", logs.String())
+	}
+	if entry["status"] != float64(http.StatusBadRequest) || entry["origin"] != ts.URL || entry["path"] != "/t/{token}/ws" {
+		t.Errorf("log entry %v", entry)
+	}
+	if strings.Contains(logs.String(), "secret-tok-0123456789") {
+		t.Error("the token reached the logs")
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logs := &syncBuffer{}
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		Logger:     slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+
+	for _, tt := range []struct {
+		header    string
+		generated bool
+	}{
+		{"", true},
+		{"req-42.a:b", false},
+		{"has space", true},
+		{strings.Repeat("x", 129), true},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+"/login", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Request-Id", tt.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		got := resp.Header.Get("X-Request-Id")
+		if tt.generated && (got == tt.header || len(got) != 16) {
+			t.Errorf("header %q: got ID %q, want a generated one", tt.header, got)
+		}
+		if !tt.generated && got != tt.header {
+			t.Errorf("header %q: got ID %q, want it echoed", tt.header, got)
+		}
+	}
+
+	// The ID follows a WebSocket from the upgrade into the session's lines.
+	header := http.Header{"X-Request-Id": {"visit-7"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/t/tok-0123456789abcdef/ws", header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "role")
+	conn.Close()
+	if resp, err := http.Get(ts.URL + "/t/wrong-token-0123456789/"); err == nil {
+		resp.Body.Close()
+	}
+
+	tagged := map[string]bool{}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !tagged["client disconnected"] {
+		time.Sleep(10 * time.Millisecond)
+		for _, line := range strings.Split(logs.String(), "\n") {
+			var entry map[string]any
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["request_id"] != nil {
+				if entry["request_id"] == "visit-7" {
+					tagged[entry["msg"].(string)] = true
+				} else {
+					tagged["other:"+entry["msg"].(string)] = true
+				}
+			}
+		}
+	}
+	for _, msg := range []string{"websocket connection", "client connected", "client disconnected", "other:invalid token access attempt"} {
+		if !tagged[msg] {
+			t.Errorf("%q was not logged with its request ID; tagged: %v", msg, tagged)
+		}
+	}
+}
+
+func TestPageCompression(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	page, err := s.page("login.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := page.Body
+	// A bare transport, so the client neither adds Accept-Encoding nor
+	// decompresses.
+	get := func(path, encoding, etag string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, body
+	}
+
+	resp, body := get("/login", "gzip, deflate", "")
+	if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("gzip request: headers %v", resp.Header)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("Content-Length %d, body %d bytes", resp.ContentLength, len(body))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); !bytes.Equal(got, want) {
+		t.Error("gzip body does not decompress to the login page")
+	}
+	gzipTag := resp.Header.Get("ETag")
+
+	resp, body = get("/login", "", "")
+	if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(body, want) {
+		t.Errorf("identity request: encoding %q, %d bytes", resp.Header.Get("Content-Encoding"), len(body))
+	}
+	identityTag := resp.Header.Get("ETag")
+	if identityTag == "" || identityTag == gzipTag {
+		t.Errorf("ETags identity %s and gzip %s should differ", identityTag, gzipTag)
+	}
+	if resp, _ := get("/login", "gzip;q=0", ""); resp.Header.Get("Content-Encoding") != "" {
+		t.Error("gzip;q=0 still got gzip")
+	}
+
+	if resp, body := get("/login", "gzip", gzipTag); resp.StatusCode != http.StatusNotModified || len(body) != 0 {
+		t.Errorf("revalidation: got %d with %d bytes, want an empty 304", resp.StatusCode, len(body))
+	}
+	if resp, _ := get("/login", "", gzipTag); resp.StatusCode != http.StatusOK {
+		t.Errorf("gzip ETag matched the identity page: %d", resp.StatusCode)
+	}
+
+	// Dynamic text responses are compressed on the fly.
+	if resp, _ := get("/t/tok-0123456789abcdef/api/status", "gzip", ""); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("status JSON: Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// The WebSocket upgrade is left alone even when gzip is offered.
+	header := http.Header{"Accept-Encoding": {"gzip"}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/t/tok-0123456789abcdef/ws", header)
+	if err != nil {
+		t.Fatalf("upgrade with Accept-Encoding: %v", err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, "role")
+}
+
+func TestTerminalPageETagFollowsContent(t *testing.T) {
+	etagFor := func(cfg Config) string {
+		_, ts := newTestServer(t, cfg)
+		resp, err := http.Get(ts.URL + "/t/tok-0123456789abcdef/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag")
+	}
+	cfg := Config{AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"}}
+	full := etagFor(cfg)
+	if again := etagFor(cfg); again != full {
+		t.Errorf("same page, different ETags: %s and %s", full, again)
+	}
+	minimal := MinimalFeatures()
+	cfg.Features = &minimal
+	if other := etagFor(cfg); other == full {
+		t.Error("the page changed but its ETag did not")
+	}
+}
+
+func TestSharedRateLimitStore(t *testing.T) {
+	// Two instances behind a load balancer see one budget per IP.
+	store := ratelimit.NewMemoryStore()
+	cfg := Config{
+		AuthConfig:     auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		TrustedProxies: loopbackProxy,
+		RateLimitStore: store,
+	}
+	_, a := newTestServer(t, cfg)
+	_, b := newTestServer(t, cfg)
+
+	var codes []int
+	for i := 0; i < 6; i++ {
+		ts := a
+		if i%2 == 1 {
+			ts = b
+		}
+		form := url.Values{"username": {"vex"}, "password": {"wrong"}}
+		req, _ := http.NewRequest("POST", ts.URL+"/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", "198.51.100.9")
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		codes = append(codes, resp.StatusCode)
+	}
+	if codes[5] != http.StatusTooManyRequests {
+		t.Errorf("statuses = %v, want the sixth attempt across both instances limited", codes)
+	}
+}
+
+func TestMinimalFeatures(t *testing.T) {
+	minimal := MinimalFeatures()
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password+token", Username: "vex", Password: "pw", Token: "tok-0123456789abcdef"},
+		Features:   &minimal,
+	})
+	client := login(t, ts, "vex", "pw")
+
+	for path, want := range map[string]int{
+		"/":                                  http.StatusOK,
+		"/t/tok-0123456789abcdef/":           http.StatusOK,
+		"/api/status":                        http.StatusNotFound,
+		"/api/history":                       http.StatusNotFound,
+		"/t/tok-0123456789abcdef/api/status": http.StatusNotFound,
+	} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+		if want == http.StatusOK && !strings.Contains(string(body), `{"features":{"status":false,"history":false}}`) {
+			t.Errorf("GET %s: page does not carry the minimal feature set", path)
+		}
+	}
+
+	// The terminal itself still works.
+	conn := dialWS(t, ts, "/ws", client)
+	readUntil(t, conn, "role")
+	sendInput(t, conn, "minimal\n")
+	readOutputUntil(t, conn, "minimal")
+}
+
+func TestFullFeaturesByDefault(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+	})
+	client := login(t, ts, "vex", "pw")
+	for path, want := range map[string]int{
+		"/api/status":  http.StatusOK,
+		"/api/unknown": http.StatusNotFound,
+	} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: got %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestStartAnnouncesListening(t *testing.T) {
+	pr, pw := io.Pipe()
+	s := New(Config{
+		ListenAddr:  "127.0.0.1:0",
+		AuthConfig:  auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg:  session.Config{Command: "cat"},
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ReadyOutput: pw,
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- s.Start() }()
+
+	var ev listeningEvent
+	if err := json.NewDecoder(pr).Decode(&ev); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = s.Shutdown(ctx)
+		<-errc
+	})
+	if ev.Event != "listening" || ev.Scheme != "http" || strings.HasSuffix(ev.Addr, ":0") {
+		t.Fatalf("unexpected event %+v", ev)
+	}
+
+	// The event means the port is bound, so this must not race the server.
+	resp, err := http.Get("http://" + ev.Addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz: got %d", resp.StatusCode)
+	}
+}
+
+func TestH2C(t *testing.T) {
+	s := New(Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg: session.Config{Command: "cat"},
+		Logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+		H2C:        true,
+	})
+	if _, err := s.session(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = s.newHTTPServer(s.buildRouter())
+	ts.Start()
+	t.Cleanup(func() {
+		ts.Close()
+		s.currentSession().Close()
+	})
+
+	h2 := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	for _, tt := range []struct {
+		path      string
+		wantProto int
+		wantCode  int
+	}{
+		{"/healthz", 2, http.StatusOK},
+		{"/t/tok-0123456789abcdef/", 2, http.StatusOK},
+		{"/t/tok-0123456789abcdef/ws", 2, http.StatusHTTPVersionNotSupported},
+	} {
+		resp, err := h2.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != tt.wantProto || resp.StatusCode != tt.wantCode {
+			t.Errorf("GET %s: %s %d, want HTTP/%d %d", tt.path, resp.Proto, resp.StatusCode, tt.wantProto, tt.wantCode)
+		}
+	}
+
+	// HTTP/1.1 keeps working alongside, WebSockets included, and a request
+	// to upgrade to h2c is answered over HTTP/1.1.
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+	req, _ := http.NewRequest("GET", ts.URL+"/healthz", nil)
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", "AAMAAABkAARAAAAAAAIAAAAA")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 || resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz with Upgrade: h2c: %s %d, want HTTP/1.1 200", resp.Proto, resp.StatusCode)
+	}
+
+	if err := (Config{H2C: true, TLSCert: "cert.pem", TLSKey: "key.pem"}).Validate(); err == nil {
+		t.Error("Validate accepted h2c with TLS")
+	}
+}
+
+func TestStartBindFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var out strings.Builder
+	s := New(Config{
+		ListenAddr:  ln.Addr().String(),
+		AuthConfig:  auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg:  session.Config{Command: "cat"},
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ReadyOutput: &out,
+	})
+	if err := s.Start(); err == nil {
+		t.Fatal("Start on a port in use succeeded")
+	}
+	if out.Len() != 0 {
+		t.Errorf("listening event emitted without a listener: %q", out.String())
+	}
+	if sess := s.currentSession(); sess != nil {
+		sess.Close()
+		t.Error("command started although the port was in use")
+	}
+}
+
+func TestListenRandomPort(t *testing.T) {
+	var out strings.Builder
+	s := New(Config{
+		ListenAddr:  "127.0.0.1:0",
+		AuthConfig:  auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		SessionCfg:  session.Config{Command: "cat"},
+		Logger:      slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ReadyOutput: &out,
+	})
+	addr, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := addr.(*net.TCPAddr).Port
+	if port == 0 {
+		t.Fatal("Listen did not report the chosen port")
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/healthz", port))
+	_ = s.Shutdown(context.Background())
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want := fmt.Sprintf(`"addr":"127.0.0.1:%d"`, port); !strings.Contains(out.String(), want) {
+		t.Errorf("listening event %q does not contain %s", out.String(), want)
+	}
+}
+
+func TestConfigValidateCookie(t *testing.T) {
+	for _, tt := range []struct {
+		cfg     auth.Config
+		wantErr bool
+	}{
+		{auth.Config{}, false},
+		{auth.Config{CookieName: "shell_one", CookieTTL: time.Hour}, false},
+		{auth.Config{CookieName: "bad name"}, true},
+		{auth.Config{CookieName: "a;b"}, true},
+		{auth.Config{CookieTTL: -time.Second}, true},
+	} {
+		if err := (Config{AuthConfig: tt.cfg}).Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v: error = %v, want error %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBranding(t *testing.T) {
+	get := func(ts *httptest.Server, path string) string {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	_, ts := newTestServer(t, Config{AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"}})
+	for _, path := range []string{"/login", "/t/tok-0123456789abcdef/"} {
+		if page := get(ts, path); !strings.Contains(page, "<title>vexShare — ") || strings.Contains(page, "{{VEXSHARE_") {
+			t.Errorf("%s without branding: %.200q", path, page)
+		}
+	}
+
+	_, ts = newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		Title:      "Acme <script>alert(1)</script>\n{{VEXSHARE_LOGO}}",
+		LogoURL:    `/logo.png?a=1&b="x"`,
+	})
+	for _, path := range []string{"/login", "/t/tok-0123456789abcdef/"} {
+		page := get(ts, path)
+		if !strings.Contains(page, "<title>Acme &lt;script&gt;alert(1)&lt;/script&gt;{{VEXSHARE_LOGO}} — ") {
+			t.Errorf("%s: title not escaped in place: %.300q", path, page)
+		}
+		if strings.Contains(page, "<script>alert") {
+			t.Errorf("%s: title injected markup", path)
+		}
+		if !strings.Contains(page, `<img class="brand-logo" src="/logo.png?a=1&amp;b=&#34;x&#34;" alt="">`) {
+			t.Errorf("%s: logo missing or unescaped", path)
+		}
+	}
+
+	for _, tt := range []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://example.com/logo.svg", false},
+		{"/static/logo.png", false},
+		{"javascript:alert(1)", true},
+		{"data:image/png;base64,AAAA", true},
+		{"//evil.example/logo.png", true},
+		{"logo.png", true},
+		{"https:///logo.png", true},
+	} {
+		if err := (Config{LogoURL: tt.url}).Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("logo %q: error = %v, want error %v", tt.url, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConsoleCommands(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	conn := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, conn, "role")
+
+	var out strings.Builder
+	s.RunConsole(strings.NewReader("!back in 5 minutes\n>console-typed\nbogus\n"), &out)
+
+	var notice struct {
+		Text string `json:"text"`
+	}
+	_ = json.Unmarshal(readUntil(t, conn, "notice").Data, &notice)
+	if notice.Text != "back in 5 minutes" {
+		t.Errorf("notice text = %q", notice.Text)
+	}
+	readOutputUntil(t, conn, "console-typed")
+	if !strings.Contains(out.String(), "unknown console command") {
+		t.Errorf("expected a hint for an unknown command, got %q", out.String())
+	}
+}
+
+func TestFailedLoginSecurityEvent(t *testing.T) {
+	for _, notify := range []bool{true, false} {
+		t.Run(fmt.Sprintf("notify=%v", notify), func(t *testing.T) {
+			_, ts := newTestServer(t, Config{
+				AuthConfig: auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+				SessionCfg: session.Config{NotifySecurityEvents: notify},
+			})
+			client := login(t, ts, "vex", "pw")
+			conn := dialWS(t, ts, "/ws", client)
+			readUntil(t, conn, "role")
+
+			form := url.Values{"username": {"mallory"}, "password": {"guess"}}
+			resp, err := http.PostForm(ts.URL+"/login", form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("expected 401, got %d", resp.StatusCode)
+			}
+
+			if !notify {
+				// A security message would arrive ahead of this echo.
+				if err := conn.WriteJSON(map[string]string{"type": "input", "data": "marker\n"}); err != nil {
+					t.Fatal(err)
+				}
+				for {
+					var msg testMessage
+					_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+					if err := conn.ReadJSON(&msg); err != nil {
+						t.Fatal(err)
+					}
+					if msg.Type == "security" {
+						t.Fatal("security event sent with NotifySecurityEvents disabled")
+					}
+					if msg.Type == "output" && strings.Contains(string(msg.Data), "marker") {
+						return
+					}
+				}
+			}
+
+			var event struct {
+				Event    string `json:"event"`
+				IP       string `json:"ip"`
+				Username string `json:"username"`
+			}
+			_ = json.Unmarshal(readUntil(t, conn, "security").Data, &event)
+			if event.Event != "failed_login" || event.Username != "mallory" || event.IP != "127.0.0.1" {
+				t.Errorf("unexpected security event %+v", event)
+			}
+		})
+	}
+}
+
+func TestLoginRateLimitedPerUsername(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:        auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		TrustedProxies:    loopbackProxy,
+		UsernameRateLimit: 3,
+	})
+
+	attempt := func(ip, username, password string) *http.Response {
+		form := url.Values{"username": {username}, "password": {password}}
+		req, _ := http.NewRequest("POST", ts.URL+"/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := attempt(fmt.Sprintf("10.0.0.%d", i), "vex", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, resp.StatusCode)
+		}
+	}
+	resp := attempt("10.0.1.1", "vex", "pw")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("fourth attempt from a new IP: expected 429, got %d", resp.StatusCode)
+	}
+	if retry, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retry < 290 || retry > 300 {
+		t.Errorf("Retry-After = %q, want about 300", resp.Header.Get("Retry-After"))
+	}
+	if resp := attempt("10.0.1.2", "other", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("other username: expected 401, got %d", resp.StatusCode)
+	}
+
+	for i := 0; i < 5; i++ {
+		attempt("10.0.2.1", "ip-limited", "wrong")
+	}
+	resp = attempt("10.0.2.1", "vex2", "wrong")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("per-IP limit: expected 429, got %d", resp.StatusCode)
+	}
+	if retry, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retry < 50 || retry > 60 {
+		t.Errorf("per-IP Retry-After = %q, want about 60", resp.Header.Get("Retry-After"))
+	}
+}
+
+func TestLoginSuccessResetsUsernameLimit(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig:        auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		UsernameRateLimit: 3,
+	})
+	s.usernameRL.Allow("vex")
+	s.usernameRL.Allow("vex")
+	login(t, ts, "vex", "pw")
+	if n := s.usernameRL.Count("vex"); n != 0 {
+		t.Errorf("username attempts after success = %d, want 0", n)
+	}
+}
+
+func TestWSMiddlewareOrdering(t *testing.T) {
+	tests := []struct {
+		name       string
+		authOnly   bool
+		path       string
+		origin     string
+		wantStatus int
+		wantCount  int
+	}{
+		{"bad origin rejected before limiter", false, "/t/tok-0123456789abcdef/ws", "http://evil.example", http.StatusForbidden, 0},
+		{"bad token counted by default", false, "/t/wrong/ws", "", http.StatusForbidden, 1},
+		{"bad token not counted when authenticated only", true, "/t/wrong/ws", "", http.StatusForbidden, 0},
+		{"authenticated request counted", true, "/t/tok-0123456789abcdef/ws", "", http.StatusBadRequest, 1},
+		{"ticket skips origin check", false, "/ws?ticket=bogus", "http://evil.example", http.StatusForbidden, 1},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ts := newTestServer(t, Config{
+				AuthConfig:                   auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+				TrustedProxies:               loopbackProxy,
+				WSRateLimitAuthenticatedOnly: tt.authOnly,
+			})
+			ip := fmt.Sprintf("192.0.2.%d", i+1)
+			req, _ := http.NewRequest("GET", ts.URL+tt.path, nil)
+			req.Header.Set("X-Forwarded-For", ip)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if n := s.wsRL.Count(ip); n != tt.wantCount {
+				t.Errorf("limiter count = %d, want %d", n, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+	})
+	host := strings.TrimPrefix(ts.URL, "http://")
+	tests := []struct {
+		origin string
+		want   int
+	}{
+		// The same origin gets past the check to the failed upgrade.
+		{ts.URL, http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+		{"http://" + strings.ToUpper(host), http.StatusBadRequest},
+		{"https://" + host + ".evil.example", http.StatusForbidden},
+		{"https://evil.example/" + host, http.StatusForbidden},
+		{"https://evil.example?" + host, http.StatusForbidden},
+		{"http://x" + host, http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+"/t/tok-0123456789abcdef/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Origin %q: got %d, want %d", tt.origin, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestAllowOrigins(t *testing.T) {
+	allowed, err := origin.Parse("https://*.preview.example.com,null")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTestServer(t, Config{
+		AuthConfig:   auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		AllowOrigins: allowed,
+	})
+	tests := []struct {
+		origin string
+		want   int
+	}{
+		// Allowed origins get past the check to the failed upgrade.
+		{"https://pr-123.preview.example.com", http.StatusBadRequest},
+		{"null", http.StatusBadRequest},
+		{"http://pr-123.preview.example.com", http.StatusForbidden},
+		{"https://evil-preview.example.com.attacker.io", http.StatusForbidden},
+		{ts.URL, http.StatusForbidden},
+		{"", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", ts.URL+"/t/tok-0123456789abcdef/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("Origin %q: got %d, want %d", tt.origin, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestMaxSessionsPerIP(t *testing.T) {
+	s, ts := newTestServer(t, Config{
+		AuthConfig:       auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		MaxSessionsPerIP: 2,
+	})
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/t/tok-0123456789abcdef/ws"
+
+	first := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, first, "role")
+	second := dialWS(t, ts, "/t/tok-0123456789abcdef/ws", nil)
+	readUntil(t, second, "role")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third connection: expected 429, got %v (err %v)", resp, err)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not released after disconnect: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// Once every connection has gone, the IP's entry goes too.
+	second.Close()
+	for {
+		s.wsPerIP.mu.Lock()
+		n := len(s.wsPerIP.counts)
+		s.wsPerIP.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d IP entries left after every connection closed", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTokenMaxConnections(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:          auth.Config{Mode: "token", Token: "tok-0123456789abcdef", ViewToken: "view-0123456789abcdef"},
+		TokenMaxConnections: 2,
+	})
+	dial := func(path string) (*websocket.Conn, int) {
+		conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+path, nil)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("dial %s: %v", path, err)
+			}
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close() })
+		readUntil(t, conn, "role")
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	first, _ := dial("/t/tok-0123456789abcdef/ws")
+	_, _ = dial("/t/tok-0123456789abcdef/ws")
+	if _, status := dial("/t/tok-0123456789abcdef/ws"); status != http.StatusTooManyRequests {
+		t.Fatalf("third connection with the token: status %d, want 429", status)
+	}
+	// The view token has a cap of its own, whichever way it is presented.
+	_, _ = dial("/t/view-0123456789abcdef/ws")
+	_, _ = dial("/ws?vt=view-0123456789abcdef")
+	if _, status := dial("/t/view-0123456789abcdef/ws"); status != http.StatusTooManyRequests {
+		t.Fatalf("third connection with the view token: status %d, want 429", status)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if conn, _ := dial("/t/tok-0123456789abcdef/ws"); conn != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("token slot not released after disconnect")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestAllowIPs(t *testing.T) {
+	allow, err := ipfilter.Parse("10.0.0.0/8,192.168.1.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ipfilter.Parse("10.66.0.0/16,172.16.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ts := newTestServer(t, Config{
+		AuthConfig:     auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		TrustedProxies: loopbackProxy,
+		AllowIPs:       allow,
+		DenyIPs:        deny,
+	})
+	tests := []struct {
+		ip   string
+		want int
+	}{
+		{"10.20.30.40", http.StatusOK},
+		{"192.168.1.7", http.StatusOK},
+		{"192.168.1.8", http.StatusForbidden},
+		{"11.0.0.1", http.StatusForbidden},
+		// Deny wins where it overlaps the allowlist.
+		{"10.66.1.2", http.StatusForbidden},
+		{"10.67.1.2", http.StatusOK},
+		{"172.16.0.1", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/healthz", "/login", "/t/tok-0123456789abcdef/"} {
+			req, _ := http.NewRequest("GET", ts.URL+path, nil)
+			req.Header.Set("X-Forwarded-For", tt.ip)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s from %s: got %d, want %d", path, tt.ip, resp.StatusCode, tt.want)
+			}
+		}
+	}
+}
+
+// slowConn sends one byte at a time, like a lossy high-latency link.
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c slowConn) Write(p []byte) (int, error) {
+	for i := range p {
+		time.Sleep(c.delay)
+		if _, err := c.Conn.Write(p[i : i+1]); err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+func TestSlowLoginPostSucceeds(t *testing.T) {
+	s := New(Config{
+		AuthConfig:   auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		WriteTimeout: 200 * time.Millisecond,
+	})
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = s.newHTTPServer(s.buildRouter())
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return slowConn{Conn: conn, delay: 3 * time.Millisecond}, nil
+			},
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	// The body alone takes longer to arrive than the write timeout.
+	form := url.Values{"username": {"vex"}, "password": {"pw"}, "pad": {strings.Repeat("x", 150)}}
+	start := time.Now()
+	resp, err := client.PostForm(ts.URL+"/login", form)
+	if err != nil {
+		t.Fatalf("slow login POST failed after %v: %v", time.Since(start), err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d", resp.StatusCode)
+	}
+}
+
+func TestDenyIPsWithoutAllowlist(t *testing.T) {
+	deny, _ := ipfilter.Parse("203.0.113.0/24")
+	_, ts := newTestServer(t, Config{
+		AuthConfig:     auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		TrustedProxies: loopbackProxy,
+		DenyIPs:        deny,
+	})
+	for ip, want := range map[string]int{"203.0.113.9": http.StatusForbidden, "198.51.100.1": http.StatusOK} {
+		req, _ := http.NewRequest("GET", ts.URL+"/healthz", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("%s: got %d, want %d", ip, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestForwardedForIgnoredFromUntrustedPeers(t *testing.T) {
+	allow, _ := ipfilter.Parse("10.0.0.0/8")
+	deny, _ := ipfilter.Parse("127.0.0.1")
+	for _, tt := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"allowlist", Config{AllowIPs: allow}},
+		{"denylist", Config{DenyIPs: deny}},
+		{"allowlist behind another proxy", Config{AllowIPs: allow, TrustedProxies: ipfilter.List{netip.MustParsePrefix("192.0.2.1/32")}}},
+	} {
+		tt.cfg.AuthConfig = auth.Config{Mode: "token", Token: "tok-0123456789abcdef"}
+		_, ts := newTestServer(t, tt.cfg)
+		// The header claims an allowed address, or hides the denied peer.
+		req, _ := http.NewRequest("GET", ts.URL+"/healthz", nil)
+		req.Header.Set("X-Forwarded-For", "10.1.2.3")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: spoofed X-Forwarded-For got %d, want 403", tt.name, resp.StatusCode)
+		}
+	}
+
+	// Per-IP limits key on the peer too.
+	s, ts := newTestServer(t, Config{AuthConfig: auth.Config{Mode: "token", Token: "tok-0123456789abcdef"}})
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", ts.URL+"/t/wrong/ws", nil)
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := s.wsRL.Count("127.0.0.1"); n != 3 {
+		t.Errorf("peer's WebSocket limiter count = %d, want 3", n)
+	}
+}
+
+func TestTrustForwardedProto(t *testing.T) {
+	proxies, err := ipfilter.Parse("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		trust  bool
+		peer   string
+		proto  string
+		secure bool
+	}{
+		{"trusted proxy, https", true, "10.1.2.3:4567", "https", true},
+		{"trusted proxy, chain", true, "10.1.2.3:4567", "HTTPS, http", true},
+		{"trusted proxy, http", true, "10.1.2.3:4567", "http", false},
+		{"trusted proxy, no header", true, "10.1.2.3:4567", "", false},
+		{"untrusted peer", true, "192.0.2.1:4567", "https", false},
+		{"disabled", false, "10.1.2.3:4567", "https", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(Config{
+				AuthConfig:          auth.Config{Mode: "password", Username: "vex", Password: "pw"},
+				TrustForwardedProto: tt.trust,
+				TrustedProxies:      proxies,
+				Logger:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+			})
+			form := url.Values{"username": {"vex"}, "password": {"pw"}}
+			req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.RemoteAddr = tt.peer
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+			s.buildRouter().ServeHTTP(rec, req)
+			cookies := rec.Result().Cookies()
+			if rec.Code != http.StatusSeeOther || len(cookies) != 1 {
+				t.Fatalf("login: status %d, cookies %v", rec.Code, cookies)
+			}
+			if cookies[0].Secure != tt.secure {
+				t.Errorf("Secure = %v, want %v", cookies[0].Secure, tt.secure)
+			}
+		})
+	}
+
+	if err := (Config{TrustForwardedProto: true}).Validate(); err == nil {
+		t.Error("TrustForwardedProto without trusted proxies passed validation")
+	}
+}
+
+func TestAdminBan(t *testing.T) {
+	_, ts := newTestServer(t, Config{
+		AuthConfig:     auth.Config{Mode: "token", Token: "tok-0123456789abcdef"},
+		TrustedProxies: loopbackProxy,
+		AdminToken:     "admin-secret-123456",
+	})
+	// from sends a request as if it came from ip.
+	from := func(ip, method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret-123456")
+		req.Header.Set("X-Forwarded-For", ip)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	const admin, banned = "198.51.100.1", "203.0.113.9"
+
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/t/tok-0123456789abcdef/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"X-Forwarded-For": {banned}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, "role")
+
+	for _, body := range []string{`{"ip":"nope","duration":"1h"}`, `{"ip":"203.0.113.9","duration":"-1h"}`, `{"ip":"203.0.113.9"}`} {
+		if resp := from(admin, "POST", "/admin/ban", body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("ban %s: got %d, want 400", body, resp.StatusCode)
+		}
+	}
+	if resp := from(admin, "POST", "/admin/ban", `{"ip":"203.0.113.9","duration":"1h"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("ban: got %d, want 201", resp.StatusCode)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("banned client: expected close 1008, got %v", err)
+			}
+			break
+		}
+	}
+	if resp := from(banned, "GET", "/healthz", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("banned IP: got %d, want 403", resp.StatusCode)
+	}
+	if resp := from(admin, "GET", "/healthz", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("other IP: got %d, want 200", resp.StatusCode)
+	}
+	var bans []banInfo
+	_ = json.NewDecoder(from(admin, "GET", "/admin/bans", "").Body).Decode(&bans)
+	if len(bans) != 1 || bans[0].IP != banned || time.Until(bans[0].ExpiresAt) < 59*time.Minute {
+		t.Errorf("bans = %+v, want %s for an hour", bans, banned)
+	}
+
+	if resp := from(admin, "DELETE", "/admin/ban/"+banned, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unban: got %d, want 204", resp.StatusCode)
+	}
+	if resp := from(admin, "DELETE", "/admin/ban/"+banned, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unban again: got %d, want 404", resp.StatusCode)
+	}
+	if resp := from(banned, "GET", "/healthz", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("after unban: got %d, want 200", resp.StatusCode)
+	}
+
+	// Bans lapse on their own.
+	from(admin, "POST", "/admin/ban", `{"ip":"203.0.113.9","duration":"50ms"}`)
+	time.Sleep(100 * time.Millisecond)
+	if resp := from(banned, "GET", "/healthz", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("after expiry: got %d, want 200", resp.StatusCode)
+	}
+	_ = json.NewDecoder(from(admin, "GET", "/admin/bans", "").Body).Decode(&bans)
+	if len(bans) != 0 {
+		t.Errorf("bans after expiry = %+v, want none", bans)
+	}
+}
+
+func TestForbiddenPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		ctype    string
+		wantType string
+		wantBody string
+	}{
+		{"default", "", "", "text/plain; charset=utf-8", "Access requires a valid token URL.\n"},
+		{"message", "Ask ops for a link.\n", "", "text/plain; charset=utf-8", "Ask ops for a link.\n"},
+		{"html", "<h1>Private</h1>", "text/html; charset=utf-8", "text/html; charset=utf-8", "<h1>Private</h1>"},
+	}
+	for _, tt := range tests {
+		// A view token takes over /, for ?vt=, but not the explanation.
+		for _, viewToken := range []string{"", "view-tok-0123456789"} {
+			name := tt.name
+			if viewToken != "" {
+				name += " with view token"
+			}
+			t.Run(name, func(t *testing.T) {
+				_, ts := newTestServer(t, Config{
+					AuthConfig:           auth.Config{Mode: "token", Token: "tok-0123456789abcdef", ViewToken: viewToken},
+					ForbiddenBody:        []byte(tt.body),
+					ForbiddenContentType: tt.ctype,
+				})
+				resp, err := http.Get(ts.URL + "/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusForbidden {
+					t.Errorf("status = %d, want 403", resp.StatusCode)
+				}
+				if got := resp.Header.Get("Content-Type"); got != tt.wantType {
+					t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+				}
+				if string(body) != tt.wantBody {
+					t.Errorf("body = %q, want %q", body, tt.wantBody)
+				}
+			})
+		}
+	}
+}
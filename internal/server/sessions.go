@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/vextm/vexshare/internal/session"
+)
+
+// closedSessionRetention is how long a closed named session stays listed.
+// Its name can be reused right away.
+const closedSessionRetention = 5 * time.Minute
+
+var sessionNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// namedSession is a session started through the admin API, next to the
+// default one and mounted under Config.SessionPathPrefix.
+type namedSession struct {
+	name    string
+	sess    *session.Session
+	created time.Time
+	// closedAt is set once the session ends. Guarded by Server.namedMu.
+	closedAt time.Time
+}
+
+type sessionInfo struct {
+	Name          string `json:"name"`
+	Command       string `json:"command"`
+	Clients       int    `json:"clients"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+	ReadOnly      bool   `json:"readOnly"`
+	BytesOut      int64  `json:"bytesOut"`
+	IdleSeconds   int64  `json:"idleSeconds"`
+	Status        string `json:"status"`
+}
+
+type createSessionRequest struct {
+	Name     string   `json:"name"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Env      []string `json:"env"`
+	ClearEnv bool     `json:"clearEnv"`
+	ReadOnly bool     `json:"readOnly"`
+}
+
+type createSessionResponse struct {
+	Name    string    `json:"name"`
+	WSPath  string    `json:"wsPath"`
+	Created time.Time `json:"created"`
+}
+
+func (s *Server) namedSession(name string) *session.Session {
+	s.namedMu.Lock()
+	defer s.namedMu.Unlock()
+	if ns := s.named[name]; ns != nil && ns.closedAt.IsZero() {
+		return ns.sess
+	}
+	return nil
+}
+
+// pruneClosedLocked forgets sessions that closed more than
+// closedSessionRetention ago. The caller holds s.namedMu.
+func (s *Server) pruneClosedLocked() {
+	for name, ns := range s.named {
+		if !ns.closedAt.IsZero() && time.Since(ns.closedAt) > closedSessionRetention {
+			delete(s.named, name)
+		}
+	}
+}
+
+// namedSessionRouter serves the named-session routes with the path prefix
+// already stripped, so handlers see /{name}/ and /{name}/ws. Short links
+// share the prefix without the trailing slash, as /{code}.
+func (s *Server) namedSessionRouter(rootAuth, ticketAuth func(http.Handler) http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /{name}/ws", s.wsRoute(ticketAuth))
+	if s.cfg.ShortURLBase != "" {
+		mux.Handle("GET /{code}", s.shortLinkHandler())
+	}
+	if rootAuth != nil {
+		mux.Handle("GET /{name}/{$}", rootAuth(http.HandlerFunc(s.handleNamedTerminal)))
+	}
+	return mux
+}
+
+func (s *Server) handleNamedTerminal(w http.ResponseWriter, r *http.Request) {
+	if s.namedSession(r.PathValue("name")) == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.handleTerminal(w, r)
+}
+
+func (s *Server) closeNamedSessions() {
+	s.namedMu.Lock()
+	var all []*session.Session
+	for _, ns := range s.named {
+		if ns.closedAt.IsZero() {
+			all = append(all, ns.sess)
+		}
+	}
+	s.namedMu.Unlock()
+	for _, sess := range all {
+		sess.Close()
+	}
+}
+
+func (s *Server) handleAdminCreateSession(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	var req createSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !sessionNameRE.MatchString(req.Name) {
+		http.Error(w, "name must be 1-64 letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+
+	s.namedMu.Lock()
+	defer s.namedMu.Unlock()
+	s.pruneClosedLocked()
+	if ns := s.named[req.Name]; ns != nil && ns.closedAt.IsZero() {
+		http.Error(w, "session already exists", http.StatusConflict)
+		return
+	}
+
+	name := req.Name
+	cfg := s.cfg.SessionCfg
+	cfg.Command, cfg.Args = req.Command, req.Args
+	if cfg.Command == "" {
+		cfg.Command = s.cfg.SessionCfg.Command
+		if len(cfg.Args) == 0 {
+			cfg.Args = s.cfg.SessionCfg.Args
+		}
+	}
+	cfg.Env, cfg.ReadOnly = req.Env, req.ReadOnly
+	cfg.ClearEnv = cfg.ClearEnv || req.ClearEnv
+	cfg.Logger = s.logger.With("session", name)
+	var sess *session.Session
+	cfg.OnClose = func() {
+		s.namedMu.Lock()
+		if ns := s.named[name]; ns != nil && ns.sess == sess {
+			ns.closedAt = time.Now()
+		}
+		s.namedMu.Unlock()
+		s.logger.Info("named session ended", "session", name)
+	}
+	sess, err := session.New(cfg)
+	if err != nil {
+		s.logger.ErrorContext(r.Context(), "create named session", "session", name, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	ns := &namedSession{name: name, sess: sess, created: time.Now().UTC()}
+	s.named[name] = ns
+	s.logger.InfoContext(r.Context(), "named session created by admin", "session", name, "command", cfg.Command, "readOnly", req.ReadOnly)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(createSessionResponse{
+		Name:    name,
+		WSPath:  s.sessionPathPrefix() + name + "/ws",
+		Created: ns.created,
+	})
+}
+
+func (s *Server) handleAdminDeleteSession(w http.ResponseWriter, r *http.Request) {
+	sess := s.namedSession(r.PathValue("name"))
+	if sess == nil {
+		r.SetPathValue("id", r.PathValue("name"))
+		s.handleAdminExpireSession(w, r)
+		return
+	}
+	sess.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleAdminListSessions(w http.ResponseWriter, r *http.Request) {
+	limit, offset := 20, 0
+	q := r.URL.Query()
+	for param, dst := range map[string]*int{"limit": &limit, "offset": &offset} {
+		if v := q.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "invalid "+param, http.StatusBadRequest)
+				return
+			}
+			*dst = n
+		}
+	}
+
+	s.namedMu.Lock()
+	s.pruneClosedLocked()
+	all := make([]*namedSession, 0, len(s.named))
+	closedAt := make(map[*namedSession]time.Time, len(s.named))
+	for _, ns := range s.named {
+		all = append(all, ns)
+		closedAt[ns] = ns.closedAt
+	}
+	s.namedMu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].sess.StartedAt(), all[j].sess.StartedAt()
+		if a.Equal(b) {
+			return all[i].name < all[j].name
+		}
+		return a.Before(b)
+	})
+	total := len(all)
+	start := min(offset, total)
+	all = all[start : start+min(limit, total-start)]
+
+	now := time.Now()
+	list := make([]sessionInfo, 0, len(all))
+	for _, ns := range all {
+		sum := ns.sess.Summary()
+		info := sessionInfo{
+			Name:          ns.name,
+			Command:       ns.sess.Command(),
+			UptimeSeconds: int64(sum.DurationSeconds),
+			ReadOnly:      ns.sess.ReadOnly(),
+			BytesOut:      sum.OutputBytes,
+			IdleSeconds:   int64(now.Sub(ns.sess.LastActive()).Seconds()),
+			Status:        "running",
+		}
+		if !closedAt[ns].IsZero() {
+			info.Status = "closed"
+		} else {
+			info.Clients = ns.sess.ClientCount()
+		}
+		list = append(list, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	_ = json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vextm/vexshare/internal/auth"
+)
+
+// shortCodeBytes of randomness give 12 URL-safe characters.
+const shortCodeBytes = 9
+
+// shortLink is a short code's entry in s.shortLinks, standing in for a
+// token URL too long to read out. Expired entries are removed when they are
+// next looked at.
+type shortLink struct {
+	// target is the token URL's path.
+	target string
+	// expires is zero for a link that lasts as long as the token, which is
+	// until the server stops.
+	expires time.Time
+}
+
+type shortenResponse struct {
+	Code      string     `json:"code"`
+	ShortURL  string     `json:"shortURL"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (l shortLink) expired(now time.Time) bool {
+	return !l.expires.IsZero() && !now.Before(l.expires)
+}
+
+// shortLinkTarget returns the token URL path for code.
+func (s *Server) shortLinkTarget(code string) (string, bool) {
+	v, ok := s.shortLinks.Load(code)
+	if !ok {
+		return "", false
+	}
+	if l := v.(shortLink); !l.expired(time.Now()) {
+		return l.target, true
+	}
+	s.shortLinks.CompareAndDelete(code, v)
+	return "", false
+}
+
+func (s *Server) handleAdminShorten(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	mode := s.cfg.AuthConfig.Mode
+	if mode != "token" && mode != "password+token" {
+		http.Error(w, "short links need a token auth mode", http.StatusBadRequest)
+		return
+	}
+	if auth.CheckToken(s.cfg.AuthConfig, token) != nil && auth.CheckViewToken(s.cfg.AuthConfig, token) != nil {
+		http.Error(w, "token is not this server's control or view token", http.StatusBadRequest)
+		return
+	}
+	var link shortLink
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "ttl must be a positive Go duration such as 24h", http.StatusBadRequest)
+			return
+		}
+		link.expires = time.Now().Add(d).UTC()
+	}
+	link.target = strings.TrimSuffix(s.cfg.AuthConfig.BasePath, "/") + "/t/" + url.PathEscape(token) + "/"
+
+	b := make([]byte, shortCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	code := base64.RawURLEncoding.EncodeToString(b)
+	s.shortLinks.Store(code, link)
+
+	resp := shortenResponse{
+		Code:     code,
+		ShortURL: strings.TrimSuffix(s.cfg.ShortURLBase, "/") + s.sessionPathPrefix() + code,
+	}
+	if !link.expires.IsZero() {
+		resp.ExpiresAt = &link.expires
+	}
+	s.logger.InfoContext(r.Context(), "short link created by admin", "expiresAt", resp.ExpiresAt)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// shortLinkHandler redirects a short link to its token URL. A code opens
+// the share just as the token does, so misses count against the login
+// limit.
+func (s *Server) shortLinkHandler() http.Handler {
+	return s.loginLimited(func(next http.Handler) http.Handler { return next }, func(r *http.Request) bool {
+		_, ok := s.shortLinkTarget(r.PathValue("code"))
+		return !ok
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, ok := s.shortLinkTarget(r.PathValue("code"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/vextm/vexshare/internal/ui"
+)
+
+// BuildInfo describes the running binary for GET /version, so monitoring
+// can tell which build each instance runs.
+type BuildInfo struct {
+	Version string `json:"version"`
+	// Commit and BuildTime are empty when the build did not record them.
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"buildTime,omitempty"`
+	// GoVersion defaults to the runtime's.
+	GoVersion string `json:"goVersion"`
+}
+
+// versionAsset renders the /version response once; it cannot change while
+// the process runs, so clients revalidate it with its ETag.
+func (s *Server) versionAsset() ui.Asset {
+	info := s.cfg.Build
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.GoVersion == "" {
+		info.GoVersion = runtime.Version()
+	}
+	body, _ := json.Marshal(info)
+	return ui.NewAsset(append(body, '\n'))
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	serveAsset(w, r, s.version, "application/json")
+}
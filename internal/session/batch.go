@@ -0,0 +1,86 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Default output batching: small interactive writes go out within a couple
+// of milliseconds, bulk output in chunks of up to 32 KiB.
+const (
+	DefaultOutputFlushBytes = 32 << 10
+	DefaultOutputFlushDelay = 2 * time.Millisecond
+)
+
+// outputBatcher joins consecutive PTY reads into one message. Buffered
+// output is flushed once it reaches maxBytes or delay after the first byte
+// arrived, whichever comes first. A zero delay flushes every read at once.
+type outputBatcher struct {
+	mu       sync.Mutex
+	buf      []byte
+	maxBytes int
+	delay    time.Duration
+	timer    *time.Timer
+	flush    func([]byte)
+	// timed, if set, replaces flush and is also given the time the first
+	// buffered byte arrived, in Unix nanoseconds.
+	timed  func(data []byte, readAt int64)
+	readAt int64
+}
+
+func newOutputBatcher(maxBytes int, delay time.Duration, flush func([]byte)) *outputBatcher {
+	if maxBytes <= 0 {
+		maxBytes = DefaultOutputFlushBytes
+	}
+	return &outputBatcher{maxBytes: maxBytes, delay: delay, flush: flush}
+}
+
+func (b *outputBatcher) Write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timed != nil && len(b.buf) == 0 {
+		b.readAt = time.Now().UnixNano()
+	}
+	b.buf = append(b.buf, p...)
+	if b.delay <= 0 || len(b.buf) >= b.maxBytes {
+		b.flushLocked()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.delay, b.Flush)
+	}
+}
+
+// Flush sends whatever is buffered now.
+func (b *outputBatcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// Barrier sends whatever is buffered, then runs fn before any later output
+// can be sent.
+func (b *outputBatcher) Barrier(fn func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+	fn()
+}
+
+func (b *outputBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.buf) == 0 {
+		return
+	}
+	// The flushed slice is handed to clients, so start a fresh buffer.
+	data := b.buf
+	b.buf = nil
+	if b.timed != nil {
+		b.timed(data, b.readAt)
+		return
+	}
+	b.flush(data)
+}
@@ -0,0 +1,147 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flushRecorder struct {
+	mu      sync.Mutex
+	flushes [][]byte
+	got     chan struct{}
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{got: make(chan struct{}, 1024)}
+}
+
+func (r *flushRecorder) flush(p []byte) {
+	r.mu.Lock()
+	r.flushes = append(r.flushes, p)
+	r.mu.Unlock()
+	r.got <- struct{}{}
+}
+
+func (r *flushRecorder) sizes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sizes []int
+	for _, f := range r.flushes {
+		sizes = append(sizes, len(f))
+	}
+	return sizes
+}
+
+func TestOutputBatcher(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		rec := newFlushRecorder()
+		b := newOutputBatcher(10, time.Hour, rec.flush)
+		b.Write([]byte("abcd"))
+		b.Write([]byte("efgh"))
+		if n := len(rec.sizes()); n != 0 {
+			t.Fatalf("flushed %d times below the threshold", n)
+		}
+		b.Write([]byte("ijkl"))
+		if got := fmt.Sprint(rec.sizes()); got != "[12]" {
+			t.Errorf("flushes = %s, want [12]", got)
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		rec := newFlushRecorder()
+		b := newOutputBatcher(1<<20, 20*time.Millisecond, rec.flush)
+		start := time.Now()
+		b.Write([]byte("a"))
+		b.Write([]byte("b"))
+		select {
+		case <-rec.got:
+		case <-time.After(2 * time.Second):
+			t.Fatal("delay flush never happened")
+		}
+		if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+			t.Errorf("flushed after %v, before the delay", elapsed)
+		}
+		if !bytes.Equal(rec.flushes[0], []byte("ab")) {
+			t.Errorf("flushed %q, want %q", rec.flushes[0], "ab")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		rec := newFlushRecorder()
+		b := newOutputBatcher(1<<20, 0, rec.flush)
+		b.Write([]byte("a"))
+		b.Write([]byte("b"))
+		if got := fmt.Sprint(rec.sizes()); got != "[1 1]" {
+			t.Errorf("flushes = %s, want [1 1]", got)
+		}
+	})
+
+	t.Run("explicit flush", func(t *testing.T) {
+		rec := newFlushRecorder()
+		b := newOutputBatcher(1<<20, time.Hour, rec.flush)
+		b.Write([]byte("tail"))
+		b.Flush()
+		b.Flush()
+		if got := fmt.Sprint(rec.sizes()); got != "[4]" {
+			t.Errorf("flushes = %s, want [4]", got)
+		}
+	})
+}
+
+var batchSettings = []struct {
+	bytes int
+	delay time.Duration
+}{
+	{DefaultOutputFlushBytes, -1},
+	{4 << 10, time.Millisecond},
+	{DefaultOutputFlushBytes, DefaultOutputFlushDelay},
+	{128 << 10, 10 * time.Millisecond},
+}
+
+func batchName(maxBytes int, delay time.Duration) string {
+	if delay < 0 {
+		return "unbatched"
+	}
+	return fmt.Sprintf("bytes=%d/delay=%v", maxBytes, delay)
+}
+
+// BenchmarkOutputBatchBulk models `cat` of a large file: 4 KiB PTY reads
+// back to back. Fewer messages per MiB means less per-message overhead.
+func BenchmarkOutputBatchBulk(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 4<<10)
+	for _, bs := range batchSettings {
+		b.Run(batchName(bs.bytes, bs.delay), func(b *testing.B) {
+			var flushes int
+			bt := newOutputBatcher(bs.bytes, bs.delay, func([]byte) { flushes++ })
+			b.SetBytes(1 << 20)
+			for i := 0; i < b.N; i++ {
+				for sent := 0; sent < 1<<20; sent += len(chunk) {
+					bt.Write(chunk)
+				}
+			}
+			bt.Flush()
+			b.ReportMetric(float64(flushes)/float64(b.N), "msgs/MiB")
+		})
+	}
+}
+
+// BenchmarkOutputBatchInteractive models typing: one echoed byte at a time.
+// The latency metric is how long a keystroke waits before it is sent.
+func BenchmarkOutputBatchInteractive(b *testing.B) {
+	for _, bs := range batchSettings {
+		b.Run(batchName(bs.bytes, bs.delay), func(b *testing.B) {
+			flushed := make(chan time.Time, 1)
+			bt := newOutputBatcher(bs.bytes, bs.delay, func([]byte) { flushed <- time.Now() })
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				bt.Write([]byte("k"))
+				total += (<-flushed).Sub(start)
+			}
+			b.ReportMetric(float64(total.Microseconds())/float64(b.N), "us/key")
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package session
+
+import (
+	"fmt"
+)
+
+// clearSequence resets the terminal, then erases the scrollback and the
+// screen for terminals that keep them across a reset.
+const clearSequence = "\x1bc\x1b[3J\x1b[H\x1b[2J"
+
+// clearOutput resets every screen and drops the history on behalf of c,
+// for its "clear" message, so what was shown cannot be downloaded
+// afterwards. The history then starts with a line naming c.
+// Output still batched is sent first, so nothing from before the clear
+// can land after it.
+func (s *Session) clearOutput(c *Client) {
+	by := clientName(c)
+	s.batcher.Barrier(func() {
+		dropped := s.history.Clear()
+		s.output([]byte(clearSequence))
+		s.syntheticOutput("[Screen and history cleared by %s]", by)
+		s.record(c, "history_cleared", fmt.Sprintf("%d bytes of history dropped", dropped))
+	})
+}
@@ -0,0 +1,59 @@
+package session
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClearDropsHistory(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+
+	sendInput(t, alice, "hunter2\n")
+	waitForHistory(t, s, "hunter2", 2)
+
+	// Only the controller can clear.
+	_ = bob.WriteJSON(wsMessage{Type: "clear"})
+	sendInput(t, alice, "marker\n")
+	waitForHistory(t, s, "marker", 2)
+	if !strings.Contains(historyString(s), "hunter2") {
+		t.Fatal("a viewer cleared the history")
+	}
+
+	_ = alice.WriteJSON(wsMessage{Type: "clear"})
+	readMessage(t, bob, "output", "cleared by alice")
+	if out := historyString(s); strings.Contains(out, "hunter2") || !strings.HasPrefix(out, clearSequence) {
+		t.Errorf("history after clear = %q", out)
+	}
+
+	// Someone joining afterwards sees nothing from before the clear.
+	carol := tr.dial("c", "carol")
+	sendInput(t, alice, "after\n")
+	var seen strings.Builder
+	_ = carol.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.Contains(seen.String(), "after") {
+		var msg wsMessage
+		if err := carol.ReadJSON(&msg); err != nil {
+			t.Fatalf("late joiner: %v", err)
+		}
+		seen.Write(msg.Data)
+	}
+	if strings.Contains(seen.String(), "hunter2") {
+		t.Errorf("late joiner received cleared output: %q", seen.String())
+	}
+
+	var types []string
+	for _, ev := range s.Timeline() {
+		types = append(types, ev.Type+":"+ev.User)
+	}
+	if len(types) != 1 || types[0] != "history_cleared:alice" {
+		t.Errorf("timeline = %v", types)
+	}
+}
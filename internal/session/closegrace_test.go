@@ -0,0 +1,70 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCloseGraceWaitsForClients(t *testing.T) {
+	closed := make(chan struct{})
+	s, err := New(Config{
+		Command:    "sh",
+		Args:       []string{"-c", "read line"},
+		Logger:     discardLogger,
+		CloseGrace: 5 * time.Second,
+		OnClose:    func() { close(closed) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+
+	// The command exits; alice hears about it but has not closed yet.
+	sendInput(t, alice, "\n")
+	readMessage(t, alice, "summary", ReasonCommandExited)
+	select {
+	case <-closed:
+		t.Fatal("session cleaned up before its client closed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if c := s.AddClient("b", nil, AuthInfo{Username: "bob"}); c != nil {
+		t.Error("closing session took a new client")
+	}
+
+	// Reading the close frame answers it, which ends the grace early.
+	if _, _, err := alice.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the close frame after the summary, got %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not cleaned up once its client closed")
+	}
+	if n := s.ClientCount(); n != 0 {
+		t.Errorf("%d clients left after close", n)
+	}
+}
+
+func TestCloseGraceDropsStragglers(t *testing.T) {
+	const grace = 300 * time.Millisecond
+	s, err := New(Config{Command: "cat", Logger: discardLogger, CloseGrace: grace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newWSTransport(t, s)
+	// bob never reads, so he never answers the close frame.
+	tr.dial("b", "bob")
+
+	start := time.Now()
+	s.Close()
+	if d := time.Since(start); d < grace {
+		t.Errorf("Close returned after %v, before the %v grace", d, grace)
+	}
+	if n := s.ClientCount(); n != 0 {
+		t.Errorf("%d clients left after the grace", n)
+	}
+}
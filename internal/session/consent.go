@@ -0,0 +1,89 @@
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const consentTimeout = 5 * time.Minute
+
+type consentMsg struct {
+	Text string `json:"text"`
+	Hash string `json:"hash"`
+}
+
+type consentReply struct {
+	Accept bool `json:"accept"`
+}
+
+func consentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// AwaitConsent asks a client that is about to join to accept
+// Config.ConsentText and waits up to consentTimeout for its answer, which
+// goes in the timeline with the text's hash. Until then the client is not
+// in the session and sees no output. It reports whether the client accepted, and may then be
+// passed to AddClient; otherwise conn has been closed. Without
+// Config.ConsentText it returns true at once.
+func (s *Session) AwaitConsent(id string, conn *websocket.Conn, info AuthInfo) bool {
+	if s.consent == "" {
+		return true
+	}
+	hash := consentHash(s.consent)
+	c := &Client{ID: id, Auth: info}
+
+	// Closing conn ends the wait if the session closes first.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.done:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	conn.SetReadLimit(s.maxMessageBytes)
+	data, _ := json.Marshal(consentMsg{Text: s.consent, Hash: hash})
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	if err := conn.WriteJSON(wsMessage{Type: "consent", Data: json.RawMessage(data)}); err != nil {
+		conn.Close()
+		return false
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+	_ = conn.SetReadDeadline(time.Now().Add(consentTimeout))
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			s.clientLogger(c).Debug("client left before consenting", "error", err)
+			conn.Close()
+			return false
+		}
+		var msg wsMessage
+		var reply consentReply
+		// Anything else, such as the page's first resize, waits until the
+		// client has joined.
+		if json.Unmarshal(raw, &msg) != nil || msg.Type != "consent" || json.Unmarshal(msg.Data, &reply) != nil {
+			continue
+		}
+		if !reply.Accept {
+			s.record(c, "consent", "declined sha256="+hash)
+			_ = conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "consent declined"),
+				time.Now().Add(time.Second),
+			)
+			conn.Close()
+			return false
+		}
+		s.record(c, "consent", "accepted sha256="+hash)
+		_ = conn.SetReadDeadline(time.Time{})
+		return true
+	}
+}
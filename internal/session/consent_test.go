@@ -0,0 +1,125 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialConsent connects a client that has to consent before it joins, and
+// returns it with the notice it was sent.
+func dialConsent(t *testing.T, s *Session, id string) (*websocket.Conn, consentMsg) {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		info := AuthInfo{Username: "alice", Role: RoleOwner}
+		if s.AwaitConsent(id, conn, info) {
+			s.AddClient(id, conn, info)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	var notice consentMsg
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg wsMessage
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != "consent" {
+		t.Fatalf("first message %+v, %v; want consent", msg, err)
+	}
+	_ = json.Unmarshal(msg.Data, &notice)
+	return conn, notice
+}
+
+func answerConsent(t *testing.T, conn *websocket.Conn, accept bool) {
+	t.Helper()
+	data, _ := json.Marshal(consentReply{Accept: accept})
+	if err := conn.WriteJSON(wsMessage{Type: "consent", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func consentEvents(s *Session) []TimelineEvent {
+	var events []TimelineEvent
+	for _, ev := range s.Timeline() {
+		if ev.Type == "consent" {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func TestConsentGatesJoining(t *testing.T) {
+	const text = "This session is recorded."
+	s, err := New(Config{Command: "cat", Logger: discardLogger, ConsentText: text})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	conn, notice := dialConsent(t, s, "a")
+	if notice.Text != text || notice.Hash != consentHash(text) || len(notice.Hash) != 64 {
+		t.Fatalf("notice = %+v", notice)
+	}
+	// A pending client is not in the session, and its input goes nowhere.
+	sendInput(t, conn, "too early\n")
+	time.Sleep(50 * time.Millisecond)
+	if n := s.ClientCount(); n != 0 {
+		t.Fatalf("ClientCount = %d before consent, want 0", n)
+	}
+	if len(consentEvents(s)) != 0 {
+		t.Fatal("consent recorded before the client answered")
+	}
+
+	answerConsent(t, conn, true)
+	readMessage(t, conn, "role", "controller")
+	sendInput(t, conn, "joined\n")
+	var out strings.Builder
+	for !strings.Contains(out.String(), "joined") {
+		out.Write(readMessage(t, conn, "output", "").Data)
+	}
+	if strings.Contains(out.String(), "too early") {
+		t.Error("input sent before consent reached the terminal")
+	}
+
+	events := consentEvents(s)
+	if len(events) != 1 {
+		t.Fatalf("consent events = %+v, want one", events)
+	}
+	ev := events[0]
+	if ev.Client != "a" || ev.User != "alice" || ev.Detail != "accepted sha256="+notice.Hash || ev.Time.IsZero() {
+		t.Errorf("consent event = %+v", ev)
+	}
+}
+
+func TestConsentDeclined(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger, ConsentText: "Recorded."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	conn, notice := dialConsent(t, s, "b")
+	answerConsent(t, conn, false)
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) || !strings.Contains(err.Error(), "consent declined") {
+		t.Errorf("after declining: %v, want a normal close", err)
+	}
+	if n := s.ClientCount(); n != 0 {
+		t.Errorf("ClientCount = %d, want 0", n)
+	}
+	if events := consentEvents(s); len(events) != 1 || events[0].Detail != "declined sha256="+notice.Hash {
+		t.Errorf("consent events = %+v", events)
+	}
+}
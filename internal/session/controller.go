@@ -0,0 +1,63 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// controllerMsg tells clients who has control, when they connect and
+// whenever it changes, including to nobody.
+type controllerMsg struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	Reconnecting bool   `json:"reconnecting,omitempty"`
+}
+
+// currentControllerLocked describes the controller. The caller holds s.mu.
+func (s *Session) currentControllerLocked() controllerMsg {
+	for _, c := range s.clients {
+		if c.IsController {
+			return controllerMsg{ID: c.ID, Name: c.Auth.DisplayName}
+		}
+	}
+	for _, h := range s.held {
+		if h.controller {
+			return controllerMsg{ID: h.id, Name: h.auth.DisplayName, Reconnecting: true}
+		}
+	}
+	return controllerMsg{}
+}
+
+// announceControllerLocked tells every client about the controller if it
+// changed since the last announcement, and reports whether it did. The
+// caller holds s.mu for writing.
+func (s *Session) announceControllerLocked() bool {
+	cur := s.currentControllerLocked()
+	if s.controllerRaw != nil && cur == s.controller {
+		return false
+	}
+	data, _ := json.Marshal(cur)
+	raw, err := json.Marshal(wsMessage{Type: "controller", Data: json.RawMessage(data)})
+	if err != nil {
+		return false
+	}
+	if s.paused && cur.ID != s.controller.ID {
+		held, dropped := s.resumeLocked(s.controller.ID)
+		s.record(nil, "resumed", fmt.Sprintf("control changed; %d bytes held, %d dropped", held, dropped))
+	}
+	s.controller, s.controllerRaw = cur, raw
+	s.notifyAllLocked(raw)
+	return true
+}
+
+// greetControllerLocked tells a newly connected c who has control. The
+// caller holds s.mu for writing.
+func (s *Session) greetControllerLocked(c *Client) {
+	if s.announceControllerLocked() {
+		return
+	}
+	select {
+	case c.send <- outbound{raw: s.controllerRaw}:
+	default:
+	}
+}
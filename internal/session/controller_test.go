@@ -0,0 +1,81 @@
+package session
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func lastController(t *testing.T, c *Client) (controllerMsg, bool) {
+	t.Helper()
+	var got controllerMsg
+	found := false
+	for {
+		select {
+		case m := <-c.send:
+			var msg wsMessage
+			_ = json.Unmarshal(m.raw, &msg)
+			if msg.Type == "controller" {
+				got, found = controllerMsg{}, true
+				_ = json.Unmarshal(msg.Data, &got)
+			}
+		default:
+			return got, found
+		}
+	}
+}
+
+func TestAnnounceController(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{})
+	s.held = make(map[string]*heldClient)
+	ctl := s.addQueueTestClient("ctl", true)
+	ctl.Auth.DisplayName = "Alice"
+	viewer := s.addQueueTestClient("v", false)
+	viewer.Auth.Role = RoleViewer
+
+	s.mu.Lock()
+	s.announceControllerLocked()
+	s.mu.Unlock()
+	if got, _ := lastController(t, viewer); got != (controllerMsg{ID: "ctl", Name: "Alice"}) {
+		t.Errorf("viewer was told %+v", got)
+	}
+
+	// Nothing changed, so only a newcomer hears about it.
+	s.mu.Lock()
+	late := s.addQueueTestClient("late", false)
+	late.Auth.Role = RoleViewer
+	s.greetControllerLocked(late)
+	s.mu.Unlock()
+	if _, ok := lastController(t, viewer); ok {
+		t.Error("an unchanged controller was announced again")
+	}
+	if got, ok := lastController(t, late); !ok || got.ID != "ctl" {
+		t.Errorf("newcomer was told %+v", got)
+	}
+
+	// With only viewers left, nobody has control.
+	s.mu.Lock()
+	delete(s.clients, "ctl")
+	s.promoteLocked()
+	s.announceControllerLocked()
+	s.mu.Unlock()
+	if got, ok := lastController(t, viewer); !ok || got != (controllerMsg{}) {
+		t.Errorf("after the controller left, viewer was told %+v (sent %v)", got, ok)
+	}
+}
+
+func TestControllerMessageOnPromotion(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	alice := tr.dial("a", "alice")
+	readMessage(t, alice, "controller", `"id":"a"`)
+	bob := tr.dial("b", "bob")
+	readMessage(t, bob, "controller", `"id":"a"`)
+
+	alice.Close()
+	readMessage(t, bob, "controller", `"id":"b"`)
+}
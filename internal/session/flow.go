@@ -0,0 +1,48 @@
+package session
+
+import (
+	"encoding/json"
+)
+
+// flowBufferBytes is the most output held for a client that paused its
+// own output; see setFlow.
+const flowBufferBytes = 256 << 10
+
+type resyncMsg struct {
+	Dropped int64 `json:"dropped"`
+}
+
+// setFlow pauses or resumes c's live output, for a "flow" message. Unlike
+// the controller's pause, it affects only c, and other messages still reach
+// it. On resume c is sent what was held in one message, after a "resync"
+// if the oldest lines had to be dropped.
+func (s *Session) setFlow(c *Client, paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if paused == (c.flow != nil) {
+		return
+	}
+	if paused {
+		c.flow = &pauseBuffer{limit: flowBufferBytes}
+		s.clientLogger(c).Debug("client paused its output")
+		return
+	}
+	buf, dropped := c.flow.take()
+	c.flow = nil
+	s.clientLogger(c).Debug("client resumed its output", "held", len(buf), "dropped", dropped)
+	// s.mu is held for writing, so no new output can overtake this.
+	if dropped > 0 {
+		data, _ := json.Marshal(resyncMsg{Dropped: dropped})
+		raw, _ := json.Marshal(wsMessage{Type: "resync", Data: json.RawMessage(data)})
+		if !s.enqueueLocked(c, outbound{raw: raw}) {
+			s.skipControllerLocked(c)
+		}
+	}
+	if len(buf) > 0 {
+		data, _ := json.Marshal(string(buf))
+		raw, err := json.Marshal(wsMessage{Type: "output", Data: json.RawMessage(data)})
+		if err == nil && !s.enqueueLocked(c, outbound{raw: raw}) {
+			s.skipControllerLocked(c)
+		}
+	}
+}
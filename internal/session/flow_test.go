@@ -0,0 +1,100 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func setFlowAndWait(t *testing.T, s *Session, conn *websocket.Conn, id, state string) {
+	t.Helper()
+	data, _ := json.Marshal(state)
+	if err := conn.WriteJSON(wsMessage{Type: "flow", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.RLock()
+		c := s.clients[id]
+		done := c != nil && (c.flow != nil) == (state == "pause")
+		s.mu.RUnlock()
+		if done {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client %s did not %s its output", id, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFlowPauseHoldsOneClient(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+
+	setFlowAndWait(t, s, bob, "b", "pause")
+	sendInput(t, alice, "held\n")
+	waitForHistory(t, s, "held", 2)
+	// Everyone else still gets output live.
+	readMessage(t, alice, "output", "held")
+
+	// Bob still gets other messages, without the output.
+	_ = tr.dial("c", "carol")
+	_ = bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := bob.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "output" && strings.Contains(string(msg.Data), "held") {
+			t.Fatal("output reached a client that paused it")
+		}
+		if msg.Type == "clients" && strings.Contains(string(msg.Data), `"count":3`) {
+			break
+		}
+	}
+
+	setFlowAndWait(t, s, bob, "b", "resume")
+	if out := readMessage(t, bob, "output", "held"); strings.Count(string(out.Data), "held") != 2 {
+		t.Errorf("held output = %s, want the echo and the output in one message", out.Data)
+	}
+}
+
+func TestFlowOverflowResyncs(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	bob := tr.dial("b", "bob")
+
+	setFlowAndWait(t, s, bob, "b", "pause")
+	line := append(bytes.Repeat([]byte("x"), 1023), '\n')
+	for range flowBufferBytes/len(line) + 4 {
+		s.output(line)
+	}
+	s.output([]byte("last\n"))
+	setFlowAndWait(t, s, bob, "b", "resume")
+
+	var resync resyncMsg
+	_ = json.Unmarshal(readMessage(t, bob, "resync", "").Data, &resync)
+	if resync.Dropped <= 0 || resync.Dropped%int64(len(line)) != 0 {
+		t.Errorf("resync dropped %d bytes, want whole lines", resync.Dropped)
+	}
+	var out string
+	_ = json.Unmarshal(readMessage(t, bob, "output", "last").Data, &out)
+	if len(out) > flowBufferBytes || !strings.HasSuffix(out, "last\n") {
+		t.Errorf("resumed with %d bytes, want the newest within %d", len(out), flowBufferBytes)
+	}
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// detachTimeout bounds the wait for the PTY reader to stop.
+const detachTimeout = 5 * time.Second
+
+// HandoffState describes a running command for the process taking it over.
+type HandoffState struct {
+	Pid       int       `json:"pid"`
+	StartedAt time.Time `json:"startedAt"`
+	Cols      uint16    `json:"cols"`
+	Rows      uint16    `json:"rows"`
+	History   []byte    `json:"history,omitempty"`
+}
+
+// Inherited is a command taken over from another vexShare process.
+type Inherited struct {
+	PTY   *os.File
+	State HandoffState
+}
+
+// CanDetach reports why the session cannot be handed over, if it cannot.
+func (s *Session) CanDetach() error {
+	if len(s.rlimits) > 0 {
+		// The command is set to die with the thread that started it.
+		return errors.New("a command with resource limits cannot be handed over")
+	}
+	select {
+	case <-s.done:
+		return errors.New("the session has ended")
+	default:
+	}
+	if s.exitPending.Load() {
+		return errors.New("the command has exited")
+	}
+	s.procMu.Lock()
+	input := s.input
+	s.procMu.Unlock()
+	if !input.deadlines {
+		return errors.New("the PTY does not support deadlines")
+	}
+	return nil
+}
+
+// Detach prepares the session to be handed over to a new vexShare binary
+// and returns its PTY. It stops reading the PTY and disconnects every client
+// with close code 1012, leaving the command running. The new binary resumes
+// with Config.Inherit; clients, held reconnects, the timeline, the summary
+// counters, a pause and a spooled history are not carried over. The session
+// must not be used afterwards; in particular, Close would kill the command.
+func (s *Session) Detach() (*os.File, HandoffState, error) {
+	if err := s.CanDetach(); err != nil {
+		return nil, HandoffState{}, err
+	}
+	s.procMu.Lock()
+	cmd, ptmx, exited := s.cmd, s.ptmx, s.procExited
+	s.procMu.Unlock()
+
+	// Stop the reader without closing the PTY: a read deadline in the past
+	// makes the pending read return.
+	s.detached = make(chan struct{})
+	s.detaching.Store(true)
+	_ = ptmx.SetReadDeadline(time.Now())
+	select {
+	case <-s.detached:
+	case <-exited:
+		return nil, HandoffState{}, errors.New("the command has exited")
+	case <-time.After(detachTimeout):
+		return nil, HandoffState{}, errors.New("timed out waiting for the PTY reader")
+	}
+	_ = ptmx.SetReadDeadline(time.Time{})
+	s.batcher.Flush()
+
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	size := s.ptySize
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.kicked.Store(true)
+		_ = c.Conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseServiceRestart, "reconnect"),
+			time.Now().Add(time.Second),
+		)
+		c.Conn.Close()
+	}
+	s.logger.Info("session detached for handoff", "pid", cmd.Process.Pid, "clients", len(clients))
+
+	st := HandoffState{Pid: cmd.Process.Pid, StartedAt: s.startedAt, Cols: size.Cols, Rows: size.Rows}
+	if s.history.spoolDir == "" {
+		var buf bytes.Buffer
+		if _, err := s.history.WriteTo(&buf); err == nil {
+			st.History = buf.Bytes()
+		}
+	}
+	// A spooled history is not handed over; the new process starts its own.
+	s.history.Close()
+	return ptmx, st, nil
+}
+
+// adoptProcess takes over a command started by another vexShare process.
+func (s *Session) adoptProcess(in *Inherited) error {
+	p, err := os.FindProcess(in.State.Pid)
+	if err != nil {
+		return fmt.Errorf("find inherited command: %w", err)
+	}
+	cmd := &exec.Cmd{Path: s.command, Args: append([]string{s.command}, s.args...), Process: p}
+	s.startedAt = in.State.StartedAt
+	if in.State.Cols > 0 && in.State.Rows > 0 {
+		s.ptySize = pty.Winsize{Cols: in.State.Cols, Rows: in.State.Rows}
+	}
+	s.history.Write(in.State.History)
+	s.attachProcess(cmd, in.PTY)
+	s.logger.Info("took over command from previous process", "pid", in.State.Pid)
+	return nil
+}
@@ -0,0 +1,69 @@
+package session
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestDetachAndInherit(t *testing.T) {
+	old, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTr := newWSTransport(t, old)
+	alice := oldTr.dial("a", "alice")
+	sendInput(t, alice, "before\n")
+	waitForHistory(t, old, "before", 2)
+
+	ptmx, st, err := old.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, _, err := alice.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+				t.Errorf("client after detach: got %v, want close 1012", err)
+			}
+			break
+		}
+	}
+	old.procMu.Lock()
+	pid := old.cmd.Process.Pid
+	old.procMu.Unlock()
+	if st.Pid != pid || !strings.Contains(string(st.History), "before") {
+		t.Fatalf("state = pid %d, history %q; want pid %d with the history", st.Pid, st.History, pid)
+	}
+
+	s, err := New(Config{Command: "cat", Logger: discardLogger, Inherit: &Inherited{PTY: ptmx, State: st}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	if !s.StartedAt().Equal(st.StartedAt) || !strings.Contains(historyString(s), "before") {
+		t.Errorf("inherited session: started %v, history %q", s.StartedAt(), historyString(s))
+	}
+	bob := newWSTransport(t, s).dial("b", "bob")
+	sendInput(t, bob, "after\n")
+	readMessage(t, bob, "output", "after")
+	s.procMu.Lock()
+	if s.cmd.Process.Pid != pid {
+		t.Errorf("inherited session runs pid %d, want %d", s.cmd.Process.Pid, pid)
+	}
+	s.procMu.Unlock()
+}
+
+func TestCanDetach(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CanDetach(); err != nil {
+		t.Errorf("running session: %v", err)
+	}
+	s.Close()
+	if s.CanDetach() == nil {
+		t.Error("a closed session can be detached")
+	}
+}
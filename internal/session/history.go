@@ -0,0 +1,240 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	DefaultScrollbackBytes = 1 << 20
+	spoolSegmentBytes      = 256 << 10
+	historyChunkBytes      = 32 << 10
+)
+
+// history keeps the output of a session: a fixed-size scrollback ring, or
+// when a spool directory is configured, completed segments on disk plus the
+// segment currently being filled in memory. Segment files are only written
+// once complete, so readers never see a partially written file.
+type history struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+
+	ring    []byte
+	written int64
+	// start is where the ring's content begins after a Clear.
+	start int64
+
+	spoolDir   string
+	spoolMax   int64
+	current    bytes.Buffer
+	segments   []spoolSegment
+	spoolBytes int64
+	nextSeg    int
+	// closed is set once Close has removed the spool.
+	closed bool
+}
+
+type spoolSegment struct {
+	path string
+	size int64
+}
+
+func newHistory(scrollback int, spoolDir string, spoolMax int64, logger *slog.Logger) (*history, error) {
+	if scrollback <= 0 {
+		scrollback = DefaultScrollbackBytes
+	}
+	h := &history{logger: logger}
+	if spoolDir == "" {
+		h.ring = make([]byte, scrollback)
+		return h, nil
+	}
+	if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create history spool: %w", err)
+	}
+	dir, err := os.MkdirTemp(spoolDir, "session-")
+	if err != nil {
+		return nil, fmt.Errorf("create history spool: %w", err)
+	}
+	h.spoolDir = dir
+	h.spoolMax = spoolMax
+	return h, nil
+}
+
+func (h *history) Write(p []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.spoolDir == "" {
+		h.writeRingLocked(p)
+		return
+	}
+	if h.closed {
+		return
+	}
+	h.current.Write(p)
+	if h.current.Len() >= spoolSegmentBytes {
+		h.flushSegmentLocked()
+	}
+}
+
+func (h *history) writeRingLocked(p []byte) {
+	size := int64(len(h.ring))
+	if int64(len(p)) > size {
+		h.written += int64(len(p)) - size
+		p = p[int64(len(p))-size:]
+	}
+	for len(p) > 0 {
+		off := h.written % size
+		n := copy(h.ring[off:], p)
+		p = p[n:]
+		h.written += int64(n)
+	}
+}
+
+func (h *history) flushSegmentLocked() {
+	path := filepath.Join(h.spoolDir, fmt.Sprintf("%08d.seg", h.nextSeg))
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, h.current.Bytes(), 0o600); err != nil {
+		h.logger.Error("write history segment", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		h.logger.Error("write history segment", "error", err)
+		_ = os.Remove(tmp)
+		return
+	}
+	h.nextSeg++
+	size := int64(h.current.Len())
+	h.segments = append(h.segments, spoolSegment{path: path, size: size})
+	h.spoolBytes += size
+	h.current.Reset()
+
+	for h.spoolMax > 0 && h.spoolBytes > h.spoolMax && len(h.segments) > 0 {
+		oldest := h.segments[0]
+		h.segments = h.segments[1:]
+		h.spoolBytes -= oldest.size
+		if err := os.Remove(oldest.path); err != nil {
+			h.logger.Warn("remove history segment", "error", err)
+		}
+	}
+}
+
+// Clear forgets everything recorded so far, on disk too, and returns how
+// many bytes that was.
+func (h *history) Clear() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.spoolDir == "" {
+		dropped := min(h.written-h.start, int64(len(h.ring)))
+		h.start = h.written
+		clear(h.ring)
+		return dropped
+	}
+	dropped := h.spoolBytes + int64(h.current.Len())
+	for _, seg := range h.segments {
+		if err := os.Remove(seg.path); err != nil {
+			h.logger.Warn("remove history segment", "error", err)
+		}
+	}
+	h.segments, h.spoolBytes = nil, 0
+	clear(h.current.Bytes())
+	h.current.Reset()
+	return dropped
+}
+
+// Close deletes the spool directory, so that a session's output does not
+// outlive it on disk. The history is empty afterwards.
+func (h *history) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.spoolDir == "" || h.closed {
+		return
+	}
+	h.closed = true
+	if err := os.RemoveAll(h.spoolDir); err != nil {
+		h.logger.Warn("remove history spool", "error", err)
+	}
+	h.segments, h.spoolBytes = nil, 0
+	clear(h.current.Bytes())
+	h.current.Reset()
+}
+
+// WriteTo streams the history as it was when the call started. Output
+// appended during the download is not included.
+func (h *history) WriteTo(w io.Writer) (int64, error) {
+	if h.spoolDir == "" {
+		return h.writeRingTo(w)
+	}
+	return h.writeSpoolTo(w)
+}
+
+func (h *history) writeRingTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	end := h.written
+	h.mu.Unlock()
+
+	var total int64
+	buf := make([]byte, historyChunkBytes)
+	size := int64(len(h.ring))
+	cur := max(0, end-size)
+	for cur < end {
+		h.mu.Lock()
+		// Skip anything the writer has overwritten or Clear has dropped
+		// since the last chunk.
+		cur = max(cur, h.written-size, h.start)
+		if cur >= end {
+			h.mu.Unlock()
+			break
+		}
+		n := min(int64(len(buf)), end-cur, size-cur%size)
+		copy(buf, h.ring[cur%size:cur%size+n])
+		h.mu.Unlock()
+
+		written, err := w.Write(buf[:n])
+		total += int64(written)
+		if err != nil {
+			return total, err
+		}
+		cur += n
+	}
+	return total, nil
+}
+
+func (h *history) writeSpoolTo(w io.Writer) (int64, error) {
+	// Open the completed segments under the lock so that trimming can
+	// unlink them without pulling them out from under the reader.
+	h.mu.Lock()
+	files := make([]*os.File, 0, len(h.segments))
+	for _, seg := range h.segments {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			h.logger.Warn("open history segment", "error", err)
+			continue
+		}
+		files = append(files, f)
+	}
+	tail := bytes.Clone(h.current.Bytes())
+	h.mu.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	var total int64
+	for _, f := range files {
+		n, err := io.Copy(w, f)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	n, err := w.Write(tail)
+	total += int64(n)
+	return total, err
+}
@@ -0,0 +1,206 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// clearMark in a list of writes stands for a call to Clear.
+const clearMark = "<clear>"
+
+func TestHistoryRing(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 8, nil, ""},
+		{"fits", 8, []string{"abc", "de"}, "abcde"},
+		{"wraps", 8, []string{"abcdef", "ghijk"}, "defghijk"},
+		{"oversized write", 4, []string{"ab", "cdefghij"}, "ghij"},
+		{"exact fill", 4, []string{"ab", "cd", "ef"}, "cdef"},
+		{"cleared", 8, []string{"abc", clearMark, "de"}, "de"},
+		{"cleared and empty", 8, []string{"abc", clearMark}, ""},
+		{"cleared then wraps", 4, []string{"abc", clearMark, "defgh"}, "efgh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := newHistory(tt.size, "", 0, discardLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				if w == clearMark {
+					h.Clear()
+					continue
+				}
+				h.Write([]byte(w))
+			}
+			var out bytes.Buffer
+			if _, err := h.WriteTo(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestHistorySpoolTrimsOldSegments(t *testing.T) {
+	dir := t.TempDir()
+	h, err := newHistory(0, dir, 2*spoolSegmentBytes, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := bytes.Repeat([]byte("x"), spoolSegmentBytes)
+	for i := 0; i < 5; i++ {
+		h.Write(chunk)
+	}
+	h.Write([]byte("tail"))
+
+	if len(h.segments) != 2 {
+		t.Fatalf("segments = %d, want 2", len(h.segments))
+	}
+	entries, _ := os.ReadDir(h.spoolDir)
+	if len(entries) != 2 {
+		t.Errorf("spool files = %d, want 2", len(entries))
+	}
+	var out bytes.Buffer
+	if _, err := h.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 2*spoolSegmentBytes+4 || !strings.HasSuffix(out.String(), "xtail") {
+		t.Errorf("history length = %d, want %d", out.Len(), 2*spoolSegmentBytes+4)
+	}
+}
+
+func TestHistorySpoolClear(t *testing.T) {
+	h, err := newHistory(0, t.TempDir(), 0, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write(bytes.Repeat([]byte("x"), spoolSegmentBytes))
+	h.Write([]byte("secret"))
+	if dropped := h.Clear(); dropped != spoolSegmentBytes+6 {
+		t.Errorf("Clear dropped %d bytes, want %d", dropped, spoolSegmentBytes+6)
+	}
+	if entries, _ := os.ReadDir(h.spoolDir); len(entries) != 0 {
+		t.Errorf("spool files left after Clear: %d", len(entries))
+	}
+	h.Write([]byte("after"))
+	var out bytes.Buffer
+	if _, err := h.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "after" {
+		t.Errorf("history after Clear = %q, want %q", out.String(), "after")
+	}
+}
+
+func TestHistorySpoolRemovedOnClose(t *testing.T) {
+	spool := t.TempDir()
+	s, err := New(Config{Command: "cat", Logger: discardLogger, HistorySpoolDir: spool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.history.Write(bytes.Repeat([]byte("x"), spoolSegmentBytes))
+	if entries, _ := os.ReadDir(spool); len(entries) != 1 {
+		t.Fatalf("spool directories = %d, want 1", len(entries))
+	}
+	s.Close()
+	if entries, _ := os.ReadDir(spool); len(entries) != 0 {
+		t.Errorf("session spool left after Close: %v", entries)
+	}
+	// Output that arrives late is not spooled again.
+	s.history.Write(bytes.Repeat([]byte("x"), spoolSegmentBytes))
+	if _, err := os.Stat(s.history.spoolDir); !os.IsNotExist(err) {
+		t.Errorf("spool recreated after Close: %v", err)
+	}
+}
+
+// slowWriter yields between writes so the appender makes progress while a
+// download is in flight.
+type slowWriter struct {
+	bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	for rest := p; len(rest) > 0; {
+		n := min(len(rest), 512)
+		w.Buffer.Write(rest[:n])
+		rest = rest[n:]
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func TestHistoryConcurrentAppendWhileDownloading(t *testing.T) {
+	h, err := newHistory(0, t.TempDir(), 8*spoolSegmentBytes, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			h.Write([]byte(fmt.Sprintf("line %08d\n", i)))
+		}
+	}()
+
+	for round := 0; round < 20; round++ {
+		var out slowWriter
+		if _, err := h.WriteTo(&out); err != nil {
+			t.Fatal(err)
+		}
+		checkContiguous(t, out.String())
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// checkContiguous verifies that every complete line follows its predecessor.
+// The first line may be cut where the oldest segment was trimmed.
+func checkContiguous(t *testing.T, s string) {
+	t.Helper()
+	if s == "" {
+		return
+	}
+	if !strings.HasSuffix(s, "\n") {
+		t.Fatalf("history ends mid-line: %q", s[max(0, len(s)-20):])
+	}
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if !strings.HasPrefix(lines[0], "line ") || len(lines[0]) != len("line 00000000") {
+		lines = lines[1:]
+	}
+	prev := -1
+	for _, line := range lines {
+		n, err := strconv.Atoi(strings.TrimPrefix(line, "line "))
+		if err != nil {
+			t.Fatalf("corrupt line %q", line)
+		}
+		if prev >= 0 && n != prev+1 {
+			t.Fatalf("line %d follows %d", n, prev)
+		}
+		prev = n
+	}
+}
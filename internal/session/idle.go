@@ -0,0 +1,151 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	keepaliveInterval = time.Minute
+	deadlineInterval  = 10 * time.Second
+)
+
+// Deadline is where a session stands against its idle timeout. Clients get
+// it in the role message and in "deadline" messages, as durations so that
+// their clocks do not matter.
+type Deadline struct {
+	// IdleTimeoutSeconds is the idle budget, extensions included.
+	IdleTimeoutSeconds int64 `json:"idleTimeoutSeconds"`
+	// IdleSeconds is the time since the last activity.
+	IdleSeconds      int64 `json:"idleSeconds"`
+	RemainingSeconds int64 `json:"remainingSeconds"`
+}
+
+type idleMsg struct {
+	Reason           string `json:"reason"`
+	By               string `json:"by,omitempty"`
+	RemainingSeconds int64  `json:"remainingSeconds"`
+	ExtendedSeconds  int64  `json:"extendedSeconds"`
+}
+
+// idleRemainingLocked is the time left before the idle timeout. The caller
+// holds s.activeMu.
+func (s *Session) idleRemainingLocked() time.Duration {
+	return s.lastActive.Add(s.idleTimeout + s.idleExtra).Sub(s.timeNow())
+}
+
+// keepalive counts as activity for c unless c sent one within the last
+// keepaliveInterval. It reports whether it was accepted.
+func (s *Session) keepalive(c *Client) bool {
+	if s.idleTimeout <= 0 {
+		return false
+	}
+	now := s.timeNow()
+	s.activeMu.Lock()
+	if !c.lastKeepalive.IsZero() && now.Sub(c.lastKeepalive) < keepaliveInterval {
+		s.activeMu.Unlock()
+		return false
+	}
+	c.lastKeepalive = now
+	s.lastActive = now
+	remaining, extra := s.idleRemainingLocked(), s.idleExtra
+	d, due := s.deadlineLocked(), s.deadlineDueLocked(now)
+	s.activeMu.Unlock()
+
+	s.record(c, "keepalive", "")
+	s.announceIdle(c, "keepalive", remaining, extra)
+	if due {
+		s.announceDeadline(d)
+	}
+	return true
+}
+
+// extendIdle adds IdleExtendStep to the idle budget, or whatever is left
+// under IdleExtendMax. It reports whether the budget grew.
+func (s *Session) extendIdle(c *Client) bool {
+	if s.idleTimeout <= 0 || s.idleExtendStep <= 0 {
+		return false
+	}
+	s.activeMu.Lock()
+	added := s.idleExtendStep
+	if s.idleExtendMax > 0 {
+		added = min(added, s.idleExtendMax-s.idleExtra)
+	}
+	if added <= 0 {
+		s.activeMu.Unlock()
+		s.record(c, "idle_extend_refused", fmt.Sprintf("already extended by %s", s.idleExtendMax))
+		return false
+	}
+	s.idleExtra += added
+	remaining, extra := s.idleRemainingLocked(), s.idleExtra
+	d := s.deadlineLocked()
+	s.lastDeadline = s.timeNow()
+	s.activeMu.Unlock()
+
+	s.record(c, "idle_extend", fmt.Sprintf("+%s, idle budget now %s", added, s.idleTimeout+extra))
+	s.announceIdle(c, "extend", remaining, extra)
+	s.announceDeadline(d)
+	return true
+}
+
+// Deadline reports where the session stands against its idle timeout, or
+// false if it has none.
+func (s *Session) Deadline() (Deadline, bool) {
+	if s.idleTimeout <= 0 {
+		return Deadline{}, false
+	}
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	return s.deadlineLocked(), true
+}
+
+// deadlineLocked is the current Deadline. The caller holds s.activeMu.
+func (s *Session) deadlineLocked() Deadline {
+	return Deadline{
+		IdleTimeoutSeconds: int64((s.idleTimeout + s.idleExtra).Seconds()),
+		IdleSeconds:        int64(s.timeNow().Sub(s.lastActive).Seconds()),
+		RemainingSeconds:   int64(s.idleRemainingLocked().Seconds()),
+	}
+}
+
+// deadlineDueLocked reports whether a "deadline" message may go out now,
+// and if so counts it as sent. The caller holds s.activeMu.
+func (s *Session) deadlineDueLocked(now time.Time) bool {
+	if s.idleTimeout <= 0 || now.Sub(s.lastDeadline) < deadlineInterval {
+		return false
+	}
+	s.lastDeadline = now
+	return true
+}
+
+func (s *Session) announceDeadline(d Deadline) {
+	data, _ := json.Marshal(d)
+	raw, err := json.Marshal(wsMessage{Type: "deadline", Data: json.RawMessage(data)})
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	s.notifyAllLocked(raw)
+	s.mu.RUnlock()
+}
+
+func (s *Session) announceIdle(c *Client, reason string, remaining, extra time.Duration) {
+	by := c.Auth.DisplayName
+	if by == "" {
+		by = c.Auth.Username
+	}
+	data, _ := json.Marshal(idleMsg{
+		Reason:           reason,
+		By:               by,
+		RemainingSeconds: int64(remaining.Seconds()),
+		ExtendedSeconds:  int64(extra.Seconds()),
+	})
+	raw, err := json.Marshal(wsMessage{Type: "idle", Data: json.RawMessage(data)})
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	s.notifyAllLocked(raw)
+	s.mu.RUnlock()
+}
@@ -0,0 +1,173 @@
+package session
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (f *fakeClock) Now() time.Time          { return f.t }
+func (f *fakeClock) Advance(d time.Duration) { f.t = f.t.Add(d) }
+
+func TestIdleBudget(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s := newQueueTestSession(SendPolicy{})
+	s.now = clock.Now
+	s.lastActive = clock.Now()
+	s.idleTimeout = 30 * time.Minute
+	s.idleExtendStep = 15 * time.Minute
+	s.idleExtendMax = 40 * time.Minute
+	controller := s.addQueueTestClient("ctl", true)
+	controller.Auth.Username = "alice"
+	viewer := s.addQueueTestClient("v", false)
+	viewer.Auth.Username = "bob"
+
+	remaining := func() time.Duration {
+		s.activeMu.Lock()
+		defer s.activeMu.Unlock()
+		return s.idleRemainingLocked()
+	}
+	lastIdle := func(c *Client) idleMsg {
+		t.Helper()
+		var got idleMsg
+		for {
+			select {
+			case m := <-c.send:
+				var msg wsMessage
+				_ = json.Unmarshal(m.raw, &msg)
+				if msg.Type == "idle" {
+					_ = json.Unmarshal(msg.Data, &got)
+				}
+			default:
+				if got.Reason == "" {
+					t.Fatalf("client %s got no idle message", c.ID)
+				}
+				return got
+			}
+		}
+	}
+
+	clock.Advance(10 * time.Minute)
+	if got := remaining(); got != 20*time.Minute {
+		t.Fatalf("remaining after 10m = %v, want 20m", got)
+	}
+
+	// Only the controller can extend, by a step at a time up to the cap.
+	if ok, _ := s.handleMessage(viewer, []byte(`{"type":"extend"}`)); !ok || remaining() != 20*time.Minute {
+		t.Errorf("a viewer extended the budget: remaining %v", remaining())
+	}
+	for i, want := range []time.Duration{35 * time.Minute, 50 * time.Minute, 60 * time.Minute} {
+		if !s.extendIdle(controller) {
+			t.Fatalf("extension %d refused", i+1)
+		}
+		if got := remaining(); got != want {
+			t.Errorf("after extension %d remaining = %v, want %v", i+1, got, want)
+		}
+	}
+	if msg := lastIdle(viewer); msg.Reason != "extend" || msg.By != "alice" || msg.RemainingSeconds != 3600 || msg.ExtendedSeconds != 2400 {
+		t.Errorf("viewer was told %+v", msg)
+	}
+	if s.extendIdle(controller) || remaining() != 60*time.Minute {
+		t.Errorf("extension past the cap: remaining %v", remaining())
+	}
+
+	// A keepalive restarts the budget, extension included, once a minute.
+	clock.Advance(5 * time.Minute)
+	if !s.keepalive(viewer) || remaining() != 70*time.Minute {
+		t.Errorf("keepalive: remaining %v, want 70m", remaining())
+	}
+	clock.Advance(30 * time.Second)
+	if s.keepalive(viewer) || remaining() != 69*time.Minute+30*time.Second {
+		t.Errorf("second keepalive within a minute accepted: remaining %v", remaining())
+	}
+	clock.Advance(30 * time.Second)
+	if !s.keepalive(viewer) {
+		t.Error("keepalive a minute later refused")
+	}
+	if msg := lastIdle(controller); msg.Reason != "keepalive" || msg.By != "bob" || msg.RemainingSeconds != 4200 {
+		t.Errorf("controller was told %+v", msg)
+	}
+
+	var types []string
+	for _, ev := range s.Timeline() {
+		types = append(types, ev.Type+":"+ev.User)
+	}
+	want := []string{"idle_extend:alice", "idle_extend:alice", "idle_extend:alice", "idle_extend_refused:alice", "keepalive:bob", "keepalive:bob"}
+	if len(types) != len(want) {
+		t.Fatalf("timeline %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Errorf("timeline %v, want %v", types, want)
+			break
+		}
+	}
+}
+
+func TestIdleMessagesWithoutTimeout(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{})
+	c := s.addQueueTestClient("c", true)
+	if s.keepalive(c) || s.extendIdle(c) {
+		t.Error("keepalive or extend accepted without an idle timeout")
+	}
+	if len(s.Timeline()) != 0 {
+		t.Errorf("timeline = %v", s.Timeline())
+	}
+}
+
+func TestDeadlineMessages(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	s := newQueueTestSession(SendPolicy{})
+	s.now = clock.Now
+	s.lastActive = clock.Now()
+	s.idleTimeout = 30 * time.Minute
+	s.idleExtendStep = 15 * time.Minute
+	c := s.addQueueTestClient("ctl", true)
+
+	deadlines := func() []Deadline {
+		var got []Deadline
+		for {
+			select {
+			case m := <-c.send:
+				var msg wsMessage
+				_ = json.Unmarshal(m.raw, &msg)
+				if msg.Type == "deadline" {
+					var d Deadline
+					_ = json.Unmarshal(msg.Data, &d)
+					got = append(got, d)
+				}
+			default:
+				return got
+			}
+		}
+	}
+
+	clock.Advance(4 * time.Minute)
+	if d, ok := s.Deadline(); !ok || d != (Deadline{IdleTimeoutSeconds: 1800, IdleSeconds: 240, RemainingSeconds: 1560}) {
+		t.Errorf("Deadline() = %+v, %v", d, ok)
+	}
+
+	// Activity restarts the clock, announced at most every 10 seconds.
+	s.touchActivity()
+	clock.Advance(5 * time.Second)
+	s.touchActivity()
+	if got := deadlines(); len(got) != 1 || got[0].RemainingSeconds != 1800 || got[0].IdleSeconds != 0 {
+		t.Errorf("deadlines after two bursts of activity = %+v, want one with 1800s left", got)
+	}
+	clock.Advance(5 * time.Second)
+	s.touchActivity()
+	if got := deadlines(); len(got) != 1 {
+		t.Errorf("deadlines 10s later = %+v, want one", got)
+	}
+
+	// An extension is announced at once.
+	clock.Advance(time.Second)
+	if !s.extendIdle(c) {
+		t.Fatal("extension refused")
+	}
+	if got := deadlines(); len(got) != 1 || got[0].IdleTimeoutSeconds != 2700 || got[0].RemainingSeconds != 2699 {
+		t.Errorf("deadlines after extending = %+v", got)
+	}
+}
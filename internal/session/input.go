@@ -0,0 +1,174 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	inputQueueSize    = 256
+	defaultStallAfter = time.Second
+	// inputWriteTimeout bounds each write, so the writer notices when the
+	// command exits while it is waiting for the command to read.
+	inputWriteTimeout = 250 * time.Millisecond
+)
+
+var errInputClosed = errors.New("the command is no longer reading input")
+
+type inputStalledMsg struct {
+	Stalled bool `json:"stalled"`
+}
+
+// inputWriter feeds one process's PTY from a bounded queue, so a command
+// that stops reading its terminal cannot block the client that typed into
+// it. When the queue stays full for stallAfter, input is dropped until the
+// command catches up, and the clients it came from are sent
+// "input-stalled".
+type inputWriter struct {
+	ptmx      *os.File
+	queue     chan []byte
+	quit      chan struct{} // closed when the writer stops
+	deadlines bool
+
+	mu      sync.Mutex
+	stalled bool
+	told    map[*Client]bool
+}
+
+func (s *Session) startInputWriter(ptmx *os.File, exited <-chan struct{}) *inputWriter {
+	w := &inputWriter{
+		ptmx:      ptmx,
+		queue:     make(chan []byte, inputQueueSize),
+		quit:      make(chan struct{}),
+		deadlines: setNonblock(ptmx),
+	}
+	go s.runInputWriter(w, exited)
+	return w
+}
+
+func (s *Session) runInputWriter(w *inputWriter, exited <-chan struct{}) {
+	defer close(w.quit)
+	for {
+		select {
+		case data := <-w.queue:
+			if err := w.write(data, exited); err != nil {
+				s.logger.Debug("pty write error", "error", err)
+				return
+			}
+			if len(w.queue) == 0 {
+				s.inputDrained(w)
+			}
+		case <-exited:
+			return
+		}
+	}
+}
+
+func (w *inputWriter) write(data []byte, exited <-chan struct{}) error {
+	for len(data) > 0 {
+		if w.deadlines {
+			_ = w.ptmx.SetWriteDeadline(time.Now().Add(inputWriteTimeout))
+		}
+		n, err := w.ptmx.Write(data)
+		data = data[n:]
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			select {
+			case <-exited:
+				return errInputClosed
+			default:
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePTY queues input from c, which is nil for input the server injects.
+// It waits up to stallAfter for room in the queue and drops the input
+// after that. It fails only once the command has exited.
+func (s *Session) writePTY(c *Client, data []byte) error {
+	s.procMu.Lock()
+	w := s.input
+	s.procMu.Unlock()
+
+	select {
+	case w.queue <- data:
+		return nil
+	case <-w.quit:
+		return errInputClosed
+	default:
+	}
+	w.mu.Lock()
+	stalled := w.stalled
+	w.mu.Unlock()
+	if !stalled {
+		timer := time.NewTimer(s.stallAfter)
+		defer timer.Stop()
+		select {
+		case w.queue <- data:
+			return nil
+		case <-w.quit:
+			return errInputClosed
+		case <-timer.C:
+		}
+	}
+	s.inputStalled(w, c, len(data))
+	return nil
+}
+
+// inputStalled notes that input from c was dropped.
+func (s *Session) inputStalled(w *inputWriter, c *Client, dropped int) {
+	w.mu.Lock()
+	first := !w.stalled
+	w.stalled = true
+	tell := c != nil && !w.told[c]
+	if tell {
+		if w.told == nil {
+			w.told = make(map[*Client]bool)
+		}
+		w.told[c] = true
+	}
+	w.mu.Unlock()
+
+	if first {
+		s.logger.Warn("the command is not reading input; dropping input until it catches up", "dropped", dropped)
+	}
+	if tell {
+		s.sendInputStalled(c, true)
+	}
+}
+
+// inputDrained ends a stall once the writer has emptied the queue.
+func (s *Session) inputDrained(w *inputWriter) {
+	w.mu.Lock()
+	if !w.stalled {
+		w.mu.Unlock()
+		return
+	}
+	told := w.told
+	w.stalled, w.told = false, nil
+	w.mu.Unlock()
+
+	s.logger.Info("the command is reading input again")
+	for c := range told {
+		s.sendInputStalled(c, false)
+	}
+}
+
+func (s *Session) sendInputStalled(c *Client, stalled bool) {
+	data, _ := json.Marshal(inputStalledMsg{Stalled: stalled})
+	raw, err := json.Marshal(wsMessage{Type: "input-stalled", Data: json.RawMessage(data)})
+	if err != nil {
+		return
+	}
+	select {
+	case c.send <- outbound{raw: raw}:
+	default:
+	}
+}
@@ -0,0 +1,47 @@
+package session
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/creack/pty"
+)
+
+// setNonblock puts the PTY back in non-blocking mode, which pty.Start took
+// it out of, so that writes honour deadlines and Close interrupts them. It
+// reports whether that worked.
+func setNonblock(f *os.File) bool {
+	if f.SetWriteDeadline(time.Time{}) != nil {
+		return false
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var nbErr error
+	if err := rc.Control(func(fd uintptr) { nbErr = syscall.SetNonblock(int(fd), true) }); err != nil {
+		return false
+	}
+	return nbErr == nil
+}
+
+// setSize resizes the PTY. pty.Setsize would go through f.Fd, which puts
+// the PTY back in blocking mode.
+func setSize(f *os.File, size *pty.Winsize) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(size)))
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package session
+
+import (
+	"os"
+
+	"github.com/creack/pty"
+)
+
+// setNonblock leaves the PTY blocking outside Linux, so its writes cannot
+// time out. The queue still keeps a client from blocking on them.
+func setNonblock(*os.File) bool { return false }
+
+func setSize(f *os.File, size *pty.Winsize) error {
+	return pty.Setsize(f, size)
+}
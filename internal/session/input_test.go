@@ -0,0 +1,70 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInputStall(t *testing.T) {
+	// The command reads nothing until the test creates the go file.
+	dir := t.TempDir()
+	s, err := New(Config{
+		Command: "/bin/sh",
+		Args:    []string{"-c", `stty -echo; while [ ! -e "$1/go" ]; do sleep 0.05; done; exec cat >/dev/null`, "sh", dir},
+		Logger:  discardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	s.stallAfter = 100 * time.Millisecond
+	conn := newWSTransport(t, s).dial("a", "alice")
+
+	// Whole lines, since a terminal in canonical mode discards rather than
+	// blocks on a line that does not fit.
+	line := strings.Repeat("x", 63) + "\n"
+	input, _ := json.Marshal(strings.Repeat(line, 128))
+	stop, flooded := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(flooded)
+		for {
+			select {
+			case <-stop:
+				resize, _ := json.Marshal(resizeMsg{Cols: 91, Rows: 29})
+				_ = conn.WriteJSON(wsMessage{Type: "resize", Data: resize})
+				return
+			default:
+			}
+			if conn.WriteJSON(wsMessage{Type: "input", Data: input}) != nil {
+				return
+			}
+		}
+	}()
+	readMessage(t, conn, "input-stalled", `"stalled":true`)
+	close(stop)
+	<-flooded
+
+	// The client is still handled while its input is dropped.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.RLock()
+		cols := s.ptySize.Cols
+		s.mu.RUnlock()
+		if cols == 91 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resize after the stall was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "go"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	readMessage(t, conn, "input-stalled", `"stalled":false`)
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package session
+
+import "syscall"
+
+func killProcessGroup(pgid int) error {
+	return syscall.Kill(-pgid, syscall.SIGKILL)
+}
@@ -0,0 +1,54 @@
+//go:build !windows
+
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestKillProcessGroup(t *testing.T) {
+	// The job ignores the SIGHUP that closing the PTY sends, so only the
+	// group kill can end it, and keeps off the terminal so that the PTY
+	// still reaches EOF when the shell dies.
+	for _, group := range []bool{false, true} {
+		s, err := New(Config{
+			Command:          "/bin/sh",
+			Args:             []string{"-c", "trap '' HUP; sleep 300 </dev/null >/dev/null 2>&1 & echo bg=$!; wait"},
+			KillProcessGroup: group,
+			Logger:           discardLogger,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForHistory(t, s, "bg=", 1)
+		var pid int
+		if _, err := fmt.Sscanf(historyString(s)[strings.Index(historyString(s), "bg="):], "bg=%d", &pid); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		alive := func() bool {
+			stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+			if err != nil {
+				return syscall.Kill(pid, 0) == nil
+			}
+			// A zombie has been killed and only waits to be reaped.
+			fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+			return len(fields) > 0 && fields[0] != "Z"
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for alive() && group && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		if alive() != !group {
+			t.Errorf("KillProcessGroup=%v: background job alive = %v", group, alive())
+		}
+		_ = syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
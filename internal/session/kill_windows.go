@@ -0,0 +1,7 @@
+package session
+
+import "errors"
+
+func killProcessGroup(int) error {
+	return errors.New("process groups are not supported on Windows")
+}
@@ -0,0 +1,121 @@
+package session
+
+import (
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	latencySamples = 4096
+	latencyWindow  = time.Minute
+	// DefaultLatencySlowP95 is the p95 above which a stage is logged.
+	DefaultLatencySlowP95 = 100 * time.Millisecond
+)
+
+// latencyRing holds a stage's most recent samples. Writers claim slots with
+// an atomic counter, so they never wait for each other.
+type latencyRing struct {
+	next atomic.Uint64
+	at   [latencySamples]atomic.Int64
+	dur  [latencySamples]atomic.Int64
+}
+
+func (r *latencyRing) add(at, dur int64) {
+	i := (r.next.Add(1) - 1) % latencySamples
+	r.dur[i].Store(dur)
+	r.at[i].Store(at)
+}
+
+// stage summarizes the samples taken since since.
+func (r *latencyRing) stage(since int64) LatencyStage {
+	durs := make([]int64, 0, latencySamples)
+	for i := range r.at {
+		if at := r.at[i].Load(); at != 0 && at >= since {
+			durs = append(durs, r.dur[i].Load())
+		}
+	}
+	st := LatencyStage{Samples: len(durs)}
+	if len(durs) == 0 {
+		return st
+	}
+	slices.Sort(durs)
+	pct := func(p int) float64 {
+		return float64(durs[(len(durs)-1)*p/100]) / float64(time.Millisecond)
+	}
+	st.P50Ms, st.P95Ms, st.P99Ms = pct(50), pct(95), pct(99)
+	return st
+}
+
+// latencyStats times output, with Config.LatencyStats, through three
+// stages: enqueue, from the PTY read to the output being queued for every
+// client, batching included; queue, the wait in a client's queue; and
+// write, the WebSocket write. With the stats off nothing is timed.
+type latencyStats struct {
+	enqueue, queue, write latencyRing
+}
+
+// LatencyStage is one stage's latency over the last minute.
+type LatencyStage struct {
+	Samples int     `json:"samples"`
+	P50Ms   float64 `json:"p50Ms"`
+	P95Ms   float64 `json:"p95Ms"`
+	P99Ms   float64 `json:"p99Ms"`
+}
+
+// LatencyStats breaks down how long output took to reach clients.
+type LatencyStats struct {
+	Enqueue LatencyStage `json:"enqueue"`
+	Queue   LatencyStage `json:"queue"`
+	Write   LatencyStage `json:"write"`
+}
+
+// LatencyStats reports output latency over the last minute. It returns
+// false unless Config.LatencyStats is set.
+func (s *Session) LatencyStats() (LatencyStats, bool) {
+	if s.latency == nil {
+		return LatencyStats{}, false
+	}
+	since := time.Now().Add(-latencyWindow).UnixNano()
+	return LatencyStats{
+		Enqueue: s.latency.enqueue.stage(since),
+		Queue:   s.latency.queue.stage(since),
+		Write:   s.latency.write.stage(since),
+	}, true
+}
+
+// writeOutbound writes m to c, timing it if it was stamped when queued.
+func (s *Session) writeOutbound(c *Client, m outbound) error {
+	if s.latency == nil || m.queuedAt == 0 {
+		return c.WriteMessage(websocket.TextMessage, m.raw)
+	}
+	start := time.Now().UnixNano()
+	err := c.WriteMessage(websocket.TextMessage, m.raw)
+	end := time.Now().UnixNano()
+	s.latency.queue.add(start, start-m.queuedAt)
+	s.latency.write.add(end, end-start)
+	return err
+}
+
+// latencyReporter logs the stats once a minute while a stage's p95 is
+// above the threshold.
+func (s *Session) latencyReporter() {
+	ticker := time.NewTicker(latencyWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			st, _ := s.LatencyStats()
+			slow := float64(s.latencySlow) / float64(time.Millisecond)
+			if st.Enqueue.P95Ms > slow || st.Queue.P95Ms > slow || st.Write.P95Ms > slow {
+				s.logger.Debug("output latency is high",
+					"enqueueP95Ms", st.Enqueue.P95Ms, "queueP95Ms", st.Queue.P95Ms, "writeP95Ms", st.Write.P95Ms,
+					"enqueueP99Ms", st.Enqueue.P99Ms, "queueP99Ms", st.Queue.P99Ms, "writeP99Ms", st.Write.P99Ms)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLatencyRing(t *testing.T) {
+	var r latencyRing
+	now := time.Now().UnixNano()
+	r.add(now-2*int64(latencyWindow), int64(time.Hour)) // outside the window
+	for i := 1; i <= 100; i++ {
+		r.add(now, int64(i)*int64(time.Millisecond))
+	}
+	st := r.stage(now - int64(latencyWindow))
+	if st.Samples != 100 || st.P50Ms != 50 || st.P95Ms != 95 || st.P99Ms != 99 {
+		t.Errorf("stage = %+v", st)
+	}
+
+	// Old samples are overwritten once the ring wraps.
+	for i := 0; i < latencySamples; i++ {
+		r.add(now, int64(time.Millisecond))
+	}
+	if st := r.stage(0); st.Samples != latencySamples || st.P99Ms != 1 {
+		t.Errorf("after wrapping: %+v", st)
+	}
+	if st := (&latencyRing{}).stage(0); st != (LatencyStage{}) {
+		t.Errorf("empty ring: %+v", st)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	s, err := New(Config{
+		Command:      "/bin/sh",
+		Args:         []string{"-c", "while :; do echo tick; sleep 0.01; done"},
+		LatencyStats: true,
+		Logger:       discardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	conn := newWSTransport(t, s).dial("a", "alice")
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, ok := s.LatencyStats()
+		if !ok {
+			t.Fatal("stats are off")
+		}
+		if st.Enqueue.Samples > 0 && st.Queue.Samples > 0 && st.Write.Samples > 0 {
+			for name, stage := range map[string]LatencyStage{"enqueue": st.Enqueue, "queue": st.Queue, "write": st.Write} {
+				if stage.P50Ms < 0 || stage.P50Ms > stage.P95Ms || stage.P95Ms > stage.P99Ms {
+					t.Errorf("%s: %+v", name, stage)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stages never all got samples: %+v", st)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	off, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(off.Close)
+	if _, ok := off.LatencyStats(); ok {
+		t.Error("stats reported without LatencyStats")
+	}
+}
+
+// BenchmarkOutputLatencyStats pushes 32 KiB chunks from the batcher through
+// to a WebSocket client, with and without the latency stats, to show what
+// timing costs. The client is the controller, whose full queue holds the
+// batcher back rather than dropping output.
+func BenchmarkOutputLatencyStats(b *testing.B) {
+	for _, stats := range []bool{false, true} {
+		name := "off"
+		if stats {
+			name = "on"
+		}
+		b.Run(name, func(b *testing.B) {
+			s, err := New(Config{
+				Command:      "sleep",
+				Args:         []string{"3600"},
+				SendPolicy:   SendPolicy{ControllerBlockTimeout: time.Minute},
+				LatencyStats: stats,
+				Logger:       discardLogger,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			conn := newWSTransport(b, s).dial("a", "bench")
+			marker := []byte("end-of-benchmark")
+			done := make(chan struct{})
+			go func() {
+				for {
+					_, raw, err := conn.ReadMessage()
+					if err != nil {
+						return
+					}
+					if bytes.Contains(raw, marker) {
+						close(done)
+					}
+				}
+			}()
+			chunk := bytes.Repeat([]byte("x"), DefaultOutputFlushBytes)
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.batcher.Write(chunk)
+			}
+			s.batcher.Write(marker)
+			s.batcher.Flush()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package session
+
+import (
+	"encoding/json"
+	"strings"
+	"unicode"
+)
+
+// maxMOTDRunes caps the welcome message, which the UI shows whole.
+const maxMOTDRunes = 2000
+
+type motdMsg struct {
+	Text string `json:"text"`
+}
+
+// sanitizeMOTD returns text without control characters other than newlines
+// and tabs, with CRLF line endings made plain, and cut to maxMOTDRunes.
+func sanitizeMOTD(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, text)
+	text = strings.TrimSpace(text)
+	if r := []rune(text); len(r) > maxMOTDRunes {
+		text = strings.TrimSpace(string(r[:maxMOTDRunes]))
+	}
+	return text
+}
+
+// motdRaw returns the "motd" message for text, or nil if nothing is left of
+// it once sanitized.
+func motdRaw(text string) []byte {
+	text = sanitizeMOTD(text)
+	if text == "" {
+		return nil
+	}
+	data, _ := json.Marshal(motdMsg{Text: text})
+	raw, _ := json.Marshal(wsMessage{Type: "motd", Data: json.RawMessage(data)})
+	return raw
+}
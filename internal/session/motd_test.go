@@ -0,0 +1,69 @@
+package session
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeMOTD(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "Be nice.", "Be nice."},
+		{"lines kept", "Rules:\r\n\t1. Be nice\n", "Rules:\n\t1. Be nice"},
+		{"escapes dropped", "\x1b[31mred\x1b[0m\a", "[31mred[0m"},
+		{"blank", " \n\x00 ", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeMOTD(tt.in); got != tt.want {
+				t.Errorf("sanitizeMOTD(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+	if got := []rune(sanitizeMOTD(strings.Repeat("é", 3000))); len(got) != maxMOTDRunes {
+		t.Errorf("long MOTD kept %d runes, want %d", len(got), maxMOTDRunes)
+	}
+	if motdRaw("\x1b\x07") != nil {
+		t.Error("a MOTD with nothing left was sent")
+	}
+}
+
+func TestMOTDOnConnect(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger, MOTD: "Ask before typing.", ReconnectGrace: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	alice, role := tr.dialResume("a", "alice", "")
+	var motd motdMsg
+	_ = json.Unmarshal(readMessage(t, alice, "motd", "").Data, &motd)
+	if motd.Text != "Ask before typing." {
+		t.Errorf("motd = %q", motd.Text)
+	}
+
+	// A resumed client has already seen it.
+	alice.UnderlyingConn().Close()
+	waitForClients(t, s, func(list []ClientInfo) bool {
+		c, ok := findClient(list, "a")
+		return ok && c.Reconnecting
+	})
+	alice, _ = tr.dialResume("a", "alice", role.Resume)
+	_ = alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := alice.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "motd" {
+			t.Fatal("motd sent again on resume")
+		}
+		if msg.Type == "clients" {
+			break
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// pauseBufferBytes is the most output held for the viewers during a pause;
+// beyond it the oldest whole lines are dropped.
+const pauseBufferBytes = 1 << 20
+
+type pausedMsg struct {
+	Paused bool   `json:"paused"`
+	By     string `json:"by,omitempty"`
+}
+
+// pauseBuffer holds output for viewers during a pause, or for one client
+// that paused its own output.
+type pauseBuffer struct {
+	mu      sync.Mutex
+	buf     []byte
+	dropped int64
+	// limit is how much is held; pauseBufferBytes if zero.
+	limit int
+}
+
+func (p *pauseBuffer) write(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	limit := p.limit
+	if limit <= 0 {
+		limit = pauseBufferBytes
+	}
+	p.buf = append(p.buf, data...)
+	if len(p.buf) <= limit {
+		return
+	}
+	// Cut after a newline, so the viewers do not start mid-line.
+	cut := len(p.buf) - limit
+	if i := bytes.IndexByte(p.buf[cut-1:], '\n'); i >= 0 {
+		cut += i
+	}
+	p.dropped += int64(cut)
+	p.buf = p.buf[:copy(p.buf, p.buf[cut:])]
+}
+
+// take empties the buffer, returning what it held and how many bytes were
+// dropped from the front.
+func (p *pauseBuffer) take() ([]byte, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buf, dropped := p.buf, p.dropped
+	p.buf, p.dropped = nil, 0
+	return buf, dropped
+}
+
+// fanOutPausedLocked enqueues m for the controller only and holds data for
+// the viewers. The caller holds s.mu for reading. Like fanOutLocked, it
+// returns the controller if its queue is full.
+func (s *Session) fanOutPausedLocked(m outbound, data []byte) *Client {
+	s.pauseBuf.write(data)
+	for _, c := range s.clients {
+		if c.IsController && !s.enqueueLocked(c, m) {
+			return c
+		}
+	}
+	return nil
+}
+
+// pause holds output back from everyone but the controller, for its
+// "pause" message, and tells every client with a "paused" message. The
+// pause ends on resume or when control passes to someone else, who has not
+// seen the held output either.
+func (s *Session) pause(c *Client) {
+	s.mu.Lock()
+	if s.paused {
+		s.mu.Unlock()
+		return
+	}
+	s.paused = true
+	s.pausedBy = clientName(c)
+	s.notifyAllLocked(s.pausedRawLocked())
+	s.mu.Unlock()
+	s.record(c, "paused", "")
+}
+
+// resume sends the viewers what was held during the pause in one message.
+func (s *Session) resume(c *Client) {
+	s.mu.Lock()
+	if !s.paused {
+		s.mu.Unlock()
+		return
+	}
+	held, dropped := s.resumeLocked(c.ID)
+	s.mu.Unlock()
+	s.record(c, "resumed", fmt.Sprintf("%d bytes held, %d dropped", held, dropped))
+}
+
+// resumeLocked ends a pause, sending the held output to every client but
+// the one with ID saw, which got it live, and returns how many bytes were
+// held and dropped. The caller holds s.mu for writing, so no new output
+// can overtake the held output.
+func (s *Session) resumeLocked(saw string) (int, int64) {
+	s.paused, s.pausedBy = false, ""
+	buf, dropped := s.pauseBuf.take()
+	held := len(buf)
+	if dropped > 0 {
+		marker := fmt.Sprintf("\r\n\x1b[1;33m[%d bytes of output skipped during the pause]\x1b[0m\r\n", dropped)
+		buf = append([]byte(marker), buf...)
+	}
+	if len(buf) > 0 {
+		data, _ := json.Marshal(string(buf))
+		raw, err := json.Marshal(wsMessage{Type: "output", Data: json.RawMessage(data)})
+		if err == nil {
+			for _, v := range s.clients {
+				// s.mu is held for writing, so a full controller queue
+				// cannot be waited on here.
+				if v.ID != saw && !s.enqueueLocked(v, outbound{raw: raw, output: buf}) {
+					s.skipControllerLocked(v)
+				}
+			}
+		}
+	}
+	s.notifyAllLocked(s.pausedRawLocked())
+	return held, dropped
+}
+
+// pausedRawLocked encodes the current pause state. The caller holds s.mu.
+func (s *Session) pausedRawLocked() []byte {
+	data, _ := json.Marshal(pausedMsg{Paused: s.paused, By: s.pausedBy})
+	raw, _ := json.Marshal(wsMessage{Type: "paused", Data: json.RawMessage(data)})
+	return raw
+}
+
+// clientName is how c is shown to other clients.
+func clientName(c *Client) string {
+	switch {
+	case c.Auth.DisplayName != "":
+		return c.Auth.DisplayName
+	case c.Auth.Username != "":
+		return c.Auth.Username
+	}
+	return "client " + c.ID
+}
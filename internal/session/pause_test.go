@@ -0,0 +1,109 @@
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauseHoldsViewerOutput(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+
+	// Only the controller can pause.
+	_ = bob.WriteJSON(wsMessage{Type: "pause"})
+	_ = alice.WriteJSON(wsMessage{Type: "pause"})
+	readMessage(t, alice, "paused", `"by":"alice"`)
+	readMessage(t, bob, "paused", `"paused":true`)
+
+	sendInput(t, alice, "secret\n")
+	waitForHistory(t, s, "secret", 2)
+	readMessage(t, alice, "output", "secret")
+	// A late joiner is told about the pause and held back too.
+	carol := tr.dial("c", "carol")
+	readMessage(t, carol, "paused", `"paused":true`)
+
+	_ = alice.WriteJSON(wsMessage{Type: "resume"})
+	var outputs []string
+	_ = bob.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := bob.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == "paused" {
+			break
+		}
+		if msg.Type == "output" {
+			var out string
+			_ = json.Unmarshal(msg.Data, &out)
+			outputs = append(outputs, out)
+		}
+	}
+	// The held output comes in one message, just before the resume.
+	if len(outputs) == 0 || strings.Count(outputs[len(outputs)-1], "secret") != 2 {
+		t.Fatalf("viewer output on resume = %q, want the held output last", outputs)
+	}
+	for _, out := range outputs[:len(outputs)-1] {
+		if strings.Contains(out, "secret") {
+			t.Errorf("viewer got %q during the pause", out)
+		}
+	}
+	readMessage(t, carol, "output", "secret")
+
+	var types []string
+	for _, ev := range s.Timeline() {
+		types = append(types, ev.Type+":"+ev.User)
+	}
+	if strings.Join(types, ",") != "paused:alice,resumed:alice" {
+		t.Errorf("timeline = %v", types)
+	}
+}
+
+func TestPauseEndsWhenControlChanges(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+
+	_ = alice.WriteJSON(wsMessage{Type: "pause"})
+	readMessage(t, bob, "paused", `"paused":true`)
+	sendInput(t, alice, "setup\n")
+	waitForHistory(t, s, "setup", 2)
+	alice.Close()
+
+	// Bob takes over and must not be left without the held output.
+	readMessage(t, bob, "output", "setup")
+	readMessage(t, bob, "paused", `"paused":false`)
+}
+
+func TestPauseBufferOverflow(t *testing.T) {
+	var p pauseBuffer
+	line := bytes.Repeat([]byte("x"), 1023)
+	line = append(line, '\n')
+	for range pauseBufferBytes/len(line) + 3 {
+		p.write(line)
+	}
+	buf, dropped := p.take()
+	if len(buf) > pauseBufferBytes || len(buf)%len(line) != 0 {
+		t.Errorf("kept %d bytes, want whole lines within %d", len(buf), pauseBufferBytes)
+	}
+	if dropped != 3*int64(len(line)) {
+		t.Errorf("dropped = %d, want %d", dropped, 3*len(line))
+	}
+	if buf, dropped := p.take(); len(buf) != 0 || dropped != 0 {
+		t.Errorf("second take = %d bytes, %d dropped", len(buf), dropped)
+	}
+}
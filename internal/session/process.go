@@ -0,0 +1,229 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+const (
+	OnExitClose   = "close"
+	OnExitPrompt  = "prompt"
+	OnExitRestart = "restart"
+)
+
+// startProcess runs the command on a new PTY. It is called once from New and
+// again for each restart; connected clients are kept across restarts.
+func (s *Session) startProcess() error {
+	cmd, ptmx, err := s.startPTY()
+	if err != nil {
+		return fmt.Errorf("start pty: %w", err)
+	}
+	s.attachProcess(cmd, ptmx)
+	return nil
+}
+
+// attachProcess starts feeding and reading the PTY of a running command.
+func (s *Session) attachProcess(cmd *exec.Cmd, ptmx *os.File) {
+	exited := make(chan struct{})
+	input := s.startInputWriter(ptmx, exited)
+
+	s.procMu.Lock()
+	s.cmd, s.ptmx, s.input, s.procExited = cmd, ptmx, input, exited
+	s.procMu.Unlock()
+
+	go s.readPTY(ptmx, cmd, exited)
+
+	// Close may have run while the process was starting.
+	select {
+	case <-s.done:
+		ptmx.Close()
+		s.kill(cmd)
+	default:
+	}
+}
+
+// startPTY starts the command, trying again up to s.retries times if it
+// fails. A Cmd cannot be started twice, so each attempt builds a new one.
+func (s *Session) startPTY() (*exec.Cmd, *os.File, error) {
+	for attempt := 1; ; attempt++ {
+		cmd := exec.Command(s.command, s.args...)
+		if s.clearEnv {
+			cmd.Env = []string{"TERM=xterm-256color"}
+		} else {
+			cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+		}
+		if s.runAs != nil {
+			cmd.Env = append(cmd.Env, s.runAs.env()...)
+			setRunAs(cmd, s.runAs)
+		}
+		cmd.Env = append(cmd.Env, s.env...)
+		var report *limitReport
+		if len(s.rlimits) > 0 {
+			var err error
+			if report, err = prepareLimited(cmd, s.rlimits); err != nil {
+				return nil, nil, fmt.Errorf("set resource limits: %w", err)
+			}
+		}
+
+		s.mu.RLock()
+		size := s.ptySize
+		s.mu.RUnlock()
+
+		ptmx, err := pty.StartWithSize(cmd, &size)
+		if report != nil {
+			err = report.wait(cmd, ptmx, err)
+		}
+		if err == nil || attempt > s.retries {
+			return cmd, ptmx, err
+		}
+		s.logger.Warn("command failed to start, retrying",
+			"attempt", attempt, "retries", s.retries, "delay", s.retryWait, "error", err)
+		select {
+		case <-time.After(s.retryWait):
+		case <-s.done:
+			return nil, nil, err
+		}
+	}
+}
+
+func (s *Session) readPTY(ptmx *os.File, cmd *exec.Cmd, exited chan struct{}) {
+	started := time.Now()
+	buf := make([]byte, 4096)
+	for {
+		n, err := ptmx.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && s.detaching.Load() {
+			// Detach leaves the PTY and the command to the next process.
+			close(s.detached)
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.logger.Debug("pty read error", "error", err)
+			}
+			break
+		}
+		s.touchActivity()
+		s.batcher.Write(buf[:n])
+		if s.prompts != nil {
+			if events := s.prompts.scan(buf[:n]); len(events) > 0 {
+				s.batcher.Barrier(func() { s.shellEvents(events) })
+			}
+		}
+	}
+	s.batcher.Flush()
+
+	ptmx.Close()
+	s.kill(cmd)
+	code := exitCode(cmd.Wait())
+	close(exited)
+	s.processExited(code, time.Since(started))
+}
+
+// DefaultKillProcessGroup is the KillProcessGroup the server uses: on by
+// default on Linux, off on macOS, where a PTY's process group outliving its
+// leader behaves differently.
+var DefaultKillProcessGroup = runtime.GOOS == "linux"
+
+// kill stops cmd, and with KillProcessGroup the rest of its process group.
+// Starting on a PTY makes the command a session leader, so its process
+// group ID is its PID; it must not also ask for Setpgid, which fails for a
+// session leader.
+func (s *Session) kill(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if s.killGroup {
+		if err := killProcessGroup(cmd.Process.Pid); err == nil {
+			return
+		}
+	}
+	_ = cmd.Process.Kill()
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// output records data in the history and sends it to every client. PTY
+// output and server-generated messages both go through here.
+func (s *Session) output(data []byte) {
+	s.outputRead(data, 0)
+}
+
+// outputRead is output for data the PTY produced at readAt; see
+// broadcastRead.
+func (s *Session) outputRead(data []byte, readAt int64) {
+	s.history.Write(data)
+	s.noteOutput(len(data))
+	s.broadcastRead(data, readAt)
+}
+
+func (s *Session) syntheticOutput(format string, args ...any) {
+	s.output([]byte("\r\n\x1b[1;33m" + fmt.Sprintf(format, args...) + "\x1b[0m\r\n"))
+}
+
+func (s *Session) processExited(code int, ranFor time.Duration) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	s.logger.Info("command exited", "code", code, "ranFor", ranFor.Round(time.Millisecond), "onExit", s.onExit)
+
+	switch s.onExit {
+	case OnExitRestart:
+		s.syntheticOutput("[process exited with code %d, restarting]", code)
+		// Avoid spinning on a command that exits immediately.
+		if ranFor < s.restartWait {
+			select {
+			case <-time.After(s.restartWait):
+			case <-s.done:
+				return
+			}
+		}
+		s.restart()
+	case OnExitPrompt:
+		s.exitPending.Store(true)
+		s.syntheticOutput("[process exited with code %d — press r to restart, q to quit]", code)
+	default:
+		s.closeWithReason(ReasonCommandExited)
+	}
+}
+
+func (s *Session) restart() {
+	if err := s.startProcess(); err != nil {
+		s.logger.Error("restart command", "error", err)
+		s.syntheticOutput("[restart failed: %v]", err)
+		s.closeWithReason(ReasonRestartFailed)
+	}
+}
+
+// handleExitKey answers the exit prompt with the controller's keypress.
+func (s *Session) handleExitKey(input string) {
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "r":
+		if s.exitPending.CompareAndSwap(true, false) {
+			s.syntheticOutput("[restarting]")
+			s.restart()
+		}
+	case "q":
+		if s.exitPending.CompareAndSwap(true, false) {
+			s.closeWithReason(ReasonQuit)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func historyString(s *Session) string {
+	var buf bytes.Buffer
+	_, _ = s.WriteHistory(&buf)
+	return buf.String()
+}
+
+func waitForHistory(t *testing.T, s *Session, substr string, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(historyString(s), substr) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d× %q in history %q", count, substr, historyString(s))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func newExitTestSession(t *testing.T, command, onExit string) *Session {
+	t.Helper()
+	s, err := New(Config{Command: command, OnExit: onExit, RestartDelay: 10 * time.Millisecond, Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func isDone(s *Session) bool {
+	select {
+	case <-s.Done():
+		return true
+	case <-time.After(2 * time.Second):
+		return false
+	}
+}
+
+func TestOnExitClose(t *testing.T) {
+	s := newExitTestSession(t, "true", "")
+	if !isDone(s) {
+		t.Fatal("session should close when the command exits")
+	}
+}
+
+func TestOnExitPrompt(t *testing.T) {
+	s := newExitTestSession(t, "true", OnExitPrompt)
+	waitForHistory(t, s, "exited with code 0 — press r to restart", 1)
+
+	s.handleExitKey("x")
+	if !s.exitPending.Load() {
+		t.Fatal("an unrelated key should leave the prompt waiting")
+	}
+
+	s.handleExitKey("r")
+	waitForHistory(t, s, "press r to restart", 2)
+	if strings.Count(historyString(s), "[restarting]") != 1 {
+		t.Errorf("expected one restart notice, history %q", historyString(s))
+	}
+
+	s.handleExitKey("Q")
+	if !isDone(s) {
+		t.Fatal("q should close the session")
+	}
+}
+
+func TestOnExitPromptReportsExitCode(t *testing.T) {
+	s := newExitTestSession(t, "false", OnExitPrompt)
+	waitForHistory(t, s, "exited with code 1", 1)
+}
+
+func TestOnExitRestart(t *testing.T) {
+	s := newExitTestSession(t, "true", OnExitRestart)
+	waitForHistory(t, s, "restarting]", 3)
+	select {
+	case <-s.Done():
+		t.Fatal("restart mode should keep the session open")
+	default:
+	}
+}
+
+func TestClearEnv(t *testing.T) {
+	t.Setenv("VEXSHARE_HOST_VAR", "inherited")
+	for _, clear := range []bool{false, true} {
+		s, err := New(Config{
+			Command:  "/bin/sh",
+			Args:     []string{"-c", "env; echo VEXSHARE_ENV_DONE; sleep 5"},
+			Env:      []string{"GIVEN=yes"},
+			ClearEnv: clear,
+			Logger:   discardLogger,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		waitForHistory(t, s, "VEXSHARE_ENV_DONE", 1)
+		out := historyString(s)
+		if !strings.Contains(out, "GIVEN=yes") || !strings.Contains(out, "TERM=xterm-256color") {
+			t.Errorf("ClearEnv=%v: Env or TERM missing from %q", clear, out)
+		}
+		if inherited := strings.Contains(out, "VEXSHARE_HOST_VAR=inherited"); inherited == clear {
+			t.Errorf("ClearEnv=%v: host variable inherited = %v", clear, inherited)
+		}
+	}
+}
+
+func TestStartupRetries(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "service")
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	// Nothing to start: New gives up after the retries.
+	_, err := New(Config{Command: command, StartupRetries: 2, StartupRetryDelay: time.Millisecond, Logger: logger})
+	if err == nil {
+		t.Fatal("New started a missing command")
+	}
+	if n := strings.Count(logs.String(), "retrying"); n != 2 {
+		t.Errorf("logged %d retries, want 2:\n%s", n, logs.String())
+	}
+
+	// The command appears while New is retrying. It is renamed into place
+	// so that no attempt runs a half-written file.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tmp := command + ".tmp"
+		_ = os.WriteFile(tmp, []byte("#!/bin/sh\necho ready; sleep 5\n"), 0o755)
+		_ = os.Rename(tmp, command)
+	}()
+	s, err := New(Config{Command: command, StartupRetries: 200, StartupRetryDelay: 10 * time.Millisecond, Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	waitForHistory(t, s, "ready", 1)
+}
@@ -0,0 +1,220 @@
+package session
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxPromptLine and maxOSC bound what the detector keeps of a line and
+	// of an OSC sequence; longer sequences are not semantic prompt marks.
+	maxPromptLine = 1024
+	maxOSC        = 4096
+)
+
+// ShellEvent is the data of a "prompt", "command-start" or "command-end"
+// message. Command is the command line when the shell reports it, and
+// ExitCode the command's status when the shell reports it at the end.
+type ShellEvent struct {
+	Type     string `json:"-"`
+	Source   string `json:"source,omitempty"`
+	Command  string `json:"command,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+}
+
+type promptState int
+
+const (
+	promptGround promptState = iota
+	promptEscape
+	promptEscapeIntermediate
+	promptCSI
+	promptOSC
+	promptOSCEscape
+	promptString
+	promptStringEscape
+)
+
+// promptDetector scans PTY output for prompts, from OSC 133 marks
+// (ESC ] 133 ; A/B/C/D ST) or by matching re against the line the cursor is
+// on. Sequences split across reads are handled; it is only used from
+// readPTY.
+type promptDetector struct {
+	re    *regexp.Regexp
+	osc   bool
+	state promptState
+	seq   []byte
+	// overflow is set when the OSC sequence being read outgrew maxOSC.
+	overflow bool
+	// line is the plain text of the current line, and matched whether re
+	// already matched it.
+	line    []byte
+	matched bool
+	// command is set between a command's start and end marks.
+	running bool
+	command string
+	events  []ShellEvent
+}
+
+func newPromptDetector(re *regexp.Regexp, osc bool) *promptDetector {
+	if re == nil && !osc {
+		return nil
+	}
+	return &promptDetector{re: re, osc: osc}
+}
+
+// scan returns the events p completes.
+func (d *promptDetector) scan(p []byte) []ShellEvent {
+	d.events = d.events[:0]
+	for _, b := range p {
+		d.step(b)
+	}
+	if d.re != nil && !d.matched && len(d.line) > 0 && d.re.Match(d.line) {
+		d.matched = true
+		d.events = append(d.events, ShellEvent{Type: "prompt", Source: "regex"})
+	}
+	return d.events
+}
+
+func (d *promptDetector) step(b byte) {
+	switch d.state {
+	case promptGround:
+		switch {
+		case b == 0x1b:
+			d.state = promptEscape
+		case b == '\n':
+			d.line, d.matched = d.line[:0], false
+		case b == '\r':
+			// Shells redraw the prompt from column 0.
+			d.line = d.line[:0]
+		case b < 0x20 || b == 0x7f:
+		default:
+			if len(d.line) == maxPromptLine {
+				d.line = append(d.line[:0], d.line[maxPromptLine/2:]...)
+			}
+			d.line = append(d.line, b)
+		}
+	case promptEscape:
+		switch {
+		case b == '[':
+			d.state = promptCSI
+		case b == ']':
+			d.state, d.seq, d.overflow = promptOSC, d.seq[:0], false
+		case b == 'P' || b == 'X' || b == '^' || b == '_':
+			d.state = promptString
+		case b >= 0x20 && b <= 0x2f:
+			d.state = promptEscapeIntermediate
+		default:
+			d.state = promptGround
+		}
+	case promptEscapeIntermediate:
+		if b < 0x20 || b > 0x2f {
+			d.state = promptGround
+		}
+	case promptCSI:
+		if b >= 0x40 && b <= 0x7e {
+			d.state = promptGround
+		}
+	case promptOSC:
+		switch b {
+		case 0x07:
+			d.state = promptGround
+			d.finishOSC()
+		case 0x1b:
+			d.state = promptOSCEscape
+		default:
+			if len(d.seq) < maxOSC {
+				d.seq = append(d.seq, b)
+			} else {
+				d.overflow = true
+			}
+		}
+	case promptOSCEscape:
+		if b == '\\' {
+			d.state = promptGround
+			d.finishOSC()
+			return
+		}
+		// An escape that is not the string terminator cancels the
+		// sequence and starts a new one.
+		d.state = promptEscape
+		d.step(b)
+	case promptString:
+		switch b {
+		case 0x07:
+			d.state = promptGround
+		case 0x1b:
+			d.state = promptStringEscape
+		}
+	case promptStringEscape:
+		if b == '\\' {
+			d.state = promptGround
+		} else {
+			d.state = promptString
+		}
+	}
+}
+
+// finishOSC handles a complete OSC sequence: 133;A starts the prompt,
+// 133;C starts a command, optionally with cmdline_url= (percent-encoded,
+// as fish sends it) or cmdline=, and 133;D[;status] ends it. 133;B, which
+// ends the prompt, carries nothing automation needs.
+func (d *promptDetector) finishOSC() {
+	if !d.osc || d.overflow || !strings.HasPrefix(string(d.seq), "133;") {
+		return
+	}
+	fields := strings.Split(string(d.seq[len("133;"):]), ";")
+	switch fields[0] {
+	case "A":
+		d.matched = true
+		d.events = append(d.events, ShellEvent{Type: "prompt", Source: "osc133"})
+	case "C":
+		d.running, d.command = true, ""
+		for i, f := range fields[1:] {
+			if v, ok := strings.CutPrefix(f, "cmdline_url="); ok {
+				if cmd, err := url.PathUnescape(v); err == nil {
+					d.command = cmd
+				}
+				break
+			}
+			if _, ok := strings.CutPrefix(f, "cmdline="); ok {
+				// The command line itself may contain semicolons.
+				d.command = strings.TrimPrefix(strings.Join(fields[i+1:], ";"), "cmdline=")
+				break
+			}
+		}
+		d.events = append(d.events, ShellEvent{Type: "command-start", Source: "osc133", Command: d.command})
+	case "D":
+		// Shells send D before every prompt, including the first and
+		// after an empty command line; only a started command ends.
+		if !d.running {
+			return
+		}
+		ev := ShellEvent{Type: "command-end", Source: "osc133", Command: d.command}
+		if len(fields) > 1 {
+			if code, err := strconv.Atoi(fields[1]); err == nil {
+				ev.ExitCode = &code
+			}
+		}
+		d.running, d.command = false, ""
+		d.events = append(d.events, ev)
+	}
+}
+
+// shellEvents sends events to every client and logs them.
+func (s *Session) shellEvents(events []ShellEvent) {
+	for _, ev := range events {
+		data, _ := json.Marshal(ev)
+		raw, err := json.Marshal(wsMessage{Type: ev.Type, Data: json.RawMessage(data)})
+		if err != nil {
+			continue
+		}
+		s.logger.Debug("shell event", "type", ev.Type, "source", ev.Source, "command", ev.Command)
+		s.mu.RLock()
+		s.notifyAllLocked(raw)
+		s.mu.RUnlock()
+	}
+}
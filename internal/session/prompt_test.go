@@ -0,0 +1,132 @@
+package session
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// Output captured from zsh 5.9 with a precmd/preexec OSC 133 integration,
+// running "echo hi", an empty command line and "false".
+const zshOSC133 = "\x1b]133;D\x07\x1b]133;A\x07\r\x1b[0m\x1b[27m\x1b[24m\x1b[Juser@host ~ % \x1b]133;B\x07\x1b[K" +
+	"e\becho hi\x1b[?2004l\r\r\n\x1b]133;C\x07hi\r\n" +
+	"\x1b]133;D;0\x07\x1b]133;A\x07\r\x1b[0m\x1b[27m\x1b[24m\x1b[Juser@host ~ % \x1b]133;B\x07\x1b[K\x1b[?2004l\r\r\n" +
+	"\x1b]133;D\x07\x1b]133;A\x07\r\x1b[0m\x1b[27m\x1b[24m\x1b[Juser@host ~ % \x1b]133;B\x07\x1b[Kfalse\x1b[?2004l\r\r\n\x1b]133;C\x07" +
+	"\x1b]133;D;1\x07\x1b]133;A\x07\r\x1b[0m\x1b[27m\x1b[24m\x1b[Juser@host ~ % \x1b]133;B\x07\x1b[K"
+
+// Output captured from fish 4.0, which terminates with ST and reports the
+// command line, running "ls; exit 3" after "printf 'a;b'".
+const fishOSC133 = "\x1b]133;A;click_events=1\x1b\\\x1b[92muser\x1b[m@host ~> \x1b]133;B\x1b\\" +
+	"printf 'a;b'\r\n\x1b]133;C;cmdline_url=printf%20%27a%3Bb%27\x1b\\a;b\x1b]133;D;0\x1b\\" +
+	"\x1b]133;A;click_events=1\x1b\\\x1b[92muser\x1b[m@host ~> \x1b]133;B\x1b\\ls; false\r\n" +
+	"\x1b]133;C;cmdline_url=ls%3B%20false\x1b\\prompt.go\r\n\x1b]133;D;1\x1b\\" +
+	"\x1b]133;A;click_events=1\x1b\\\x1b[92muser\x1b[m@host ~> \x1b]133;B\x1b\\"
+
+func intPtr(n int) *int { return &n }
+
+func TestPromptDetectorOSC133(t *testing.T) {
+	prompt := ShellEvent{Type: "prompt", Source: "osc133"}
+	tests := []struct {
+		name   string
+		stream string
+		want   []ShellEvent
+	}{
+		{"zsh", zshOSC133, []ShellEvent{
+			prompt,
+			{Type: "command-start", Source: "osc133"},
+			{Type: "command-end", Source: "osc133", ExitCode: intPtr(0)},
+			prompt,
+			prompt,
+			{Type: "command-start", Source: "osc133"},
+			{Type: "command-end", Source: "osc133", ExitCode: intPtr(1)},
+			prompt,
+		}},
+		{"fish", fishOSC133, []ShellEvent{
+			prompt,
+			{Type: "command-start", Source: "osc133", Command: "printf 'a;b'"},
+			{Type: "command-end", Source: "osc133", Command: "printf 'a;b'", ExitCode: intPtr(0)},
+			prompt,
+			{Type: "command-start", Source: "osc133", Command: "ls; false"},
+			{Type: "command-end", Source: "osc133", Command: "ls; false", ExitCode: intPtr(1)},
+			prompt,
+		}},
+		{"kitty cmdline", "\x1b]133;C;cmdline=echo a;b\x07\x1b]133;D;0\x07", []ShellEvent{
+			{Type: "command-start", Source: "osc133", Command: "echo a;b"},
+			{Type: "command-end", Source: "osc133", Command: "echo a;b", ExitCode: intPtr(0)},
+		}},
+		// ESC without \ cancels the sequence.
+		{"cancelled", "\x1b]133;A\x1b[0m\x1b]133;A\x07", []ShellEvent{prompt}},
+		{"other OSC", "\x1b]0;title\x07\x1b]1337;133;A\x07", nil},
+	}
+	for _, tt := range tests {
+		// Every chunk size, down to one byte per read, must give the same
+		// events.
+		for size := 1; size <= len(tt.stream); size++ {
+			d := newPromptDetector(nil, true)
+			var got []ShellEvent
+			for i := 0; i < len(tt.stream); i += size {
+				got = append(got, d.scan([]byte(tt.stream[i:min(i+size, len(tt.stream))]))...)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("%s in chunks of %d: got %s, want %s", tt.name, size, eventsJSON(got), eventsJSON(tt.want))
+			}
+		}
+	}
+}
+
+func TestPromptDetectorRegex(t *testing.T) {
+	d := newPromptDetector(regexp.MustCompile(`\$ $`), false)
+	var got []string
+	for _, chunk := range []string{
+		"\x1b[32muser@host\x1b[0m:~",
+		"$ ",        // prompt
+		"ls\r\n",    // typed command
+		"a.txt $ b", // output that only looks like a prompt mid-line
+		"\r\n$ ",    // prompt
+		"\r$ ",      // redrawn on the same line: not a new prompt
+		"\x1b]133;A\x07",
+	} {
+		for _, ev := range d.scan([]byte(chunk)) {
+			got = append(got, ev.Type+":"+ev.Source)
+		}
+	}
+	if want := []string{"prompt:regex", "prompt:regex"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if newPromptDetector(nil, false) != nil {
+		t.Error("detector created with detection off")
+	}
+}
+
+func eventsJSON(events []ShellEvent) string {
+	var out []string
+	for _, ev := range events {
+		data, _ := json.Marshal(ev)
+		out = append(out, ev.Type+string(data))
+	}
+	b, _ := json.Marshal(out)
+	return string(b)
+}
+
+func TestShellEventMessages(t *testing.T) {
+	s, err := New(Config{
+		Command:          "sh",
+		Args:             []string{"-c", `read x; printf '\033]133;A\007$ \033]133;B\007'; read y; printf '\033]133;C;cmdline_url=make%%20test\007ok\r\n\033]133;D;2\007'; cat`},
+		ShellIntegration: true,
+		Logger:           discardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+
+	sendInput(t, alice, "go\n")
+	readMessage(t, alice, "prompt", `"source":"osc133"`)
+	sendInput(t, alice, "make test\n")
+	readMessage(t, alice, "output", "ok")
+	readMessage(t, alice, "command-start", `"command":"make test"`)
+	readMessage(t, alice, "command-end", `"exitCode":2`)
+}
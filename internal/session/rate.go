@@ -0,0 +1,54 @@
+package session
+
+import (
+	"time"
+)
+
+// outputRateWindow is how many one-second samples OutputRate averages.
+const outputRateWindow = 5
+
+// outputRate is the sampler's state; it is only used from
+// outputRateSampler.
+type outputRate struct {
+	last    int64
+	samples [outputRateWindow]int64
+	n       int
+	next    int
+}
+
+// sample records the total at the end of another second and returns the
+// average bytes per second over the samples held.
+func (r *outputRate) sample(total int64) int64 {
+	r.samples[r.next] = total - r.last
+	r.last = total
+	r.next = (r.next + 1) % outputRateWindow
+	r.n = min(r.n+1, outputRateWindow)
+	var sum int64
+	for _, d := range r.samples[:r.n] {
+		sum += d
+	}
+	return sum / int64(r.n)
+}
+
+// outputRateSampler turns the growth of bytesOut into OutputRate once a
+// second.
+func (s *Session) outputRateSampler() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var r outputRate
+	for {
+		select {
+		case <-ticker.C:
+			s.outputRateBps.Store(r.sample(s.bytesOut.Load()))
+		case <-s.done:
+			s.outputRateBps.Store(0)
+			return
+		}
+	}
+}
+
+// OutputRate returns how many bytes per second the command has sent to
+// clients, averaged over the last 5 seconds.
+func (s *Session) OutputRate() int64 {
+	return s.outputRateBps.Load()
+}
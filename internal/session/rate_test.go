@@ -0,0 +1,49 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutputRateSample(t *testing.T) {
+	var r outputRate
+	var total int64
+	// Partial windows average over the samples so far.
+	for i, want := range []int64{1000, 1000, 1000} {
+		total += 1000
+		if got := r.sample(total); got != want {
+			t.Fatalf("sample %d = %d, want %d", i, got, want)
+		}
+	}
+	total += 6000
+	if got := r.sample(total); got != 2250 {
+		t.Errorf("after a burst = %d, want 2250", got)
+	}
+	// A burst leaves the window after 5 quiet seconds.
+	for range 4 {
+		r.sample(total)
+	}
+	if got := r.sample(total); got != 0 {
+		t.Errorf("after 5 quiet seconds = %d, want 0", got)
+	}
+}
+
+func TestOutputRate(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+
+	s.output(make([]byte, 5000))
+	deadline := time.Now().Add(5 * time.Second)
+	for s.OutputRate() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("output rate stayed 0")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := s.OutputRate(); got < 1000 || got > 5000 {
+		t.Errorf("OutputRate = %d, want 1000 to 5000 for 5000 bytes", got)
+	}
+}
@@ -0,0 +1,73 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// heldClient is a client whose connection broke, kept under its resume
+// token for Config.ReconnectGrace. It is not replaced as controller
+// meanwhile, and a connection that presents the token in time gets its ID
+// and role back.
+type heldClient struct {
+	id         string
+	auth       AuthInfo
+	controller bool
+	timer      *time.Timer
+	// lastSeq carries input deduplication over to the resumed connection,
+	// which is where a client resends what may not have arrived.
+	lastSeq uint64
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// holdLocked keeps c for the grace period. The caller holds s.mu.
+func (s *Session) holdLocked(c *Client) {
+	h := &heldClient{id: c.ID, auth: c.Auth, controller: c.IsController, lastSeq: c.lastSeq}
+	token := c.resumeToken
+	s.held[token] = h
+	h.timer = time.AfterFunc(s.reconnectGrace, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.held[token] != h {
+			return
+		}
+		s.logger.Info("reconnect grace expired", "id", h.id, "user", h.auth.Username)
+		s.releaseHeldLocked(token, h)
+		if h.controller {
+			s.promoteLocked()
+		}
+		s.announceControllerLocked()
+	})
+}
+
+// releaseHeldLocked stops holding h. The caller holds s.mu.
+func (s *Session) releaseHeldLocked(token string, h *heldClient) {
+	h.timer.Stop()
+	delete(s.held, token)
+}
+
+// forgetHeld drops the held client with the given ID, passing on control
+// if it had it. It reports whether such a client was held.
+func (s *Session) forgetHeld(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, h := range s.held {
+		if h.id != id {
+			continue
+		}
+		s.logger.Info("held client removed by admin", "id", id, "user", h.auth.Username)
+		s.releaseHeldLocked(token, h)
+		if h.controller {
+			s.promoteLocked()
+		}
+		s.announceControllerLocked()
+		return true
+	}
+	return false
+}
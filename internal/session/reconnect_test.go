@@ -0,0 +1,143 @@
+package session
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func waitForClients(t *testing.T, s *Session, want func([]ClientInfo) bool) []ClientInfo {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list := s.Clients()
+		if want(list) {
+			return list
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("clients never reached the expected state: %+v", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func findClient(list []ClientInfo, id string) (ClientInfo, bool) {
+	for _, c := range list {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return ClientInfo{}, false
+}
+
+func TestReconnectGrace(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger, ReconnectGrace: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	alice, role := tr.dialResume("a", "alice", "")
+	if role.Role != "controller" || role.Resume == "" {
+		t.Fatalf("first client: %+v", role)
+	}
+	_ = tr.dial("b", "bob")
+
+	// A broken connection is held, and control stays with it.
+	alice.UnderlyingConn().Close()
+	waitForClients(t, s, func(list []ClientInfo) bool {
+		c, ok := findClient(list, "a")
+		return ok && c.Reconnecting && c.Controller
+	})
+	if _, role := tr.dialResume("m", "mallory", role.Resume); role.Role != "viewer" {
+		t.Errorf("another user took over the held client: %+v", role)
+	}
+
+	alice, resumed := tr.dialResume("a2", "alice", role.Resume)
+	if resumed.Role != "controller" || resumed.Resume == role.Resume {
+		t.Errorf("resumed client: %+v", resumed)
+	}
+	list := waitForClients(t, s, func(list []ClientInfo) bool {
+		c, ok := findClient(list, "a")
+		return ok && !c.Reconnecting
+	})
+	if _, ok := findClient(list, "a2"); ok {
+		t.Error("resumed client got a new ID")
+	}
+	if _, role := tr.dialResume("x", "alice", role.Resume); role.Role != "viewer" {
+		t.Error("a resume token worked twice")
+	}
+	if sum := s.Summary(); sum.TotalClients != 4 {
+		t.Errorf("TotalClients = %d, want 4 with the resume not counted", sum.TotalClients)
+	}
+
+	// Once the grace period runs out, control passes on.
+	alice.UnderlyingConn().Close()
+	waitForClients(t, s, func(list []ClientInfo) bool {
+		_, held := findClient(list, "a")
+		for _, c := range list {
+			if c.Controller && !held {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestReconnectGraceSkipsDeliberateCloses(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger, ReconnectGrace: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+
+	_ = alice.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+	readMessage(t, bob, "role", "controller")
+	_ = tr.dial("c", "carol")
+	s.Kick("c")
+	waitForClients(t, s, func(list []ClientInfo) bool { return len(list) == 1 && list[0].ID == "b" })
+}
+
+func TestResumeKeepsInputSeq(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger, ReconnectGrace: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+	send := func(conn *websocket.Conn, seq uint64, input string) {
+		t.Helper()
+		data, _ := json.Marshal(input)
+		if err := conn.WriteJSON(wsMessage{Type: "input", Data: data, Seq: seq}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alice, role := tr.dialResume("a", "alice", "")
+	send(alice, 1, "one\n")
+	send(alice, 2, "two\n")
+	waitForHistory(t, s, "two", 2)
+	alice.UnderlyingConn().Close()
+	waitForClients(t, s, func(list []ClientInfo) bool {
+		c, ok := findClient(list, "a")
+		return ok && c.Reconnecting
+	})
+
+	// Not knowing whether seq 2 arrived, the client sends it again.
+	alice, _ = tr.dialResume("a2", "alice", role.Resume)
+	send(alice, 2, "two\n")
+	send(alice, 3, "three\n")
+	waitForHistory(t, s, "three", 2)
+	if n := strings.Count(historyString(s), "two"); n != 2 {
+		t.Errorf("resent input reached the PTY again: %d× %q in %q", n, "two", historyString(s))
+	}
+}
@@ -0,0 +1,43 @@
+package session
+
+import (
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// resizeWindow is how long a client's resizes are coalesced for, since each
+// PTY resize makes full-screen programs redraw for everyone.
+const resizeWindow = 100 * time.Millisecond
+
+// queueResizeLocked notes size as c's pending size and starts c's resize
+// timer unless it is running. The caller holds s.mu for writing.
+func (s *Session) queueResizeLocked(c *Client, size pty.Winsize) {
+	c.pendingSize = size
+	if c.resizeTimer != nil {
+		return
+	}
+	c.resizeTimer = time.AfterFunc(resizeWindow, func() { s.applyResize(c) })
+}
+
+// applyResize makes c's pending size its size and resizes the PTY to fit.
+func (s *Session) applyResize(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.resizeTimer == nil {
+		// c left, or the session closed, after the timer fired.
+		return
+	}
+	c.resizeTimer = nil
+	c.size = c.pendingSize
+	s.applySizeLocked()
+}
+
+// stopResizeLocked drops c's pending resize. The caller holds s.mu for
+// writing.
+func stopResizeLocked(c *Client) {
+	if c.resizeTimer != nil {
+		c.resizeTimer.Stop()
+		c.resizeTimer = nil
+	}
+}
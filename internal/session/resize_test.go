@@ -0,0 +1,100 @@
+package session
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// countSetSize replaces s's PTY resize with one that records the sizes.
+func countSetSize(s *Session) func() []pty.Winsize {
+	var sizes []pty.Winsize
+	s.mu.Lock()
+	s.setSize = func(_ *os.File, size *pty.Winsize) error {
+		sizes = append(sizes, *size)
+		return nil
+	}
+	s.mu.Unlock()
+	return func() []pty.Winsize {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return append([]pty.Winsize(nil), sizes...)
+	}
+}
+
+func sendResize(t *testing.T, conn *websocket.Conn, cols, rows uint16) {
+	t.Helper()
+	data, _ := json.Marshal(resizeMsg{Cols: cols, Rows: rows})
+	if err := conn.WriteJSON(wsMessage{Type: "resize", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResizeStormCoalesced(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	calls := countSetSize(s)
+	conn := newWSTransport(t, s).dial("a", "alice")
+
+	for i := range 50 {
+		sendResize(t, conn, uint16(100+i), 30)
+	}
+	final := pty.Winsize{Cols: 149, Rows: 30}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := calls()
+		if len(got) > 0 && got[len(got)-1] == final {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("PTY never resized to %+v: %+v", final, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := calls(); len(got) > 3 {
+		t.Errorf("50 resizes made %d PTY resizes, want at most 3", len(got))
+	}
+
+	// Resending the size the PTY has does not resize it again.
+	n := len(calls())
+	sendResize(t, conn, 149, 30)
+	time.Sleep(3 * resizeWindow)
+	if got := calls(); len(got) != n {
+		t.Errorf("an unchanged size resized the PTY: %+v", got[n:])
+	}
+}
+
+func TestResizeDroppedWhenClientLeaves(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	calls := countSetSize(s)
+	tr := newWSTransport(t, s)
+	alice := tr.dial("a", "alice")
+
+	sendResize(t, alice, 120, 40)
+	_ = alice.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	waitForClients(t, s, func(list []ClientInfo) bool { return len(list) == 0 })
+	time.Sleep(3 * resizeWindow)
+	if got := calls(); len(got) != 0 {
+		t.Errorf("a departed client's resize was applied: %+v", got)
+	}
+
+	bob := tr.dial("b", "bob")
+	sendResize(t, bob, 120, 40)
+	s.Close()
+	time.Sleep(3 * resizeWindow)
+	if got := calls(); len(got) != 0 {
+		t.Errorf("a resize was applied after the session closed: %+v", got)
+	}
+}
@@ -0,0 +1,53 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RLimit is a resource limit for the command, as for setrlimit(2).
+// Resource is an RLIMIT_* constant.
+type RLimit struct {
+	Resource int
+	Soft     uint64
+	Hard     uint64
+}
+
+// RLimitInfinity is an unlimited Soft or Hard value.
+const RLimitInfinity = ^uint64(0)
+
+// RLimitExecCommand is the first argument the server's own binary is
+// started with to run a command under resource limits. main hands the rest
+// of the arguments to RunRLimitExec.
+const RLimitExecCommand = "rlimit-exec"
+
+// ParseRLimit reads NAME:SOFT:HARD, where NAME is one of RLIMIT_AS,
+// RLIMIT_CPU, RLIMIT_NOFILE or RLIMIT_NPROC and a value may be
+// "unlimited".
+func ParseRLimit(s string) (RLimit, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return RLimit{}, fmt.Errorf("resource limit %q: want NAME:SOFT:HARD", s)
+	}
+	resource, ok := rlimitResources[strings.ToUpper(parts[0])]
+	if !ok {
+		return RLimit{}, fmt.Errorf("resource limit %q: unsupported resource %q", s, parts[0])
+	}
+	var vals [2]uint64
+	for i, p := range parts[1:] {
+		if p == "unlimited" {
+			vals[i] = RLimitInfinity
+			continue
+		}
+		v, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return RLimit{}, fmt.Errorf("resource limit %q: invalid value %q", s, p)
+		}
+		vals[i] = v
+	}
+	if vals[0] > vals[1] {
+		return RLimit{}, fmt.Errorf("resource limit %q: soft limit is above the hard limit", s)
+	}
+	return RLimit{Resource: resource, Soft: vals[0], Hard: vals[1]}, nil
+}
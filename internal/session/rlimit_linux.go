@@ -0,0 +1,134 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// rlimitNPROC is missing from package syscall.
+const rlimitNPROC = 6
+
+var rlimitResources = map[string]int{
+	"RLIMIT_AS":     syscall.RLIMIT_AS,
+	"RLIMIT_CPU":    syscall.RLIMIT_CPU,
+	"RLIMIT_NOFILE": syscall.RLIMIT_NOFILE,
+	"RLIMIT_NPROC":  rlimitNPROC,
+}
+
+// rlimitReportFD is the descriptor the RLimitExecCommand helper reports a
+// failure on, the first of cmd.ExtraFiles.
+const rlimitReportFD = 3
+
+// prepareLimited turns cmd into a run of this binary's RLimitExecCommand
+// mode, which sets limits and then execs the command, so they are in place
+// before its first instruction. Go offers no hook between fork and exec.
+// The command is also made to die with the server rather than outlive it.
+func prepareLimited(cmd *exec.Cmd, limits []RLimit) (*limitReport, error) {
+	if cmd.Err != nil {
+		return nil, cmd.Err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find own executable: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{self, RLimitExecCommand}
+	for _, l := range limits {
+		args = append(args, fmt.Sprintf("%d:%d:%d", l.Resource, l.Soft, l.Hard))
+	}
+	args = append(args, "--", cmd.Path)
+	cmd.Path, cmd.Args = self, append(args, cmd.Args...)
+	cmd.ExtraFiles = []*os.File{w}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	return &limitReport{r: r, w: w}, nil
+}
+
+// limitReport is the server's side of the pipe the helper reports on. The
+// helper's end is closed by its exec, so a read that ends with nothing
+// means the command is running with its limits.
+type limitReport struct {
+	r, w *os.File
+}
+
+// wait returns startErr, the error from starting cmd, or else whatever
+// the helper reported, in which case cmd is reaped and ptmx closed.
+func (l *limitReport) wait(cmd *exec.Cmd, ptmx *os.File, startErr error) error {
+	l.w.Close()
+	defer l.r.Close()
+	if startErr != nil {
+		return startErr
+	}
+	msg, _ := io.ReadAll(l.r)
+	if len(msg) == 0 {
+		return nil
+	}
+	ptmx.Close()
+	_ = cmd.Wait()
+	return fmt.Errorf("set resource limits: %s", msg)
+}
+
+// RunRLimitExec is the RLimitExecCommand mode. args are the limits as
+// RESOURCE:SOFT:HARD numbers, "--", the command's path and its argv. It
+// sets the limits with setrlimit(2) and execs the command, so it returns
+// only on failure, with the exit status to use. The failure is written to
+// stderr and to the server's report pipe.
+func RunRLimitExec(args []string, stderr io.Writer) int {
+	err := rlimitExec(args)
+	fmt.Fprintf(stderr, "vexshare %s: %v\n", RLimitExecCommand, err)
+	if report := os.NewFile(rlimitReportFD, "rlimit-report"); report != nil {
+		fmt.Fprint(report, err)
+		report.Close()
+	}
+	return 127
+}
+
+func rlimitExec(args []string) error {
+	sep := -1
+	for i, a := range args {
+		if a == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(args) < sep+3 {
+		return errors.New("usage: LIMIT... -- PATH ARGV0 [ARG...]")
+	}
+	for _, a := range args[:sep] {
+		parts := strings.Split(a, ":")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid limit %q", a)
+		}
+		resource, err1 := strconv.Atoi(parts[0])
+		soft, err2 := strconv.ParseUint(parts[1], 10, 64)
+		hard, err3 := strconv.ParseUint(parts[2], 10, 64)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			return fmt.Errorf("invalid limit %q: %w", a, err)
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: soft, Max: hard}); err != nil {
+			return fmt.Errorf("%s: %w", rlimitName(resource), err)
+		}
+	}
+	syscall.CloseOnExec(rlimitReportFD)
+	return syscall.Exec(args[sep+1], args[sep+2:], os.Environ())
+}
+
+func rlimitName(resource int) string {
+	for name, r := range rlimitResources {
+		if r == resource {
+			return name
+		}
+	}
+	return strconv.Itoa(resource)
+}
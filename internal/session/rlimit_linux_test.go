@@ -0,0 +1,70 @@
+package session
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestMain lets the test binary stand in for vexshare when a session
+// starts its command through RLimitExecCommand.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == RLimitExecCommand {
+		os.Exit(RunRLimitExec(os.Args[2:], os.Stderr))
+	}
+	os.Exit(m.Run())
+}
+
+func TestParseRLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    RLimit
+		wantErr bool
+	}{
+		{"RLIMIT_NOFILE:1024:1024", RLimit{Resource: syscall.RLIMIT_NOFILE, Soft: 1024, Hard: 1024}, false},
+		{"rlimit_cpu:60:unlimited", RLimit{Resource: syscall.RLIMIT_CPU, Soft: 60, Hard: RLimitInfinity}, false},
+		{"RLIMIT_NPROC:100:200", RLimit{Resource: rlimitNPROC, Soft: 100, Hard: 200}, false},
+		{"RLIMIT_AS:unlimited:unlimited", RLimit{Resource: syscall.RLIMIT_AS, Soft: RLimitInfinity, Hard: RLimitInfinity}, false},
+		{"RLIMIT_NOFILE:1024", RLimit{}, true},
+		{"RLIMIT_CORE:0:0", RLimit{}, true},
+		{"RLIMIT_NOFILE:2048:1024", RLimit{}, true},
+		{"RLIMIT_NOFILE:-1:1024", RLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRLimit(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseRLimit(%q) = %+v, %v; want %+v, err %v", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestResourceLimitsApplied(t *testing.T) {
+	s, err := New(Config{
+		Command:        "/bin/sh",
+		Args:           []string{"-c", "echo soft=$(ulimit -n) hard=$(ulimit -Hn) END; sleep 5"},
+		ResourceLimits: []RLimit{{Resource: syscall.RLIMIT_NOFILE, Soft: 64, Hard: 128}},
+		Logger:         discardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	waitForHistory(t, s, "END", 1)
+	if out := historyString(s); !strings.Contains(out, "soft=64 hard=128") {
+		t.Errorf("limits not applied: %q", out)
+	}
+}
+
+func TestResourceLimitsFailure(t *testing.T) {
+	// No one may raise RLIMIT_NOFILE above fs.nr_open, not even root.
+	_, err := New(Config{
+		Command:        "/bin/sh",
+		Args:           []string{"-c", "sleep 5"},
+		ResourceLimits: []RLimit{{Resource: syscall.RLIMIT_NOFILE, Soft: 1 << 40, Hard: 1 << 40}},
+		Logger:         discardLogger,
+	})
+	if err == nil || !strings.Contains(err.Error(), "RLIMIT_NOFILE") {
+		t.Fatalf("New = %v, want the RLIMIT_NOFILE failure", err)
+	}
+}
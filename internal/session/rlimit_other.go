@@ -0,0 +1,30 @@
+//go:build !linux
+
+package session
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+var rlimitResources = map[string]int{}
+
+var errRLimitUnsupported = errors.New("resource limits are only supported on Linux")
+
+type limitReport struct{}
+
+func prepareLimited(*exec.Cmd, []RLimit) (*limitReport, error) {
+	return nil, errRLimitUnsupported
+}
+
+func (*limitReport) wait(_ *exec.Cmd, _ *os.File, startErr error) error {
+	return startErr
+}
+
+func RunRLimitExec(_ []string, stderr io.Writer) int {
+	fmt.Fprintf(stderr, "vexshare %s: %v\n", RLimitExecCommand, errRLimitUnsupported)
+	return 127
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// RunAs is the user the command runs as, resolved to numeric IDs.
+type RunAs struct {
+	Name string
+	Home string
+	UID  uint32
+	GID  uint32
+	// Groups are the user's supplementary groups. The server's own are
+	// dropped.
+	Groups []uint32
+}
+
+// ResolveRunAs looks up USER[:GROUP], where either may be a name or a
+// numeric ID. Without GROUP the command gets the user's primary group. It
+// fails if the user or group does not exist or the server cannot switch to
+// them.
+func ResolveRunAs(spec string) (*RunAs, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" || (hasGroup && groupPart == "") {
+		return nil, fmt.Errorf("run as %q: want USER or USER:GROUP", spec)
+	}
+	u, err := lookupUser(userPart)
+	if err != nil {
+		return nil, fmt.Errorf("run as %q: %w", spec, err)
+	}
+	uid, err := parseID(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("run as %q: user %s has no numeric uid", spec, u.Username)
+	}
+	gidStr := u.Gid
+	if hasGroup {
+		g, err := lookupGroup(groupPart)
+		if err != nil {
+			return nil, fmt.Errorf("run as %q: %w", spec, err)
+		}
+		gidStr = g.Gid
+	}
+	gid, err := parseID(gidStr)
+	if err != nil {
+		return nil, fmt.Errorf("run as %q: group %s has no numeric gid", spec, gidStr)
+	}
+	r := &RunAs{Name: u.Username, Home: u.HomeDir, UID: uid, GID: gid, Groups: []uint32{}}
+	if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if g, err := parseID(id); err == nil && g != gid {
+				r.Groups = append(r.Groups, g)
+			}
+		}
+	}
+	if err := checkRunAs(r); err != nil {
+		return nil, fmt.Errorf("run as %q: %w", spec, err)
+	}
+	return r, nil
+}
+
+func lookupUser(s string) (*user.User, error) {
+	if _, err := parseID(s); err == nil {
+		return user.LookupId(s)
+	}
+	return user.Lookup(s)
+}
+
+func lookupGroup(s string) (*user.Group, error) {
+	if _, err := parseID(s); err == nil {
+		return user.LookupGroupId(s)
+	}
+	return user.LookupGroup(s)
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// env is the login environment for the user, set before Config.Env so
+// that Env can still override it.
+func (r *RunAs) env() []string {
+	return []string{"HOME=" + r.Home, "USER=" + r.Name, "LOGNAME=" + r.Name}
+}
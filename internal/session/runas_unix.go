@@ -0,0 +1,31 @@
+//go:build !windows
+
+package session
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// checkRunAs fails early when the server cannot switch to r, rather than
+// on every start of the command. Only root can change to another user;
+// a process that is merely granted CAP_SETUID is not detected.
+func checkRunAs(r *RunAs) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if r.UID == uint32(os.Geteuid()) && r.GID == uint32(os.Getegid()) {
+		return nil
+	}
+	return fmt.Errorf("switching to uid %d gid %d needs root", r.UID, r.GID)
+}
+
+// setRunAs makes cmd start as r, dropping the server's supplementary groups.
+func setRunAs(cmd *exec.Cmd, r *RunAs) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: r.UID, Gid: r.GID, Groups: r.Groups}
+}
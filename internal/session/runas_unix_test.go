@@ -0,0 +1,68 @@
+//go:build !windows
+
+package session
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResolveRunAs(t *testing.T) {
+	me, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	r, err := ResolveRunAs(me.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.Itoa(int(r.UID)) != me.Uid || strconv.Itoa(int(r.GID)) != me.Gid || r.Home != me.HomeDir {
+		t.Errorf("ResolveRunAs(%q) = %+v, want uid %s gid %s", me.Username, r, me.Uid, me.Gid)
+	}
+	if r2, err := ResolveRunAs(me.Uid); err != nil || r2.UID != r.UID {
+		t.Errorf("ResolveRunAs(%q) = %+v, %v", me.Uid, r2, err)
+	}
+
+	for _, spec := range []string{"", ":", me.Username + ":", "no-such-user-vexshare", me.Username + ":no-such-group-vexshare"} {
+		if _, err := ResolveRunAs(spec); err == nil {
+			t.Errorf("ResolveRunAs(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestRunAsNeedsRoot(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("running as root")
+	}
+	if _, err := ResolveRunAs("0"); err == nil || !strings.Contains(err.Error(), "needs root") {
+		t.Errorf("ResolveRunAs(root) as uid %d: err = %v", os.Geteuid(), err)
+	}
+}
+
+func TestRunAsApplied(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+	r, err := ResolveRunAs("nobody:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := New(Config{
+		Command: "/bin/sh",
+		Args:    []string{"-c", "sleep 0.3; echo uid=$(id -u) gid=$(id -g) user=$USER END; sleep 5"},
+		RunAs:   r,
+		Logger:  discardLogger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	waitForHistory(t, s, "END", 1)
+	want := "uid=" + strconv.Itoa(int(r.UID)) + " gid=0 user=" + r.Name
+	if out := historyString(s); !strings.Contains(out, want) {
+		t.Errorf("want %q in %q", want, out)
+	}
+}
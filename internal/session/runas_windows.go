@@ -0,0 +1,12 @@
+package session
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func checkRunAs(*RunAs) error {
+	return errors.New("running the command as another user is not supported on Windows")
+}
+
+func setRunAs(*exec.Cmd, *RunAs) {}
@@ -0,0 +1,283 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SendPolicy bounds how far each client's outgoing queue may fall behind the
+// PTY. Viewers that exceed QueueSize are disconnected. The controller gets a
+// larger queue and is never dropped: when its queue is full the PTY reader
+// blocks for up to ControllerBlockTimeout, without holding the session's
+// lock, and after that the chunk is skipped for the controller only.
+// ControllerQueueSize is raised to QueueSize if smaller.
+type SendPolicy struct {
+	QueueSize              int
+	ControllerQueueSize    int
+	ControllerBlockTimeout time.Duration
+	// The controller is reported as degraded when its queue holds at least
+	// DegradedQueueDepth messages or no pong has arrived for PongTimeout.
+	DegradedQueueDepth  int
+	PingInterval        time.Duration
+	PongTimeout         time.Duration
+	HealthCheckInterval time.Duration
+}
+
+func (p SendPolicy) withDefaults() SendPolicy {
+	if p.QueueSize <= 0 {
+		p.QueueSize = 256
+	}
+	if p.ControllerQueueSize <= 0 {
+		p.ControllerQueueSize = 1024
+	}
+	p.ControllerQueueSize = max(p.ControllerQueueSize, p.QueueSize)
+	if p.ControllerBlockTimeout <= 0 {
+		p.ControllerBlockTimeout = 2 * time.Second
+	}
+	if p.DegradedQueueDepth <= 0 {
+		p.DegradedQueueDepth = p.ControllerQueueSize / 2
+	}
+	if p.PingInterval <= 0 {
+		p.PingInterval = 30 * time.Second
+	}
+	if p.PongTimeout <= 0 {
+		p.PongTimeout = 2*p.PingInterval + 15*time.Second
+	}
+	if p.HealthCheckInterval <= 0 {
+		p.HealthCheckInterval = 5 * time.Second
+	}
+	return p
+}
+
+type degradedMsg struct {
+	Degraded bool   `json:"degraded"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// outbound is a message waiting in a client's queue. queuedAt is when
+// output was queued, in Unix nanoseconds, if latency stats are on. output
+// is the terminal output raw carries, held instead for a client that
+// paused its output.
+type outbound struct {
+	raw      []byte
+	queuedAt int64
+	output   []byte
+}
+
+func (s *Session) newClientQueue() chan outbound {
+	// Sized for the controller, since any client may be promoted; viewers
+	// are held to QueueSize by enqueueLocked.
+	return make(chan outbound, s.policy.ControllerQueueSize)
+}
+
+// ParallelBroadcastMinClients is the audience size below which broadcasts
+// stay serial even with BroadcastWorkers set; smaller fan-outs finish
+// faster than the goroutines start.
+const ParallelBroadcastMinClients = 128
+
+// fanOutLocked enqueues m for every client. The caller holds s.mu for
+// reading. If the controller's queue is full it is returned, and the
+// caller waits for room with sendController once it has let go of s.mu.
+func (s *Session) fanOutLocked(m outbound) *Client {
+	var stalled *Client
+	if s.workers <= 1 || len(s.clients) < ParallelBroadcastMinClients {
+		for _, c := range s.clients {
+			if !s.enqueueLocked(c, m) {
+				stalled = c
+			}
+		}
+		return stalled
+	}
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	chunk := (len(clients) + s.workers - 1) / s.workers
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for start := 0; start < len(clients); start += chunk {
+		wg.Add(1)
+		go func(part []*Client) {
+			defer wg.Done()
+			for _, c := range part {
+				if !s.enqueueLocked(c, m) {
+					mu.Lock()
+					stalled = c
+					mu.Unlock()
+				}
+			}
+		}(clients[start:min(start+chunk, len(clients))])
+	}
+	wg.Wait()
+	return stalled
+}
+
+// enqueueLocked hands m to c's writer. The caller holds s.mu for reading.
+// It never blocks: it reports false, leaving m unsent, if c is the
+// controller and its queue is full.
+func (s *Session) enqueueLocked(c *Client, m outbound) bool {
+	if c.flow != nil && m.output != nil {
+		c.flow.write(m.output)
+		return true
+	}
+	if c.IsController {
+		select {
+		case c.send <- m:
+		default:
+			return false
+		}
+		if len(c.send) >= s.policy.DegradedQueueDepth {
+			s.setControllerDegradedLocked(true, "queue")
+		}
+		return true
+	}
+	if len(c.send) >= s.policy.QueueSize {
+		s.dropSlowClient(c)
+		return true
+	}
+	select {
+	case c.send <- m:
+	default:
+		s.dropSlowClient(c)
+	}
+	return true
+}
+
+// sendController waits up to ControllerBlockTimeout for room in the
+// controller's full queue, and then skips m for it. The caller must not
+// hold s.mu, so that a slow controller holds up only the PTY reader and
+// not clients joining, leaving or resizing.
+func (s *Session) sendController(c *Client, m outbound) {
+	timer := time.NewTimer(s.policy.ControllerBlockTimeout)
+	defer timer.Stop()
+	select {
+	case c.send <- m:
+	case <-c.closed:
+		return
+	case <-timer.C:
+		s.mu.RLock()
+		s.skipControllerLocked(c)
+		s.mu.RUnlock()
+		return
+	}
+	if len(c.send) >= s.policy.DegradedQueueDepth {
+		s.mu.RLock()
+		s.setControllerDegradedLocked(true, "queue")
+		s.mu.RUnlock()
+	}
+}
+
+// skipControllerLocked reports output the controller missed because its
+// queue stayed full. The caller holds s.mu.
+func (s *Session) skipControllerLocked(c *Client) {
+	s.logger.Warn("controller send queue full, skipping output for controller", "client", c.ID, "user", c.Auth.Username)
+	s.setControllerDegradedLocked(true, "blocked")
+}
+
+func (s *Session) dropSlowClient(c *Client) {
+	c.dropOnce.Do(func() {
+		s.logger.Warn("client send queue full, dropping slow client", "client", c.ID, "user", c.Auth.Username)
+		// readClient sees the closed connection and removes the client.
+		c.Conn.Close()
+	})
+}
+
+func (s *Session) writePump(c *Client) {
+	ticker := time.NewTicker(s.policy.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-c.send:
+			if err := s.writeOutbound(c, m); err != nil {
+				if errors.Is(err, websocket.ErrCloseSent) {
+					// The session is closing; leave the connection to the
+					// closing handshake.
+					return
+				}
+				s.logger.Debug("write to client failed", "client", c.ID, "error", err)
+				c.Conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				s.logger.Debug("ping client failed", "client", c.ID, "error", err)
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (s *Session) controllerHealthChecker() {
+	ticker := time.NewTicker(s.policy.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.RLock()
+			s.checkControllerHealthLocked()
+			s.mu.RUnlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) checkControllerHealthLocked() {
+	for _, c := range s.clients {
+		if !c.IsController {
+			continue
+		}
+		switch {
+		case len(c.send) >= s.policy.DegradedQueueDepth:
+			s.setControllerDegradedLocked(true, "queue")
+		case time.Since(time.Unix(0, c.lastPong.Load())) > s.policy.PongTimeout:
+			s.setControllerDegradedLocked(true, "pong")
+		default:
+			s.setControllerDegradedLocked(false, "")
+		}
+		return
+	}
+	s.setControllerDegradedLocked(false, "")
+}
+
+// setControllerDegradedLocked tells every client when the controller's
+// connection becomes unhealthy or recovers, so viewers know why the
+// terminal stalled.
+func (s *Session) setControllerDegradedLocked(degraded bool, reason string) {
+	if !s.controllerDegraded.CompareAndSwap(!degraded, degraded) {
+		return
+	}
+	if degraded {
+		s.logger.Warn("controller connection degraded", "reason", reason)
+	} else {
+		s.logger.Info("controller connection recovered")
+	}
+	data, _ := json.Marshal(degradedMsg{Degraded: degraded, Reason: reason})
+	raw, err := json.Marshal(wsMessage{Type: "controller-degraded", Data: json.RawMessage(data)})
+	if err != nil {
+		return
+	}
+	s.notifyAllLocked(raw)
+}
+
+// notifyAllLocked queues an out-of-band message for every client. It never
+// blocks; clients whose queue is full miss the message.
+func (s *Session) notifyAllLocked(raw []byte) {
+	for _, c := range s.clients {
+		s.notifyLocked(c, raw)
+	}
+}
+
+// notifyLocked queues an out-of-band message for c, unless its queue is
+// full.
+func (s *Session) notifyLocked(c *Client, raw []byte) {
+	select {
+	case c.send <- outbound{raw: raw}:
+	default:
+	}
+}
@@ -0,0 +1,240 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newQueueTestSession(policy SendPolicy) *Session {
+	return &Session{
+		clients: make(map[string]*Client),
+		logger:  discardLogger,
+		policy:  policy.withDefaults(),
+	}
+}
+
+func (s *Session) addQueueTestClient(id string, controller bool) *Client {
+	c := &Client{ID: id, IsController: controller, send: s.newClientQueue(), closed: make(chan struct{})}
+	c.lastPong.Store(time.Now().UnixNano())
+	s.clients[id] = c
+	return c
+}
+
+func drainTypes(c *Client) []string {
+	var types []string
+	for {
+		select {
+		case m := <-c.send:
+			var msg wsMessage
+			_ = json.Unmarshal(m.raw, &msg)
+			types = append(types, msg.Type)
+		default:
+			return types
+		}
+	}
+}
+
+func TestLaggyControllerBlocksWithCap(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{
+		QueueSize:              4,
+		ControllerQueueSize:    4,
+		ControllerBlockTimeout: 100 * time.Millisecond,
+		DegradedQueueDepth:     100,
+	})
+	controller := s.addQueueTestClient("controller", true)
+	viewer := s.addQueueTestClient("viewer", false)
+
+	// The viewer keeps up; the controller never reads.
+	var types []string
+	for i := 0; i < 4; i++ {
+		s.broadcast([]byte("x"))
+		types = append(types, drainTypes(viewer)...)
+	}
+	start := time.Now()
+	s.broadcast([]byte("blocked"))
+	elapsed := time.Since(start)
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("broadcast to a full controller queue took %v, want about the 100ms cap", elapsed)
+	}
+	if len(controller.send) != 4 {
+		t.Errorf("controller queue holds %d messages, want 4", len(controller.send))
+	}
+	if !s.controllerDegraded.Load() {
+		t.Error("controller should be reported degraded after hitting the cap")
+	}
+
+	types = append(types, drainTypes(viewer)...)
+	if len(types) != 6 || !slices.Contains(types, "controller-degraded") {
+		t.Errorf("viewer received %v, want 5 outputs and a controller-degraded notice", types)
+	}
+}
+
+func TestControllerBlockReleasedByDrain(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{
+		QueueSize:              2,
+		ControllerQueueSize:    2,
+		ControllerBlockTimeout: 5 * time.Second,
+		DegradedQueueDepth:     10,
+	})
+	controller := s.addQueueTestClient("controller", true)
+	s.broadcast([]byte("a"))
+	s.broadcast([]byte("b"))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		<-controller.send
+	}()
+	start := time.Now()
+	s.broadcast([]byte("c"))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("broadcast blocked %v after the controller caught up", elapsed)
+	}
+	if s.controllerDegraded.Load() {
+		t.Error("a brief stall should not mark the controller degraded")
+	}
+}
+
+func TestBlockedControllerDoesNotHoldLock(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{
+		QueueSize:              2,
+		ControllerQueueSize:    2,
+		ControllerBlockTimeout: 2 * time.Second,
+		DegradedQueueDepth:     10,
+	})
+	s.addQueueTestClient("controller", true)
+	s.broadcast([]byte("a"))
+	s.broadcast([]byte("b"))
+
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		s.broadcast([]byte("c"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		s.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-blocked:
+		t.Fatal("broadcast returned before the controller's block timeout")
+	case <-time.After(time.Second):
+		t.Fatal("the session lock is held while waiting on the controller")
+	}
+	<-blocked
+}
+
+func TestClientCountIsQueued(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{})
+	a := s.addQueueTestClient("a", true)
+	b := s.addQueueTestClient("b", false)
+	s.broadcastClientCount()
+	for _, c := range []*Client{a, b} {
+		if types := drainTypes(c); !slices.Equal(types, []string{"clients"}) {
+			t.Errorf("%s queued %v, want the client count", c.ID, types)
+		}
+	}
+}
+
+func TestControllerHealthFromPongs(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{PongTimeout: time.Minute})
+	controller := s.addQueueTestClient("controller", true)
+	viewer := s.addQueueTestClient("viewer", false)
+
+	s.checkControllerHealthLocked()
+	if s.controllerDegraded.Load() {
+		t.Fatal("fresh controller reported degraded")
+	}
+
+	controller.lastPong.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+	s.checkControllerHealthLocked()
+	if !s.controllerDegraded.Load() {
+		t.Fatal("controller with missed pongs not reported degraded")
+	}
+
+	controller.lastPong.Store(time.Now().UnixNano())
+	s.checkControllerHealthLocked()
+	if s.controllerDegraded.Load() {
+		t.Fatal("controller did not recover after a pong")
+	}
+	var notices []degradedMsg
+	for _, raw := range drainRaw(viewer) {
+		var msg wsMessage
+		var notice degradedMsg
+		_ = json.Unmarshal(raw, &msg)
+		_ = json.Unmarshal(msg.Data, &notice)
+		notices = append(notices, notice)
+	}
+	if len(notices) != 2 || !notices[0].Degraded || notices[0].Reason != "pong" || notices[1].Degraded {
+		t.Errorf("viewer notices = %+v, want degraded(pong) then recovered", notices)
+	}
+}
+
+func drainRaw(c *Client) [][]byte {
+	var out [][]byte
+	for {
+		select {
+		case m := <-c.send:
+			out = append(out, m.raw)
+		default:
+			return out
+		}
+	}
+}
+
+func TestParallelBroadcastReachesEveryClient(t *testing.T) {
+	s := newQueueTestSession(SendPolicy{})
+	s.workers = 7
+	clients := make([]*Client, ParallelBroadcastMinClients+3)
+	for i := range clients {
+		clients[i] = s.addQueueTestClient(fmt.Sprint(i), i == 0)
+	}
+	s.broadcast([]byte("one"))
+	s.broadcast([]byte("two"))
+	for _, c := range clients {
+		if got := drainTypes(c); !slices.Equal(got, []string{"output", "output"}) {
+			t.Fatalf("client %s got %v", c.ID, got)
+		}
+	}
+}
+
+// BenchmarkBroadcastFanOut compares serial and parallel fan-out of one
+// output message. Each client's writer is modelled by a goroutine draining
+// its queue.
+func BenchmarkBroadcastFanOut(b *testing.B) {
+	for _, clients := range []int{8, 64, 256, 1024} {
+		for _, workers := range []int{0, 4, 16} {
+			b.Run(fmt.Sprintf("clients=%d/workers=%d", clients, workers), func(b *testing.B) {
+				s := newQueueTestSession(SendPolicy{QueueSize: 1 << 16, ControllerQueueSize: 1 << 16})
+				s.workers = workers
+				done := make(chan struct{})
+				defer close(done)
+				for i := 0; i < clients; i++ {
+					c := s.addQueueTestClient(fmt.Sprint(i), i == 0)
+					go func() {
+						for {
+							select {
+							case <-c.send:
+							case <-done:
+								return
+							}
+						}
+					}()
+				}
+				raw := []byte(`{"type":"output","data":"hello, world\r\n"}`)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					s.mu.RLock()
+					s.fanOutLocked(outbound{raw: raw})
+					s.mu.RUnlock()
+				}
+			})
+		}
+	}
+}
@@ -7,8 +7,11 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creack/pty"
@@ -18,6 +21,34 @@ import (
 type wsMessage struct {
 	Type string          `json:"type"`
 	Data json.RawMessage `json:"data,omitempty"`
+	Seq  uint64          `json:"seq,omitempty"`
+}
+
+type roleMsg struct {
+	Role        string   `json:"role"`
+	Access      string   `json:"access,omitempty"`
+	SharedInput bool     `json:"sharedInput"`
+	User        string   `json:"user,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	// Resume is the token to reconnect with; set only when the session
+	// has a reconnect grace period.
+	Resume string `json:"resume,omitempty"`
+	// IdleTimeoutSeconds is set when the session has an idle timeout, and
+	// IdleExtendSeconds when the controller may extend it.
+	IdleTimeoutSeconds int64 `json:"idleTimeoutSeconds,omitempty"`
+	IdleExtendSeconds  int64 `json:"idleExtendSeconds,omitempty"`
+	// Deadline is where the idle timeout stands as the client joins.
+	Deadline *Deadline `json:"deadline,omitempty"`
+}
+
+type noticeMsg struct {
+	Text string `json:"text"`
+}
+
+type securityMsg struct {
+	Event    string `json:"event"`
+	IP       string `json:"ip,omitempty"`
+	Username string `json:"username,omitempty"`
 }
 
 type resizeMsg struct {
@@ -25,11 +56,68 @@ type resizeMsg struct {
 	Rows uint16 `json:"rows"`
 }
 
+type AuthInfo struct {
+	Username    string
+	DisplayName string
+	Groups      []string
+	Role        string
+	// RequestID is the ID of the HTTP request that opened the connection,
+	// added to the client's log lines when set.
+	RequestID string
+	// IP is the address the connection came from.
+	IP string
+}
+
+const DefaultMaxMessageBytes = 1 << 20
+
+const (
+	RoleOwner  = "owner"
+	RoleWriter = "writer"
+	RoleViewer = "viewer"
+)
+
 type Client struct {
 	ID           string
 	Conn         *websocket.Conn
+	Auth         AuthInfo
 	IsController bool
 	mu           sync.Mutex
+	lastSeq      uint64
+	// size is the client's last reported terminal size; zero until it
+	// reports one. Guarded by Session.mu.
+	size      pty.Winsize
+	send      chan outbound
+	closed    chan struct{}
+	closeOnce sync.Once
+	dropOnce  sync.Once
+	lastPong  atomic.Int64
+	logger    *slog.Logger
+	// resumeToken reclaims the client after a drop; kicked stops that.
+	resumeToken string
+	kicked      atomic.Bool
+	// lastKeepalive is guarded by Session.activeMu.
+	lastKeepalive time.Time
+	// flow holds output while the client has paused it; see setFlow.
+	// Guarded by Session.mu.
+	flow *pauseBuffer
+	// pendingSize is applied when resizeTimer fires; see
+	// queueResizeLocked. Both are guarded by Session.mu.
+	pendingSize pty.Winsize
+	resizeTimer *time.Timer
+}
+
+// clientLogger returns the logger for lines about c, tagged with its ID
+// and the request that opened it.
+func (s *Session) clientLogger(c *Client) *slog.Logger {
+	if c.logger == nil {
+		return s.logger.With("id", c.ID)
+	}
+	return c.logger
+}
+
+// Done is closed once the client has left the session.
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
 }
 
 func (c *Client) WriteJSON(v interface{}) error {
@@ -45,8 +133,20 @@ func (c *Client) WriteMessage(messageType int, data []byte) error {
 }
 
 type Session struct {
+	command     string
+	args        []string
+	env         []string
+	clearEnv    bool
+	killGroup   bool
+	rlimits     []RLimit
+	runAs       *RunAs
+	readOnly    bool
+	startedAt   time.Time
+	procMu      sync.Mutex
 	cmd         *exec.Cmd
 	ptmx        *os.File
+	input       *inputWriter
+	procExited  chan struct{}
 	clients     map[string]*Client
 	mu          sync.RWMutex
 	sharedInput bool
@@ -57,14 +157,175 @@ type Session struct {
 	done        chan struct{}
 	closeOnce   sync.Once
 	onClose     func()
+	history     *history
+	resizeMode  string
+	ptySize     pty.Winsize
+	policy      SendPolicy
+	workers     int
+	onExit      string
+	restartWait time.Duration
+	retries     int
+	retryWait   time.Duration
+	stallAfter  time.Duration
+	notifySec   bool
+	stats       sessionStats
+	batcher     *outputBatcher
+	latency     *latencyStats
+	latencySlow time.Duration
+	prompts     *promptDetector
+	motd        []byte
+	consent     string
+
+	// bytesOut counts the output broadcast to clients; see OutputRate.
+	bytesOut      atomic.Int64
+	outputRateBps atomic.Int64
+	// setSize resizes the PTY; tests replace it. Guarded by mu.
+	setSize func(*os.File, *pty.Winsize) error
+
+	// held keeps dropped clients by resume token for reconnectGrace.
+	// Guarded by mu.
+	held           map[string]*heldClient
+	reconnectGrace time.Duration
+	closeGrace     time.Duration
+
+	// idleExtra is what the controller has added to idleTimeout. Guarded
+	// by activeMu.
+	idleExtra      time.Duration
+	idleExtendStep time.Duration
+	idleExtendMax  time.Duration
+	// lastDeadline is when the last "deadline" message went out. Guarded
+	// by activeMu.
+	lastDeadline time.Time
+
+	now        func() time.Time
+	timeline   []TimelineEvent
+	timelineMu sync.Mutex
+
+	// maxMessageBytes and maxMalformed bound what a client may send.
+	maxMessageBytes int64
+	maxMalformed    int
+
+	controllerDegraded atomic.Bool
+	exitPending        atomic.Bool
+
+	// detaching is set by Detach, and readPTY closes detached once it has
+	// stopped reading.
+	detaching atomic.Bool
+	detached  chan struct{}
+
+	// controller is the last announced controller; guarded by mu.
+	controller    controllerMsg
+	controllerRaw []byte
+
+	// paused holds output back from viewers; see pause.go. paused and
+	// pausedBy are guarded by mu.
+	paused   bool
+	pausedBy string
+	pauseBuf pauseBuffer
 }
 
 type Config struct {
-	Command     string
+	Command string
+	// Args and Env are passed to Command; Env adds to the server's
+	// environment. With ClearEnv the command gets only Env and TERM.
+	Args     []string
+	Env      []string
+	ClearEnv bool
+	// KillProcessGroup ends the command's whole process group, such as a
+	// shell's background jobs, rather than just the command when the
+	// session closes or the command exits. See DefaultKillProcessGroup.
+	KillProcessGroup bool
+	// ResourceLimits are set before the command runs, by starting it through
+	// the RLimitExecCommand mode of the server's binary; Linux only. A
+	// command with limits is also killed if the server dies.
+	ResourceLimits []RLimit
+	// RunAs starts the command as another user, with their HOME, USER and
+	// LOGNAME; see ResolveRunAs. Nil runs it as the server's user.
+	RunAs *RunAs
+	// ReadOnly stops every client, including the controller, from typing.
+	ReadOnly    bool
 	SharedInput bool
 	IdleTimeout time.Duration
 	Logger      *slog.Logger
 	OnClose     func()
+	// ResizeMode picks the PTY size from the connected clients: "min" (the
+	// default) uses the smallest reported size, "controller" the controller's.
+	ResizeMode string
+	SendPolicy SendPolicy
+	// OnExit decides what happens when the command exits: OnExitClose (the
+	// default) ends the session, OnExitPrompt asks the controller whether to
+	// restart, and OnExitRestart restarts it straight away.
+	OnExit string
+	// RestartDelay is the pause before restarting a command that exited
+	// sooner than this after starting. Defaults to one second.
+	RestartDelay time.Duration
+	// StartupRetries is how many more times to try starting the command
+	// when it cannot be started, for instance because a parallel setup step
+	// has not installed it yet, with StartupRetryDelay between attempts.
+	StartupRetries    int
+	StartupRetryDelay time.Duration
+	// ScrollbackBytes sizes the in-memory output history. It is unused when
+	// HistorySpoolDir is set, in which case HistorySpoolMaxBytes caps the
+	// on-disk history (0 means unlimited).
+	ScrollbackBytes      int
+	HistorySpoolDir      string
+	HistorySpoolMaxBytes int64
+	// OutputFlushBytes and OutputFlushDelay batch PTY output into fewer
+	// messages: buffered output is sent once it reaches OutputFlushBytes or
+	// OutputFlushDelay after it started, whichever is first. Zero values
+	// pick DefaultOutputFlushBytes and DefaultOutputFlushDelay; a negative
+	// delay sends every read immediately.
+	OutputFlushBytes int
+	OutputFlushDelay time.Duration
+	// MaxMessageBytes caps a single client message (default 1 MiB); larger
+	// ones close the connection. After MaxMalformedMessages consecutive
+	// messages that do not parse (default 10) the client is disconnected
+	// with close code 1007.
+	MaxMessageBytes      int64
+	MaxMalformedMessages int
+	// NotifySecurityEvents sends security events such as failed logins to
+	// every connected client.
+	NotifySecurityEvents bool
+	// IdleExtendStep is how much one "extend" message from the controller
+	// adds to the idle budget (zero disables extending), and IdleExtendMax
+	// caps the total added (zero means no cap).
+	IdleExtendStep time.Duration
+	IdleExtendMax  time.Duration
+	// ReconnectGrace holds a client that drops unexpectedly for this long,
+	// so a reconnect with its resume token keeps its ID and controller
+	// role. Zero disables it.
+	ReconnectGrace time.Duration
+	// CloseGrace is how long a closing session waits, once it has sent
+	// every client the summary and a close frame, for the clients to close
+	// their connections before it drops them. The session stays open to
+	// lookups until then but takes no new clients, and Close blocks for it.
+	// Zero drops them at once.
+	CloseGrace time.Duration
+	// LatencyStats times output from the PTY read to the client write; see
+	// Session.LatencyStats. A stage whose p95 exceeds LatencySlowP95
+	// (DefaultLatencySlowP95 if zero) is logged at debug level once a minute.
+	LatencyStats   bool
+	LatencySlowP95 time.Duration
+	// BroadcastWorkers fans output out to clients across this many
+	// goroutines once at least ParallelBroadcastMinClients are connected.
+	// Zero or one broadcasts serially.
+	BroadcastWorkers int
+	// PromptRegex, matched against the line the cursor is on, and
+	// ShellIntegration, which reads OSC 133 semantic prompt marks, send
+	// "prompt", "command-start" and "command-end" messages; see ShellEvent.
+	PromptRegex      *regexp.Regexp
+	ShellIntegration bool
+	// MOTD is a welcome message, such as the session's rules, sent as a
+	// "motd" message to each client when it connects, but not when it
+	// resumes. Control characters are removed and it is cut to 2000
+	// characters.
+	MOTD string
+	// ConsentText, if set, is a notice every client has to accept before
+	// it joins; see Session.AwaitConsent.
+	ConsentText string
+	// Inherit takes over a command that another vexShare process detached,
+	// instead of starting Command; see Session.Detach.
+	Inherit *Inherited
 }
 
 func New(cfg Config) (*Session, error) {
@@ -77,22 +338,26 @@ func New(cfg Config) (*Session, error) {
 		shell = "bash"
 	}
 
-	cmd := exec.Command(shell)
-	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
-
-	ptmx, err := pty.Start(cmd)
-	if err != nil {
-		return nil, fmt.Errorf("start pty: %w", err)
-	}
-
 	logger := cfg.Logger
 	if logger == nil {
 		logger = slog.Default()
 	}
 
+	hist, err := newHistory(cfg.ScrollbackBytes, cfg.HistorySpoolDir, cfg.HistorySpoolMaxBytes, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Session{
-		cmd:         cmd,
-		ptmx:        ptmx,
+		command:     shell,
+		args:        cfg.Args,
+		env:         cfg.Env,
+		clearEnv:    cfg.ClearEnv,
+		killGroup:   cfg.KillProcessGroup,
+		rlimits:     cfg.ResourceLimits,
+		runAs:       cfg.RunAs,
+		readOnly:    cfg.ReadOnly,
+		startedAt:   time.Now(),
 		clients:     make(map[string]*Client),
 		sharedInput: cfg.SharedInput,
 		logger:      logger,
@@ -100,9 +365,70 @@ func New(cfg Config) (*Session, error) {
 		lastActive:  time.Now(),
 		done:        make(chan struct{}),
 		onClose:     cfg.OnClose,
+		history:     hist,
+		resizeMode:  cfg.ResizeMode,
+		// Start with a sane size so the program never sees 0x0, even if no
+		// client ever reports one.
+		ptySize: pty.Winsize{Cols: 80, Rows: 24},
+		policy:  cfg.SendPolicy.withDefaults(),
+		workers: cfg.BroadcastWorkers,
+		prompts: newPromptDetector(cfg.PromptRegex, cfg.ShellIntegration),
+		motd:    motdRaw(cfg.MOTD),
+		setSize: setSize,
+		consent: cfg.ConsentText,
+
+		held:           make(map[string]*heldClient),
+		reconnectGrace: cfg.ReconnectGrace,
+		closeGrace:     cfg.CloseGrace,
+		idleExtendStep: cfg.IdleExtendStep,
+		idleExtendMax:  cfg.IdleExtendMax,
+		now:            time.Now,
+		onExit:         cfg.OnExit,
+		restartWait:    cfg.RestartDelay,
+		retries:        cfg.StartupRetries,
+		retryWait:      cfg.StartupRetryDelay,
+		stallAfter:     defaultStallAfter,
+		notifySec:      cfg.NotifySecurityEvents,
+
+		maxMessageBytes: cfg.MaxMessageBytes,
+		maxMalformed:    cfg.MaxMalformedMessages,
+	}
+	if s.maxMessageBytes <= 0 {
+		s.maxMessageBytes = DefaultMaxMessageBytes
+	}
+	if s.maxMalformed <= 0 {
+		s.maxMalformed = 10
+	}
+	delay := cfg.OutputFlushDelay
+	if delay == 0 {
+		delay = DefaultOutputFlushDelay
+	}
+	s.batcher = newOutputBatcher(cfg.OutputFlushBytes, delay, s.output)
+	if cfg.LatencyStats {
+		s.latency = &latencyStats{}
+		s.latencySlow = cfg.LatencySlowP95
+		if s.latencySlow <= 0 {
+			s.latencySlow = DefaultLatencySlowP95
+		}
+		s.batcher.timed = s.outputRead
+	}
+	if s.restartWait <= 0 {
+		s.restartWait = time.Second
 	}
 
-	go s.readPTY()
+	if cfg.Inherit != nil {
+		err = s.adoptProcess(cfg.Inherit)
+	} else {
+		err = s.startProcess()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go s.controllerHealthChecker()
+	go s.outputRateSampler()
+	if s.latency != nil {
+		go s.latencyReporter()
+	}
 	if s.idleTimeout > 0 {
 		go s.idleChecker()
 	}
@@ -110,25 +436,14 @@ func New(cfg Config) (*Session, error) {
 	return s, nil
 }
 
-func (s *Session) readPTY() {
-	buf := make([]byte, 4096)
-	for {
-		n, err := s.ptmx.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				s.logger.Debug("pty read error", "error", err)
-			}
-			s.Close()
-			return
-		}
-		s.touchActivity()
-		data := make([]byte, n)
-		copy(data, buf[:n])
-		s.broadcast(data)
-	}
+func (s *Session) broadcast(data []byte) {
+	s.broadcastRead(data, 0)
 }
 
-func (s *Session) broadcast(data []byte) {
+// broadcastRead sends output that the PTY produced at readAt, in Unix
+// nanoseconds, timing it when latency stats are on. A zero readAt is not
+// timed.
+func (s *Session) broadcastRead(data []byte, readAt int64) {
 	encodedData, err := json.Marshal(string(data))
 	if err != nil {
 		s.logger.Error("marshal output data", "error", err)
@@ -144,97 +459,378 @@ func (s *Session) broadcast(data []byte) {
 		return
 	}
 
+	s.bytesOut.Add(int64(len(data)))
+	m := outbound{raw: raw, output: data}
+	timed := s.latency != nil && readAt != 0
+	if timed {
+		m.queuedAt = time.Now().UnixNano()
+	}
+	var stalled *Client
 	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for id, c := range s.clients {
-		if err := c.WriteMessage(websocket.TextMessage, raw); err != nil {
-			s.logger.Debug("write to client failed", "client", id, "error", err)
-		}
+	if s.paused {
+		stalled = s.fanOutPausedLocked(m, data)
+	} else {
+		stalled = s.fanOutLocked(m)
+	}
+	s.mu.RUnlock()
+	if stalled != nil {
+		s.sendController(stalled, m)
+	}
+	if timed {
+		now := time.Now().UnixNano()
+		s.latency.enqueue.add(now, now-readAt)
 	}
 }
 
-func (s *Session) AddClient(id string, conn *websocket.Conn) *Client {
+// AddClient joins conn to the session as id. It returns nil, leaving conn
+// alone, once the session is closing.
+func (s *Session) AddClient(id string, conn *websocket.Conn, info AuthInfo) *Client {
+	return s.addClient(id, conn, info, "")
+}
+
+// Resume reattaches a client that dropped within the reconnect grace
+// period, keeping its ID and controller role. It returns false, leaving
+// conn alone, if the token is unknown or expired, info is a different
+// identity from the one that dropped, or the session is closing.
+func (s *Session) Resume(token string, conn *websocket.Conn, info AuthInfo) (*Client, bool) {
+	if token == "" {
+		return nil, false
+	}
+	c := s.addClient("", conn, info, token)
+	return c, c != nil
+}
+
+func (s *Session) addClient(id string, conn *websocket.Conn, info AuthInfo, resumeToken string) *Client {
 	s.mu.Lock()
-	isController := len(s.clients) == 0
+	select {
+	case <-s.done:
+		// A session waiting out its close grace takes no one new.
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	wasController := false
+	var lastSeq uint64
+	if resumeToken != "" {
+		h, ok := s.held[resumeToken]
+		if !ok || h.auth.Username != info.Username || h.auth.Role != info.Role {
+			s.mu.Unlock()
+			return nil
+		}
+		s.releaseHeldLocked(resumeToken, h)
+		id, wasController, lastSeq = h.id, h.controller, h.lastSeq
+	}
 	c := &Client{
-		ID:           id,
-		Conn:         conn,
-		IsController: isController,
+		ID:     id,
+		Conn:   conn,
+		Auth:   info,
+		send:   s.newClientQueue(),
+		closed: make(chan struct{}),
+		logger: s.logger.With("id", id),
 	}
+	if info.RequestID != "" {
+		c.logger = c.logger.With("request_id", info.RequestID)
+	}
+	c.lastSeq = lastSeq
+	c.lastPong.Store(time.Now().UnixNano())
+	conn.SetReadLimit(s.maxMessageBytes)
+	conn.SetPongHandler(func(string) error {
+		c.lastPong.Store(time.Now().UnixNano())
+		return nil
+	})
+	if s.reconnectGrace > 0 {
+		c.resumeToken = newResumeToken()
+	}
+	c.IsController = canControl(c) && (wasController || !s.hasControllerLocked())
+	isController := c.IsController
 	s.clients[id] = c
-	s.mu.Unlock()
-
+	s.noteClientLocked(c)
+	if isController {
+		s.noteController(id)
+	}
 	role := "viewer"
 	if isController {
 		role = "controller"
 	}
-	s.logger.Info("client connected", "id", id, "role", role)
+	// The role comes first, ahead of anything else queued for c.
+	s.notifyLocked(c, s.roleRaw(c, role))
+	if s.motd != nil && resumeToken == "" {
+		s.notifyLocked(c, s.motd)
+	}
+	s.greetControllerLocked(c)
+	if s.paused {
+		select {
+		case c.send <- outbound{raw: s.pausedRawLocked()}:
+		default:
+		}
+	}
+	s.mu.Unlock()
 
-	_ = c.WriteJSON(wsMessage{
-		Type: "role",
-		Data: json.RawMessage(fmt.Sprintf(`{"role":%q,"sharedInput":%v}`, role, s.sharedInput)),
-	})
+	if resumeToken != "" {
+		s.clientLogger(c).Info("client resumed", "role", role, "user", info.Username)
+	} else {
+		s.clientLogger(c).Info("client connected", "role", role, "user", info.Username)
+	}
 
 	s.broadcastClientCount()
 
+	go s.writePump(c)
 	go s.readClient(c)
 	return c
 }
 
+// roleRaw encodes the "role" message that greets c.
+func (s *Session) roleRaw(c *Client, role string) []byte {
+	rm := roleMsg{
+		Role:        role,
+		Access:      c.Auth.Role,
+		SharedInput: s.sharedInput,
+		User:        c.Auth.DisplayName,
+		Groups:      c.Auth.Groups,
+		Resume:      c.resumeToken,
+	}
+	if s.idleTimeout > 0 {
+		rm.IdleTimeoutSeconds = int64(s.idleTimeout.Seconds())
+		rm.IdleExtendSeconds = int64(s.idleExtendStep.Seconds())
+		if d, ok := s.Deadline(); ok {
+			rm.Deadline = &d
+		}
+	}
+	roleData, _ := json.Marshal(rm)
+	raw, _ := json.Marshal(wsMessage{
+		Type: "role",
+		Data: json.RawMessage(roleData),
+	})
+	return raw
+}
+
 func (s *Session) readClient(c *Client) {
-	defer s.RemoveClient(c.ID)
+	hold := false
+	defer func() { s.removeClient(c.ID, hold) }()
+	malformed := 0
 	for {
 		_, raw, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-				s.logger.Debug("client read error", "id", c.ID, "error", err)
+				s.clientLogger(c).Debug("client read error", "error", err)
 			}
+			// Only a connection that broke, rather than one the client
+			// closed or was kicked off, is held for a resume.
+			hold = !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) && !c.kicked.Load()
 			return
 		}
 
-		var msg wsMessage
-		if err := json.Unmarshal(raw, &msg); err != nil {
-			s.logger.Debug("invalid message from client", "id", c.ID, "error", err)
+		ok, err := s.handleMessage(c, raw)
+		if err != nil {
+			s.logger.Debug("pty write error", "error", err)
+			return
+		}
+		if ok {
+			malformed = 0
 			continue
 		}
+		malformed++
+		s.clientLogger(c).Debug("invalid message from client", "consecutive", malformed)
+		if malformed >= s.maxMalformed {
+			s.clientLogger(c).Warn("disconnecting client after repeated malformed messages", "user", c.Auth.Username, "count", malformed)
+			_ = c.Conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, "too many malformed messages"),
+				time.Now().Add(time.Second),
+			)
+			return
+		}
+	}
+}
 
-		switch msg.Type {
-		case "input":
-			if !s.canWrite(c) {
-				continue
-			}
-			var input string
-			if err := json.Unmarshal(msg.Data, &input); err != nil {
-				continue
-			}
-			s.touchActivity()
-			if _, err := s.ptmx.Write([]byte(input)); err != nil {
-				s.logger.Debug("pty write error", "error", err)
-				return
+// handleMessage applies one message from c. It reports whether the message
+// was well formed; unknown types count as well formed so that newer clients
+// keep working. A non-nil error means the PTY could not be written.
+func (s *Session) handleMessage(c *Client, raw []byte) (bool, error) {
+	var msg wsMessage
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return false, nil
+	}
+
+	switch msg.Type {
+	case "input":
+		if !s.canWrite(c) {
+			return true, nil
+		}
+		var input string
+		if err := json.Unmarshal(msg.Data, &input); err != nil {
+			return false, nil
+		}
+		if s.exitPending.Load() {
+			// The command has exited; keys answer the prompt instead of
+			// reaching a PTY.
+			if s.isController(c) {
+				s.handleExitKey(input)
 			}
-		case "resize":
-			var r resizeMsg
-			if err := json.Unmarshal(msg.Data, &r); err != nil {
-				continue
+			return true, nil
+		}
+		if msg.Seq != 0 {
+			// Only retransmits are detected here; two clients typing the
+			// same thing concurrently is indistinguishable from intent.
+			if msg.Seq <= c.lastSeq {
+				s.clientLogger(c).Debug("dropping duplicate input", "seq", msg.Seq, "last", c.lastSeq)
+				return true, nil
 			}
-			if err := pty.Setsize(s.ptmx, &pty.Winsize{
-				Cols: r.Cols,
-				Rows: r.Rows,
-			}); err != nil {
-				s.logger.Debug("pty resize error", "error", err)
+			c.lastSeq = msg.Seq
+		}
+		s.touchActivity()
+		if err := s.writePTY(c, []byte(input)); err != nil {
+			return true, err
+		}
+		s.noteInput(c.ID, len(input))
+	case "resize":
+		var r resizeMsg
+		if err := json.Unmarshal(msg.Data, &r); err != nil {
+			return false, nil
+		}
+		if r.Cols == 0 || r.Rows == 0 {
+			return true, nil
+		}
+		s.mu.Lock()
+		s.queueResizeLocked(c, pty.Winsize{Cols: r.Cols, Rows: r.Rows})
+		s.mu.Unlock()
+	case "keepalive":
+		s.keepalive(c)
+	case "extend":
+		if s.isController(c) {
+			s.extendIdle(c)
+		}
+	case "clear":
+		if s.isController(c) {
+			s.clearOutput(c)
+		}
+	case "pause":
+		if s.isController(c) {
+			s.pause(c)
+		}
+	case "resume":
+		if s.isController(c) {
+			s.resume(c)
+		}
+	case "flow":
+		var state string
+		if err := json.Unmarshal(msg.Data, &state); err != nil || (state != "pause" && state != "resume") {
+			return false, nil
+		}
+		s.setFlow(c, state == "pause")
+	case "kick_viewers":
+		// Only the controller may clear the room, and it stays connected.
+		if s.isController(c) {
+			s.KickAll(true)
+		}
+	}
+	return true, nil
+}
+
+// applySizeLocked resizes the PTY to fit the clients that have reported a
+// size. Clients that never sent one are ignored, and the PTY keeps its last
+// size when no client qualifies.
+func (s *Session) applySizeLocked() {
+	size, ok := s.desiredSizeLocked()
+	if !ok || size == s.ptySize {
+		return
+	}
+	s.procMu.Lock()
+	err := s.setSize(s.ptmx, &size)
+	s.procMu.Unlock()
+	if err != nil {
+		s.logger.Debug("pty resize error", "error", err)
+		return
+	}
+	s.ptySize = size
+}
+
+func (s *Session) desiredSizeLocked() (pty.Winsize, bool) {
+	var size pty.Winsize
+	for _, c := range s.clients {
+		if c.size.Cols == 0 {
+			continue
+		}
+		if s.resizeMode == "controller" {
+			if c.IsController {
+				return c.size, true
 			}
+			continue
+		}
+		if size.Cols == 0 || c.size.Cols < size.Cols {
+			size.Cols = c.size.Cols
+		}
+		if size.Rows == 0 || c.size.Rows < size.Rows {
+			size.Rows = c.size.Rows
 		}
 	}
+	return size, size.Cols != 0
 }
 
 func (s *Session) canWrite(c *Client) bool {
+	if s.readOnly || c.Auth.Role == RoleViewer {
+		return false
+	}
 	if s.sharedInput {
 		return true
 	}
+	return s.isController(c)
+}
+
+// isController reads c.IsController, which RemoveClient may change when it
+// promotes c.
+func (s *Session) isController(c *Client) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return c.IsController
 }
 
+// canControl reports whether a client may be made controller. Writers only
+// type when input is shared; clients without a role keep legacy behaviour.
+func canControl(c *Client) bool {
+	return c.Auth.Role == "" || c.Auth.Role == RoleOwner
+}
+
+// hasControllerLocked reports whether a connected client, or one held for
+// a resume, has control.
+func (s *Session) hasControllerLocked() bool {
+	for _, c := range s.clients {
+		if c.IsController {
+			return true
+		}
+	}
+	for _, h := range s.held {
+		if h.controller {
+			return true
+		}
+	}
+	return false
+}
+
+// promoteLocked hands control to the first client able to take it. The
+// caller holds s.mu.
+func (s *Session) promoteLocked() {
+	for _, next := range s.clients {
+		if !canControl(next) {
+			continue
+		}
+		next.IsController = true
+		s.noteController(next.ID)
+		s.clientLogger(next).Info("promoted client to controller", "user", next.Auth.Username)
+		raw, _ := json.Marshal(wsMessage{
+			Type: "role",
+			Data: json.RawMessage(`{"role":"controller"}`),
+		})
+		s.notifyLocked(next, raw)
+		return
+	}
+}
+
 func (s *Session) RemoveClient(id string) {
+	s.removeClient(id, false)
+}
+
+func (s *Session) removeClient(id string, hold bool) {
 	s.mu.Lock()
 	c, ok := s.clients[id]
 	if !ok {
@@ -243,45 +839,65 @@ func (s *Session) RemoveClient(id string) {
 	}
 	wasController := c.IsController
 	delete(s.clients, id)
+	stopResizeLocked(c)
+	c.closeOnce.Do(func() { close(c.closed) })
 
-	if wasController && len(s.clients) > 0 {
-		for _, next := range s.clients {
-			next.IsController = true
-			s.logger.Info("promoted client to controller", "id", next.ID)
-			_ = next.WriteJSON(wsMessage{
-				Type: "role",
-				Data: json.RawMessage(`{"role":"controller"}`),
-			})
-			break
-		}
+	closing := false
+	select {
+	case <-s.done:
+		closing = true
+	default:
+	}
+	if closing {
+		// The others have been sent a close frame too, so there is no one
+		// left to promote or tell.
+		s.mu.Unlock()
+		s.clientLogger(c).Info("client disconnected", "user", c.Auth.Username)
+		c.Conn.Close()
+		return
 	}
+	hold = hold && c.resumeToken != ""
+	if hold {
+		s.holdLocked(c)
+	} else if wasController {
+		s.promoteLocked()
+	}
+	s.announceControllerLocked()
+	s.applySizeLocked()
 	s.mu.Unlock()
 
-	s.logger.Info("client disconnected", "id", id)
+	if hold {
+		s.clientLogger(c).Info("client dropped, holding for reconnect", "user", c.Auth.Username, "grace", s.reconnectGrace)
+	} else {
+		s.clientLogger(c).Info("client disconnected", "user", c.Auth.Username)
+	}
 	c.Conn.Close()
 	s.broadcastClientCount()
 }
 
 func (s *Session) broadcastClientCount() {
 	s.mu.RLock()
-	count := len(s.clients)
-	s.mu.RUnlock()
-
-	msg := wsMessage{
+	defer s.mu.RUnlock()
+	raw, err := json.Marshal(wsMessage{
 		Type: "clients",
-		Data: json.RawMessage(fmt.Sprintf(`{"count":%d}`, count)),
-	}
-	s.mu.RLock()
-	for _, c := range s.clients {
-		_ = c.WriteJSON(msg)
+		Data: json.RawMessage(fmt.Sprintf(`{"count":%d}`, len(s.clients))),
+	})
+	if err != nil {
+		return
 	}
-	s.mu.RUnlock()
+	s.notifyAllLocked(raw)
 }
 
 func (s *Session) touchActivity() {
+	now := s.timeNow()
 	s.activeMu.Lock()
-	s.lastActive = time.Now()
+	s.lastActive = now
+	due := s.deadlineDueLocked(now)
+	d := s.deadlineLocked()
 	s.activeMu.Unlock()
+	if due {
+		s.announceDeadline(d)
+	}
 }
 
 func (s *Session) idleChecker() {
@@ -291,11 +907,13 @@ func (s *Session) idleChecker() {
 		select {
 		case <-ticker.C:
 			s.activeMu.Lock()
-			idle := time.Since(s.lastActive)
+			idle := s.timeNow().Sub(s.lastActive)
+			remaining := s.idleRemainingLocked()
 			s.activeMu.Unlock()
-			if idle > s.idleTimeout {
+			if remaining < 0 {
 				s.logger.Warn("idle timeout reached, closing session", "idle", idle.Round(time.Second))
-				s.Close()
+				s.record(nil, "idle_timeout", "idle for "+idle.Round(time.Second).String())
+				s.closeWithReason(ReasonIdleTimeout)
 				return
 			}
 		case <-s.done:
@@ -304,6 +922,140 @@ func (s *Session) idleChecker() {
 	}
 }
 
+func (s *Session) Command() string {
+	return s.command
+}
+
+func (s *Session) StartedAt() time.Time {
+	return s.startedAt
+}
+
+func (s *Session) ReadOnly() bool {
+	return s.readOnly
+}
+
+// LastActive is the time of the last PTY output or client input.
+func (s *Session) LastActive() time.Time {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	return s.lastActive
+}
+
+// Notify shows a message from the server operator to every client.
+func (s *Session) Notify(text string) {
+	data, _ := json.Marshal(noticeMsg{Text: text})
+	raw, err := json.Marshal(wsMessage{Type: "notice", Data: json.RawMessage(data)})
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	s.notifyAllLocked(raw)
+	s.mu.RUnlock()
+}
+
+// SecurityEvent tells connected clients about an event such as a failed
+// login. It does nothing unless Config.NotifySecurityEvents is set.
+func (s *Session) SecurityEvent(event, ip, username string) {
+	if !s.notifySec {
+		return
+	}
+	data, _ := json.Marshal(securityMsg{Event: event, IP: ip, Username: username})
+	raw, err := json.Marshal(wsMessage{Type: "security", Data: json.RawMessage(data)})
+	if err != nil {
+		return
+	}
+	s.mu.RLock()
+	s.notifyAllLocked(raw)
+	s.mu.RUnlock()
+}
+
+// Inject writes input to the PTY as if a controller had typed it.
+func (s *Session) Inject(input []byte) error {
+	s.touchActivity()
+	return s.writePTY(nil, input)
+}
+
+func (s *Session) WriteHistory(w io.Writer) (int64, error) {
+	return s.history.WriteTo(w)
+}
+
+// ClientInfo describes a connected client for the admin API.
+type ClientInfo struct {
+	ID         string `json:"id"`
+	User       string `json:"user,omitempty"`
+	Access     string `json:"access"`
+	Controller bool   `json:"controller"`
+	IP         string `json:"ip,omitempty"`
+	// Reconnecting marks a client that dropped and is held for a resume.
+	Reconnecting bool `json:"reconnecting,omitempty"`
+}
+
+// Clients lists the connected clients, and those held for a reconnect,
+// ordered by ID.
+func (s *Session) Clients() []ClientInfo {
+	s.mu.RLock()
+	list := make([]ClientInfo, 0, len(s.clients)+len(s.held))
+	for _, c := range s.clients {
+		list = append(list, ClientInfo{ID: c.ID, User: c.Auth.Username, Access: c.Auth.Role, Controller: c.IsController, IP: c.Auth.IP})
+	}
+	for _, h := range s.held {
+		list = append(list, ClientInfo{ID: h.id, User: h.auth.Username, Access: h.auth.Role, Controller: h.controller, IP: h.auth.IP, Reconnecting: true})
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Kick disconnects the client with the given ID, or forgets it if it is
+// held for a reconnect. It reports whether the client was found.
+func (s *Session) Kick(id string) bool {
+	if s.forgetHeld(id) {
+		return true
+	}
+	s.mu.RLock()
+	c, ok := s.clients[id]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	s.clientLogger(c).Info("client removed by admin", "user", c.Auth.Username)
+	kickClient(c, "removed by admin")
+	return true
+}
+
+// KickAll disconnects every client, or every client but the controller
+// when excludeController is set, and returns how many it disconnected.
+func (s *Session) KickAll(excludeController bool) int {
+	// Collect under the lock but close outside it: close frames can take
+	// up to a second each, and RemoveClient needs the write lock.
+	s.mu.RLock()
+	var kicked []*Client
+	for _, c := range s.clients {
+		if excludeController && c.IsController {
+			continue
+		}
+		kicked = append(kicked, c)
+	}
+	s.mu.RUnlock()
+
+	for _, c := range kicked {
+		kickClient(c, "host ended viewing")
+	}
+	s.logger.Info("clients removed by host", "count", len(kicked), "excludeController", excludeController)
+	return len(kicked)
+}
+
+func kickClient(c *Client, reason string) {
+	c.kicked.Store(true)
+	_ = c.Conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(time.Second),
+	)
+	// readClient sees the closed connection and removes the client.
+	c.Conn.Close()
+}
+
 func (s *Session) ClientCount() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -311,27 +1063,54 @@ func (s *Session) ClientCount() int {
 }
 
 func (s *Session) Close() {
+	s.closeWithReason(ReasonClosed)
+}
+
+func (s *Session) closeWithReason(reason string) {
 	s.closeOnce.Do(func() {
 		close(s.done)
-		s.logger.Info("closing session")
+		s.logger.Info("closing session", "reason", reason)
+		summary := s.finishSummary(reason)
 
+		// done is closed, so no client can join now; the writes happen
+		// without s.mu so that a stuck client cannot hold up the others.
+		s.mu.RLock()
+		clients := make([]*Client, 0, len(s.clients))
+		for _, c := range s.clients {
+			clients = append(clients, c)
+		}
+		s.mu.RUnlock()
+		var wg sync.WaitGroup
+		for _, c := range clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sendSummary(c, summary)
+			}()
+		}
+		wg.Wait()
+
+		var closing []*Client
 		s.mu.Lock()
-		for id, c := range s.clients {
-			_ = c.Conn.WriteMessage(
-				websocket.CloseMessage,
-				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session closed"),
-			)
-			c.Conn.Close()
-			delete(s.clients, id)
+		for _, c := range clients {
+			if s.closeGrace > 0 {
+				closing = append(closing, c)
+				continue
+			}
+			if s.clients[c.ID] == c {
+				s.dropClientLocked(c)
+			}
 		}
 		s.mu.Unlock()
 
-		s.ptmx.Close()
-
-		if s.cmd.Process != nil {
-			_ = s.cmd.Process.Kill()
-		}
-		_ = s.cmd.Wait()
+		s.procMu.Lock()
+		ptmx, cmd, exited := s.ptmx, s.cmd, s.procExited
+		s.procMu.Unlock()
+		ptmx.Close()
+		s.kill(cmd)
+		<-exited
+		s.awaitClosing(closing)
+		s.history.Close()
 
 		if s.onClose != nil {
 			s.onClose()
@@ -339,6 +1118,55 @@ func (s *Session) Close() {
 	})
 }
 
+// sendSummary writes the summary and then a close frame to c, each with a
+// deadline of a second. It holds c.mu throughout so that writePump cannot
+// slip output in between.
+func sendSummary(c *Client, summary wsMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.Conn.WriteJSON(summary)
+	_ = c.Conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session closed"),
+		time.Now().Add(time.Second),
+	)
+}
+
+// dropClientLocked closes c's connection and removes it at once; its
+// readClient then finds it gone.
+func (s *Session) dropClientLocked(c *Client) {
+	c.Conn.Close()
+	stopResizeLocked(c)
+	c.closeOnce.Do(func() { close(c.closed) })
+	delete(s.clients, c.ID)
+}
+
+// awaitClosing gives clients that were sent a close frame until closeGrace
+// runs out to answer it, so their connections end with the closing
+// handshake rather than a reset, and then drops those that have not.
+func (s *Session) awaitClosing(clients []*Client) {
+	if len(clients) == 0 {
+		return
+	}
+	timer := time.NewTimer(s.closeGrace)
+	defer timer.Stop()
+	for i, c := range clients {
+		select {
+		case <-c.closed:
+			continue
+		case <-timer.C:
+		}
+		s.logger.Info("dropping clients still connected after the close grace", "count", len(clients)-i, "grace", s.closeGrace)
+		s.mu.Lock()
+		for _, c := range clients[i:] {
+			s.dropClientLocked(c)
+		}
+		s.mu.Unlock()
+		return
+	}
+}
+
 func (s *Session) Done() <-chan struct{} {
 	return s.done
 }
@@ -0,0 +1,284 @@
+package session
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+func TestRolePermissions(t *testing.T) {
+	tests := []struct {
+		role         string
+		sharedInput  bool
+		isController bool
+		canControl   bool
+		canWrite     bool
+	}{
+		{"", false, true, true, true},
+		{"", false, false, true, false},
+		{"", true, false, true, true},
+		{RoleOwner, false, true, true, true},
+		{RoleOwner, false, false, true, false},
+		{RoleOwner, true, false, true, true},
+		{RoleWriter, false, false, false, false},
+		{RoleWriter, true, false, false, true},
+		{RoleViewer, false, false, false, false},
+		{RoleViewer, true, false, false, false},
+		{RoleViewer, true, true, false, false},
+	}
+	for _, tt := range tests {
+		s := &Session{sharedInput: tt.sharedInput}
+		c := &Client{Auth: AuthInfo{Role: tt.role}, IsController: tt.isController}
+		if got := canControl(c); got != tt.canControl {
+			t.Errorf("role %q: canControl = %v, want %v", tt.role, got, tt.canControl)
+		}
+		if got := s.canWrite(c); got != tt.canWrite {
+			t.Errorf("role %q shared=%v controller=%v: canWrite = %v, want %v",
+				tt.role, tt.sharedInput, tt.isController, got, tt.canWrite)
+		}
+	}
+}
+
+func TestControllerSkipsNonOwners(t *testing.T) {
+	s := &Session{clients: map[string]*Client{
+		"v": {ID: "v", Auth: AuthInfo{Role: RoleViewer}},
+		"w": {ID: "w", Auth: AuthInfo{Role: RoleWriter}},
+	}}
+	if s.hasControllerLocked() {
+		t.Fatal("no controller expected among viewers and writers")
+	}
+	owner := &Client{ID: "o", Auth: AuthInfo{Role: RoleOwner}}
+	if !canControl(owner) || s.hasControllerLocked() {
+		t.Error("owner joining a room without a controller should become controller")
+	}
+}
+
+func TestDesiredSize(t *testing.T) {
+	size := func(cols, rows uint16) pty.Winsize { return pty.Winsize{Cols: cols, Rows: rows} }
+	tests := []struct {
+		name    string
+		mode    string
+		clients []*Client
+		want    pty.Winsize
+		wantOK  bool
+	}{
+		{"no clients", "min", nil, pty.Winsize{}, false},
+		{"only sizeless clients", "min", []*Client{{ID: "a"}, {ID: "b", IsController: true}}, pty.Winsize{}, false},
+		{"min ignores sizeless", "min", []*Client{
+			{ID: "a", size: size(120, 40)},
+			{ID: "b"},
+			{ID: "c", size: size(100, 50)},
+		}, size(100, 40), true},
+		{"controller", "controller", []*Client{
+			{ID: "a", size: size(80, 24)},
+			{ID: "b", IsController: true, size: size(200, 60)},
+		}, size(200, 60), true},
+		{"sizeless controller keeps last size", "controller", []*Client{
+			{ID: "a", size: size(80, 24)},
+			{ID: "b", IsController: true},
+		}, pty.Winsize{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Session{resizeMode: tt.mode, clients: make(map[string]*Client)}
+			for _, c := range tt.clients {
+				s.clients[c.ID] = c
+			}
+			got, ok := s.desiredSizeLocked()
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("got %+v (%v), want %+v (%v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// newMessageTestSession returns a session whose "PTY" is a pipe, so message
+// handling can run without starting a process.
+func newMessageTestSession(t testing.TB) (*Session, *Client) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = io.Copy(io.Discard, r) }()
+	exited := make(chan struct{})
+	t.Cleanup(func() { close(exited); w.Close(); r.Close() })
+	s := &Session{
+		clients:    make(map[string]*Client),
+		logger:     discardLogger,
+		ptmx:       w,
+		ptySize:    pty.Winsize{Cols: 80, Rows: 24},
+		stallAfter: defaultStallAfter,
+	}
+	// The debounced resize lands after the test; w is no terminal.
+	s.setSize = func(*os.File, *pty.Winsize) error { return nil }
+	s.input = s.startInputWriter(w, exited)
+	c := &Client{ID: "c", IsController: true}
+	s.clients[c.ID] = c
+	return s, c
+}
+
+func TestHandleMessage(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bool
+	}{
+		{`{"type":"input","data":"ls\n"}`, true},
+		{`{"type":"input","data":"x","seq":3}`, true},
+		{`{"type":"resize","data":{"cols":120,"rows":40}}`, true},
+		{`{"type":"resize","data":{"cols":0,"rows":0}}`, true},
+		{`{"type":"future-feature","data":[1,2,3]}`, true},
+		{`{"type":"input","data":42}`, false},
+		{`{"type":"resize","data":{"cols":-1,"rows":40}}`, false},
+		{`{"type":"resize","data":{"cols":70000,"rows":40}}`, false},
+		{`{"type":"resize","data":"big"}`, false},
+		{`not json`, false},
+		{`[]`, false},
+		{``, false},
+	}
+	for _, tt := range tests {
+		s, c := newMessageTestSession(t)
+		ok, err := s.handleMessage(c, []byte(tt.raw))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.raw, err)
+		}
+		if ok != tt.want {
+			t.Errorf("%s: well formed = %v, want %v", tt.raw, ok, tt.want)
+		}
+	}
+}
+
+func FuzzHandleMessage(f *testing.F) {
+	for _, seed := range []string{
+		`{"type":"input","data":"ls\n","seq":1}`,
+		`{"type":"resize","data":{"cols":120,"rows":40}}`,
+		`{"type":"resize","data":{"cols":65535,"rows":65535}}`,
+		`{"type":"input","data":{"nested":[null]}}`,
+		`{"type":"input","seq":18446744073709551615,"data":""}`,
+		`{"type":"resize"}`,
+		`{"type":null,"data":null}`,
+		"\xff\xfe",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		s, c := newMessageTestSession(t)
+		_, _ = s.handleMessage(c, raw)
+		_, _ = s.handleMessage(c, append([]byte(`{"type":"input","data":`), raw...))
+		_, _ = s.handleMessage(c, append([]byte(`{"type":"resize","data":`), raw...))
+	})
+}
+
+func TestMalformedMessagesDisconnect(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger, MaxMalformedMessages: 3, MaxMessageBytes: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	conn := tr.dial("a", "alice")
+	for i := 0; i < 2; i++ {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("garbage"))
+	}
+	// A good message resets the count.
+	sendInput(t, conn, "still here\n")
+	readMessage(t, conn, "output", "still here")
+	for i := 0; i < 3; i++ {
+		_ = conn.WriteMessage(websocket.TextMessage, []byte("garbage"))
+	}
+	var closeErr *websocket.CloseError
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseInvalidFramePayloadData {
+				t.Fatalf("expected close 1007, got %v", err)
+			}
+			break
+		}
+	}
+
+	big := tr.dial("b", "bob")
+	_ = big.WriteMessage(websocket.TextMessage, []byte(`{"type":"input","data":"`+strings.Repeat("x", 2048)+`"}`))
+	for {
+		if _, _, err := big.ReadMessage(); err != nil {
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+				t.Fatalf("expected close 1009, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+// closeCode reads until conn is closed and returns the close code and text.
+func closeCode(t *testing.T, conn *websocket.Conn) (int, string) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("expected a close frame, got %v", err)
+			}
+			return closeErr.Code, closeErr.Text
+		}
+	}
+}
+
+func TestKickViewers(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+	carol := tr.dial("c", "carol")
+
+	// A viewer cannot clear the room.
+	_ = bob.WriteJSON(wsMessage{Type: "kick_viewers"})
+	sendInput(t, alice, "before\n")
+	readMessage(t, bob, "output", "before")
+
+	// Keep output flowing so the kick races the broadcast path.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				s.broadcast([]byte("noise"))
+			}
+		}
+	}()
+
+	_ = alice.WriteJSON(wsMessage{Type: "kick_viewers"})
+	for name, conn := range map[string]*websocket.Conn{"bob": bob, "carol": carol} {
+		if code, text := closeCode(t, conn); code != websocket.ClosePolicyViolation || text != "host ended viewing" {
+			t.Errorf("%s: close %d %q", name, code, text)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); s.ClientCount() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients left, want only the controller", s.ClientCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sendInput(t, alice, "after\n")
+	readMessage(t, alice, "output", "after")
+
+	if n := s.KickAll(false); n != 1 {
+		t.Errorf("KickAll(false) disconnected %d clients, want 1", n)
+	}
+	if code, _ := closeCode(t, alice); code != websocket.ClosePolicyViolation {
+		t.Errorf("controller: close %d", code)
+	}
+}
@@ -0,0 +1,144 @@
+package session
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Shutdown reasons reported in Summary.Reason.
+const (
+	ReasonClosed        = "closed"
+	ReasonCommandExited = "command exited"
+	ReasonIdleTimeout   = "idle timeout"
+	ReasonQuit          = "quit"
+	ReasonRestartFailed = "restart failed"
+)
+
+// Summary recaps a session. It is sent to clients as a "summary" message
+// just before the close frame, logged, and available from Session.Summary.
+type Summary struct {
+	StartedAt       time.Time       `json:"startedAt"`
+	DurationSeconds float64         `json:"durationSeconds"`
+	PeakClients     int             `json:"peakClients"`
+	TotalClients    int             `json:"totalClients"`
+	OutputBytes     int64           `json:"outputBytes"`
+	Clients         []ClientSummary `json:"clients"`
+	Handoffs        int             `json:"handoffs"`
+	Reason          string          `json:"reason,omitempty"`
+}
+
+type ClientSummary struct {
+	ID         string `json:"id"`
+	User       string `json:"user,omitempty"`
+	InputBytes int64  `json:"inputBytes"`
+}
+
+type sessionStats struct {
+	mu             sync.Mutex
+	peak           int
+	handoffs       int
+	outputBytes    int64
+	clients        []*ClientSummary
+	byID           map[string]*ClientSummary
+	lastController string
+	reason         string
+	endedAt        time.Time
+}
+
+// noteClientLocked records a newly added client. A resumed client keeps
+// its entry. The caller holds s.mu.
+func (s *Session) noteClientLocked(c *Client) {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.peak = max(st.peak, len(s.clients))
+	if st.byID[c.ID] != nil {
+		return
+	}
+	cs := &ClientSummary{ID: c.ID, User: c.Auth.Username}
+	if st.byID == nil {
+		st.byID = make(map[string]*ClientSummary)
+	}
+	st.clients = append(st.clients, cs)
+	st.byID[c.ID] = cs
+}
+
+// noteController records id taking control. Control passing from one client
+// to another counts as a handoff; the first controller does not.
+func (s *Session) noteController(id string) {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.lastController != "" && st.lastController != id {
+		st.handoffs++
+	}
+	st.lastController = id
+}
+
+func (s *Session) noteInput(id string, n int) {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if cs := st.byID[id]; cs != nil {
+		cs.InputBytes += int64(n)
+	}
+}
+
+func (s *Session) noteOutput(n int) {
+	s.stats.mu.Lock()
+	s.stats.outputBytes += int64(n)
+	s.stats.mu.Unlock()
+}
+
+// Summary returns the session's statistics so far, or the final ones once
+// it has closed.
+func (s *Session) Summary() Summary {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	end := st.endedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	sum := Summary{
+		StartedAt:       s.startedAt,
+		DurationSeconds: end.Sub(s.startedAt).Seconds(),
+		PeakClients:     st.peak,
+		TotalClients:    len(st.clients),
+		OutputBytes:     st.outputBytes,
+		Clients:         make([]ClientSummary, 0, len(st.clients)),
+		Handoffs:        st.handoffs,
+		Reason:          st.reason,
+	}
+	for _, cs := range st.clients {
+		sum.Clients = append(sum.Clients, *cs)
+	}
+	return sum
+}
+
+// finishSummary freezes the statistics with the shutdown reason, logs them,
+// and returns the summary message for Close to send ahead of the close frame.
+func (s *Session) finishSummary(reason string) wsMessage {
+	s.stats.mu.Lock()
+	s.stats.reason = reason
+	s.stats.endedAt = time.Now()
+	s.stats.mu.Unlock()
+
+	sum := s.Summary()
+	inputBytes := make(map[string]int64, len(sum.Clients))
+	for _, c := range sum.Clients {
+		inputBytes[c.ID] = c.InputBytes
+	}
+	s.logger.Info("session summary",
+		"reason", sum.Reason,
+		"duration", time.Duration(sum.DurationSeconds*float64(time.Second)).Round(time.Second),
+		"peakClients", sum.PeakClients,
+		"totalClients", sum.TotalClients,
+		"outputBytes", sum.OutputBytes,
+		"inputBytes", inputBytes,
+		"handoffs", sum.Handoffs,
+	)
+	data, _ := json.Marshal(sum)
+	return wsMessage{Type: "summary", Data: json.RawMessage(data)}
+}
@@ -0,0 +1,149 @@
+package session
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsTransport connects WebSocket clients to s through an in-process server.
+type wsTransport struct {
+	t  testing.TB
+	s  *Session
+	ts *httptest.Server
+}
+
+func newWSTransport(t testing.TB, s *Session) *wsTransport {
+	tr := &wsTransport{t: t, s: s}
+	upgrader := websocket.Upgrader{}
+	tr.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		q := r.URL.Query()
+		info := AuthInfo{Username: q.Get("user"), Role: RoleOwner}
+		if _, ok := s.Resume(q.Get("resume"), conn, info); !ok {
+			s.AddClient(q.Get("id"), conn, info)
+		}
+	}))
+	t.Cleanup(tr.ts.Close)
+	return tr
+}
+
+func (tr *wsTransport) dial(id, user string) *websocket.Conn {
+	tr.t.Helper()
+	conn, _ := tr.dialResume(id, user, "")
+	return conn
+}
+
+// dialResume connects, presenting a resume token if one is given, and
+// returns the role message the session sent.
+func (tr *wsTransport) dialResume(id, user, resume string) (*websocket.Conn, roleMsg) {
+	tr.t.Helper()
+	url := "ws" + strings.TrimPrefix(tr.ts.URL, "http") + "/?id=" + id + "&user=" + user + "&resume=" + resume
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	tr.t.Cleanup(func() { conn.Close() })
+	var role roleMsg
+	_ = json.Unmarshal(readMessage(tr.t, conn, "role", "").Data, &role)
+	return conn, role
+}
+
+// readMessage reads until a message of type msgType whose data contains
+// substr arrives.
+func readMessage(t testing.TB, conn *websocket.Conn, msgType, substr string) wsMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %q message: %v", msgType, err)
+		}
+		if msg.Type == msgType && strings.Contains(string(msg.Data), substr) {
+			return msg
+		}
+	}
+}
+
+func sendInput(t *testing.T, conn *websocket.Conn, input string) {
+	t.Helper()
+	data, _ := json.Marshal(input)
+	if err := conn.WriteJSON(wsMessage{Type: "input", Data: data}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionSummary(t *testing.T) {
+	s, err := New(Config{Command: "cat", Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	tr := newWSTransport(t, s)
+
+	alice := tr.dial("a", "alice")
+	bob := tr.dial("b", "bob")
+	sendInput(t, alice, "hello\n")
+	readMessage(t, bob, "output", "hello")
+
+	// Alice leaves, so control passes to bob.
+	alice.Close()
+	readMessage(t, bob, "role", "controller")
+	sendInput(t, bob, "hi\n")
+	readMessage(t, bob, "output", "hi")
+	carol := tr.dial("c", "carol")
+	// cat's output can trail its echo; wait for both before counting.
+	waitForHistory(t, s, "hello", 2)
+	waitForHistory(t, s, "hi", 2)
+
+	s.Close()
+	var got Summary
+	if err := json.Unmarshal(readMessage(t, carol, "summary", "").Data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := carol.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the close frame after the summary, got %v", err)
+	}
+
+	if got.Reason != ReasonClosed || got.PeakClients != 2 || got.TotalClients != 3 || got.Handoffs != 1 {
+		t.Errorf("unexpected summary %+v", got)
+	}
+	wantInput := map[string]int64{"a": 6, "b": 3, "c": 0}
+	for _, c := range got.Clients {
+		if c.InputBytes != wantInput[c.ID] {
+			t.Errorf("client %s (%s): input bytes = %d, want %d", c.ID, c.User, c.InputBytes, wantInput[c.ID])
+		}
+	}
+	if len(got.Clients) != 3 || got.Clients[0].User != "alice" {
+		t.Errorf("clients = %+v, want alice, bob and carol in join order", got.Clients)
+	}
+	// cat's echo plus its output.
+	if got.OutputBytes < 2*int64(len("hello\r\nhi\r\n")) {
+		t.Errorf("output bytes = %d", got.OutputBytes)
+	}
+	if got.DurationSeconds <= 0 {
+		t.Errorf("duration = %v", got.DurationSeconds)
+	}
+
+	if final := s.Summary(); final.DurationSeconds != got.DurationSeconds || final.Reason != got.Reason {
+		t.Errorf("Summary() after close = %+v, want %+v", final, got)
+	}
+}
+
+func TestSessionSummaryReason(t *testing.T) {
+	s := newExitTestSession(t, "true", OnExitClose)
+	if !isDone(s) {
+		t.Fatal("session did not close")
+	}
+	if got := s.Summary().Reason; got != ReasonCommandExited {
+		t.Errorf("reason = %q, want %q", got, ReasonCommandExited)
+	}
+}
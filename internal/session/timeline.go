@@ -0,0 +1,47 @@
+package session
+
+import (
+	"time"
+)
+
+const timelineSize = 256
+
+// TimelineEvent is one entry in the session timeline, a short record of
+// who changed how the session behaves, such as extending its idle budget.
+// Client and User are empty for actions the session took by itself.
+type TimelineEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Client string    `json:"client,omitempty"`
+	User   string    `json:"user,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// record appends an event for c, which may be nil, and logs it.
+func (s *Session) record(c *Client, typ, detail string) {
+	ev := TimelineEvent{Time: s.timeNow().UTC(), Type: typ, Detail: detail}
+	if c != nil {
+		ev.Client, ev.User = c.ID, c.Auth.Username
+	}
+	s.timelineMu.Lock()
+	if len(s.timeline) == timelineSize {
+		s.timeline = append(s.timeline[:0], s.timeline[1:]...)
+	}
+	s.timeline = append(s.timeline, ev)
+	s.timelineMu.Unlock()
+	s.logger.Info("timeline", "type", typ, "client", ev.Client, "user", ev.User, "detail", detail)
+}
+
+// Timeline returns the most recent timeline events, oldest first.
+func (s *Session) Timeline() []TimelineEvent {
+	s.timelineMu.Lock()
+	defer s.timelineMu.Unlock()
+	return append([]TimelineEvent(nil), s.timeline...)
+}
+
+func (s *Session) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
@@ -4,9 +4,13 @@ import (
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 )
 
+const MinTokenLength = 16
+
 func Generate() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -15,11 +19,68 @@ func Generate() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func Validate(expected, provided string) bool {
-	if expected == "" || provided == "" {
-		return false
+func GenerateHex(bytes int) (string, error) {
+	if bytes <= 0 {
+		return "", fmt.Errorf("token byte count must be positive")
+	}
+	b := make([]byte, bytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+const DefaultPrefix = "vsx"
+
+func GeneratePrefixed(prefix string) (string, error) {
+	token, err := Generate()
+	if err != nil {
+		return "", err
+	}
+	if prefix == "" {
+		return token, nil
 	}
-	return subtle.ConstantTimeCompare([]byte(expected), []byte(provided)) == 1
+	return prefix + "_" + token, nil
+}
+
+var (
+	// ErrTokenTooShort means the provided token is shorter than
+	// MinTokenLength.
+	ErrTokenTooShort = errors.New("token shorter than minimum length")
+	ErrTokenMismatch = errors.New("token does not match")
+)
+
+// Check compares both tokens padded to the same length so that neither an
+// empty nor a length-mismatched expected token takes a faster path. Tokens
+// shorter than MinTokenLength never match. Check logs nothing; a caller
+// that wants to note ErrTokenTooShort logs it with its request's context.
+// Only the provided token's length, which its sender knows anyway, picks
+// the error.
+func Check(expected, provided string) error {
+	n := max(len(expected), len(provided))
+	a := make([]byte, n)
+	b := make([]byte, n)
+	copy(a, expected)
+	copy(b, provided)
+
+	equal := subtle.ConstantTimeCompare(a, b)
+	sameLen := subtle.ConstantTimeEq(int32(len(expected)), int32(len(provided)))
+	longEnough := subtle.ConstantTimeLessOrEq(MinTokenLength, len(expected)) &
+		subtle.ConstantTimeLessOrEq(MinTokenLength, len(provided))
+
+	switch {
+	case equal&sameLen&longEnough == 1:
+		return nil
+	case len(provided) < MinTokenLength:
+		return ErrTokenTooShort
+	default:
+		return ErrTokenMismatch
+	}
+}
+
+// Validate reports whether Check finds the tokens equal.
+func Validate(expected, provided string) bool {
+	return Check(expected, provided) == nil
 }
 
 func GeneratePassword(length int) (string, error) {
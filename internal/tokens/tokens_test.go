@@ -1,6 +1,9 @@
 package tokens
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestGenerate(t *testing.T) {
 	token, err := Generate()
@@ -19,6 +22,44 @@ func TestGenerate(t *testing.T) {
 	}
 }
 
+func TestGeneratePrefixed(t *testing.T) {
+	token, err := GeneratePrefixed(DefaultPrefix)
+	if err != nil {
+		t.Fatalf("GeneratePrefixed error: %v", err)
+	}
+	if !strings.HasPrefix(token, "vsx_") {
+		t.Errorf("expected vsx_ prefix, got %q", token)
+	}
+	if len(token) != len("vsx_")+43 {
+		t.Errorf("expected length %d, got %d", len("vsx_")+43, len(token))
+	}
+	plain, err := GeneratePrefixed("")
+	if err != nil {
+		t.Fatalf("GeneratePrefixed error: %v", err)
+	}
+	if len(plain) != 43 {
+		t.Errorf("expected unprefixed length 43, got %d", len(plain))
+	}
+}
+
+func TestGenerateHex(t *testing.T) {
+	token, err := GenerateHex(32)
+	if err != nil {
+		t.Fatalf("GenerateHex error: %v", err)
+	}
+	if len(token) != 64 {
+		t.Errorf("expected length 64, got %d", len(token))
+	}
+	for _, c := range token {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			t.Fatalf("unexpected character %q in %q", c, token)
+		}
+	}
+	if _, err := GenerateHex(0); err == nil {
+		t.Error("expected error for zero bytes")
+	}
+}
+
 func TestValidate(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -26,11 +67,17 @@ func TestValidate(t *testing.T) {
 		provided string
 		want     bool
 	}{
-		{"matching", "abc123", "abc123", true},
-		{"mismatch", "abc123", "xyz789", false},
-		{"empty expected", "", "abc123", false},
-		{"empty provided", "abc123", "", false},
+		{"matching", "abc123def456ghi7", "abc123def456ghi7", true},
+		{"mismatch", "abc123def456ghi7", "xyz789uvw012rst3", false},
+		{"empty expected", "", "abc123def456ghi7", false},
+		{"empty provided", "abc123def456ghi7", "", false},
 		{"both empty", "", "", false},
+		{"short matching", "abc123", "abc123", false},
+		{"short expected", "abc123def456ghi", "abc123def456ghi7", false},
+		{"short provided", "abc123def456ghi7", "abc123def456ghi", false},
+		{"prefix of expected", "abc123def456ghi7xyz", "abc123def456ghi7", false},
+		{"expected is prefix", "abc123def456ghi7", "abc123def456ghi7xyz", false},
+		{"padding bytes", "abc123def456ghi7", "abc123def456ghi7\x00\x00", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -42,6 +89,44 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestCheckReportsShortTokens(t *testing.T) {
+	const expected = "abc123def456ghi7"
+	tests := []struct {
+		provided string
+		want     error
+	}{
+		{expected, nil},
+		{"xyz789uvw012rst3", ErrTokenMismatch},
+		{"abc123", ErrTokenTooShort},
+		{"", ErrTokenTooShort},
+	}
+	for _, tt := range tests {
+		if err := Check(expected, tt.provided); err != tt.want {
+			t.Errorf("Check(%q) = %v, want %v", tt.provided, err, tt.want)
+		}
+	}
+	// A short expected token is a configuration mistake, not something
+	// the sender did, so it reads as a plain mismatch.
+	if err := Check("abc123", "abc123def456ghi7"); err != ErrTokenMismatch {
+		t.Errorf("short expected token: %v, want %v", err, ErrTokenMismatch)
+	}
+}
+
+// The benchmark pair is the timing check for Validate, and it is manual:
+// run go test -bench 'Validate(Short|Long)Expected' ./internal/tokens and
+// compare the two ns/op. Wall-clock ratios are too noisy to gate go test.
+func BenchmarkValidateShortExpected(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Validate("short", "longer-value")
+	}
+}
+
+func BenchmarkValidateLongExpected(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Validate("longer-value", "short")
+	}
+}
+
 func TestGeneratePassword(t *testing.T) {
 	pw, err := GeneratePassword(20)
 	if err != nil {
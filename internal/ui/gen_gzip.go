@@ -0,0 +1,28 @@
+//go:build ignore
+
+// gen_gzip writes a .gz copy of the static pages for embedding. Run it
+// through go generate after editing one. terminal.html and login.html are
+// not listed: the server fills in their config and branding and compresses
+// the result once at startup.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/vextm/vexshare/internal/ui"
+)
+
+var pages = []string{"static/admin.html"}
+
+func main() {
+	for _, page := range pages {
+		body, err := os.ReadFile(page)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(page+".gz", ui.Compress(body), 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,70 @@
 package ui
 
-import "embed"
+//go:generate go run gen_gzip.go
 
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io"
+)
+
+// StaticFS holds the pages and, next to the static ones, a gzip copy made
+// by go generate so that serving them costs no compression per request.
+//
 //go:embed static/*
 var StaticFS embed.FS
+
+// Asset is a page ready to serve in either encoding.
+type Asset struct {
+	Body []byte
+	Gzip []byte
+	// ETag identifies Body; it is quoted, and the gzip variant appends
+	// "-gz" inside the quotes.
+	ETag string
+}
+
+// LoadAsset returns the embedded static/name with its precompressed
+// variant. If the .gz copy is missing or stale it is compressed here.
+func LoadAsset(name string) (Asset, error) {
+	body, err := StaticFS.ReadFile("static/" + name)
+	if err != nil {
+		return Asset{}, err
+	}
+	gz, err := StaticFS.ReadFile("static/" + name + ".gz")
+	if err != nil || !gzipMatches(gz, body) {
+		return NewAsset(body), nil
+	}
+	return Asset{Body: body, Gzip: gz, ETag: etag(body)}, nil
+}
+
+// NewAsset compresses body, for pages that are rendered at run time.
+func NewAsset(body []byte) Asset {
+	return Asset{Body: body, Gzip: Compress(body), ETag: etag(body)}
+}
+
+// Compress gzips p at the best compression level with an empty header, so
+// the output depends only on p.
+func Compress(p []byte) []byte {
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	zw.Write(p)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func gzipMatches(gz, body []byte) bool {
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return false
+	}
+	got, err := io.ReadAll(zr)
+	return err == nil && bytes.Equal(got, body)
+}
+
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
@@ -0,0 +1,42 @@
+package ui
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestEmbeddedGzipUpToDate(t *testing.T) {
+	gzFiles, _ := fs.Glob(StaticFS, "static/*.gz")
+	if len(gzFiles) == 0 {
+		t.Fatal("no precompressed pages embedded")
+	}
+	for _, gzName := range gzFiles {
+		page := strings.TrimSuffix(gzName, ".gz")
+		body, err := StaticFS.ReadFile(page)
+		if err != nil {
+			t.Errorf("%s has no source page", gzName)
+			continue
+		}
+		gz, _ := StaticFS.ReadFile(gzName)
+		if !gzipMatches(gz, body) {
+			t.Errorf("%s is stale; run go generate ./internal/ui", gzName)
+		}
+	}
+}
+
+func TestNewAsset(t *testing.T) {
+	a, b := NewAsset([]byte("<p>one</p>")), NewAsset([]byte("<p>two</p>"))
+	if a.ETag == b.ETag {
+		t.Error("different bodies share an ETag")
+	}
+	if !strings.HasPrefix(a.ETag, `"`) || !strings.HasSuffix(a.ETag, `"`) {
+		t.Errorf("ETag %s is not quoted", a.ETag)
+	}
+	if !gzipMatches(a.Gzip, a.Body) {
+		t.Error("gzip variant does not match the body")
+	}
+	if NewAsset([]byte("<p>one</p>")).ETag != a.ETag {
+		t.Error("ETag is not stable for the same body")
+	}
+}